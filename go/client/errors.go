@@ -0,0 +1,111 @@
+package client
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Codes of server errors
+const (
+	ErrCodeBadRequest           = "bad_request"
+	ErrCodeInvalidRequest       = "invalid_request"
+	ErrCodeInvalidPath          = "invalid_path"
+	ErrCodeUnsupportedMediaType = "unsupported_media_type"
+	ErrCodeUnauthorized         = "unauthorized"
+	ErrCodeForbidden            = "forbidden"
+	ErrCodeInsufficientScope    = "insufficient_scope"
+	ErrCodeNotFound             = "not_found"
+	ErrCodeMethodNotAllowed     = "method_not_allowed"
+	ErrCodeProjectNotFound      = "project_not_found"
+	ErrCodeUnsupportedHash      = "unsupported_hash_algorithm"
+	ErrCodeInvalidUpload        = "invalid_upload"
+	ErrCodeInvalidArchive       = "invalid_archive"
+	ErrCodeUploadTooLarge       = "upload_too_large"
+	ErrCodeRequestTooLarge      = "request_too_large"
+	ErrCodeQuotaExceeded        = "quota_exceeded"
+	ErrCodeCorruptedFile        = "corrupted_file"
+	ErrCodeIncompleteUpload     = "incomplete_upload"
+	ErrCodeOffsetMismatch       = "offset_mismatch"
+	ErrCodeTooManyUploads       = "too_many_uploads"
+	ErrCodeServerError          = "server_error"
+	ErrCodeAuthError            = "auth_error"
+	ErrCodeMapServerError       = "map_server_error"
+	// code of error responses without JSON body (older servers or proxies)
+	ErrCodeUnknown = "unknown"
+)
+
+// ServerError is an error response from the server
+type ServerError struct {
+	StatusCode int    `json:"-"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	// raw JSON details of the error (see DecodeDetails)
+	Details   json.RawMessage `json:"details"`
+	RequestID string          `json:"request_id"`
+}
+
+func (e *ServerError) Error() string {
+	return e.Message
+}
+
+// DecodeDetails decodes details of the error into one of *Details types
+func (e *ServerError) DecodeDetails(v interface{}) error {
+	if len(e.Details) == 0 {
+		return nil
+	}
+	return json.Unmarshal(e.Details, v)
+}
+
+// FileErrorDetails are details of errors related to a single file
+// (corrupted_file, incomplete_upload of upload session, bad_request of
+// uploaded file inconsistent with removed files or manifest)
+type FileErrorDetails struct {
+	Path string `json:"path"`
+}
+
+// SizeErrorDetails are details of upload_too_large errors
+type SizeErrorDetails struct {
+	Size  int64 `json:"size"`
+	Limit int64 `json:"limit"`
+}
+
+// QuotaErrorDetails are details of quota_exceeded errors
+type QuotaErrorDetails struct {
+	Used  int64 `json:"used"`
+	Quota int64 `json:"quota"`
+	Free  int64 `json:"free"`
+	Size  int64 `json:"size"`
+}
+
+// ValidationErrorDetails are details of invalid_request errors
+type ValidationErrorDetails []struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ErrorCode returns code of server error ("" for other errors)
+func ErrorCode(err error) string {
+	if e, ok := err.(*ServerError); ok {
+		return e.Code
+	}
+	return ""
+}
+
+func newServerError(resp *http.Response) *ServerError {
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	e := &ServerError{StatusCode: resp.StatusCode, RequestID: resp.Header.Get(requestIDHeader)}
+	ctype, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if ctype == "application/json" && json.Unmarshal(data, e) == nil && e.Code != "" {
+		return e
+	}
+	e.Code = ErrCodeUnknown
+	e.Message = strings.TrimSpace(string(data))
+	if e.Message == "" {
+		e.Message = http.StatusText(resp.StatusCode)
+	}
+	return e
+}
@@ -0,0 +1,115 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewServerError(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		code        string
+		message     string
+		requestID   string
+	}{
+		{
+			"JSON error", http.StatusNotFound, "application/json",
+			`{"code":"project_not_found","message":"Project not found","request_id":"abc"}`,
+			ErrCodeProjectNotFound, "Project not found", "abc",
+		},
+		{
+			"content type with charset", http.StatusForbidden, "application/json; charset=utf-8",
+			`{"code":"insufficient_scope","message":"Token scope is not sufficient"}`,
+			ErrCodeInsufficientScope, "Token scope is not sufficient", "header-id",
+		},
+		{"plain text", http.StatusBadGateway, "text/plain", "Bad gateway\n", ErrCodeUnknown, "Bad gateway", "header-id"},
+		{"empty body", http.StatusServiceUnavailable, "text/plain", "", ErrCodeUnknown, "Service Unavailable", "header-id"},
+		{"JSON without code", http.StatusBadRequest, "application/json", `{"error":"invalid"}`, ErrCodeUnknown, `{"error":"invalid"}`, "header-id"},
+		{"invalid JSON", http.StatusBadRequest, "application/json", `{"code":`, ErrCodeUnknown, `{"code":`, "header-id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Header().Set(requestIDHeader, "header-id")
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+			resp, err := http.Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			e := newServerError(resp)
+			if e.StatusCode != tt.status || e.Code != tt.code || e.Message != tt.message || e.RequestID != tt.requestID {
+				t.Errorf("newServerError() = %+v", e)
+			}
+			if ErrorCode(e) != tt.code || e.Error() != tt.message {
+				t.Errorf("ErrorCode() = %q, Error() = %q", ErrorCode(e), e.Error())
+			}
+		})
+	}
+	if code := ErrorCode(errors.New("connection refused")); code != "" {
+		t.Errorf("ErrorCode() of other error = %q", code)
+	}
+}
+
+func TestServerErrorDetails(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/size":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"code":"upload_too_large","message":"Upload size is over limit","details":{"size":300,"limit":200}}`))
+		case "/quota":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"code":"quota_exceeded","message":"Storage quota exceeded","details":{"used":90,"quota":100,"free":10,"size":20}}`))
+		case "/file":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"code":"corrupted_file","message":"Corrupted file: a.txt","details":{"path":"a.txt"}}`))
+		case "/validation":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"code":"invalid_request","message":"Request doesn't match API specification","details":[{"field":"body.name","message":"is required"}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"code":"not_found","message":"Not found"}`))
+		}
+	}))
+	defer server.Close()
+	get := func(path string) *ServerError {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		return newServerError(resp)
+	}
+
+	var size SizeErrorDetails
+	if e := get("/size"); e.Code != ErrCodeUploadTooLarge || e.DecodeDetails(&size) != nil || size != (SizeErrorDetails{300, 200}) {
+		t.Errorf("size error: %+v, %+v", e, size)
+	}
+	var quota QuotaErrorDetails
+	if e := get("/quota"); e.Code != ErrCodeQuotaExceeded || e.DecodeDetails(&quota) != nil || quota != (QuotaErrorDetails{90, 100, 10, 20}) {
+		t.Errorf("quota error: %+v, %+v", e, quota)
+	}
+	var file FileErrorDetails
+	if e := get("/file"); e.Code != ErrCodeCorruptedFile || e.DecodeDetails(&file) != nil || file.Path != "a.txt" {
+		t.Errorf("file error: %+v, %+v", e, file)
+	}
+	var validation ValidationErrorDetails
+	if e := get("/validation"); e.Code != ErrCodeInvalidRequest || e.DecodeDetails(&validation) != nil || len(validation) != 1 || validation[0].Field != "body.name" {
+		t.Errorf("validation error: %+v, %+v", e, validation)
+	}
+	// errors without details are decoded into empty details
+	var empty SizeErrorDetails
+	if e := get("/other"); e.Code != ErrCodeNotFound || e.DecodeDetails(&empty) != nil || empty != (SizeErrorDetails{}) {
+		t.Errorf("error without details: %+v", e)
+	}
+}
@@ -3,7 +3,7 @@ module github.com/gislab-npo/gisquick-settings/client
 go 1.12
 
 require (
-	github.com/gislab-npo/gisquick-settings v0.0.0-20201207190211-733ed49c9ca9
+	github.com/gislab-npo/gisquick-settings/fs v0.0.0-00010101000000-000000000000
 	github.com/gorilla/websocket v1.4.2
 )
 
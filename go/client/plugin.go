@@ -16,9 +16,10 @@ import (
 	"net/url"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"time"
 
-	"github.com/gislab-npo/gisquick-settings/go/src/fs"
+	"github.com/gislab-npo/gisquick-settings/fs"
 	"github.com/gorilla/websocket"
 )
 
@@ -27,6 +28,7 @@ type Client struct {
 	Server            string
 	User              string
 	Password          string
+	Token             string
 	ClientInfo        string
 	httpClient        *http.Client
 	WsConn            *websocket.Conn
@@ -42,22 +44,54 @@ type message struct {
 	Type   string          `json:"type"`
 	Status int             `json:"status,omitempty"`
 	Data   json.RawMessage `json:"data,omitempty"`
+	// ID of the server request which triggered the message
+	RequestID string `json:"request_id,omitempty"`
 }
 
 type genericMessage struct {
-	Type   string      `json:"type"`
-	Status int         `json:"status,omitempty"`
-	Data   interface{} `json:"data"`
+	Type      string      `json:"type"`
+	Status    int         `json:"status,omitempty"`
+	Data      interface{} `json:"data"`
+	RequestID string      `json:"request_id,omitempty"`
 }
 
-// NewClient export
+// requestIDHeader is a response header with ID of the server request
+const requestIDHeader = "X-Request-ID"
+
+// tokenPrefix is a prefix of personal API tokens issued by the server
+const tokenPrefix = "gqt_"
+
+// tokenTransport adds personal API token to all requests
+type tokenTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// request must not be modified by RoundTripper
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Authorization", "Bearer "+t.token)
+	return t.base.RoundTrip(r)
+}
+
+// NewClient export (personal API token can be used instead of password)
 func NewClient(url, user, password string) *Client {
 	c := Client{}
 	c.Server = url
 	c.User = user
-	c.Password = password
 	cookieJar, _ := cookiejar.New(nil)
 	c.httpClient = &http.Client{Jar: cookieJar}
+	if strings.HasPrefix(password, tokenPrefix) {
+		c.Token = password
+		c.httpClient.Transport = &tokenTransport{password, http.DefaultTransport}
+	} else {
+		c.Password = password
+	}
 	c.registerHandlers()
 	return &c
 }
@@ -72,6 +106,15 @@ func (c *Client) sendErrorMessage(msgType string, data string) error {
 	return c.WsConn.WriteJSON(genericMessage{Type: msgType, Status: 500, Data: data})
 }
 
+// sends error message, request ID of server errors is included
+func (c *Client) sendError(msgType string, err error) error {
+	msg := genericMessage{Type: msgType, Status: 500, Data: err.Error()}
+	if serverErr, ok := err.(*ServerError); ok {
+		msg.RequestID = serverErr.RequestID
+	}
+	return c.WsConn.WriteJSON(msg)
+}
+
 // send message to plugin handler and return response message
 func (c *Client) propagateMessage(msgType string, data interface{}) (*message, error) {
 	request, err := json.Marshal(genericMessage{Type: msgType, Data: data})
@@ -112,7 +155,7 @@ func (c *Client) registerHandlers() {
 }
 
 func (c *Client) handlePluginStatus(msg message) error {
-	data := map[string]string{"client": c.ClientInfo}
+	data := map[string]interface{}{"client": c.ClientInfo, "hash_algorithms": fs.HashAlgorithms}
 	return c.sendResponseMessage("PluginStatus", data)
 }
 
@@ -121,6 +164,15 @@ func (c *Client) handleProjectFiles(msg message) error {
 		Directory string    `json:"directory"`
 		Files     []fs.File `json:"files"`
 	}
+	type Params struct {
+		Algorithm string `json:"algorithm"`
+	}
+	var params Params
+	if len(msg.Data) > 0 {
+		if err := json.Unmarshal(msg.Data, &params); err != nil {
+			return err
+		}
+	}
 
 	projDirMsg, err := c.propagateMessage("ProjectDirectory", nil)
 	if err != nil {
@@ -132,8 +184,16 @@ func (c *Client) handleProjectFiles(msg message) error {
 	}
 	var directory string
 	json.Unmarshal(projDirMsg.Data, &directory)
-	files, err := fs.ListDir(directory, true)
 
+	lastNotification := time.Now()
+	progress := func(done, total int) {
+		if now := time.Now(); now.Sub(lastNotification).Seconds() > 0.3 {
+			c.sendResponseMessage("ProjectFilesProgress", map[string]int{"done": done, "total": total})
+			lastNotification = now
+		}
+	}
+	opts := fs.ListOptions{Checksum: true, Algorithm: params.Algorithm, Progress: progress}
+	files, err := fs.ListDirContext(context.Background(), directory, opts)
 	if err != nil {
 		return err
 	}
@@ -154,8 +214,10 @@ func (c *Client) handleAbortUpload(msg message) error {
 
 func (c *Client) handleUploadFiles(msg message) error {
 	type Params struct {
-		Project string    `json:"project"`
-		Files   []fs.File `json:"files"`
+		Project  string    `json:"project"`
+		Files    []fs.File `json:"files"`
+		Removes  []string  `json:"removes"`
+		Manifest []fs.File `json:"manifest"`
 	}
 	var params Params
 	if err := json.Unmarshal(msg.Data, &params); err != nil {
@@ -173,7 +235,18 @@ func (c *Client) handleUploadFiles(msg message) error {
 	var directory string
 	json.Unmarshal(projDirMsg.Data, &directory)
 
+	// only files inside of the project directory can be uploaded
+	for _, f := range params.Files {
+		if _, err := fs.SafeJoin(directory, f.Path); err != nil {
+			return err
+		}
+	}
+
 	go func() {
+		if useChunkedUpload(params.Files) {
+			c.uploadFilesInChunks(params.Project, directory, uploadSessionInfo{params.Files, params.Removes, params.Manifest})
+			return
+		}
 		readBody, writeBody := io.Pipe()
 		defer readBody.Close()
 
@@ -233,16 +306,15 @@ func (c *Client) handleUploadFiles(msg message) error {
 		defer resp.Body.Close()
 		c.cancelUpload = nil
 
-		log.Println("Upload response:", resp.StatusCode)
-
-		respData, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			log.Printf("Failed to read upload response: %s\n", err)
-		}
+		log.Printf("Upload response: %d (request: %s)\n", resp.StatusCode, resp.Header.Get(requestIDHeader))
 		if resp.StatusCode >= 400 {
-			if err = c.sendErrorMessage("UploadError", string(respData)); err != nil {
+			serverErr := newServerError(resp)
+			log.Printf("Upload error: %s (code: %s)\n", serverErr, serverErr.Code)
+			if err = c.sendError("UploadError", serverErr); err != nil {
 				log.Printf("Failed to send error message: %s\n", err)
 			}
+		} else if _, err = io.Copy(ioutil.Discard, resp.Body); err != nil {
+			log.Printf("Failed to read upload response: %s\n", err)
 		}
 		err = <-errChan
 		if err != nil {
@@ -255,6 +327,9 @@ func (c *Client) handleUploadFiles(msg message) error {
 /* Normal methods */
 
 func (c *Client) login() error {
+	if c.Token != "" {
+		return nil
+	}
 	form := url.Values{"username": {c.User}, "password": {c.Password}}
 	url := fmt.Sprintf("%s/api/auth/login/", c.Server)
 	resp, err := c.httpClient.PostForm(url, form)
@@ -269,6 +344,9 @@ func (c *Client) login() error {
 }
 
 func (c *Client) logout() error {
+	if c.Token != "" {
+		return nil
+	}
 	url := fmt.Sprintf("%s/api/auth/logout/", c.Server)
 	_, err := c.httpClient.Get(url)
 	if err != nil {
@@ -302,6 +380,9 @@ func (c *Client) Start() error {
 	}
 	header := make(http.Header, 1)
 	header.Set("User-Agent", c.ClientInfo)
+	if c.Token != "" {
+		header.Set("Authorization", "Bearer "+c.Token)
+	}
 	wsConn, _, err := dialer.Dial(u.String(), header)
 	if err != nil {
 		return err
@@ -331,7 +412,7 @@ func (c *Client) Start() error {
 			if ok {
 				if err := msgHandler(msg); err != nil {
 					log.Println(err)
-					c.sendErrorMessage(msg.Type, err.Error())
+					c.sendError(msg.Type, err)
 				}
 				continue
 			}
@@ -0,0 +1,257 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gislab-npo/gisquick-settings/fs"
+)
+
+const (
+	// files larger than this limit are uploaded with resumable upload session
+	chunkedUploadThreshold = 32 * 1024 * 1024
+	uploadChunkSize        = 8 * 1024 * 1024
+	uploadMaxRetries       = 5
+)
+
+// uploadSessionInfo describes uploaded files and files removed from the project
+type uploadSessionInfo struct {
+	Files    []fs.File `json:"files"`
+	Removes  []string  `json:"removes"`
+	Manifest []fs.File `json:"manifest"`
+}
+
+type uploadFileStatus struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Offset int64  `json:"offset"`
+}
+
+type uploadSessionStatus struct {
+	ID    string             `json:"id"`
+	Files []uploadFileStatus `json:"files"`
+}
+
+// ProjectChanges export
+type ProjectChanges struct {
+	New       []fs.File `json:"new"`
+	Modified  []fs.File `json:"modified"`
+	Deleted   []fs.File `json:"deleted"`
+	Identical []fs.File `json:"identical"`
+}
+
+// hashAlgorithm returns hash algorithm supported by both client and server
+func (c *Client) hashAlgorithm() (string, error) {
+	resp, err := c.httpClient.Get(fmt.Sprintf("%s/api/project/hash-algorithms", c.Server))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	// older servers support only the default algorithm
+	if resp.StatusCode == http.StatusNotFound {
+		return fs.DefaultHashAlgorithm, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", newServerError(resp)
+	}
+	var serverAlgorithms []string
+	if err = json.NewDecoder(resp.Body).Decode(&serverAlgorithms); err != nil {
+		return "", err
+	}
+	return fs.NegotiateHashAlgorithm(serverAlgorithms), nil
+}
+
+// ProjectDiff compares files in the local project directory with published
+// project files ("<user>/<directory>"). Client must be logged in.
+func (c *Client) ProjectDiff(project, directory string) (*ProjectChanges, error) {
+	algorithm, err := c.hashAlgorithm()
+	if err != nil {
+		return nil, err
+	}
+	files, err := fs.ListDirContext(context.Background(), directory, fs.ListOptions{Checksum: true, Algorithm: algorithm})
+	if err != nil {
+		return nil, err
+	}
+	for i, f := range *files {
+		(*files)[i].Path = filepath.ToSlash(f.Path)
+	}
+	data, err := json.Marshal(map[string]interface{}{"algorithm": algorithm, "files": *files})
+	if err != nil {
+		return nil, err
+	}
+	diffURL := fmt.Sprintf("%s/api/project/diff/%s", c.Server, project)
+	resp, err := c.httpClient.Post(diffURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, newServerError(resp)
+	}
+	var changes ProjectChanges
+	if err = json.NewDecoder(resp.Body).Decode(&changes); err != nil {
+		return nil, err
+	}
+	return &changes, nil
+}
+
+func useChunkedUpload(files []fs.File) bool {
+	for _, f := range files {
+		if f.Size > chunkedUploadThreshold {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) createUploadSession(ctx context.Context, project string, info uploadSessionInfo) (*uploadSessionStatus, error) {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	sessionsURL := fmt.Sprintf("%s/api/project/uploads/%s", c.Server, project)
+	req, err := http.NewRequest("POST", sessionsURL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, newServerError(resp)
+	}
+	var status uploadSessionStatus
+	if err = json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// uploadChunk sends chunk of the file starting at given offset and returns
+// offset of the next chunk expected by the server
+func (c *Client) uploadChunk(ctx context.Context, fileURL string, file *os.File, size, offset int64) (int64, error) {
+	length := size - offset
+	if length > uploadChunkSize {
+		length = uploadChunkSize
+	}
+	req, err := http.NewRequest("PATCH", fileURL, io.NewSectionReader(file, offset, length))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = length
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// on conflict, server responds with the offset it expects
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusConflict {
+		return 0, newServerError(resp)
+	}
+	return strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+}
+
+func (c *Client) uploadFileChunks(ctx context.Context, fileURL, filename string, size, offset int64) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	failures := 0
+	for offset < size {
+		newOffset, err := c.uploadChunk(ctx, fileURL, file, size, offset)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if _, ok := err.(*ServerError); ok {
+				return err
+			}
+			failures++
+			if failures > uploadMaxRetries {
+				return err
+			}
+			log.Printf("Failed to upload chunk (attempt %d): %s\n", failures, err)
+			select {
+			case <-time.After(time.Duration(failures) * 2 * time.Second):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+		failures = 0
+		offset = newOffset
+	}
+	return nil
+}
+
+// uploadInChunks uploads files with resumable upload session. Unfinished
+// session of the same files is continued from the last received data.
+func (c *Client) uploadInChunks(ctx context.Context, project, directory string, info uploadSessionInfo) error {
+	session, err := c.createUploadSession(ctx, project, info)
+	if err != nil {
+		return err
+	}
+	sessionURL := fmt.Sprintf("%s/api/project/uploads/%s/%s", c.Server, project, session.ID)
+	for _, f := range session.Files {
+		if f.Offset == f.Size {
+			continue
+		}
+		fileURL := fmt.Sprintf("%s/files/%s", sessionURL, (&url.URL{Path: f.Path}).EscapedPath())
+		filename := filepath.Join(directory, filepath.FromSlash(f.Path))
+		if err = c.uploadFileChunks(ctx, fileURL, filename, f.Size, f.Offset); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest("POST", sessionURL+"/commit", nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return newServerError(resp)
+	}
+	return nil
+}
+
+func (c *Client) uploadFilesInChunks(project, directory string, info uploadSessionInfo) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancelUpload = cancel
+	defer cancel()
+
+	err := c.uploadInChunks(ctx, project, directory, info)
+	c.cancelUpload = nil
+	if err == nil || err == context.Canceled {
+		return
+	}
+	log.Printf("Upload error: %s\n", err)
+	if _, ok := err.(*ServerError); !ok {
+		err = errors.New("Upload error")
+	}
+	if err = c.sendError("UploadError", err); err != nil {
+		log.Printf("Failed to send error message: %s\n", err)
+	}
+}
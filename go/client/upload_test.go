@@ -0,0 +1,42 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gislab-npo/gisquick-settings/fs"
+)
+
+func TestHashAlgorithm(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		algorithm string
+		err       bool
+	}{
+		{"preferred algorithm", http.StatusOK, `["xxh64", "sha256", "sha1"]`, fs.XXHash, false},
+		{"unknown algorithms", http.StatusOK, `["blake3", "sha256"]`, fs.SHA256, false},
+		{"old server", http.StatusNotFound, "Not found", fs.DefaultHashAlgorithm, false},
+		{"server error", http.StatusInternalServerError, "Error", "", true},
+		{"invalid response", http.StatusOK, `{"sha1"`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/api/project/hash-algorithms" {
+					t.Errorf("unexpected request: %s", r.URL.Path)
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+			c := NewClient(server.URL, "user1", "password")
+			algorithm, err := c.hashAlgorithm()
+			if algorithm != tt.algorithm || (err != nil) != tt.err {
+				t.Errorf("hashAlgorithm() = %q, %v", algorithm, err)
+			}
+		})
+	}
+}
@@ -1,13 +1,16 @@
 package fs
 
 import (
-	"crypto/sha1"
+	"context"
+	"crypto/rand"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -17,74 +20,314 @@ type File struct {
 	Hash  string    `json:"hash"`
 	Size  int64     `json:"size"`
 	Mtime time.Time `json:"mtime"`
+	// Algorithm of the hash (empty value means DefaultHashAlgorithm)
+	Algorithm string `json:"algorithm,omitempty"`
 }
 
 // Checksum export
 func Checksum(path string) (string, error) {
+	return checksumContext(context.Background(), path, DefaultHashAlgorithm)
+}
+
+// ChecksumAlgorithm computes checksum of the file with given hash algorithm
+func ChecksumAlgorithm(path, algorithm string) (string, error) {
+	return checksumContext(context.Background(), path, algorithm)
+}
+
+// contextReader stops reading when the context is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+func checksumContext(ctx context.Context, path, algorithm string) (string, error) {
+	h, err := NewHash(algorithm)
+	if err != nil {
+		return "", err
+	}
 	file, err := os.Open(path)
 	if err != nil {
 		return "", err
 	}
 	defer file.Close()
-	h := sha1.New()
-	if _, err := io.Copy(h, file); err != nil {
+	if _, err := io.Copy(h, &contextReader{ctx, file}); err != nil {
 		return "", err
 	}
 	return fmt.Sprintf("%x", h.Sum(nil)), nil
 }
 
-// ListDir export
+var excludeExtRegex = regexp.MustCompile(`(?i).*\.(gpkg-wal|gpkg-shm)$`)
+
+// IsExcluded reports whether the file with given relative path should be
+// left out of project files listing
+func IsExcluded(relPath string) bool {
+	relPath = filepath.ToSlash(relPath)
+	return relPath == ".gisquick" || strings.HasPrefix(relPath, ".gisquick/") || strings.HasSuffix(relPath, "~") || excludeExtRegex.MatchString(relPath)
+}
+
+// ListOptions export
+type ListOptions struct {
+	// Checksum enables computation of files checksums
+	Checksum bool
+	// Algorithm of checksums (default is DefaultHashAlgorithm)
+	Algorithm string
+	// Workers is a number of files hashed in parallel (default is number of CPUs)
+	Workers int
+	// Progress is called after each hashed file with number of hashed files
+	// and total number of files (it's never called concurrently)
+	Progress func(done, total int)
+	// Ignore is a list of default ignore patterns, extended with patterns from
+	// IgnoreFile in the root directory (nil means DefaultIgnorePatterns)
+	Ignore []string
+	// SkipIgnoreFile disables patterns from IgnoreFile
+	SkipIgnoreFile bool
+}
+
+// ListDir export. Checksums are cached in the project's checksum index.
 func ListDir(root string, checksum bool) (*[]File, error) {
+	return ListDirContext(context.Background(), root, ListOptions{Checksum: checksum})
+}
+
+// ListDirContext lists files in the directory, listing is canceled when the
+// context is done
+func ListDirContext(ctx context.Context, root string, opts ListOptions) (*[]File, error) {
 	var files []File = []File{}
-	excludeExtRegex := regexp.MustCompile(`(?i).*\.(gpkg-wal|gpkg-shm)$`)
+	var infos []os.FileInfo
 
 	root, _ = filepath.Abs(root)
+	if opts.Ignore == nil {
+		opts.Ignore = DefaultIgnorePatterns
+	}
+	var ignore *IgnoreRules
+	if opts.SkipIgnoreFile {
+		ignore = NewIgnoreRules(opts.Ignore)
+	} else {
+		ignore = LoadIgnoreRules(root, opts.Ignore)
+	}
 	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		if !info.IsDir() {
-			hash := ""
-			if checksum {
-				if hash, err = Checksum(path); err != nil {
-					return err
-				}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		relPath := path[len(root)+1:]
+		if info.IsDir() {
+			if ignore.Match(filepath.ToSlash(relPath), true) {
+				return filepath.SkipDir
 			}
-			relPath := path[len(root)+1:]
-			if !strings.HasPrefix(relPath, ".gisquick") && !strings.HasSuffix(relPath, "~") && !excludeExtRegex.Match([]byte(relPath)) {
-				files = append(files, File{relPath, hash, info.Size(), info.ModTime()})
+		} else if !IsExcluded(relPath) && !ignore.Match(filepath.ToSlash(relPath), false) {
+			if info.Mode()&os.ModeSymlink != 0 {
+				// symbolic links are listed only when they refer to a file
+				// inside of the root directory
+				if _, err := SafeJoin(root, filepath.ToSlash(relPath)); err != nil {
+					return nil
+				}
+				if info, err = os.Stat(path); err != nil || info.IsDir() {
+					return nil
+				}
 			}
+			files = append(files, File{Path: relPath, Size: info.Size(), Mtime: info.ModTime()})
+			infos = append(infos, info)
 		}
 		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
+	if opts.Checksum {
+		if _, err := NewHash(opts.Algorithm); err != nil {
+			return nil, err
+		}
+		opts.Algorithm = normalizeHashAlgorithm(opts.Algorithm)
+		index := OpenChecksumIndex(root)
+		if err = computeChecksums(ctx, index, files, infos, opts); err != nil {
+			return nil, err
+		}
+		paths := make(map[string]bool, len(files))
+		for _, f := range files {
+			paths[filepath.ToSlash(f.Path)] = true
+		}
+		index.Retain(paths)
+		// index is just a cache, listing doesn't fail when it can't be saved
+		index.Save()
+	}
 	return &files, nil
 }
 
-// SaveToFile export
-func SaveToFile(src io.Reader, filename string) (err error) {
-	err = os.MkdirAll(filepath.Dir(filename), os.ModePerm)
-	if err != nil {
+// computeChecksums fills checksums of files with a pool of workers
+func computeChecksums(ctx context.Context, index *ChecksumIndex, files []File, infos []os.FileInfo, opts ListOptions) error {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var firstErr error
+	done := 0
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				hash, err := index.Checksum(ctx, files[i].Path, infos[i], opts.Algorithm)
+				mutex.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+					}
+					cancel()
+				} else {
+					files[i].Hash = hash
+					files[i].Algorithm = opts.Algorithm
+					done++
+					if opts.Progress != nil {
+						opts.Progress(done, len(files))
+					}
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for i := range files {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// FilesChanges export
+type FilesChanges struct {
+	New       []File `json:"new"`
+	Modified  []File `json:"modified"`
+	Deleted   []File `json:"deleted"`
+	Identical []File `json:"identical"`
+}
+
+// Diff compares source files (e.g. local project files) with destination
+// files (e.g. published project files). Files are compared by checksum, or
+// by size when the checksum is missing (or computed with different hash
+// algorithms). Deleted files are destination files missing in source files,
+// all other lists contain source files.
+func Diff(src, dest []File) FilesChanges {
+	changes := FilesChanges{
+		New:       []File{},
+		Modified:  []File{},
+		Deleted:   []File{},
+		Identical: []File{},
+	}
+	destFiles := make(map[string]File, len(dest))
+	for _, f := range dest {
+		destFiles[f.Path] = f
+	}
+	srcFiles := make(map[string]bool, len(src))
+	for _, f := range src {
+		srcFiles[f.Path] = true
+		destFile, ok := destFiles[f.Path]
+		if !ok {
+			changes.New = append(changes.New, f)
+		} else if f.Size != destFile.Size || (f.Hash != "" && destFile.Hash != "" &&
+			normalizeHashAlgorithm(f.Algorithm) == normalizeHashAlgorithm(destFile.Algorithm) && f.Hash != destFile.Hash) {
+			changes.Modified = append(changes.Modified, f)
+		} else {
+			changes.Identical = append(changes.Identical, f)
+		}
+	}
+	for _, f := range dest {
+		if !srcFiles[f.Path] {
+			changes.Deleted = append(changes.Deleted, f)
+		}
+	}
+	return changes
+}
+
+// AtomicFile is a file written into a temporary location, which replaces
+// the destination file only when successfully closed
+type AtomicFile struct {
+	*os.File
+	path string
+}
+
+// CreateAtomic creates new AtomicFile (including parent directories).
+// Temporary file is created in the same directory with name ending with "~",
+// so it is skipped by ListDir.
+func CreateAtomic(filename string) (*AtomicFile, error) {
+	dir, name := filepath.Split(filename)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	for {
+		suffix := make([]byte, 6)
+		if _, err := rand.Read(suffix); err != nil {
+			return nil, err
+		}
+		tmpPath := filepath.Join(dir, fmt.Sprintf(".%s.%x~", name, suffix))
+		file, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &AtomicFile{file, filename}, nil
+	}
+}
+
+// Close closes the file and moves it to the destination path
+func (f *AtomicFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.Name())
 		return err
 	}
-	file, err := os.Create(filename)
-	if err != nil {
+	if err := os.Rename(f.Name(), f.path); err != nil {
+		os.Remove(f.Name())
 		return err
 	}
+	return nil
+}
 
-	// more verbose but with better errors propagation
-	defer func() {
-		if cerr := file.Close(); cerr != nil && err == nil {
-			err = cerr
-		}
-	}()
+// Abort closes and removes the file, destination file is left untouched
+func (f *AtomicFile) Abort() error {
+	f.File.Close()
+	return os.Remove(f.Name())
+}
 
+// SaveToFile writes content into the file. Destination file is replaced only
+// when the whole content was successfully written.
+func SaveToFile(src io.Reader, filename string) error {
+	file, err := CreateAtomic(filename)
+	if err != nil {
+		return err
+	}
 	if _, err := io.Copy(file, src); err != nil {
+		file.Abort()
 		return err
 	}
-	return nil
+	return file.Close()
 }
 
 // CopyFile export
@@ -0,0 +1,166 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestFiles(t *testing.T, root string, count int) {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		writeTestFile(t, root, fmt.Sprintf("dir%d/file%d.txt", i%3, i), strings.Repeat(fmt.Sprint(i), i*100), time.Hour)
+	}
+}
+
+func listChecksums(t *testing.T, root string, opts ListOptions) []File {
+	t.Helper()
+	// index would be reused by next listing
+	os.Remove(filepath.Join(root, filepath.FromSlash(IndexFile)))
+	files, err := ListDirContext(context.Background(), root, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(*files, func(i, j int) bool { return (*files)[i].Path < (*files)[j].Path })
+	return *files
+}
+
+func TestParallelChecksums(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+	writeTestFiles(t, root, 50)
+
+	for _, algorithm := range HashAlgorithms {
+		sequential := listChecksums(t, root, ListOptions{Checksum: true, Algorithm: algorithm, Workers: 1})
+		for _, workers := range []int{0, 4, 100} {
+			parallel := listChecksums(t, root, ListOptions{Checksum: true, Algorithm: algorithm, Workers: workers})
+			if !reflect.DeepEqual(parallel, sequential) {
+				t.Errorf("%s with %d workers: results differ from sequential computation", algorithm, workers)
+			}
+		}
+		for _, f := range sequential {
+			if f.Hash == "" || f.Algorithm != algorithm {
+				t.Errorf("%s: missing checksum of %s", algorithm, f.Path)
+			}
+		}
+	}
+}
+
+func TestChecksumsProgress(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+	writeTestFiles(t, root, 20)
+
+	var calls []int
+	listChecksums(t, root, ListOptions{Checksum: true, Workers: 4, Progress: func(done, total int) {
+		if total != 20 {
+			t.Errorf("Progress total = %d", total)
+		}
+		calls = append(calls, done)
+	}})
+	if len(calls) != 20 {
+		t.Fatalf("Progress called %d times", len(calls))
+	}
+	for i, done := range calls {
+		if done != i+1 {
+			t.Errorf("Progress calls = %v", calls)
+			break
+		}
+	}
+}
+
+func TestChecksumsCancel(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+	writeTestFiles(t, root, 50)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ListDirContext(ctx, root, ListOptions{Checksum: true}); err != context.Canceled {
+		t.Errorf("listing with canceled context: error = %v", err)
+	}
+
+	// canceled during hashing
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	hashed := 0
+	_, err := ListDirContext(ctx, root, ListOptions{Checksum: true, Workers: 2, Progress: func(done, total int) {
+		hashed = done
+		if done == 5 {
+			cancel()
+		}
+	}})
+	if err != context.Canceled {
+		t.Errorf("listing canceled during hashing: error = %v", err)
+	}
+	// workers stop soon after cancellation (each of them can finish current file)
+	if hashed > 5+2 {
+		t.Errorf("%d files were hashed after cancellation", hashed-5)
+	}
+	if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(IndexFile))); !os.IsNotExist(err) {
+		t.Errorf("index was saved after canceled listing (%v)", err)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	paths := func(files []File) string {
+		p := make([]string, len(files))
+		for i, f := range files {
+			p[i] = f.Path
+		}
+		return strings.Join(p, ",")
+	}
+	tests := []struct {
+		name string
+		src  []File
+		dest []File
+		// expected paths of new, modified, deleted and identical files
+		changes [4]string
+	}{
+		{"empty", nil, nil, [4]string{}},
+		{"new project", []File{{Path: "a", Size: 1}, {Path: "b", Size: 2}}, nil, [4]string{"a,b", "", "", ""}},
+		{"deleted project", nil, []File{{Path: "a", Size: 1}}, [4]string{"", "", "a", ""}},
+		{
+			"by checksum",
+			[]File{{Path: "same", Size: 1, Hash: "h1"}, {Path: "changed", Size: 1, Hash: "h2"}, {Path: "added", Size: 1, Hash: "h3"}},
+			[]File{{Path: "same", Size: 1, Hash: "h1"}, {Path: "changed", Size: 1, Hash: "old"}, {Path: "removed", Size: 1, Hash: "h4"}},
+			[4]string{"added", "changed", "removed", "same"},
+		},
+		{
+			"by size",
+			[]File{{Path: "same", Size: 1}, {Path: "changed", Size: 2, Hash: "h"}},
+			[]File{{Path: "same", Size: 1, Hash: "h"}, {Path: "changed", Size: 1, Hash: "h"}},
+			[4]string{"", "changed", "", "same"},
+		},
+		{
+			"default algorithm",
+			[]File{{Path: "a", Size: 1, Hash: "h1", Algorithm: SHA1}},
+			[]File{{Path: "a", Size: 1, Hash: "h2"}},
+			[4]string{"", "a", "", ""},
+		},
+		{
+			"different algorithms",
+			[]File{{Path: "a", Size: 1, Hash: "h1", Algorithm: SHA256}},
+			[]File{{Path: "a", Size: 1, Hash: "h2", Algorithm: SHA1}},
+			[4]string{"", "", "", "a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Diff(tt.src, tt.dest)
+			got := [4]string{paths(c.New), paths(c.Modified), paths(c.Deleted), paths(c.Identical)}
+			if got != tt.changes {
+				t.Errorf("Diff() = %q, want %q", got, tt.changes)
+			}
+			if c.New == nil || c.Modified == nil || c.Deleted == nil || c.Identical == nil {
+				t.Errorf("Diff() has nil lists: %+v", c)
+			}
+		})
+	}
+}
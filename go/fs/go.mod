@@ -1,3 +1,5 @@
 module github.com/gislab-npo/gisquick-settings/fs
 
 go 1.12
+
+require github.com/cespare/xxhash/v2 v2.1.2
@@ -0,0 +1,62 @@
+package fs
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Supported hash algorithms
+const (
+	SHA1   = "sha1"
+	SHA256 = "sha256"
+	XXHash = "xxh64"
+)
+
+// DefaultHashAlgorithm is used when the algorithm is not specified (the only
+// one supported by old clients)
+const DefaultHashAlgorithm = SHA1
+
+// HashAlgorithms lists supported algorithms in order of preference
+var HashAlgorithms = []string{XXHash, SHA256, SHA1}
+
+// IsHashAlgorithm reports whether the algorithm is supported (empty value
+// means default algorithm)
+func IsHashAlgorithm(algorithm string) bool {
+	_, err := NewHash(algorithm)
+	return err == nil
+}
+
+// NewHash returns new hash of given algorithm
+func NewHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case SHA1, "":
+		return sha1.New(), nil
+	case SHA256:
+		return sha256.New(), nil
+	case XXHash:
+		return xxhash.New(), nil
+	}
+	return nil, fmt.Errorf("Unsupported hash algorithm: %s", algorithm)
+}
+
+// NegotiateHashAlgorithm returns the first of preferred algorithms which is
+// supported, or default algorithm when there is no such algorithm
+func NegotiateHashAlgorithm(preferred []string) string {
+	for _, algorithm := range preferred {
+		if algorithm != "" && IsHashAlgorithm(algorithm) {
+			return algorithm
+		}
+	}
+	return DefaultHashAlgorithm
+}
+
+func normalizeHashAlgorithm(algorithm string) string {
+	if algorithm == "" {
+		return DefaultHashAlgorithm
+	}
+	return algorithm
+}
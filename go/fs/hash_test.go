@@ -0,0 +1,49 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNegotiateHashAlgorithm(t *testing.T) {
+	tests := []struct {
+		name      string
+		preferred []string
+		algorithm string
+	}{
+		{"old server", nil, SHA1},
+		{"first supported", []string{SHA256, XXHash}, SHA256},
+		{"unknown algorithms", []string{"blake3", "", SHA256}, SHA256},
+		{"no supported", []string{"blake3", "md5"}, DefaultHashAlgorithm},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NegotiateHashAlgorithm(tt.preferred); got != tt.algorithm {
+				t.Errorf("NegotiateHashAlgorithm(%v) = %s, want %s", tt.preferred, got, tt.algorithm)
+			}
+		})
+	}
+}
+
+func TestChecksumAlgorithm(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+	writeTestFile(t, root, "file.txt", "abc", 0)
+	path := filepath.Join(root, "file.txt")
+
+	tests := map[string]string{
+		"":     "a9993e364706816aba3e25717850c26c9cd0d89d",
+		SHA1:   "a9993e364706816aba3e25717850c26c9cd0d89d",
+		SHA256: "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+		XXHash: "44bc2cf5ad770999",
+	}
+	for algorithm, expected := range tests {
+		if hash, err := ChecksumAlgorithm(path, algorithm); err != nil || hash != expected {
+			t.Errorf("ChecksumAlgorithm(%q) = %s, %v, want %s", algorithm, hash, err, expected)
+		}
+	}
+	if _, err := ChecksumAlgorithm(path, "md5"); err == nil {
+		t.Error("ChecksumAlgorithm() with unsupported algorithm succeeded")
+	}
+}
@@ -0,0 +1,174 @@
+package fs
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// IgnoreFile is a name of the file with gitignore-style patterns of files
+// excluded from the project (in the project root directory)
+const IgnoreFile = ".gisquickignore"
+
+// DefaultIgnorePatterns are patterns of temporary and auxiliary files which
+// are not part of the project
+var DefaultIgnorePatterns = []string{
+	".DS_Store",
+	"Thumbs.db",
+	"desktop.ini",
+	"__pycache__/",
+	"*.pyc",
+	"*.bak",
+	"*.lock",
+	".~lock.*#",
+	"*.gpkg-journal",
+	"*.sqlite-journal",
+}
+
+type ignoreRule struct {
+	regex   *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// IgnoreRules matches paths against a list of gitignore-style patterns.
+// Later patterns take precedence over earlier ones.
+type IgnoreRules struct {
+	rules []ignoreRule
+}
+
+// NewIgnoreRules compiles patterns (invalid patterns are skipped)
+func NewIgnoreRules(patterns []string) *IgnoreRules {
+	r := &IgnoreRules{}
+	for _, p := range patterns {
+		if rule, ok := compileIgnorePattern(p); ok {
+			r.rules = append(r.rules, rule)
+		}
+	}
+	return r
+}
+
+// ReadIgnorePatterns reads patterns from the content of ignore file
+func ReadIgnorePatterns(r io.Reader) ([]string, error) {
+	var patterns []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		patterns = append(patterns, scanner.Text())
+	}
+	return patterns, scanner.Err()
+}
+
+// LoadIgnoreRules returns default patterns extended with patterns from the
+// ignore file in the project directory
+func LoadIgnoreRules(root string, defaults []string) *IgnoreRules {
+	patterns := append([]string{}, defaults...)
+	if file, err := os.Open(filepath.Join(root, IgnoreFile)); err == nil {
+		defer file.Close()
+		if filePatterns, err := ReadIgnorePatterns(file); err == nil {
+			patterns = append(patterns, filePatterns...)
+		}
+	}
+	return NewIgnoreRules(patterns)
+}
+
+func compileIgnorePattern(pattern string) (ignoreRule, bool) {
+	var rule ignoreRule
+	// trailing spaces are ignored unless escaped
+	if !strings.HasSuffix(pattern, "\\ ") {
+		pattern = strings.TrimRight(pattern, " \t\r")
+	}
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return rule, false
+	}
+	if strings.HasPrefix(pattern, "!") {
+		rule.negate = true
+		pattern = pattern[1:]
+	} else if strings.HasPrefix(pattern, "\\!") || strings.HasPrefix(pattern, "\\#") {
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		rule.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if pattern == "" {
+		return rule, false
+	}
+	// pattern containing separator is relative to the project root,
+	// otherwise it matches at any level
+	var expr strings.Builder
+	if strings.Contains(pattern, "/") {
+		expr.WriteString("^")
+		pattern = strings.TrimPrefix(pattern, "/")
+	} else {
+		expr.WriteString("^(?:.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/") && (i == 0 || pattern[i-1] == '/'):
+			expr.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**") && i+2 == len(pattern) && (i == 0 || pattern[i-1] == '/'):
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end == -1 {
+				expr.WriteString(regexp.QuoteMeta("["))
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + strings.Replace(class, "\\", "\\\\", -1) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			expr.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	regex, err := regexp.Compile(expr.String())
+	if err != nil {
+		return rule, false
+	}
+	rule.regex = regex
+	return rule, true
+}
+
+// Match reports whether the path (slash separated, relative to the project
+// root) matches the rules, without checking its parent directories
+func (r *IgnoreRules) Match(relPath string, isDir bool) bool {
+	ignored := false
+	for _, rule := range r.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.regex.MatchString(relPath) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// Ignored reports whether the file (slash separated path relative to the
+// project root) is ignored, directly or by ignored parent directory
+func (r *IgnoreRules) Ignored(relPath string) bool {
+	parts := strings.Split(relPath, "/")
+	for i := 1; i < len(parts); i++ {
+		if r.Match(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+	return r.Match(relPath, false)
+}
@@ -0,0 +1,119 @@
+package fs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIgnoreRules(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		path     string
+		ignored  bool
+	}{
+		// basic patterns
+		{"name at any level", []string{"*.bak"}, "a/b/file.bak", true},
+		{"name in root", []string{"*.bak"}, "file.bak", true},
+		{"no match", []string{"*.bak"}, "file.bak.txt", false},
+		{"star doesn't match separator", []string{"data/*.gpkg"}, "data/sub/a.gpkg", false},
+		{"question mark", []string{"file?.txt"}, "file1.txt", true},
+		{"question mark needs character", []string{"file?.txt"}, "file.txt", false},
+		{"character class", []string{"file[0-9].txt"}, "file5.txt", true},
+		{"negated character class", []string{"file[!0-9].txt"}, "file5.txt", false},
+		{"comment", []string{"#file.txt"}, "#file.txt", false},
+		{"escaped hash", []string{"\\#file.txt"}, "#file.txt", true},
+		{"escaped wildcard", []string{"file\\*.txt"}, "file1.txt", false},
+		{"trailing spaces", []string{"file.txt  "}, "file.txt", true},
+		{"empty pattern", []string{""}, "file.txt", false},
+
+		// anchoring
+		{"pattern with separator is anchored", []string{"data/cache"}, "data/cache", true},
+		{"anchored pattern in subdirectory", []string{"data/cache"}, "x/data/cache", false},
+		{"leading slash anchors", []string{"/cache"}, "cache", true},
+		{"leading slash in subdirectory", []string{"/cache"}, "data/cache", false},
+		{"name without slash matches in subdirectory", []string{"cache"}, "data/cache", true},
+
+		// double star
+		{"leading double star", []string{"**/cache"}, "a/b/cache", true},
+		{"leading double star in root", []string{"**/cache"}, "cache", true},
+		{"trailing double star", []string{"data/**"}, "data/a/b.txt", true},
+		{"trailing double star outside", []string{"data/**"}, "other/data/b.txt", false},
+		{"middle double star", []string{"a/**/b.txt"}, "a/x/y/b.txt", true},
+		{"middle double star zero dirs", []string{"a/**/b.txt"}, "a/b.txt", true},
+		{"double star not separated", []string{"a**b"}, "axxb", true},
+		{"double star not separated is single star", []string{"a**b"}, "ax/xb", false},
+
+		// directories
+		{"directory pattern ignores content", []string{"tmp/"}, "a/tmp/file.txt", true},
+		{"directory pattern doesn't match file", []string{"tmp/"}, "a/tmp", false},
+		{"pattern matching directory", []string{"tmp"}, "tmp/file.txt", true},
+
+		// negation
+		{"negation", []string{"*.txt", "!keep.txt"}, "keep.txt", false},
+		{"negation of other file", []string{"*.txt", "!keep.txt"}, "other.txt", true},
+		{"later pattern wins", []string{"!keep.txt", "*.txt"}, "keep.txt", true},
+		{"escaped exclamation", []string{"\\!file.txt"}, "!file.txt", true},
+		{"negation doesn't include file in ignored directory", []string{"tmp/", "!tmp/keep.txt"}, "tmp/keep.txt", true},
+		{"negation of directory", []string{"data/*", "!data/keep/"}, "data/keep/file.txt", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := NewIgnoreRules(tt.patterns)
+			if got := rules.Ignored(tt.path); got != tt.ignored {
+				t.Errorf("%q.Ignored(%q) = %v, want %v", tt.patterns, tt.path, got, tt.ignored)
+			}
+		})
+	}
+}
+
+func TestDefaultIgnorePatterns(t *testing.T) {
+	rules := NewIgnoreRules(DefaultIgnorePatterns)
+	ignored := []string{".DS_Store", "data/Thumbs.db", "scripts/__pycache__/a.cpython.pyc", "x.pyc", "project.qgs.bak", ".~lock.data.csv#", "db.gpkg-journal"}
+	for _, p := range ignored {
+		if !rules.Ignored(p) {
+			t.Errorf("%s is not ignored", p)
+		}
+	}
+	for _, p := range []string{"project.qgs", "data/layer.gpkg", "scripts/app.js", "lock.txt"} {
+		if rules.Ignored(p) {
+			t.Errorf("%s is ignored", p)
+		}
+	}
+}
+
+func TestListDirIgnoreFile(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+	for _, p := range []string{"project.qgs", "project.qgs.bak", "data/a.gpkg", "data/tmp/x.txt", "cache/tile.png", "cache/keep.png", "notes.txt"} {
+		writeTestFile(t, root, p, "x", time.Hour)
+	}
+	writeTestFile(t, root, IgnoreFile, "# comment\ntmp/\n/cache/*\n!cache/keep.png\n*.txt\n", time.Hour)
+
+	files, err := ListDir(root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, f := range *files {
+		paths = append(paths, filepath.ToSlash(f.Path))
+	}
+	sort.Strings(paths)
+	want := ".gisquickignore,cache/keep.png,data/a.gpkg,project.qgs"
+	if strings.Join(paths, ",") != want {
+		t.Errorf("ListDir() = %v, want %s", paths, want)
+	}
+
+	files, err = ListDirContext(context.Background(), root, ListOptions{Ignore: []string{}, SkipIgnoreFile: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*files) != 8 {
+		t.Errorf("ListDirContext() without ignore file = %v", *files)
+	}
+}
@@ -0,0 +1,127 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// IndexFile is a path of the checksum index relative to the project root
+const IndexFile = ".gisquick/checksums.json"
+
+// files modified recently are not cached by ListDir, because their content
+// could change again without the change of modification time
+const indexMtimeGranularity = 2 * time.Second
+
+type indexEntry struct {
+	Size  int64     `json:"size"`
+	Mtime time.Time `json:"mtime"`
+	Inode uint64    `json:"inode"`
+	// checksums by hash algorithm
+	Hashes map[string]string `json:"hashes"`
+}
+
+func (e indexEntry) matches(info os.FileInfo) bool {
+	return e.Size == info.Size() && e.Mtime.Equal(info.ModTime()) && e.Inode == inode(info)
+}
+
+// ChecksumIndex is a persistent cache of files checksums in a project
+// directory. Cached checksum is used only when size, modification time and
+// inode of the file are unchanged.
+type ChecksumIndex struct {
+	root     string
+	entries  map[string]indexEntry
+	modified bool
+	mutex    sync.Mutex
+}
+
+// OpenChecksumIndex loads checksum index of the project directory (invalid
+// or missing index is treated as empty)
+func OpenChecksumIndex(root string) *ChecksumIndex {
+	idx := &ChecksumIndex{root: root, entries: make(map[string]indexEntry)}
+	data, err := ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(IndexFile)))
+	if err == nil {
+		if err = json.Unmarshal(data, &idx.entries); err != nil {
+			idx.entries = make(map[string]indexEntry)
+		}
+	}
+	return idx
+}
+
+func (idx *ChecksumIndex) lookup(relPath string, info os.FileInfo, algorithm string) (string, bool) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	e, ok := idx.entries[filepath.ToSlash(relPath)]
+	if !ok || !e.matches(info) {
+		return "", false
+	}
+	hash, ok := e.Hashes[algorithm]
+	return hash, ok
+}
+
+// Checksum returns checksum of the file from the index, or computes it when
+// the file was changed
+func (idx *ChecksumIndex) Checksum(ctx context.Context, relPath string, info os.FileInfo, algorithm string) (string, error) {
+	algorithm = normalizeHashAlgorithm(algorithm)
+	if hash, ok := idx.lookup(relPath, info, algorithm); ok {
+		return hash, nil
+	}
+	hash, err := checksumContext(ctx, filepath.Join(idx.root, relPath), algorithm)
+	if err != nil {
+		return "", err
+	}
+	if time.Since(info.ModTime()) > indexMtimeGranularity {
+		idx.Update(relPath, info, algorithm, hash)
+	}
+	return hash, nil
+}
+
+// Update records checksum of the file (e.g. when the file was written with
+// already known checksum)
+func (idx *ChecksumIndex) Update(relPath string, info os.FileInfo, algorithm, hash string) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	key := filepath.ToSlash(relPath)
+	e, ok := idx.entries[key]
+	if !ok || !e.matches(info) || e.Hashes == nil {
+		e = indexEntry{info.Size(), info.ModTime(), inode(info), make(map[string]string)}
+	}
+	e.Hashes[normalizeHashAlgorithm(algorithm)] = hash
+	idx.entries[key] = e
+	idx.modified = true
+}
+
+// Retain removes entries of files not present in the given set of paths
+func (idx *ChecksumIndex) Retain(paths map[string]bool) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	for p := range idx.entries {
+		if !paths[p] {
+			delete(idx.entries, p)
+			idx.modified = true
+		}
+	}
+}
+
+// Save writes the index into the project directory (if it was modified)
+func (idx *ChecksumIndex) Save() error {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	if !idx.modified {
+		return nil
+	}
+	data, err := json.Marshal(idx.entries)
+	if err != nil {
+		return err
+	}
+	if err = SaveToFile(bytes.NewReader(data), filepath.Join(idx.root, filepath.FromSlash(IndexFile))); err != nil {
+		return err
+	}
+	idx.modified = false
+	return nil
+}
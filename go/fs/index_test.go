@@ -0,0 +1,153 @@
+package fs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "gisquick-fs-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// writeTestFile writes file with given modification time (relative to now)
+func writeTestFile(t *testing.T, root, relPath, content string, age time.Duration) os.FileInfo {
+	t.Helper()
+	p := filepath.Join(root, filepath.FromSlash(relPath))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(-age).Truncate(time.Second)
+	if err := os.Chtimes(p, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestChecksumIndex(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+	ctx := context.Background()
+	const helloSHA1 = "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"
+
+	info := writeTestFile(t, root, "data/a.txt", "hello", time.Hour)
+	idx := OpenChecksumIndex(root)
+	hash, err := idx.Checksum(ctx, "data/a.txt", info, SHA1)
+	if err != nil || hash != helloSHA1 {
+		t.Fatalf("Checksum() = %s, %v", hash, err)
+	}
+	if err = idx.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// file with the same size and mtime is not read again (content is
+	// changed to detect usage of the index)
+	info = writeTestFile(t, root, "data/a.txt", "HELLO", time.Hour)
+	idx = OpenChecksumIndex(root)
+	if hash, _ = idx.Checksum(ctx, "data/a.txt", info, SHA1); hash != helloSHA1 {
+		t.Errorf("checksum of unchanged file was not taken from the index")
+	}
+	// other algorithms are computed and cached separately
+	if hash, _ = idx.Checksum(ctx, "data/a.txt", info, SHA256); hash == helloSHA1 || len(hash) != 64 {
+		t.Errorf("SHA256 checksum = %s", hash)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		age     time.Duration
+	}{
+		{"changed mtime", "HELLO", 2 * time.Hour},
+		{"changed size", "hello!", 2 * time.Hour},
+		{"recent modification", "hellO", 0},
+	}
+	for _, tt := range tests {
+		info = writeTestFile(t, root, "data/a.txt", tt.content, tt.age)
+		want, _ := ChecksumAlgorithm(filepath.Join(root, "data", "a.txt"), SHA1)
+		if hash, _ = idx.Checksum(ctx, "data/a.txt", info, SHA1); hash != want {
+			t.Errorf("%s: Checksum() = %s, want %s", tt.name, hash, want)
+		}
+	}
+	// recently modified file is not cached (it could change again within
+	// mtime granularity)
+	if _, ok := idx.lookup("data/a.txt", info, SHA1); ok {
+		t.Error("recently modified file was cached")
+	}
+}
+
+func TestChecksumIndexPersistence(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+	a := writeTestFile(t, root, "a.txt", "a", time.Hour)
+	b := writeTestFile(t, root, "b.txt", "b", time.Hour)
+
+	idx := OpenChecksumIndex(root)
+	idx.Update("a.txt", a, SHA1, "hash-a")
+	idx.Update("b.txt", b, "", "hash-b")
+	idx.Retain(map[string]bool{"a.txt": true})
+	if err := idx.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	idx = OpenChecksumIndex(root)
+	if hash, ok := idx.lookup("a.txt", a, SHA1); !ok || hash != "hash-a" {
+		t.Errorf("lookup(a.txt) = %s, %v", hash, ok)
+	}
+	if _, ok := idx.lookup("b.txt", b, SHA1); ok {
+		t.Error("entry removed by Retain was saved")
+	}
+
+	// invalid index is treated as empty
+	ioutil.WriteFile(filepath.Join(root, filepath.FromSlash(IndexFile)), []byte("{invalid"), 0644)
+	if idx = OpenChecksumIndex(root); len(idx.entries) != 0 {
+		t.Errorf("entries of invalid index: %v", idx.entries)
+	}
+}
+
+func TestListDirUsesIndex(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+	writeTestFile(t, root, "a.txt", "hello", time.Hour)
+	writeTestFile(t, root, "b.txt", "world", time.Hour)
+	opts := ListOptions{Checksum: true}
+
+	files, err := ListDirContext(context.Background(), root, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(root, filepath.FromSlash(IndexFile))); err != nil {
+		t.Fatalf("index was not saved: %s", err)
+	}
+	first := make(map[string]string)
+	for _, f := range *files {
+		first[f.Path] = f.Hash
+	}
+
+	// a.txt is modified without change of size and mtime, b.txt is removed
+	writeTestFile(t, root, "a.txt", "HELLO", time.Hour)
+	os.Remove(filepath.Join(root, "b.txt"))
+	if files, err = ListDirContext(context.Background(), root, opts); err != nil {
+		t.Fatal(err)
+	}
+	if len(*files) != 1 || (*files)[0].Hash != first["a.txt"] {
+		t.Errorf("ListDirContext() = %+v, want cached checksum of a.txt", *files)
+	}
+	if idx := OpenChecksumIndex(root); len(idx.entries) != 1 {
+		t.Errorf("index entries after removal of file: %v", idx.entries)
+	}
+}
@@ -0,0 +1,8 @@
+package fs
+
+import "os"
+
+// file index is not available in os.FileInfo on Windows
+func inode(info os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,141 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		path  string
+		clean string
+		// empty reason means valid path
+		reason string
+	}{
+		{"file.txt", "file.txt", ""},
+		{"data/layer.gpkg", "data/layer.gpkg", ""},
+		{"./data//layer.gpkg", "data/layer.gpkg", ""},
+		{"data/../file.txt", "file.txt", ""},
+		{"data/", "data", ""},
+		{"..file", "..file", ""},
+		{"file..", "file..", ""},
+		{".gisquick/checksums.json", ".gisquick/checksums.json", ""},
+		{"%2e%2e/file", "%2e%2e/file", ""},
+		{"..%2Ffile", "..%2Ffile", ""},
+
+		{"", "", "empty path"},
+		{".", "", "empty path"},
+		{"./", "", "empty path"},
+		{"data/..", "", "empty path"},
+		{"..", "", "outside of base directory"},
+		{"../file", "", "outside of base directory"},
+		{"../../../etc/passwd", "", "outside of base directory"},
+		{"data/../../file", "", "outside of base directory"},
+		{"./../file", "", "outside of base directory"},
+		{"/etc/passwd", "", "absolute path"},
+		{"//server/share", "", "absolute path"},
+		{"C:/Windows/win.ini", "", "absolute path"},
+		{"c:file", "", "absolute path"},
+		{"..\\..\\file", "", "contains backslash"},
+		{"data\\file", "", "contains backslash"},
+		{"\\\\server\\share", "", "contains backslash"},
+		{"file\x00.txt", "", "contains NUL byte"},
+		{"../\x00", "", "contains NUL byte"},
+	}
+	for _, tt := range tests {
+		clean, err := CleanPath(tt.path)
+		if tt.reason == "" {
+			if err != nil || clean != tt.clean {
+				t.Errorf("CleanPath(%q) = %q, %v, want %q", tt.path, clean, err, tt.clean)
+			}
+			continue
+		}
+		pathErr, ok := err.(*UnsafePathError)
+		if !ok || pathErr.Reason != tt.reason || pathErr.Path != tt.path {
+			t.Errorf("CleanPath(%q) = %q, %v, want error %q", tt.path, clean, err, tt.reason)
+		}
+	}
+}
+
+func TestCleanName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"project", true},
+		{"my project.v2", true},
+		{"..project", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"a/b", false},
+		{"a/", false},
+		{"./a", false},
+		{"/a", false},
+		{"a\\b", false},
+		{"a\x00", false},
+		{"C:", false},
+	}
+	for _, tt := range tests {
+		clean, err := CleanName(tt.name)
+		if (err == nil) != tt.valid || (tt.valid && clean != tt.name) {
+			t.Errorf("CleanName(%q) = %q, %v, want valid: %v", tt.name, clean, err, tt.valid)
+		}
+	}
+}
+
+func TestSafeJoin(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symbolic links are not supported")
+	}
+	tmp := tempDir(t)
+	defer os.RemoveAll(tmp)
+	root := filepath.Join(tmp, "project")
+	outside := filepath.Join(tmp, "outside")
+	for _, dir := range []string{filepath.Join(root, "data"), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"data/inside":  filepath.Join(root, "data"),
+		"data/outside": outside,
+		"data/file":    "/etc/passwd",
+		"data/broken":  filepath.Join(tmp, "missing"),
+		"data/parent":  "..",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, filepath.FromSlash(link))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		path  string
+		valid bool
+	}{
+		{"data/new.txt", true},
+		{"new/dir/file.txt", true},
+		{"data/inside/file.txt", true},
+		{"data/parent/data/file.txt", true},
+		{"data/outside", false},
+		{"data/outside/file.txt", false},
+		{"data/outside/new/dir/file.txt", false},
+		{"data/file", false},
+		{"data/broken", false},
+		{"data/broken/file.txt", false},
+		{"../outside/file.txt", false},
+		{"/etc/passwd", false},
+	}
+	for _, tt := range tests {
+		p, err := SafeJoin(root, tt.path)
+		if (err == nil) != tt.valid {
+			t.Errorf("SafeJoin(%q) = %q, %v, want valid: %v", tt.path, p, err, tt.valid)
+		}
+		if err == nil && p != filepath.Join(root, filepath.FromSlash(tt.path)) {
+			t.Errorf("SafeJoin(%q) = %q", tt.path, p)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// UnsafePathError is returned for paths which could refer to a file outside
+// of the base directory
+type UnsafePathError struct {
+	Path   string
+	Reason string
+}
+
+func (e *UnsafePathError) Error() string {
+	return fmt.Sprintf("Unsafe path %q: %s", e.Path, e.Reason)
+}
+
+// CleanPath validates slash separated path relative to some base directory
+// and returns it in canonical form
+func CleanPath(p string) (string, error) {
+	switch {
+	case strings.IndexByte(p, 0) != -1:
+		return "", &UnsafePathError{p, "contains NUL byte"}
+	case strings.HasPrefix(p, "/") || filepath.IsAbs(p) || hasDriveLetter(p):
+		return "", &UnsafePathError{p, "absolute path"}
+	case strings.Contains(p, "\\"):
+		return "", &UnsafePathError{p, "contains backslash"}
+	}
+	clean := path.Clean(p)
+	if clean == "." {
+		return "", &UnsafePathError{p, "empty path"}
+	}
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", &UnsafePathError{p, "outside of base directory"}
+	}
+	return clean, nil
+}
+
+// hasDriveLetter reports whether the path starts with Windows drive letter
+func hasDriveLetter(p string) bool {
+	return len(p) > 1 && p[1] == ':' && (('a' <= p[0] && p[0] <= 'z') || ('A' <= p[0] && p[0] <= 'Z'))
+}
+
+// CleanName validates name of a single file or directory
+func CleanName(name string) (string, error) {
+	clean, err := CleanPath(name)
+	if err != nil {
+		return "", err
+	}
+	if clean != name || strings.Contains(name, "/") {
+		return "", &UnsafePathError{name, "not a single path element"}
+	}
+	return clean, nil
+}
+
+// SafeJoin joins the root directory with slash separated relative path. The
+// path must not refer outside of the root directory, not even by symbolic
+// links of already existing files or directories.
+func SafeJoin(root, p string) (string, error) {
+	clean, err := CleanPath(p)
+	if err != nil {
+		return "", err
+	}
+	root = filepath.Clean(root)
+	fullPath := filepath.Join(root, filepath.FromSlash(clean))
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fullPath, nil
+		}
+		return "", err
+	}
+	// resolve the deepest existing part of the path
+	existing := fullPath
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if len(parent) < len(root) || parent == existing {
+			return fullPath, nil
+		}
+		existing = parent
+	}
+	realPath, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", &UnsafePathError{p, "broken symbolic link"}
+		}
+		return "", err
+	}
+	if !isWithin(realRoot, realPath) {
+		return "", &UnsafePathError{p, "symbolic link outside of base directory"}
+	}
+	return fullPath, nil
+}
+
+// isWithin reports whether the path is equal to the directory or inside of it
+func isWithin(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
@@ -0,0 +1,244 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/gislab-npo/gisquick-settings/server/storage"
+	"github.com/go-chi/chi"
+)
+
+// Permissions which can be granted to project collaborators
+var aclPermissions = map[string]access{
+	"read":   accessRead,
+	"upload": accessWrite,
+	"admin":  accessAdmin,
+}
+
+// projectACL grants permissions on the project to other users and groups
+type projectACL struct {
+	Users  map[string]string `json:"users"`
+	Groups map[string]string `json:"groups"`
+}
+
+func newProjectACL() *projectACL {
+	return &projectACL{Users: make(map[string]string), Groups: make(map[string]string)}
+}
+
+func (acl *projectACL) validate() error {
+	for _, entries := range []map[string]string{acl.Users, acl.Groups} {
+		for name, permission := range entries {
+			if name == "" {
+				return errors.New("Empty user or group name")
+			}
+			if _, ok := aclPermissions[permission]; !ok {
+				return fmt.Errorf("Invalid permission: %s", permission)
+			}
+		}
+	}
+	return nil
+}
+
+// access returns the highest level of access granted to the user or to any
+// of the user's groups
+func (acl *projectACL) access(user *User) access {
+	granted := accessLogin
+	if a, ok := aclPermissions[acl.Users[user.Username]]; ok && a > granted {
+		granted = a
+	}
+	for _, group := range user.Groups {
+		if a, ok := aclPermissions[acl.Groups[group]]; ok && a > granted {
+			granted = a
+		}
+	}
+	return granted
+}
+
+// aclPath returns storage path of project's ACL. ACLs are stored in the
+// server's internal directory in the storage root, outside of directories
+// writable by project collaborators.
+func aclPath(username, directory string) string {
+	return path.Join(".gisquick", "acl", username, directory+".json")
+}
+
+// loadACL returns ACL of the project (empty when it wasn't set)
+func (s *Server) loadACL(username, directory string) (*projectACL, error) {
+	acl := newProjectACL()
+	data, err := s.readFile(aclPath(username, directory))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return acl, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(data, acl); err != nil {
+		return nil, err
+	}
+	if acl.Users == nil {
+		acl.Users = make(map[string]string)
+	}
+	if acl.Groups == nil {
+		acl.Groups = make(map[string]string)
+	}
+	return acl, nil
+}
+
+func (s *Server) saveACL(username, directory string, acl *projectACL) error {
+	data, err := json.Marshal(acl)
+	if err != nil {
+		return err
+	}
+	return storage.SaveFile(s.storage, bytes.NewReader(data), aclPath(username, directory))
+}
+
+// updateACL modifies ACL of the project, concurrent updates are serialized
+func (s *Server) updateACL(username, directory string, update func(acl *projectACL)) (*projectACL, error) {
+	s.aclMutex.Lock()
+	defer s.aclMutex.Unlock()
+	acl, err := s.loadACL(username, directory)
+	if err != nil {
+		return nil, err
+	}
+	update(acl)
+	if err = s.saveACL(username, directory, acl); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// aclEntries returns users or groups entries of the ACL by URL parameter
+func aclEntries(acl *projectACL, kind string) map[string]string {
+	switch kind {
+	case "users":
+		return acl.Users
+	case "groups":
+		return acl.Groups
+	}
+	return nil
+}
+
+// projectExists writes 404 response when the project doesn't exist
+func (s *Server) projectExists(w http.ResponseWriter, r *http.Request, username, directory string) bool {
+	if _, err := s.storage.Stat(projectPath(username, directory)); err != nil {
+		if os.IsNotExist(err) {
+			s.errorResponse(w, r, http.StatusNotFound, errCodeProjectNotFound, "Project not found", nil)
+		} else {
+			s.errorf(r, "Failed to read project directory: %s\n", err)
+			s.serverError(w, r)
+		}
+		return false
+	}
+	return true
+}
+
+func (s *Server) handleGetACL() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := chi.URLParam(r, "user")
+		directory := chi.URLParam(r, "directory")
+		if !s.projectExists(w, r, username, directory) {
+			return
+		}
+		acl, err := s.loadACL(username, directory)
+		if err != nil {
+			s.errorf(r, "Failed to load project ACL: %s\n", err)
+			s.serverError(w, r)
+			return
+		}
+		s.jsonResponse(w, acl)
+	}
+}
+
+func (s *Server) handleSetACL() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := chi.URLParam(r, "user")
+		directory := chi.URLParam(r, "directory")
+		if !s.projectExists(w, r, username, directory) {
+			return
+		}
+		data := newProjectACL()
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024*1024)).Decode(data); err != nil {
+			s.badRequest(w, r, "Invalid ACL", nil)
+			return
+		}
+		if err := data.validate(); err != nil {
+			s.badRequest(w, r, err.Error(), nil)
+			return
+		}
+		acl, err := s.updateACL(username, directory, func(acl *projectACL) {
+			*acl = *data
+		})
+		if err != nil {
+			s.errorf(r, "Failed to save project ACL: %s\n", err)
+			s.serverError(w, r)
+			return
+		}
+		s.jsonResponse(w, acl)
+	}
+}
+
+func (s *Server) handleSetACLEntry() http.HandlerFunc {
+	type entryInfo struct {
+		Permission string `json:"permission"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := chi.URLParam(r, "user")
+		directory := chi.URLParam(r, "directory")
+		kind := chi.URLParam(r, "kind")
+		name := chi.URLParam(r, "name")
+		if aclEntries(newProjectACL(), kind) == nil {
+			s.notFound(w, r, "Not found")
+			return
+		}
+		if !s.projectExists(w, r, username, directory) {
+			return
+		}
+		var info entryInfo
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&info); err != nil {
+			s.badRequest(w, r, "Invalid ACL entry", nil)
+			return
+		}
+		if _, ok := aclPermissions[info.Permission]; !ok {
+			s.badRequest(w, r, fmt.Sprintf("Invalid permission: %s", info.Permission), map[string]string{"permission": info.Permission})
+			return
+		}
+		acl, err := s.updateACL(username, directory, func(acl *projectACL) {
+			aclEntries(acl, kind)[name] = info.Permission
+		})
+		if err != nil {
+			s.errorf(r, "Failed to save project ACL: %s\n", err)
+			s.serverError(w, r)
+			return
+		}
+		s.jsonResponse(w, acl)
+	}
+}
+
+func (s *Server) handleDeleteACLEntry() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := chi.URLParam(r, "user")
+		directory := chi.URLParam(r, "directory")
+		kind := chi.URLParam(r, "kind")
+		name := chi.URLParam(r, "name")
+		if aclEntries(newProjectACL(), kind) == nil {
+			s.notFound(w, r, "Not found")
+			return
+		}
+		if !s.projectExists(w, r, username, directory) {
+			return
+		}
+		acl, err := s.updateACL(username, directory, func(acl *projectACL) {
+			delete(aclEntries(acl, kind), name)
+		})
+		if err != nil {
+			s.errorf(r, "Failed to save project ACL: %s\n", err)
+			s.serverError(w, r)
+			return
+		}
+		s.jsonResponse(w, acl)
+	}
+}
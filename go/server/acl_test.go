@@ -0,0 +1,72 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestACLNotWritableByCollaborators(t *testing.T) {
+	writer := &User{Username: "user2"}
+	s := newTestServer(t, Settings{}, testUser, writer)
+	writeFile(t, s, "user1/project/project.qgs", "<qgis/>")
+
+	w := request(s, "PUT", "/api/project/acl/user1/project/users/user2", "user1", strings.NewReader(`{"permission": "upload"}`), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("set ACL entry: %d %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(filepath.Join(s.config.ProjectsRoot, ".gisquick", "acl", "user1", "project.json")); err != nil {
+		t.Errorf("ACL is not stored in the internal directory: %s", err)
+	}
+	if w := request(s, "GET", "/api/project/acl/user1/project", "user2", nil, nil); w.Code != http.StatusForbidden {
+		t.Errorf("ACL read by collaborator with upload permission: %d", w.Code)
+	}
+
+	// collaborator can't upload own ACL into the project
+	for _, p := range []string{".gisquick/acl/acl.json", "../../.gisquick/acl/user1/project.json"} {
+		body := fmt.Sprintf(`{"files": [{"path": %q, "size": 2}]}`, p)
+		w := request(s, "POST", "/api/project/uploads/user1/project", "user2", strings.NewReader(body), map[string]string{"Content-Type": "application/json"})
+		if w.Code != http.StatusBadRequest || errorCode(w) != errCodeInvalidPath {
+			t.Errorf("upload of %s: %d %s", p, w.Code, w.Body)
+		}
+	}
+	// ACL is not a part of project files
+	writeFile(t, s, "user1/project/.gisquick/acl/acl.json", `{"users": {"user2": "admin"}}`)
+	if w := request(s, "GET", "/api/project/acl/user1/project", "user2", nil, nil); w.Code != http.StatusForbidden {
+		t.Errorf("ACL in project directory was used: %d", w.Code)
+	}
+}
+
+func TestACLReservedOwner(t *testing.T) {
+	attacker := &User{Username: ".gisquick"}
+	s := newTestServer(t, Settings{}, testUser, attacker)
+	writeFile(t, s, "user1/project/project.qgs", "<qgis/>")
+	request(s, "PUT", "/api/project/acl/user1/project/users/user3", "user1", strings.NewReader(`{"permission": "read"}`), nil)
+
+	// projects of user named as internal directory would contain ACLs of
+	// all projects
+	for _, url := range []string{"/api/project/files/.gisquick/acl", "/api/usage/.gisquick", "/api/project/acl/.gisquick/acl"} {
+		if w := request(s, "GET", url, ".gisquick", nil, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: %d %s", url, w.Code, w.Body)
+		}
+	}
+	body := `{"files": [{"path": "user1/project.json", "size": 2}]}`
+	if w := request(s, "POST", "/api/project/uploads/.gisquick/acl", ".gisquick", strings.NewReader(body), map[string]string{"Content-Type": "application/json"}); w.Code != http.StatusBadRequest {
+		t.Errorf("upload into internal directory: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestACLRemovedWithProject(t *testing.T) {
+	s := newTestServer(t, Settings{}, testUser, &User{Username: "user2"})
+	writeFile(t, s, "user1/project/project.qgs", "<qgis/>")
+	request(s, "PUT", "/api/project/acl/user1/project/users/user2", "user1", strings.NewReader(`{"permission": "read"}`), nil)
+	if w := request(s, "DELETE", "/api/project/delete/user1/project", "user1", nil, nil); w.Code != http.StatusOK {
+		t.Fatalf("delete project: %d %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(filepath.Join(s.config.ProjectsRoot, ".gisquick", "acl", "user1", "project.json")); !os.IsNotExist(err) {
+		t.Errorf("ACL of deleted project was kept (%v)", err)
+	}
+}
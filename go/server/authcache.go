@@ -0,0 +1,103 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+type authCacheEntry struct {
+	user    *User
+	expires time.Time
+}
+
+// authCall is an authentication request in progress, shared by concurrent
+// lookups of the same session
+type authCall struct {
+	done chan struct{}
+	user *User
+	err  error
+}
+
+// authCache caches authenticated users (or anonymous user) by session ID.
+// Concurrent lookups of the same session are deduplicated, failed lookups
+// are not cached.
+type authCache struct {
+	ttl       time.Duration
+	mutex     sync.Mutex
+	entries   map[string]authCacheEntry
+	calls     map[string]*authCall
+	lastSweep time.Time
+}
+
+func newAuthCache(ttl time.Duration) *authCache {
+	return &authCache{
+		ttl:       ttl,
+		entries:   make(map[string]authCacheEntry),
+		calls:     make(map[string]*authCall),
+		lastSweep: time.Now(),
+	}
+}
+
+// get returns cached user of the session, or fetches it when it's not cached
+func (c *authCache) get(session string, fetch func() (*User, error)) (*User, error) {
+	c.mutex.Lock()
+	if e, ok := c.entries[session]; ok && time.Now().Before(e.expires) {
+		c.mutex.Unlock()
+		return copyUser(e.user), nil
+	}
+	if call, ok := c.calls[session]; ok {
+		c.mutex.Unlock()
+		<-call.done
+		return copyUser(call.user), call.err
+	}
+	call := &authCall{done: make(chan struct{})}
+	c.calls[session] = call
+	c.mutex.Unlock()
+
+	call.user, call.err = fetch()
+
+	c.mutex.Lock()
+	// the call could be removed by invalidation during the fetch, then
+	// its result is outdated
+	if c.calls[session] == call {
+		delete(c.calls, session)
+		if call.err == nil {
+			c.put(session, call.user)
+		}
+	}
+	c.mutex.Unlock()
+	close(call.done)
+	return copyUser(call.user), call.err
+}
+
+// put stores the entry and removes expired entries (must be called with
+// locked mutex)
+func (c *authCache) put(session string, user *User) {
+	now := time.Now()
+	c.entries[session] = authCacheEntry{user, now.Add(c.ttl)}
+	if now.Sub(c.lastSweep) > c.ttl {
+		for key, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, key)
+			}
+		}
+		c.lastSweep = now
+	}
+}
+
+// invalidate removes cached user of the session
+func (c *authCache) invalidate(session string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.entries, session)
+	delete(c.calls, session)
+}
+
+// copyUser returns a copy of cached user, so it can't be modified by handlers
+func copyUser(user *User) *User {
+	if user == nil {
+		return nil
+	}
+	u := *user
+	return &u
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAuthCacheConcurrentMisses(t *testing.T) {
+	c := newAuthCache(time.Minute)
+	var calls int32
+	release := make(chan struct{})
+	fetch := func() (*User, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return &User{Username: "user1"}, nil
+	}
+
+	const lookups = 20
+	var wg sync.WaitGroup
+	users := make([]*User, lookups)
+	errs := make([]error, lookups)
+	for i := 0; i < lookups; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			users[i], errs[i] = c.get("session", fetch)
+		}(i)
+	}
+	// wait until all lookups are blocked by the first call
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("backend was called %d times", calls)
+	}
+	for i := range users {
+		if errs[i] != nil || users[i] == nil || users[i].Username != "user1" {
+			t.Fatalf("lookup %d = %+v, %v", i, users[i], errs[i])
+		}
+		if i > 0 && users[i] == users[0] {
+			t.Error("lookups share the same user instance")
+		}
+	}
+	// other sessions are fetched separately
+	c.get("other", func() (*User, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, nil
+	})
+	if calls != 2 {
+		t.Errorf("other session was not fetched")
+	}
+}
+
+func TestAuthCacheTTL(t *testing.T) {
+	c := newAuthCache(50 * time.Millisecond)
+	calls := 0
+	fetch := func() (*User, error) {
+		calls++
+		return &User{Username: "user1"}, nil
+	}
+	c.get("session", fetch)
+	user, _ := c.get("session", fetch)
+	if calls != 1 {
+		t.Errorf("cached user was fetched again (calls: %d)", calls)
+	}
+	// returned user is a copy
+	user.IsSuperuser = true
+	if user, _ = c.get("session", fetch); user.IsSuperuser {
+		t.Error("cached user was modified")
+	}
+
+	time.Sleep(80 * time.Millisecond)
+	c.get("session", fetch)
+	if calls != 2 {
+		t.Errorf("expired entry was used (calls: %d)", calls)
+	}
+	// expired entries are removed by later updates
+	c.get("other", fetch)
+	time.Sleep(80 * time.Millisecond)
+	c.get("new", fetch)
+	if _, ok := c.entries["other"]; ok {
+		t.Error("expired entry was not removed")
+	}
+}
+
+func TestAuthCacheAnonymous(t *testing.T) {
+	c := newAuthCache(time.Minute)
+	calls := 0
+	fetch := func() (*User, error) {
+		calls++
+		return nil, nil
+	}
+	for i := 0; i < 3; i++ {
+		if user, err := c.get("session", fetch); user != nil || err != nil {
+			t.Fatalf("get() = %+v, %v", user, err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("anonymous user was not cached (calls: %d)", calls)
+	}
+}
+
+func TestAuthCacheErrors(t *testing.T) {
+	c := newAuthCache(time.Minute)
+	backendErr := errors.New("backend unavailable")
+	calls := 0
+	user, err := c.get("session", func() (*User, error) {
+		calls++
+		return &User{Username: "partial"}, backendErr
+	})
+	if err != backendErr {
+		t.Fatalf("get() error = %v", err)
+	}
+	user, err = c.get("session", func() (*User, error) {
+		calls++
+		return &User{Username: "user1"}, nil
+	})
+	if err != nil || user.Username != "user1" || calls != 2 {
+		t.Errorf("failed lookup was cached: %+v, %v (calls: %d)", user, err, calls)
+	}
+}
+
+func TestAuthCacheInvalidate(t *testing.T) {
+	c := newAuthCache(time.Minute)
+	c.get("session", func() (*User, error) { return &User{Username: "user1"}, nil })
+	c.invalidate("session")
+	user, _ := c.get("session", func() (*User, error) { return nil, nil })
+	if user != nil {
+		t.Errorf("invalidated user was returned: %+v", user)
+	}
+
+	// result of lookup in progress during invalidation is not cached
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		c.get("logout", func() (*User, error) {
+			close(started)
+			<-release
+			return &User{Username: "user1"}, nil
+		})
+		close(done)
+	}()
+	<-started
+	c.invalidate("logout")
+	close(release)
+	<-done
+	user, _ = c.get("logout", func() (*User, error) { return nil, nil })
+	if user != nil {
+		t.Errorf("outdated lookup was cached: %+v", user)
+	}
+}
+
+func TestAuthCacheAppServerErrors(t *testing.T) {
+	var status, calls int32
+	appServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		code := int(atomic.LoadInt32(&status))
+		w.WriteHeader(code)
+		if code == http.StatusOK {
+			w.Write([]byte(`{"user": {"username": "user1"}}`))
+		}
+	}))
+	defer appServer.Close()
+	s := newTestServerConfig(t, Config{
+		Authenticator: NewAppServerAuthenticator(appServer.URL, "", nil),
+		AuthCacheTTL:  time.Minute,
+	})
+	session := map[string]string{"Cookie": "sessionid=session"}
+
+	// server errors of the app server are not cached as anonymous user
+	atomic.StoreInt32(&status, http.StatusBadGateway)
+	if w := request(s, "GET", "/api/tokens", "", nil, session); w.Code != http.StatusInternalServerError {
+		t.Errorf("request during app server failure: %d %s", w.Code, w.Body)
+	}
+	atomic.StoreInt32(&status, http.StatusOK)
+	if w := request(s, "GET", "/api/tokens", "", nil, session); w.Code != http.StatusOK {
+		t.Errorf("request after app server failure: %d %s", w.Code, w.Body)
+	}
+	if calls != 2 {
+		t.Errorf("app server was called %d times", calls)
+	}
+
+	// rejected sessions are cached
+	other := map[string]string{"Cookie": "sessionid=other"}
+	atomic.StoreInt32(&status, http.StatusUnauthorized)
+	for i := 0; i < 2; i++ {
+		if w := request(s, "GET", "/api/tokens", "", nil, other); w.Code != http.StatusUnauthorized {
+			t.Errorf("request of rejected session: %d %s", w.Code, w.Body)
+		}
+	}
+	if calls != 3 {
+		t.Errorf("rejected session was not cached (calls: %d)", calls)
+	}
+}
+
+// blockingAuthenticator authenticates user1 when released, or fails when
+// context of the request is done
+type blockingAuthenticator struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (a *blockingAuthenticator) Authenticate(r *http.Request) (*User, error) {
+	a.started <- struct{}{}
+	select {
+	case <-r.Context().Done():
+		return nil, r.Context().Err()
+	case <-a.release:
+		return &User{Username: "user1"}, nil
+	}
+}
+
+func (a *blockingAuthenticator) CacheKey(r *http.Request) string {
+	return "session"
+}
+
+func TestAuthCacheCanceledRequest(t *testing.T) {
+	a := &blockingAuthenticator{make(chan struct{}, 10), make(chan struct{})}
+	s := newTestServerConfig(t, Config{Authenticator: a, AuthCacheTTL: time.Minute, AuthTimeout: time.Minute})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error)
+	go func() {
+		_, err := s.authenticate(httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+		first <- err
+	}()
+	<-a.started
+	type result struct {
+		user *User
+		err  error
+	}
+	second := make(chan result)
+	go func() {
+		user, err := s.authenticate(httptest.NewRequest("GET", "/", nil))
+		second <- result{user, err}
+	}()
+	// wait until the second request waits for the first lookup
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	close(a.release)
+	if err := <-first; err != nil {
+		t.Errorf("first request: %v", err)
+	}
+	if res := <-second; res.err != nil || res.user == nil || res.user.Username != "user1" {
+		t.Errorf("request waiting for canceled request: %+v, %v", res.user, res.err)
+	}
+	if len(a.started) != 0 {
+		t.Errorf("lookup was not shared")
+	}
+
+	// shared lookup is limited by auth timeout
+	a = &blockingAuthenticator{make(chan struct{}, 10), make(chan struct{})}
+	s = newTestServerConfig(t, Config{Authenticator: a, AuthCacheTTL: time.Minute, AuthTimeout: 20 * time.Millisecond})
+	if _, err := s.authenticate(httptest.NewRequest("GET", "/", nil)); err != context.DeadlineExceeded {
+		t.Errorf("authentication over timeout: %v", err)
+	}
+}
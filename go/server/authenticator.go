@@ -0,0 +1,147 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Authenticator authenticates users of requests
+type Authenticator interface {
+	// Authenticate returns user of the request (nil user means anonymous user)
+	Authenticate(r *http.Request) (*User, error)
+	// CacheKey returns key under which the result of authentication can be
+	// cached (empty key disables caching)
+	CacheKey(r *http.Request) string
+}
+
+// UserLookup is implemented by authenticators which can look up users by
+// username, it's required by personal API tokens to get current state of
+// the token's owner
+type UserLookup interface {
+	// LookupUser returns user with the username (nil user when user doesn't
+	// exist or is not active)
+	LookupUser(r *http.Request, username string) (*User, error)
+}
+
+// AppServerAuthenticator authenticates users by session of the app server
+type AppServerAuthenticator struct {
+	URL           string
+	SessionCookie string
+	Client        *http.Client
+	// Token used to authenticate lookups of users by username
+	APIToken string
+}
+
+// NewAppServerAuthenticator export
+func NewAppServerAuthenticator(url, sessionCookie string, client *http.Client) *AppServerAuthenticator {
+	if sessionCookie == "" {
+		sessionCookie = "sessionid"
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &AppServerAuthenticator{URL: url, SessionCookie: sessionCookie, Client: client}
+}
+
+// Authenticate requests user of the request's session from the app server
+func (a *AppServerAuthenticator) Authenticate(r *http.Request) (*User, error) {
+	type Data struct {
+		User User `json:"user"`
+	}
+	authURL := fmt.Sprintf("%s/api/auth/user/", a.URL)
+	authReq, err := http.NewRequest(http.MethodGet, authURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	authReq.Header.Set("Host", r.Host)
+	authReq.Header.Set("X-Forwarded-For", r.RemoteAddr)
+	propagate(r, authReq)
+	for _, cookie := range r.Cookies() {
+		authReq.AddCookie(cookie)
+	}
+	resp, err := a.Client.Do(authReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// other errors of the app server are failures of authentication, not
+	// anonymous users (they mustn't be cached)
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("authentication: %s", resp.Status)
+	}
+	var data Data
+	if err = json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	return &data.User, nil
+}
+
+// LookupUser requests user with the username from the app server (see
+// Config.AppServerToken)
+func (a *AppServerAuthenticator) LookupUser(r *http.Request, username string) (*User, error) {
+	type Data struct {
+		User User `json:"user"`
+	}
+	userURL := fmt.Sprintf("%s/api/auth/users/%s/", a.URL, url.PathEscape(username))
+	req, err := http.NewRequest(http.MethodGet, userURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if a.APIToken != "" {
+		req.Header.Set("Authorization", "Token "+a.APIToken)
+	}
+	propagate(r, req)
+	resp, err := a.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("user lookup: %s", resp.Status)
+	}
+	var data Data
+	if err = json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	return &data.User, nil
+}
+
+// CacheKey returns value of the session cookie (empty when not present)
+func (a *AppServerAuthenticator) CacheKey(r *http.Request) string {
+	if cookie, err := r.Cookie(a.SessionCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// newAuthenticator creates authenticator of the configured type
+func (s *Server) newAuthenticator(config Config) (Authenticator, error) {
+	if config.Authenticator != nil {
+		return config.Authenticator, nil
+	}
+	client := &http.Client{Timeout: config.AuthTimeout}
+	switch config.Auth {
+	case "", "app":
+		a := NewAppServerAuthenticator(config.AppServer, config.SessionCookie, client)
+		a.APIToken = config.AppServerToken
+		return a, nil
+	case "jwt":
+		a, err := NewJWTAuthenticator(config.JWT, client)
+		if err != nil {
+			return nil, err
+		}
+		a.Errorf = s.errorf
+		return a, nil
+	}
+	return nil, fmt.Errorf("Unknown authentication: %s", config.Auth)
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gislab-npo/gisquick-settings/fs"
+	"github.com/go-chi/chi"
+)
+
+// access is a level of access required by a route (or granted to a user),
+// higher levels include all lower levels
+type access int
+
+const (
+	// no authentication is required
+	accessPublic access = iota
+	// any authenticated user
+	accessLogin
+	// read project files and settings
+	accessRead
+	// upload project files
+	accessWrite
+	// manage project settings, delete project
+	accessAdmin
+)
+
+func (a access) String() string {
+	return [...]string{"public", "login", "read", "write", "admin"}[a]
+}
+
+// projectResolver returns owner and directory of the project accessed by
+// the request
+type projectResolver func(r *http.Request) (username, directory string, err error)
+
+// urlProject resolves project from {user} and {directory} URL parameters
+func urlProject(r *http.Request) (string, string, error) {
+	return chi.URLParam(r, "user"), chi.URLParam(r, "directory"), nil
+}
+
+// mapProject resolves project from MAP query parameter of map requests
+func mapProject(r *http.Request) (string, string, error) {
+	mapParam, err := fs.CleanPath(r.URL.Query().Get("MAP"))
+	if err != nil {
+		return "", "", err
+	}
+	parts := strings.SplitN(mapParam, "/", 3)
+	if len(parts) < 3 {
+		return "", "", &fs.UnsafePathError{Path: mapParam, Reason: "not a project file"}
+	}
+	if err = checkOwnerName(parts[0]); err != nil {
+		return "", "", err
+	}
+	return parts[0], parts[1], nil
+}
+
+// userAccount resolves account of the user given by {user} URL parameter
+// (with empty project directory)
+func userAccount(r *http.Request) (string, string, error) {
+	return chi.URLParam(r, "user"), "", nil
+}
+
+type routePolicy struct {
+	access  access
+	project projectResolver
+	// scope required from personal API tokens (at least access)
+	scope access
+}
+
+// route registers handler of the route with required access level (method
+// "*" matches all methods). Project levels of access are checked on the
+// project given by {user} and {directory} URL parameters.
+func (s *Server) route(r chi.Router, method, pattern string, a access, h http.HandlerFunc) {
+	s.routeProject(r, method, pattern, a, urlProject, h)
+}
+
+// routeProject is route with custom resolver of the accessed project
+func (s *Server) routeProject(r chi.Router, method, pattern string, a access, project projectResolver, h http.HandlerFunc) {
+	s.register(r, method, pattern, routePolicy{a, project, a}, h)
+}
+
+// routeScope is route accessible by any authenticated user, which requires
+// given scope from personal API tokens (e.g. for writes into user's own
+// projects, which are not given by URL)
+func (s *Server) routeScope(r chi.Router, method, pattern string, scope access, h http.HandlerFunc) {
+	s.register(r, method, pattern, routePolicy{accessLogin, urlProject, scope}, h)
+}
+
+func (s *Server) register(r chi.Router, method, pattern string, policy routePolicy, h http.HandlerFunc) {
+	s.policies[method+" "+pattern] = policy
+	if method == "*" {
+		r.HandleFunc(pattern, h)
+	} else {
+		r.MethodFunc(method, pattern, h)
+	}
+}
+
+// projectAccess returns level of access of the user to the project (owner
+// has full access, other users can be granted access by project's ACL).
+// Access to user's account (empty directory) can't be granted.
+func (s *Server) projectAccess(r *http.Request, user *User, username, directory string) access {
+	if user.IsSuperuser || user.Username == username {
+		return accessAdmin
+	}
+	if directory == "" {
+		return accessLogin
+	}
+	acl, err := s.loadACL(username, directory)
+	if err != nil {
+		s.errorf(r, "Failed to load project ACL: %s/%s (%s)\n", username, directory, err)
+		return accessLogin
+	}
+	return acl.access(user)
+}
+
+// authorize checks access to the matched route according to its policy.
+// Routes without policy are forbidden.
+func (s *Server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pattern := chi.RouteContext(r.Context()).RoutePattern()
+		policy, ok := s.policies[r.Method+" "+pattern]
+		if !ok {
+			policy, ok = s.policies["* "+pattern]
+		}
+		if !ok {
+			s.errorf(r, "Missing access policy of route: %s %s\n", r.Method, pattern)
+			s.errorResponse(w, r, http.StatusForbidden, errCodeForbidden, "Forbidden", nil)
+			return
+		}
+		if policy.access == accessPublic {
+			next.ServeHTTP(w, r)
+			return
+		}
+		s.loginRequired(func(w http.ResponseWriter, r *http.Request) {
+			user := r.Context().Value(contextKeyUser).(*User)
+			if user.token != nil && policy.scope > user.token.access() {
+				s.errorResponse(w, r, http.StatusForbidden, errCodeInsufficientScope, "Insufficient token scope", map[string]string{"required": policy.scope.String()})
+				return
+			}
+			if policy.access > accessLogin {
+				username, directory, err := policy.project(r)
+				if err != nil {
+					if !s.pathErrorResponse(w, r, err) {
+						s.badRequest(w, r, "Invalid request", nil)
+					}
+					return
+				}
+				if s.projectAccess(r, user, username, directory) < policy.access {
+					s.debugf(r, "Access denied: %s (required access: %s)\n", r.URL.Path, policy.access)
+					s.errorResponse(w, r, http.StatusForbidden, errCodeForbidden, "Forbidden", nil)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})(w, r)
+	})
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+)
+
+func TestRoutesPolicies(t *testing.T) {
+	s := newTestServer(t, Settings{}, testUser)
+	routes := 0
+	err := chi.Walk(s.router, func(method, route string, h http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		routes++
+		_, ok := s.policies[method+" "+route]
+		if !ok {
+			_, ok = s.policies["* "+route]
+		}
+		if !ok {
+			t.Errorf("route without access policy: %s %s", method, route)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if routes == 0 {
+		t.Error("no routes were registered")
+	}
+}
+
+// policyURL returns URL of the route pattern accessing user1/project
+func policyURL(pattern string) string {
+	replacer := strings.NewReplacer(
+		"{user}", "user1",
+		"{directory}", "project",
+		"{kind}", "users",
+		"{id}", "1",
+		"{name}", "name",
+		"{module}", "module",
+		"*", "file",
+	)
+	url := replacer.Replace(pattern)
+	if strings.HasPrefix(pattern, "/api/project/map") {
+		url += "?MAP=user1/project/project.qgs"
+	}
+	return url
+}
+
+func TestAuthorize(t *testing.T) {
+	s := newTestServer(t, Settings{}, testUser, &User{Username: "user2"}, &User{Username: "user3"})
+	writeFile(t, s, "user1/project/project.qgs", "<qgis/>")
+	if w := request(s, "PUT", "/api/project/acl/user1/project/users/user2", "user1", strings.NewReader(`{"permission": "read"}`), nil); w.Code != http.StatusOK {
+		t.Fatalf("set ACL entry: %d %s", w.Code, w.Body)
+	}
+
+	// routes with access policies of the server and stub handlers
+	router := chi.NewRouter()
+	r := router.With(s.authorize)
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+	for key := range s.policies {
+		parts := strings.SplitN(key, " ", 2)
+		if parts[0] == "*" {
+			r.HandleFunc(parts[1], ok)
+		} else {
+			r.MethodFunc(parts[0], parts[1], ok)
+		}
+	}
+	r.Get("/unregistered", ok)
+
+	callers := []struct {
+		name     string
+		username string
+		access   access
+	}{
+		{"anonymous", "", accessPublic},
+		{"user", "user3", accessLogin},
+		{"read collaborator", "user2", accessRead},
+		{"owner", "user1", accessAdmin},
+	}
+	for key, policy := range s.policies {
+		parts := strings.SplitN(key, " ", 2)
+		method := parts[0]
+		if method == "*" {
+			method = "GET"
+		}
+		url := policyURL(parts[1])
+		for _, c := range callers {
+			req, _ := http.NewRequest(method, url, nil)
+			if c.username != "" {
+				req.Header.Set("X-Test-User", c.username)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			status := http.StatusNoContent
+			if policy.access > c.access {
+				status = http.StatusForbidden
+				if c.access == accessPublic {
+					status = http.StatusUnauthorized
+				}
+			}
+			if w.Code != status {
+				t.Errorf("%s %s by %s: %d, want %d", method, url, c.name, w.Code, status)
+			}
+		}
+	}
+
+	// routes without policy are forbidden
+	req, _ := http.NewRequest("GET", "/unregistered", nil)
+	req.Header.Set("X-Test-User", "user1")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("route without policy: %d", w.Code)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/gislab-npo/gisquick-settings/server"
+	"gopkg.in/yaml.v3"
+)
+
+// options are all settings of the server application
+type options struct {
+	config server.Config
+	port   int
+	dev    bool
+	// listening on unix socket (instead of port) with file mode of the socket
+	unixSocket     string
+	unixSocketMode os.FileMode
+	// TLS certificate and private key files (PEM)
+	tlsCert string
+	tlsKey  string
+	// timeouts of HTTP server and graceful shutdown
+	readHeaderTimeout time.Duration
+	idleTimeout       time.Duration
+	shutdownTimeout   time.Duration
+}
+
+// setting is a configuration value, which can be set in config file (by key,
+// nested keys are separated by dots), by environment variable or by flag
+type setting struct {
+	key string
+	env string
+	def string
+	set func(o *options, value string) error
+}
+
+func stringSetting(key, env, def string, field func(o *options) *string) setting {
+	return setting{key, env, def, func(o *options, value string) error {
+		*field(o) = value
+		return nil
+	}}
+}
+
+func sizeSetting(key, env, def string, field func(o *options) *int64) setting {
+	return setting{key, env, def, func(o *options, value string) (err error) {
+		*field(o), err = parseFileSize(value)
+		return
+	}}
+}
+
+func intSetting(key, env, def string, field func(o *options) *int) setting {
+	return setting{key, env, def, func(o *options, value string) (err error) {
+		*field(o), err = parseInt(value)
+		return
+	}}
+}
+
+func durationSetting(key, env, def string, field func(o *options) *time.Duration) setting {
+	return setting{key, env, def, func(o *options, value string) (err error) {
+		*field(o), err = parseDuration(value)
+		return
+	}}
+}
+
+func listSetting(key, env, def string, field func(o *options) *[]string) setting {
+	return setting{key, env, def, func(o *options, value string) error {
+		*field(o) = parseList(value)
+		return nil
+	}}
+}
+
+var settings = []setting{
+	stringSetting("projects_root", "PROJECTS_ROOT", "", func(o *options) *string { return &o.config.ProjectsRoot }),
+	stringSetting("map_cache_root", "MAP_CACHE_ROOT", "", func(o *options) *string { return &o.config.MapCacheRoot }),
+	stringSetting("server_url", "SERVER_URL", "", func(o *options) *string { return &o.config.AppServer }),
+	stringSetting("server_api_token", "SERVER_API_TOKEN", "", func(o *options) *string { return &o.config.AppServerToken }),
+	stringSetting("mapserver_url", "MAPSERVER_URL", "", func(o *options) *string { return &o.config.MapServer }),
+	sizeSetting("max_file_upload", "MAX_FILE_UPLOAD", "100M", func(o *options) *int64 { return &o.config.MaxFileUpload }),
+	sizeSetting("max_project_size", "MAX_PROJECT_SIZE", "200M", func(o *options) *int64 { return &o.config.MaxProjectSize }),
+	intSetting("snapshots_limit", "SNAPSHOTS_LIMIT", "10", func(o *options) *int { return &o.config.SnapshotsLimit }),
+	durationSetting("snapshots_max_age", "SNAPSHOTS_MAX_AGE", "", func(o *options) *time.Duration { return &o.config.SnapshotsMaxAge }),
+	sizeSetting("snapshots_quota", "SNAPSHOTS_QUOTA", "0", func(o *options) *int64 { return &o.config.SnapshotsQuota }),
+	stringSetting("storage", "STORAGE", "local", func(o *options) *string { return &o.config.Storage }),
+	intSetting("hash_workers", "HASH_WORKERS", "0", func(o *options) *int { return &o.config.HashWorkers }),
+	{"ignore_file", "IGNORE_FILE", "", func(o *options, value string) (err error) {
+		o.config.IgnorePatterns, err = loadIgnorePatterns(value)
+		return
+	}},
+	sizeSetting("user_quota", "USER_QUOTA", "0", func(o *options) *int64 { return &o.config.UserQuota }),
+	{"user_quota_overrides", "USER_QUOTA_OVERRIDES", "", func(o *options, value string) (err error) {
+		o.config.QuotaOverrides, err = parseQuotas(value)
+		return
+	}},
+	listSetting("allowed_origins", "ALLOWED_ORIGINS", "", func(o *options) *[]string { return &o.config.AllowedOrigins }),
+	stringSetting("log_level", "LOG_LEVEL", "info", func(o *options) *string { return &o.config.LogLevel }),
+	stringSetting("session_cookie", "SESSION_COOKIE", "sessionid", func(o *options) *string { return &o.config.SessionCookie }),
+	durationSetting("auth_timeout", "AUTH_TIMEOUT", "10s", func(o *options) *time.Duration { return &o.config.AuthTimeout }),
+	durationSetting("auth_cache_ttl", "AUTH_CACHE_TTL", "30s", func(o *options) *time.Duration { return &o.config.AuthCacheTTL }),
+	stringSetting("auth", "AUTH", "app", func(o *options) *string { return &o.config.Auth }),
+	stringSetting("jwt.issuer", "JWT_ISSUER", "", func(o *options) *string { return &o.config.JWT.Issuer }),
+	stringSetting("jwt.audience", "JWT_AUDIENCE", "", func(o *options) *string { return &o.config.JWT.Audience }),
+	stringSetting("jwt.jwks_file", "JWT_JWKS_FILE", "", func(o *options) *string { return &o.config.JWT.JWKSFile }),
+	stringSetting("jwt.jwks_url", "JWT_JWKS_URL", "", func(o *options) *string { return &o.config.JWT.JWKSURL }),
+	durationSetting("jwt.leeway", "JWT_LEEWAY", "1m", func(o *options) *time.Duration { return &o.config.JWT.Leeway }),
+	stringSetting("jwt.username_claim", "JWT_USERNAME_CLAIM", "preferred_username", func(o *options) *string { return &o.config.JWT.UsernameClaim }),
+	stringSetting("jwt.groups_claim", "JWT_GROUPS_CLAIM", "groups", func(o *options) *string { return &o.config.JWT.GroupsClaim }),
+	stringSetting("jwt.superuser_claim", "JWT_SUPERUSER_CLAIM", "is_superuser", func(o *options) *string { return &o.config.JWT.SuperuserClaim }),
+	stringSetting("jwt.superuser_group", "JWT_SUPERUSER_GROUP", "", func(o *options) *string { return &o.config.JWT.SuperuserGroup }),
+	sizeSetting("min_free_space", "MIN_FREE_SPACE", "100M", func(o *options) *int64 { return &o.config.MinFreeSpace }),
+	{"validate_requests", "VALIDATE_REQUESTS", "false", func(o *options, value string) (err error) {
+		o.config.ValidateRequests, err = parseBool(value)
+		return
+	}},
+	stringSetting("metrics_token", "METRICS_TOKEN", "", func(o *options) *string { return &o.config.MetricsToken }),
+	stringSetting("tracing.exporter", "OTEL_TRACES_EXPORTER", "", func(o *options) *string { return &o.config.Tracing.Exporter }),
+	stringSetting("tracing.endpoint", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "http://localhost:4318/v1/traces", func(o *options) *string { return &o.config.Tracing.Endpoint }),
+	stringSetting("tracing.service_name", "OTEL_SERVICE_NAME", "gisquick-settings", func(o *options) *string { return &o.config.Tracing.ServiceName }),
+	{"tracing.sample_ratio", "OTEL_TRACES_SAMPLER_ARG", "1", func(o *options, value string) (err error) {
+		o.config.Tracing.SampleRatio, err = strconv.ParseFloat(strings.TrimSpace(value), 64)
+		return
+	}},
+	stringSetting("s3.endpoint", "S3_ENDPOINT", "", func(o *options) *string { return &o.config.S3.Endpoint }),
+	stringSetting("s3.region", "S3_REGION", "", func(o *options) *string { return &o.config.S3.Region }),
+	stringSetting("s3.bucket", "S3_BUCKET", "", func(o *options) *string { return &o.config.S3.Bucket }),
+	stringSetting("s3.access_key", "S3_ACCESS_KEY", "", func(o *options) *string { return &o.config.S3.AccessKey }),
+	stringSetting("s3.secret_key", "S3_SECRET_KEY", "", func(o *options) *string { return &o.config.S3.SecretKey }),
+	durationSetting("s3.timeout", "S3_TIMEOUT", "1m", func(o *options) *time.Duration { return &o.config.S3.Timeout }),
+	intSetting("port", "", "8001", func(o *options) *int { return &o.port }),
+	{"dev", "", "false", func(o *options, value string) (err error) {
+		o.dev, err = parseBool(value)
+		return
+	}},
+	stringSetting("unix_socket", "UNIX_SOCKET", "", func(o *options) *string { return &o.unixSocket }),
+	{"unix_socket_mode", "UNIX_SOCKET_MODE", "0660", func(o *options, value string) error {
+		mode, err := strconv.ParseUint(value, 8, 32)
+		if err != nil || mode > 0777 {
+			return errors.New("expected octal file mode")
+		}
+		o.unixSocketMode = os.FileMode(mode)
+		return nil
+	}},
+	stringSetting("tls_cert", "TLS_CERT", "", func(o *options) *string { return &o.tlsCert }),
+	stringSetting("tls_key", "TLS_KEY", "", func(o *options) *string { return &o.tlsKey }),
+	durationSetting("read_header_timeout", "READ_HEADER_TIMEOUT", "10s", func(o *options) *time.Duration { return &o.readHeaderTimeout }),
+	durationSetting("idle_timeout", "IDLE_TIMEOUT", "2m", func(o *options) *time.Duration { return &o.idleTimeout }),
+	durationSetting("shutdown_timeout", "SHUTDOWN_TIMEOUT", "1m", func(o *options) *time.Duration { return &o.shutdownTimeout }),
+}
+
+// flattenConfig converts values of config file to strings by keys of settings
+func flattenConfig(prefix string, value interface{}, known map[string]bool, values map[string]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if known[prefix] {
+			// map setting (e.g. user quotas) in format "key=value,..."
+			items := make([]string, 0, len(v))
+			for key, item := range v {
+				items = append(items, fmt.Sprintf("%s=%v", key, item))
+			}
+			sort.Strings(items)
+			values[prefix] = strings.Join(items, ",")
+			return
+		}
+		for key, item := range v {
+			if prefix != "" {
+				key = prefix + "." + key
+			}
+			flattenConfig(key, item, known, values)
+		}
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = fmt.Sprint(item)
+		}
+		values[prefix] = strings.Join(items, ",")
+	case nil:
+		values[prefix] = ""
+	default:
+		values[prefix] = fmt.Sprint(v)
+	}
+}
+
+// readConfigFile reads YAML or TOML config file (by file extension)
+func readConfigFile(filename string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	content := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &content)
+	case ".toml":
+		err = toml.Unmarshal(data, &content)
+	default:
+		return nil, fmt.Errorf("unknown format of config file: %s (expected .yaml, .yml or .toml)", filename)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	known := make(map[string]bool, len(settings))
+	for _, s := range settings {
+		known[s.key] = true
+	}
+	values := make(map[string]string)
+	flattenConfig("", content, known, values)
+	var unknown []string
+	for key := range values {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("%s: unknown settings: %s", filename, strings.Join(unknown, ", "))
+	}
+	return values, nil
+}
+
+// loadOptions merges default values, config file, environment variables and
+// flags (in order of priority) and validates resulting configuration
+func loadOptions(configFile string, flags map[string]string) (*options, error) {
+	var fileValues map[string]string
+	if configFile != "" {
+		var err error
+		if fileValues, err = readConfigFile(configFile); err != nil {
+			return nil, err
+		}
+	}
+	o := &options{}
+	var errs server.ConfigError
+	for _, s := range settings {
+		value, source := s.def, "default value"
+		if v, ok := fileValues[s.key]; ok {
+			value, source = v, "config file"
+		}
+		if v, ok := os.LookupEnv(s.env); ok && s.env != "" {
+			value, source = v, "env "+s.env
+		}
+		if v, ok := flags[s.key]; ok {
+			value, source = v, "flag"
+		}
+		if err := s.set(o, value); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid %s %q (%s): %s", s.key, value, source, err))
+		}
+	}
+	if (o.tlsCert == "") != (o.tlsKey == "") {
+		errs = append(errs, "both tls_cert and tls_key must be set")
+	}
+	if len(errs) == 0 {
+		if err := o.config.Validate(); err != nil {
+			return nil, err
+		}
+		return o, nil
+	}
+	return nil, errs
+}
+
+// restartRequired reports whether options differ in settings which can't be
+// changed without restart
+func restartRequired(o1, o2 *options) bool {
+	c1, c2 := *o1, *o2
+	c1.config.Settings = server.Settings{}
+	c2.config.Settings = server.Settings{}
+	return !reflect.DeepEqual(c1, c2)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gislab-npo/gisquick-settings/server"
+)
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestReadConfigFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		values  map[string]string
+		err     string
+	}{
+		{
+			name:    "yaml",
+			file:    "config.yaml",
+			content: "max_file_upload: 10M\njwt:\n  issuer: https://sso.example.com\nallowed_origins: [https://a.example.com, https://b.example.com]\nuser_quota_overrides:\n  user2: 2G\n  user1: 1G\n",
+			values: map[string]string{
+				"max_file_upload":      "10M",
+				"jwt.issuer":           "https://sso.example.com",
+				"allowed_origins":      "https://a.example.com,https://b.example.com",
+				"user_quota_overrides": "user1=1G,user2=2G",
+			},
+		},
+		{
+			name:    "toml",
+			file:    "config.toml",
+			content: "snapshots_limit = 5\n[s3]\nbucket = \"projects\"\n",
+			values:  map[string]string{"snapshots_limit": "5", "s3.bucket": "projects"},
+		},
+		{"unknown key", "config.yaml", "max_file_upload: 10M\nmax_upload: 10M\n", nil, "unknown settings: max_upload"},
+		{"unknown nested key", "config.yaml", "jwt:\n  issuer: x\n  secret: y\n", nil, "unknown settings: jwt.secret"},
+		{"unknown format", "config.json", "{}", nil, "unknown format"},
+		{"invalid syntax", "config.yaml", "max_file_upload: [10M\n", nil, "config.yaml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, err := readConfigFile(writeConfigFile(t, tt.file, tt.content))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("readConfigFile() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(values) != len(tt.values) {
+				t.Errorf("readConfigFile() = %v, want %v", values, tt.values)
+			}
+			for key, value := range tt.values {
+				if values[key] != value {
+					t.Errorf("readConfigFile()[%s] = %q, want %q", key, values[key], value)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadOptionsPrecedence(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("PROJECTS_ROOT", root)
+	t.Setenv("SERVER_URL", "http://app:8000")
+	configFile := writeConfigFile(t, "config.yaml", "max_file_upload: 10M\nmax_project_size: 20M\nsnapshots_limit: 3\n")
+
+	tests := []struct {
+		name  string
+		env   map[string]string
+		flags map[string]string
+		// expected values of max_file_upload, max_project_size and snapshots_limit
+		maxFileUpload  int64
+		maxProjectSize int64
+		snapshotsLimit int
+	}{
+		{"config file", nil, nil, 10 << 20, 20 << 20, 3},
+		{"env over config file", map[string]string{"MAX_FILE_UPLOAD": "5M"}, nil, 5 << 20, 20 << 20, 3},
+		{
+			"flag over env",
+			map[string]string{"MAX_FILE_UPLOAD": "5M", "SNAPSHOTS_LIMIT": "4"},
+			map[string]string{"max_file_upload": "1M"},
+			1 << 20, 20 << 20, 4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			o, err := loadOptions(configFile, tt.flags)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := o.config
+			if c.MaxFileUpload != tt.maxFileUpload || c.MaxProjectSize != tt.maxProjectSize || c.SnapshotsLimit != tt.snapshotsLimit {
+				t.Errorf("loadOptions() = %d, %d, %d", c.MaxFileUpload, c.MaxProjectSize, c.SnapshotsLimit)
+			}
+			if c.ProjectsRoot != root || c.LogLevel != "info" || o.port != 8001 {
+				t.Errorf("loadOptions() values from env and defaults: %+v", o)
+			}
+		})
+	}
+}
+
+func TestLoadOptionsErrors(t *testing.T) {
+	t.Setenv("PROJECTS_ROOT", t.TempDir())
+	t.Setenv("SERVER_URL", "http://app:8000")
+	tests := []struct {
+		name  string
+		flags map[string]string
+		err   string
+	}{
+		{"invalid size", map[string]string{"max_file_upload": "10B"}, `invalid max_file_upload "10B" (flag)`},
+		{"invalid duration", map[string]string{"auth_timeout": "10"}, "invalid auth_timeout"},
+		{"invalid socket mode", map[string]string{"unix_socket_mode": "999"}, "invalid unix_socket_mode"},
+		{"tls key without cert", map[string]string{"tls_key": "key.pem"}, "both tls_cert and tls_key must be set"},
+		{"invalid config", map[string]string{"log_level": "verbose"}, "invalid log level"},
+		{"missing projects root", map[string]string{"projects_root": ""}, "projects root is not set"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadOptions("", tt.flags)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("loadOptions() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	current := &options{port: 8001, config: server.Config{ProjectsRoot: "/data"}}
+	current.config.MaxFileUpload = 10
+	tests := []struct {
+		name    string
+		change  func(o *options)
+		restart bool
+	}{
+		{"no change", func(o *options) {}, false},
+		{"settings", func(o *options) { o.config.MaxFileUpload = 20 }, false},
+		{"port", func(o *options) { o.port = 8002 }, true},
+		{"projects root", func(o *options) { o.config.ProjectsRoot = "/other" }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := *current
+			tt.change(&o)
+			if restartRequired(current, &o) != tt.restart {
+				t.Errorf("restartRequired() = %v", !tt.restart)
+			}
+		})
+	}
+}
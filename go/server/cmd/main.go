@@ -1,56 +1,152 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
-	"net/http"
+	"math"
 	"os"
+	"os/signal"
+	"regexp"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/gislab-npo/gisquick-settings/fs"
 	"github.com/gislab-npo/gisquick-settings/server"
 )
 
-func optEnv(key, defaultValue string) string {
-	val, ok := os.LookupEnv(key)
-	if ok {
-		return val
+var fileSizeRegex = regexp.MustCompile(`^(\d+)\s*(([KMGT])B?)?$`)
+
+var fileSizeUnits = map[string]int64{"": 1, "K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+
+// parseFileSize parses size in bytes with optional unit (e.g. 100M, 2GB)
+func parseFileSize(value string) (int64, error) {
+	match := fileSizeRegex.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(value)))
+	if match == nil {
+		return 0, errors.New("expected number of bytes with optional unit K, M, G or T")
+	}
+	num, err := strconv.ParseInt(match[1], 10, 64)
+	unit := fileSizeUnits[match[3]]
+	if err != nil || num > math.MaxInt64/unit {
+		return 0, errors.New("size is too large")
+	}
+	return num * unit, nil
+}
+
+// parseQuotas parses list of users quotas in format "user=size,user=size"
+func parseQuotas(value string) (map[string]int64, error) {
+	quotas := make(map[string]int64)
+	for _, item := range parseList(value) {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid user quota: %s", item)
+		}
+		quota, err := parseFileSize(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid quota of user %s: %s", parts[0], err)
+		}
+		quotas[parts[0]] = quota
+	}
+	return quotas, nil
+}
+
+func parseDuration(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(value)
+}
+
+func parseInt(value string) (int, error) {
+	return strconv.Atoi(strings.TrimSpace(value))
+}
+
+func parseBool(value string) (bool, error) {
+	return strconv.ParseBool(strings.TrimSpace(value))
+}
+
+// parseList parses comma separated list of values
+func parseList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
 	}
-	return defaultValue
+	return list
 }
 
-func parseFileSize(value string) int64 {
-	unit := 1
-	if strings.HasSuffix(value, "M") {
-		unit = 1024 * 1024
-	} else if strings.HasSuffix(value, "G") {
-		unit = 1024 * 1024 * 1024
+// loadIgnorePatterns returns default ignore patterns extended with patterns
+// from the file
+func loadIgnorePatterns(filename string) ([]string, error) {
+	if filename == "" {
+		return nil, nil
 	}
-	num, err := strconv.Atoi(strings.TrimRight(value, "MGB"))
+	file, err := os.Open(filename)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	defer file.Close()
+	patterns, err := fs.ReadIgnorePatterns(file)
+	if err != nil {
+		return nil, err
 	}
-	return int64(num * unit)
+	return append(append([]string{}, fs.DefaultIgnorePatterns...), patterns...), nil
 }
 
-func main() {
-	config := server.Config{
-		ProjectsRoot:   os.Getenv("PROJECTS_ROOT"),
-		MapCacheRoot:   os.Getenv("MAP_CACHE_ROOT"),
-		AppServer:      os.Getenv("SERVER_URL"),
-		MapServer:      os.Getenv("MAPSERVER_URL"),
-		MaxFileUpload:  parseFileSize(optEnv("MAX_FILE_UPLOAD", "100M")),
-		MaxProjectSize: parseFileSize(optEnv("MAX_PROJECT_SIZE", "200M")),
+// reloadOnSignal reloads settings of the server on SIGHUP
+func reloadOnSignal(s *server.Server, current *options, configFile string, flags map[string]string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		o, err := loadOptions(configFile, flags)
+		if err == nil {
+			err = s.Reload(o.config.Settings)
+		}
+		if err != nil {
+			log.Printf("Failed to reload configuration: %s\n", err)
+			continue
+		}
+		if restartRequired(current, o) {
+			log.Println("Configuration reloaded, some of changed settings require restart")
+		} else {
+			log.Println("Configuration reloaded")
+		}
+		current = o
 	}
+}
 
-	devPtr := flag.Bool("dev", false, "development mode")
-	portPtr := flag.Int("port", 8001, "port number")
+func main() {
+	log.SetFlags(0)
+	log.SetOutput(server.NewLogWriter(os.Stderr))
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "config file (YAML or TOML)")
+	flag.Bool("dev", false, "development mode")
+	flag.Int("port", 8001, "port number")
+	flag.String("log-level", "info", "log level (debug, info or error)")
 	flag.Parse()
 
-	s := server.NewServer(config, *devPtr)
+	// explicitly set flags override values from config file and environment
+	flags := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name != "config" {
+			flags[strings.Replace(f.Name, "-", "_", -1)] = f.Value.String()
+		}
+	})
+	o, err := loadOptions(*configFile, flags)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s, err := server.NewServer(o.config, o.dev)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go reloadOnSignal(s, o, *configFile, flags)
 	syscall.Umask(0)
-	address := fmt.Sprintf(":%d", *portPtr)
-	log.Fatal(http.ListenAndServe(address, s))
+	if err = serve(s, o); err != nil {
+		log.Fatal(err)
+	}
 }
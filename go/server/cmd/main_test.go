@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+func TestParseFileSize(t *testing.T) {
+	tests := []struct {
+		value string
+		size  int64
+		valid bool
+	}{
+		{"0", 0, true},
+		{"1024", 1024, true},
+		{" 10 ", 10, true},
+		{"10K", 10 << 10, true},
+		{"10k", 10 << 10, true},
+		{"100M", 100 << 20, true},
+		{"100 MB", 100 << 20, true},
+		{"2GB", 2 << 30, true},
+		{"1T", 1 << 40, true},
+		// plain bytes have no unit
+		{"10B", 0, false},
+		{"", 0, false},
+		{"-1", 0, false},
+		{"1.5G", 0, false},
+		{"10P", 0, false},
+		{"M", 0, false},
+		{"9999999999T", 0, false},
+		{"99999999999999999999", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			size, err := parseFileSize(tt.value)
+			if (err == nil) != tt.valid || size != tt.size {
+				t.Errorf("parseFileSize(%q) = %d, %v, want %d (valid: %v)", tt.value, size, err, tt.size, tt.valid)
+			}
+		})
+	}
+}
+
+func TestParseQuotas(t *testing.T) {
+	tests := []struct {
+		value  string
+		quotas map[string]int64
+		valid  bool
+	}{
+		{"", map[string]int64{}, true},
+		{"user1=1G, user2=500M", map[string]int64{"user1": 1 << 30, "user2": 500 << 20}, true},
+		{"user1", nil, false},
+		{"=1G", nil, false},
+		{"user1=lot", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			quotas, err := parseQuotas(tt.value)
+			if (err == nil) != tt.valid || len(quotas) != len(tt.quotas) {
+				t.Fatalf("parseQuotas(%q) = %v, %v", tt.value, quotas, err)
+			}
+			for user, quota := range tt.quotas {
+				if quotas[user] != quota {
+					t.Errorf("parseQuotas(%q) = %v, want %v", tt.value, quotas, tt.quotas)
+				}
+			}
+		})
+	}
+}
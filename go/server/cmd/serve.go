@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gislab-npo/gisquick-settings/server"
+)
+
+// websockets are closed with this timeout after all requests are finished,
+// then remaining traces are exported
+const (
+	websocketsCloseTimeout = 5 * time.Second
+	tracesFlushTimeout     = 5 * time.Second
+)
+
+// certReloader provides TLS certificate, which is reloaded when its files are
+// changed (e.g. renewed certificate)
+type certReloader struct {
+	certFile string
+	keyFile  string
+	mutex    sync.Mutex
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// modified returns the latest modification time of certificate files
+func (r *certReloader) modified() time.Time {
+	var modTime time.Time
+	for _, filename := range []string{r.certFile, r.keyFile} {
+		if info, err := os.Stat(filename); err == nil && info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	return modTime
+}
+
+func (r *certReloader) reload() error {
+	modTime := r.modified()
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+// GetCertificate returns current certificate (previous certificate is used
+// when changed files can't be loaded)
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.modified().After(r.modTime) {
+		if err := r.reload(); err != nil {
+			log.Printf("Failed to reload TLS certificate: %s\n", err)
+		} else {
+			log.Println("TLS certificate reloaded")
+		}
+	}
+	return r.cert, nil
+}
+
+// listen listens on unix socket or on TCP port
+func listen(o *options) (net.Listener, error) {
+	if o.unixSocket == "" {
+		return net.Listen("tcp", fmt.Sprintf(":%d", o.port))
+	}
+	// remove socket left by previous process
+	if info, err := os.Lstat(o.unixSocket); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(o.unixSocket)
+	}
+	ln, err := net.Listen("unix", o.unixSocket)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(o.unixSocket, o.unixSocketMode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// serve runs HTTP server until SIGINT or SIGTERM is received, then it waits
+// (with timeout) for active requests like uploads to finish and closes
+// websocket connections
+func serve(s *server.Server, o *options) error {
+	srv := &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: o.readHeaderTimeout,
+		IdleTimeout:       o.idleTimeout,
+	}
+	if o.tlsCert != "" {
+		certs, err := newCertReloader(o.tlsCert, o.tlsKey)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = &tls.Config{
+			GetCertificate: certs.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+	}
+	ln, err := listen(o)
+	if err != nil {
+		return err
+	}
+	log.Printf("Listening on %s\n", ln.Addr())
+
+	errs := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			errs <- srv.ServeTLS(ln, "", "")
+		} else {
+			errs <- srv.Serve(ln)
+		}
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err = <-errs:
+		return err
+	case sig := <-signals:
+		log.Printf("Shutting down (%s)\n", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), o.shutdownTimeout)
+	defer cancel()
+	if err = srv.Shutdown(ctx); err != nil {
+		log.Printf("Active requests were not finished in time: %s\n", err)
+		srv.Close()
+	}
+	s.CloseWebsockets(websocketsCloseTimeout)
+	s.Close()
+	s.FlushTraces(tracesFlushTimeout)
+	log.Println("Server stopped")
+	return nil
+}
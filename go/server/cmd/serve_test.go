@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes self-signed certificate with given common name
+// and its key, files are modified at given time
+func writeCertificate(t *testing.T, certFile, keyFile, name string, modTime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDer},
+	}
+	for filename, block := range files {
+		if err = ioutil.WriteFile(filename, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Chtimes(filename, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func certificateName(t *testing.T, r *certReloader) string {
+	t.Helper()
+	cert, err := r.GetCertificate(nil)
+	if err != nil || cert == nil {
+		t.Fatalf("GetCertificate() = %v, %v", cert, err)
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	now := time.Now()
+
+	if _, err := newCertReloader(certFile, keyFile); err == nil {
+		t.Error("newCertReloader() without certificate files succeeded")
+	}
+	writeCertificate(t, certFile, keyFile, "first", now.Add(-time.Hour))
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := certificateName(t, r); name != "first" {
+		t.Errorf("certificate: %s", name)
+	}
+
+	// renewed certificate
+	writeCertificate(t, certFile, keyFile, "renewed", now)
+	if name := certificateName(t, r); name != "renewed" {
+		t.Errorf("certificate was not reloaded: %s", name)
+	}
+
+	// previous certificate is used when changed files are invalid
+	if err = ioutil.WriteFile(keyFile, []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(keyFile, now.Add(time.Hour), now.Add(time.Hour))
+	if name := certificateName(t, r); name != "renewed" {
+		t.Errorf("certificate after failed reload: %s", name)
+	}
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "server.sock")
+	o := &options{unixSocket: socket, unixSocketMode: 0660}
+
+	// socket left by previous process
+	previous, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous.(*net.UnixListener).SetUnlinkOnClose(false)
+	previous.Close()
+
+	ln, err := listen(o)
+	if err != nil {
+		t.Fatalf("listen() with stale socket: %s", err)
+	}
+	defer ln.Close()
+	if info, err := os.Stat(socket); err != nil {
+		t.Error(err)
+	} else if info.Mode().Perm() != 0660 {
+		t.Errorf("socket mode: %v", info.Mode())
+	}
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatalf("connect to socket: %s", err)
+	}
+	conn.Close()
+
+	// other files are not removed
+	file := filepath.Join(t.TempDir(), "file")
+	if err = ioutil.WriteFile(file, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if ln, err := listen(&options{unixSocket: file, unixSocketMode: 0660}); err == nil {
+		ln.Close()
+		t.Error("listen() replaced regular file")
+	}
+	if data, err := ioutil.ReadFile(file); err != nil || string(data) != "data" {
+		t.Errorf("regular file was changed: %q, %v", data, err)
+	}
+}
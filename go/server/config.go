@@ -0,0 +1,199 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Settings export
+type Settings struct {
+	MaxFileUpload  int64
+	MaxProjectSize int64
+	// Number of kept snapshots of each project (0 disables snapshots)
+	SnapshotsLimit int
+	// Snapshots older than this are removed (0 means no limit)
+	SnapshotsMaxAge time.Duration
+	// Max. size of content of snapshots of all projects of each user, new
+	// snapshots are not created when it would be exceeded (0 means the same
+	// as user's quota)
+	SnapshotsQuota int64
+	// Total storage quota of each user (0 means unlimited). Only project
+	// files are counted, snapshots have separate SnapshotsQuota.
+	UserQuota int64
+	// Quotas of specific users overriding UserQuota
+	QuotaOverrides map[string]int64
+	// Origins allowed to open websocket connections, e.g.
+	// "https://gisquick.example.com" (empty means all origins)
+	AllowedOrigins []string
+	// Level of logging - "debug", "info" (default) or "error"
+	LogLevel string
+}
+
+// Levels of logging
+const (
+	logDebug = iota
+	logInfo
+	logError
+)
+
+var logLevels = map[string]int{"debug": logDebug, "info": logInfo, "": logInfo, "error": logError}
+
+// ConfigError is a list of problems of invalid configuration
+type ConfigError []string
+
+func (e ConfigError) Error() string {
+	return "Invalid configuration:\n  " + strings.Join(e, "\n  ")
+}
+
+// Validate checks settings
+func (c *Settings) Validate() error {
+	var errs ConfigError
+	if c.MaxFileUpload <= 0 {
+		errs = append(errs, "max file upload size must be positive")
+	}
+	if c.MaxProjectSize <= 0 {
+		errs = append(errs, "max project size must be positive")
+	}
+	if c.SnapshotsLimit < 0 {
+		errs = append(errs, "snapshots limit can't be negative")
+	}
+	if c.SnapshotsMaxAge < 0 {
+		errs = append(errs, "snapshots max age can't be negative")
+	}
+	if c.SnapshotsQuota < 0 {
+		errs = append(errs, "snapshots quota can't be negative")
+	}
+	if c.UserQuota < 0 {
+		errs = append(errs, "user quota can't be negative")
+	}
+	for user, quota := range c.QuotaOverrides {
+		if user == "" || quota < 0 {
+			errs = append(errs, fmt.Sprintf("invalid quota of user %q", user))
+		}
+	}
+	for _, origin := range c.AllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+			errs = append(errs, fmt.Sprintf("invalid allowed origin %q (expected scheme://host[:port])", origin))
+		}
+	}
+	if _, ok := logLevels[c.LogLevel]; !ok {
+		errs = append(errs, fmt.Sprintf("invalid log level %q (expected debug, info or error)", c.LogLevel))
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// checkURL checks that value is an absolute http(s) URL
+func checkURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("expected http(s)://host[:port][/path]")
+	}
+	return nil
+}
+
+// checkWritableDir checks that directory exists and files can be created in it
+func checkWritableDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New("not a directory")
+	}
+	file, err := ioutil.TempFile(dir, ".gisquick-check-")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// Validate checks configuration, all found problems are reported in ConfigError
+func (c *Config) Validate() error {
+	var errs ConfigError
+	if err := c.Settings.Validate(); err != nil {
+		errs = append(errs, err.(ConfigError)...)
+	}
+	if c.Storage == "" || c.Storage == "local" {
+		if c.ProjectsRoot == "" {
+			errs = append(errs, "projects root is not set")
+		} else if err := checkWritableDir(c.ProjectsRoot); err != nil {
+			errs = append(errs, fmt.Sprintf("projects root %s is not usable: %s", c.ProjectsRoot, err))
+		}
+	}
+	if c.MapCacheRoot != "" {
+		if err := checkWritableDir(c.MapCacheRoot); err != nil {
+			errs = append(errs, fmt.Sprintf("map cache root %s is not usable: %s", c.MapCacheRoot, err))
+		}
+	}
+	if c.Authenticator == nil && (c.Auth == "" || c.Auth == "app") {
+		if err := checkURL(c.AppServer); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid app server URL %q: %s", c.AppServer, err))
+		}
+	}
+	if c.MapServer != "" {
+		if err := checkURL(c.MapServer); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid map server URL %q: %s", c.MapServer, err))
+		}
+	}
+	if c.MinFreeSpace < 0 {
+		errs = append(errs, "min free space can't be negative")
+	}
+	if c.HashWorkers < 0 {
+		errs = append(errs, "number of hash workers can't be negative")
+	}
+	if c.AuthTimeout < 0 || c.AuthCacheTTL < 0 {
+		errs = append(errs, "authentication timeout and cache TTL can't be negative")
+	}
+	errs = append(errs, c.Tracing.Validate()...)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// settings returns current settings
+func (s *Server) settings() *Settings {
+	return s.currentSettings.Load().(*Settings)
+}
+
+// Reload applies changed settings to running server
+func (s *Server) Reload(settings Settings) error {
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+	s.currentSettings.Store(&settings)
+	return nil
+}
+
+// checkOrigin allows websocket connections from allowed origins (requests
+// without Origin header are not sent by browsers and are allowed)
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origins := s.settings().AllowedOrigins
+	origin := r.Header.Get("Origin")
+	if len(origins) == 0 || origin == "" {
+		return true
+	}
+	for _, allowed := range origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	s.debugf(r, "Websocket origin is not allowed: %s\n", origin)
+	return false
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigValidate(t *testing.T) {
+	root := t.TempDir()
+	valid := func() Config {
+		return Config{
+			ProjectsRoot: root,
+			AppServer:    "http://app:8000",
+			Settings:     Settings{MaxFileUpload: 1024, MaxProjectSize: 1024, LogLevel: "info"},
+		}
+	}
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		errs   []string
+	}{
+		{"valid", func(c *Config) {}, nil},
+		{"jwt without app server", func(c *Config) { c.Auth = "jwt"; c.AppServer = "" }, nil},
+		{"s3 without projects root", func(c *Config) { c.Storage = "s3"; c.ProjectsRoot = "" }, nil},
+		{"missing projects root", func(c *Config) { c.ProjectsRoot = "" }, []string{"projects root is not set"}},
+		{"missing projects directory", func(c *Config) { c.ProjectsRoot = filepath.Join(root, "missing") }, []string{"projects root"}},
+		{"invalid app server", func(c *Config) { c.AppServer = "app:8000" }, []string{"invalid app server URL"}},
+		{"invalid map server", func(c *Config) { c.MapServer = "ftp://map" }, []string{"invalid map server URL"}},
+		{"invalid origin", func(c *Config) { c.AllowedOrigins = []string{"*", "https://a.example.com/path"} }, []string{"invalid allowed origin"}},
+		{"negative quota", func(c *Config) { c.QuotaOverrides = map[string]int64{"user1": -1} }, []string{`invalid quota of user "user1"`}},
+		{"invalid tracing", func(c *Config) { c.Tracing = TracingConfig{Exporter: "zipkin", SampleRatio: 2} }, []string{"unknown traces exporter", "sample ratio"}},
+		{
+			"all problems are reported",
+			func(c *Config) { c.MaxFileUpload = 0; c.LogLevel = "verbose"; c.HashWorkers = -1 },
+			[]string{"max file upload size", "invalid log level", "hash workers"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid()
+			tt.change(&c)
+			err := c.Validate()
+			if len(tt.errs) == 0 {
+				if err != nil {
+					t.Errorf("Validate() = %v", err)
+				}
+				return
+			}
+			errs, ok := err.(ConfigError)
+			if !ok || len(errs) != len(tt.errs) {
+				t.Fatalf("Validate() = %v, want %d errors", err, len(tt.errs))
+			}
+			for i, msg := range tt.errs {
+				if !strings.Contains(errs[i], msg) {
+					t.Errorf("Validate() error %q, want %q", errs[i], msg)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+)
+
+// Codes of error responses. Codes are stable (clients can rely on them),
+// messages are meant for humans and may change.
+const (
+	errCodeBadRequest           = "bad_request"
+	errCodeInvalidRequest       = "invalid_request"
+	errCodeInvalidPath          = "invalid_path"
+	errCodeUnsupportedMediaType = "unsupported_media_type"
+	errCodeUnauthorized         = "unauthorized"
+	errCodeForbidden            = "forbidden"
+	errCodeInsufficientScope    = "insufficient_scope"
+	errCodeNotFound             = "not_found"
+	errCodeMethodNotAllowed     = "method_not_allowed"
+	errCodeProjectNotFound      = "project_not_found"
+	errCodeUnsupportedHash      = "unsupported_hash_algorithm"
+	errCodeInvalidUpload        = "invalid_upload"
+	errCodeInvalidArchive       = "invalid_archive"
+	errCodeUploadTooLarge       = "upload_too_large"
+	errCodeRequestTooLarge      = "request_too_large"
+	errCodeQuotaExceeded        = "quota_exceeded"
+	errCodeCorruptedFile        = "corrupted_file"
+	errCodeIncompleteUpload     = "incomplete_upload"
+	errCodeOffsetMismatch       = "offset_mismatch"
+	errCodeTooManyUploads       = "too_many_uploads"
+	errCodeServerError          = "server_error"
+	errCodeAuthError            = "auth_error"
+	errCodeMapServerError       = "map_server_error"
+)
+
+// apiError is a body of error responses
+type apiError struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+	// ID of the request (same as X-Request-ID header)
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// details of errors related to a single file
+type fileErrorDetails struct {
+	Path string `json:"path"`
+}
+
+// details of errors caused by exceeded size limit
+type sizeErrorDetails struct {
+	Size  int64 `json:"size"`
+	Limit int64 `json:"limit"`
+}
+
+// errorResponse writes JSON error response
+func (s *Server) errorResponse(w http.ResponseWriter, r *http.Request, status int, code, message string, details interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiError{
+		Code:      code,
+		Message:   message,
+		Details:   details,
+		RequestID: getRequestID(r),
+	})
+}
+
+// serverError writes response of internal server error (details are only
+// logged)
+func (s *Server) serverError(w http.ResponseWriter, r *http.Request) {
+	s.errorResponse(w, r, http.StatusInternalServerError, errCodeServerError, "Server error", nil)
+}
+
+// notFound writes response of missing resource
+func (s *Server) notFound(w http.ResponseWriter, r *http.Request, message string) {
+	s.errorResponse(w, r, http.StatusNotFound, errCodeNotFound, message, nil)
+}
+
+// badRequest writes response of invalid request
+func (s *Server) badRequest(w http.ResponseWriter, r *http.Request, message string, details interface{}) {
+	s.errorResponse(w, r, http.StatusBadRequest, errCodeBadRequest, message, details)
+}
+
+// checkMultipart checks content type of multipart requests and returns
+// boundary of parts, it writes error response when the type is invalid
+func (s *Server) checkMultipart(w http.ResponseWriter, r *http.Request) (string, bool) {
+	ctype, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || ctype != "multipart/form-data" {
+		s.errorResponse(w, r, http.StatusUnsupportedMediaType, errCodeUnsupportedMediaType, "Invalid content type", nil)
+		return "", false
+	}
+	boundary, ok := params["boundary"]
+	if !ok {
+		s.badRequest(w, r, http.ErrMissingBoundary.Error(), nil)
+		return "", false
+	}
+	return boundary, true
+}
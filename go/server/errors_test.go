@@ -0,0 +1,132 @@
+package server
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestErrorResponses(t *testing.T) {
+	s := newTestServer(t, Settings{MaxProjectSize: 15}, testUser)
+	writeFile(t, s, "user1/project/project.qgs", "<qgis/>")
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	uploadInfo := `{"files": [{"path": "big.txt", "size": 100, "hash": ""}]}`
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		user   string
+		body   string
+		status int
+		code   string
+		// keys of error details (nil when details are omitted)
+		details []string
+	}{
+		{"unknown route", "GET", "/api/unknown", "user1", "", http.StatusNotFound, errCodeNotFound, nil},
+		{"method not allowed", "PUT", "/api/project/files/user1/project", "user1", "", http.StatusMethodNotAllowed, errCodeMethodNotAllowed, nil},
+		{"unauthorized", "GET", "/api/project/files/user1/project", "", "", http.StatusUnauthorized, errCodeUnauthorized, nil},
+		{"forbidden", "GET", "/api/project/files/user2/project", "user1", "", http.StatusForbidden, errCodeForbidden, nil},
+		{"project not found", "GET", "/api/project/files/user1/other", "user1", "", http.StatusNotFound, errCodeProjectNotFound, nil},
+		{"invalid path", "POST", "/api/project/uploads/user1/project", "user1", `{"files": [{"path": "../user2/project/project.qgs", "size": 1}]}`, http.StatusBadRequest, errCodeInvalidPath, []string{"path", "reason"}},
+		{"upload too large", "POST", "/api/project/uploads/user1/project", "user1", uploadInfo, http.StatusBadRequest, errCodeUploadTooLarge, []string{"limit", "size"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, server.URL+tt.url, strings.NewReader(tt.body))
+			if tt.user != "" {
+				req.Header.Set("X-Test-User", tt.user)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.status || resp.Header.Get("Content-Type") != "application/json" {
+				t.Errorf("status: %d (%s)", resp.StatusCode, resp.Header.Get("Content-Type"))
+			}
+			var body map[string]json.RawMessage
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			var e apiError
+			data, _ := json.Marshal(body)
+			json.Unmarshal(data, &e)
+			if e.Code != tt.code || e.Message == "" {
+				t.Errorf("error: %s", data)
+			}
+			if e.RequestID == "" || e.RequestID != resp.Header.Get(RequestIDHeader) {
+				t.Errorf("request ID %q, header %q", e.RequestID, resp.Header.Get(RequestIDHeader))
+			}
+			var keys []string
+			if details, ok := body["details"]; ok {
+				var m map[string]interface{}
+				if err := json.Unmarshal(details, &m); err != nil {
+					t.Fatalf("details are not an object: %s", details)
+				}
+				for k := range m {
+					keys = append(keys, k)
+				}
+				sort.Strings(keys)
+			}
+			if strings.Join(keys, ",") != strings.Join(tt.details, ",") {
+				t.Errorf("details: %v, want %v", keys, tt.details)
+			}
+		})
+	}
+}
+
+// errorCodes returns values of error code constants (by name prefix) declared
+// in the Go source file
+func errorCodes(t *testing.T, filename, prefix string) map[string]bool {
+	t.Helper()
+	file, err := parser.ParseFile(token.NewFileSet(), filename, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes := make(map[string]bool)
+	ast.Inspect(file, func(n ast.Node) bool {
+		spec, ok := n.(*ast.ValueSpec)
+		if !ok {
+			return true
+		}
+		for i, name := range spec.Names {
+			if i >= len(spec.Values) || !strings.HasPrefix(name.Name, prefix) {
+				continue
+			}
+			if lit, ok := spec.Values[i].(*ast.BasicLit); ok {
+				codes[strings.Trim(lit.Value, `"`)] = true
+			}
+		}
+		return false
+	})
+	return codes
+}
+
+// TestClientErrorCodes checks that client package declares all error codes
+// of the server
+func TestClientErrorCodes(t *testing.T) {
+	serverCodes := errorCodes(t, "errors.go", "errCode")
+	clientCodes := errorCodes(t, "../client/errors.go", "ErrCode")
+	if len(serverCodes) == 0 {
+		t.Fatal("no error codes found")
+	}
+	for code := range serverCodes {
+		if !clientCodes[code] {
+			t.Errorf("error code %q is missing in client", code)
+		}
+	}
+	for code := range clientCodes {
+		if !serverCodes[code] && code != "unknown" {
+			t.Errorf("client declares unknown error code %q", code)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd || dragonfly)
+
+package server
+
+// free space of filesystems is not available on this platform
+func freeSpace(dir string) (int64, error) {
+	return 0, errFreeSpaceUnsupported
+}
@@ -0,0 +1,15 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+package server
+
+import "syscall"
+
+// freeSpace returns free space (available to unprivileged users) of the
+// filesystem with given directory
+func freeSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -10,29 +10,42 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
-	"mime"
 	"mime/multipart"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gislab-npo/gisquick-settings/fs"
+	"github.com/gislab-npo/gisquick-settings/server/storage"
 	"github.com/go-chi/chi"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func extractQgzFile(srcPath, destPath string) error {
-	zipReader, err := zip.OpenReader(srcPath)
+func extractQgzFile(store storage.Storage, srcPath, destPath string) error {
+	file, err := store.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	zipReader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
 	if err != nil {
 		return err
 	}
-	defer zipReader.Close()
 	var projectFile *zip.File
 	for _, f := range zipReader.File {
 		if strings.HasSuffix(f.Name, ".qgs") {
@@ -48,32 +61,33 @@ func extractQgzFile(srcPath, destPath string) error {
 		return err
 	}
 	defer freader.Close()
-	return fs.SaveToFile(freader, destPath)
+	return storage.SaveFile(store, freader, destPath)
 }
 
 func (s *Server) handlePluginWs() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		user := r.Context().Value(contextKeyUser).(*User)
 		username := user.Username
-		log.Printf("Plugin WS: %s \n", username)
-		log.Printf("Client: %s\n", r.Header.Get("User-Agent"))
+		s.infof(r, "Plugin WS: %s (client: %s)\n", username, r.Header.Get("User-Agent"))
 		srcConn, err := s.upgrader.Upgrade(w, r, nil)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			// upgrader has already replied with error response
+			s.errorf(r, "Plugin WS upgrade failed: %s\n", err)
 			return
 		}
+		defer srcConn.Close()
 		s.pluginsWs.Set(username, srcConn)
 
 		if appWs := s.appsWs.Get(username); appWs != nil {
 			info := map[string]string{"client": r.Header.Get("User-Agent")}
-			appWs.WriteJSON(genericMessage{Type: "PluginStatus", Status: 200, Data: info})
+			appWs.WriteJSON(genericMessage{Type: "PluginStatus", Status: 200, Data: info, RequestID: getRequestID(r)})
 		}
 
 		for {
 			// Read message from source connection
 			msgType, msg, err := srcConn.ReadMessage()
 			if err != nil {
-				log.Println(err)
+				s.infof(r, "WS closed: %s\n", err)
 				break
 			}
 
@@ -82,11 +96,13 @@ func (s *Server) handlePluginWs() http.HandlerFunc {
 				if err = appWs.WriteMessage(msgType, msg); err != nil {
 					break // or better reply with error message?
 				}
+				s.metrics.wsMessages.WithLabelValues("plugin", "app").Inc()
+				s.debugf(r, "Relayed message from plugin to app (%d bytes)\n", len(msg))
 			}
 		}
 		s.pluginsWs.Set(username, nil)
 		if appWs := s.appsWs.Get(username); appWs != nil {
-			appWs.WriteJSON(genericMessage{Type: "PluginStatus", Status: 503})
+			appWs.WriteJSON(genericMessage{Type: "PluginStatus", Status: 503, RequestID: getRequestID(r)})
 		}
 	}
 }
@@ -95,19 +111,21 @@ func (s *Server) handleAppWs() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		user := r.Context().Value(contextKeyUser).(*User)
 
-		log.Printf("App WS: %s\n", user.Username)
+		s.infof(r, "App WS: %s\n", user.Username)
 		srcConn, err := s.upgrader.Upgrade(w, r, nil)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			// upgrader has already replied with error response
+			s.errorf(r, "App WS upgrade failed: %s\n", err)
 			return
 		}
+		defer srcConn.Close()
 		s.appsWs.Set(user.Username, srcConn)
 
 		for {
 			// Read message from source connection
 			msgType, msg, err := srcConn.ReadMessage()
 			if err != nil {
-				log.Println(err)
+				s.infof(r, "WS closed: %s\n", err)
 				break
 			}
 			if bytes.Compare(msg, []byte("Ping")) == 0 {
@@ -118,27 +136,52 @@ func (s *Server) handleAppWs() http.HandlerFunc {
 				if err = pluginWs.WriteMessage(msgType, msg); err != nil {
 					break // or better reply with error message?
 				}
+				s.metrics.wsMessages.WithLabelValues("app", "plugin").Inc()
+				s.debugf(r, "Relayed message from app to plugin (%d bytes)\n", len(msg))
 			} else {
-				srcConn.WriteJSON(genericMessage{Type: "PluginStatus", Status: 503})
+				srcConn.WriteJSON(genericMessage{Type: "PluginStatus", Status: 503, RequestID: getRequestID(r)})
 			}
 		}
 		s.appsWs.Set(user.Username, nil)
 	}
 }
 
+// handleHashAlgorithms returns supported hash algorithms (in order of
+// preference), so clients can choose algorithm for files checksums
+func (s *Server) handleHashAlgorithms() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.jsonResponse(w, fs.HashAlgorithms)
+	}
+}
+
+// unsupportedHashAlgorithm writes response of request with unknown hash
+// algorithm
+func (s *Server) unsupportedHashAlgorithm(w http.ResponseWriter, r *http.Request, algorithm string) {
+	s.errorResponse(w, r, http.StatusBadRequest, errCodeUnsupportedHash, fmt.Sprintf("Unsupported hash algorithm: %s", algorithm), map[string]interface{}{
+		"algorithm": algorithm,
+		"supported": fs.HashAlgorithms,
+	})
+}
+
 func (s *Server) handleProjectFiles() http.HandlerFunc {
-	projectsDir := s.config.ProjectsRoot
 	return func(w http.ResponseWriter, r *http.Request) {
 		username := chi.URLParam(r, "user")
 		directory := chi.URLParam(r, "directory")
+		algorithm := r.URL.Query().Get("hash")
+		if !fs.IsHashAlgorithm(algorithm) {
+			s.unsupportedHashAlgorithm(w, r, algorithm)
+			return
+		}
 
-		projectDir := filepath.Join(projectsDir, username, directory)
-		files, err := fs.ListDir(projectDir, true)
+		// hashing is stopped when the request is canceled
+		opts := fs.ListOptions{Checksum: true, Algorithm: algorithm}
+		files, err := s.storage.ListContext(r.Context(), projectPath(username, directory), opts)
 		if err != nil {
 			if os.IsNotExist(err) {
-				http.Error(w, "Project not found", http.StatusNotFound)
+				s.errorResponse(w, r, http.StatusNotFound, errCodeProjectNotFound, "Project not found", nil)
 			} else {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				s.errorf(r, "Failed to list project files: %s\n", err)
+				s.serverError(w, r)
 			}
 			return
 		}
@@ -146,6 +189,180 @@ func (s *Server) handleProjectFiles() http.HandlerFunc {
 	}
 }
 
+// projectChanges describes files which should be removed from the project
+// by the upload. Removes is a list of explicitly removed files, Manifest is
+// a full list of project files after the upload (other files are removed).
+type projectChanges struct {
+	Removes  []string  `json:"removes"`
+	Manifest []fs.File `json:"manifest"`
+}
+
+// conflict returns path of uploaded file which is inconsistent with the
+// changes (it's removed or it doesn't match its entry in the manifest)
+func (c projectChanges) conflict(files []fs.File) (string, bool) {
+	removed := make(map[string]bool, len(c.Removes))
+	for _, p := range c.Removes {
+		removed[p] = true
+	}
+	manifest := make(map[string]fs.File, len(c.Manifest))
+	for _, f := range c.Manifest {
+		manifest[f.Path] = f
+	}
+	for _, f := range files {
+		if removed[f.Path] {
+			return f.Path, true
+		}
+		m, ok := manifest[f.Path]
+		if !ok {
+			continue
+		}
+		sameHash := m.Hash == "" || f.Hash == "" || m.Algorithm != f.Algorithm || m.Hash == f.Hash
+		if m.Size != f.Size || !sameHash {
+			return f.Path, true
+		}
+	}
+	return "", false
+}
+
+// checkProjectChanges writes error response when uploaded files are
+// inconsistent with the project changes
+func (s *Server) checkProjectChanges(w http.ResponseWriter, r *http.Request, files []fs.File, changes projectChanges) bool {
+	if p, ok := changes.conflict(files); ok {
+		s.badRequest(w, r, fmt.Sprintf("Uploaded file doesn't match project changes: %s", p), fileErrorDetails{p})
+		return false
+	}
+	return true
+}
+
+// keptFiles returns paths of given files, including QGIS project files
+// which are extracted from uploaded .qgz files
+func keptFiles(filesLists ...[]fs.File) map[string]bool {
+	keep := make(map[string]bool)
+	for _, files := range filesLists {
+		for _, f := range files {
+			keep[f.Path] = true
+			if strings.HasSuffix(f.Path, ".qgz") {
+				keep[strings.TrimSuffix(f.Path, "qgz")+"qgs"] = true
+			}
+		}
+	}
+	return keep
+}
+
+// filesToRemove returns existing project files which should be removed by
+// the upload of given files
+func (s *Server) filesToRemove(projectDir string, files []fs.File, changes projectChanges) ([]string, error) {
+	if len(changes.Removes) == 0 && changes.Manifest == nil {
+		return []string{}, nil
+	}
+	currentFiles, err := s.storage.List(projectDir, false)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	keep := keptFiles(files, changes.Manifest)
+	removed := make(map[string]bool, len(changes.Removes))
+	for _, p := range changes.Removes {
+		removed[p] = true
+	}
+	removes := []string{}
+	for _, f := range currentFiles {
+		if keep[f.Path] {
+			continue
+		}
+		if removed[f.Path] || changes.Manifest != nil {
+			removes = append(removes, f.Path)
+		}
+	}
+	return removes, nil
+}
+
+// projectSizeAfterUpload returns size of the project after update with given
+// files (ignored files are counted too, they are stored as well)
+func (s *Server) projectSizeAfterUpload(projectDir string, files []fs.File, removes []string) int64 {
+	filesSizeMap := make(map[string]int64)
+	currentFiles, err := s.listInternal(projectDir)
+	if err == nil {
+		for _, f := range currentFiles {
+			filesSizeMap[f.Path] = f.Size
+		}
+	} else if !os.IsNotExist(err) {
+		s.errorf(nil, "Failed to list project files in %s: %s\n", projectDir, err)
+	}
+	for _, p := range removes {
+		delete(filesSizeMap, p)
+	}
+	for _, f := range files {
+		filesSizeMap[f.Path] = f.Size
+	}
+	var projectSize int64
+	for _, size := range filesSizeMap {
+		projectSize += size
+	}
+	return projectSize
+}
+
+// checkUploadLimits writes error response when the project update would
+// exceed max. project size or user's quota (superusers have no limits).
+// Pending is size of the update's data received in upload session.
+func (s *Server) checkUploadLimits(w http.ResponseWriter, r *http.Request, user *User, username, projectDir string, files []fs.File, removes []string, pending int64) bool {
+	if user.IsSuperuser {
+		return true
+	}
+	maxSize := s.settings().MaxProjectSize
+	if size := s.projectSizeAfterUpload(projectDir, files, removes); size > maxSize {
+		s.errorResponse(w, r, http.StatusBadRequest, errCodeUploadTooLarge, "Upload size is over limit", sizeErrorDetails{size, maxSize})
+		return false
+	}
+	return s.checkUploadQuota(w, r, username, projectDir, files, removes, pending)
+}
+
+// lockUploads serializes commits of uploads into projects of the user, so
+// limits checked before commit can't be exceeded by concurrent uploads. It
+// returns function which releases the lock.
+func (s *Server) lockUploads(username string) func() {
+	m, _ := s.uploadLocks.LoadOrStore(username, &sync.Mutex{})
+	mutex := m.(*sync.Mutex)
+	mutex.Lock()
+	return mutex.Unlock
+}
+
+// commitUpload extracts QGIS project files from uploaded .qgz archives, moves
+// staged files into the project directory, removes deleted files and records
+// a new snapshot
+func (s *Server) commitUpload(staging *stagingArea, username, directory, author string, files []fs.File, removes []string) error {
+	for _, f := range files {
+		if strings.HasSuffix(f.Path, ".qgz") {
+			qgsFile := strings.TrimSuffix(f.Path, "qgz") + "qgs"
+			if err := extractQgzFile(s.storage, staging.Path(f.Path), staging.Path(qgsFile)); err != nil {
+				s.errorf(nil, "Failed to extract qgis project file: %s (%s)\n", f.Path, err)
+				continue
+			}
+			staging.Add(qgsFile)
+		}
+	}
+	if err := staging.Commit(); err != nil {
+		return err
+	}
+	for _, p := range removes {
+		if err := s.storage.Remove(projectPath(username, directory, p)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := s.createSnapshot(username, directory, author); err != nil {
+		s.errorf(nil, "Failed to create project snapshot: %s (%s)\n", projectPath(username, directory), err)
+	}
+	return nil
+}
+
+// isDryRun returns true when request has dry_run query parameter
+func isDryRun(r *http.Request) bool {
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	return dryRun
+}
+
 func (s *Server) handleUpload() http.HandlerFunc {
 	type fileUploadProgress struct {
 		File     string `json:"file"`
@@ -153,114 +370,180 @@ func (s *Server) handleUpload() http.HandlerFunc {
 	}
 	type uploadInfo struct {
 		Files []fs.File `json:"files"`
+		projectChanges
 	}
 
-	projectsDir := s.config.ProjectsRoot
-
 	return func(w http.ResponseWriter, r *http.Request) {
 		username := chi.URLParam(r, "user")
 		directory := chi.URLParam(r, "directory")
-		projectDir := filepath.Join(projectsDir, username, directory)
+		projectDir := projectPath(username, directory)
 
-		ctype, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
-		if err != nil || ctype != "multipart/form-data" {
-			http.Error(w, "Invalid content type", 400)
-			return
-		}
-		boundary, ok := params["boundary"]
+		boundary, ok := s.checkMultipart(w, r)
 		if !ok {
-			http.Error(w, http.ErrMissingBoundary.Error(), 400)
 			return
 		}
 
 		user := r.Context().Value(contextKeyUser).(*User)
 		if !user.IsSuperuser {
-			r.Body = http.MaxBytesReader(w, r.Body, s.config.MaxProjectSize)
+			r.Body = http.MaxBytesReader(w, r.Body, s.settings().MaxProjectSize)
 		}
 		reader := multipart.NewReader(r.Body, boundary)
 
 		// first part should contain upload info
 		var info uploadInfo
+		_, sp := s.tracer.Start(r.Context(), "multipart metadata")
 		part, err := reader.NextPart()
+		if err == nil {
+			err = json.NewDecoder(part).Decode(&info)
+		}
+		sp.SetAttributes(attribute.Int("files", len(info.Files)))
+		setSpanError(sp, err)
+		sp.End()
 		if err != nil {
-			log.Printf("Invalid upload stream: %s\n", err)
-			http.Error(w, "Invalid upload stream", http.StatusBadRequest)
+			s.errorf(r, "Failed to decode upload metadata: %s\n", err)
+			s.errorResponse(w, r, http.StatusBadRequest, errCodeInvalidUpload, "Invalid upload stream", nil)
+			return
+		}
+		for _, f := range info.Files {
+			if !fs.IsHashAlgorithm(f.Algorithm) {
+				s.unsupportedHashAlgorithm(w, r, f.Algorithm)
+				return
+			}
+		}
+		if err := validateFilePaths(info.Files); err != nil {
+			s.pathErrorResponse(w, r, err)
+			return
+		}
+		if !s.checkProjectChanges(w, r, info.Files, info.projectChanges) {
 			return
 		}
-		err = json.NewDecoder(part).Decode(&info)
+
+		removes, err := s.filesToRemove(projectDir, info.Files, info.projectChanges)
 		if err != nil {
-			log.Printf("Failed to decode upload metadata: %s\n", err)
-			http.Error(w, "Invalid upload stream", http.StatusBadRequest)
+			s.errorf(r, "Upload error: %s\n", err)
+			s.serverError(w, r)
+			return
+		}
+		if !s.checkUploadLimits(w, r, user, username, projectDir, info.Files, removes, 0) {
+			return
+		}
+		if isDryRun(r) {
+			s.jsonResponse(w, map[string][]string{"removes": removes})
 			return
 		}
 
-		// Check size limit for regular users
-		if !user.IsSuperuser {
-			filesSizeMap := make(map[string]int64)
-			currentFiles, err := fs.ListDir(projectDir, false)
-			if err == nil {
-				for _, f := range *currentFiles {
-					filesSizeMap[f.Path] = f.Size
-				}
-			} else if !os.IsNotExist(err) {
-				log.Printf("Failed to list project files in %s: %s\n", projectDir, err)
-			}
-			for _, f := range info.Files {
-				filesSizeMap[f.Path] = f.Size
-			}
-			var projectSize int64
-			for _, size := range filesSizeMap {
-				projectSize += size
-			}
-			if projectSize > s.config.MaxProjectSize {
-				http.Error(w, "Upload size is over limit", http.StatusBadRequest)
-				return
-			}
+		staging, err := s.newStagingArea(r, projectDir)
+		if err != nil {
+			s.errorf(r, "Upload error: %s\n", err)
+			s.serverError(w, r)
+			return
 		}
+		defer staging.Discard()
 
+		pendingFiles := make(map[string]fs.File, len(info.Files))
+		for _, f := range info.Files {
+			pendingFiles[f.Path] = f
+		}
 		uploadProgress := make(map[string]int)
 		lastNotification := time.Now()
 		for {
 			part, err := reader.NextPart()
 			if err == io.EOF {
-				if appWs := s.appsWs.Get(username); appWs != nil {
-					s.sendJSONMessage(appWs, "UploadProgress", uploadProgress)
-				}
 				break
 			}
+			if err != nil {
+				s.errorf(r, "Invalid upload stream: %s\n", err)
+				s.errorResponse(w, r, http.StatusBadRequest, errCodeInvalidUpload, "Invalid upload stream", nil)
+				return
+			}
+			declaredFile, ok := pendingFiles[part.FormName()]
+			if !ok {
+				s.errorf(r, "Upload error: undeclared file %s\n", part.FormName())
+				s.errorResponse(w, r, http.StatusBadRequest, errCodeInvalidUpload, "Invalid upload stream", nil)
+				return
+			}
+			_, fileSpan := s.tracer.Start(r.Context(), "upload file")
+			fileSpan.SetAttributes(attribute.String("file.path", part.FormName()))
+			// time spent in reading of multipart stream and of decompressed data
+			partTimer := &timedReader{Reader: part}
+			readTimer := partTimer
 			var partReader io.ReadCloser = part
-			if strings.HasSuffix(part.FileName(), ".gz") && !strings.HasSuffix(part.FormName(), ".gz") {
-				partReader, _ = gzip.NewReader(part)
+			compressed := strings.HasSuffix(part.FileName(), ".gz") && !strings.HasSuffix(part.FormName(), ".gz")
+			if compressed {
+				if partReader, err = gzip.NewReader(partTimer); err != nil {
+					setSpanError(fileSpan, err)
+					fileSpan.End()
+					s.errorf(r, "Invalid upload stream: %s\n", err)
+					s.errorResponse(w, r, http.StatusBadRequest, errCodeInvalidUpload, "Invalid upload stream", nil)
+					return
+				}
+				readTimer = &timedReader{Reader: partReader}
 			}
-			pr := &fs.ProgressReader{Reader: partReader, Step: 32 * 1024, Callback: func(p int) {
+			saveStart := time.Now()
+			pr := &fs.ProgressReader{Reader: readTimer, Step: 32 * 1024, Callback: func(p int) {
 				uploadProgress[part.FormName()] = p
 				now := time.Now()
 				if now.Sub(lastNotification).Seconds() > 0.5 {
-					if appWs := s.appsWs.Get(username); appWs != nil {
-						s.sendJSONMessage(appWs, "UploadProgress", uploadProgress)
+					if appWs := s.appsWs.Get(user.Username); appWs != nil {
+						s.sendJSONMessage(appWs, r, "UploadProgress", uploadProgress)
 					}
 					lastNotification = now
 					uploadProgress = make(map[string]int)
 				}
 			}}
-			filename := filepath.Join(projectDir, part.FormName())
-			err = fs.SaveToFile(pr, filename)
+			file, err := staging.Save(pr, part.FormName(), declaredFile.Algorithm)
 			partReader.Close()
+			fileSpan.SetAttributes(attribute.Int64("file.size", file.Size))
+			fileSpan.SetAttributes(attribute.Float64("multipart.read_ms", milliseconds(partTimer.elapsed)))
+			if compressed {
+				fileSpan.SetAttributes(attribute.Float64("gzip.decompress_ms", milliseconds(readTimer.elapsed-partTimer.elapsed)))
+			}
+			// writing includes computation of checksum
+			fileSpan.SetAttributes(attribute.Float64("disk.write_ms", milliseconds(time.Since(saveStart)-readTimer.elapsed)))
+			setSpanError(fileSpan, err)
+			fileSpan.End()
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				s.errorf(r, "Upload error: %s\n", err)
+				s.serverError(w, r)
 				return
 			}
+			if file.Size != declaredFile.Size || (declaredFile.Hash != "" && file.Hash != declaredFile.Hash) {
+				s.errorf(r, "Upload error: file %s doesn't match its metadata\n", file.Path)
+				s.errorResponse(w, r, http.StatusBadRequest, errCodeCorruptedFile, fmt.Sprintf("Corrupted file: %s", file.Path), fileErrorDetails{file.Path})
+				return
+			}
+			delete(pendingFiles, file.Path)
 		}
-		// extract qgz project files
-		for _, f := range info.Files {
-			if strings.HasSuffix(f.Path, ".qgz") {
-				qgzFile := filepath.Join(projectDir, f.Path)
-				qgsFile := strings.TrimSuffix(qgzFile, "qgz") + "qgs"
-				if err = extractQgzFile(qgzFile, qgsFile); err != nil {
-					log.Printf("Failed to extract qgis project file: %s (%s)\n", qgzFile, err)
-					continue
-				}
+		if len(pendingFiles) > 0 {
+			s.errorf(r, "Upload error: %d declared files were not received\n", len(pendingFiles))
+			missing := make([]string, 0, len(pendingFiles))
+			for path := range pendingFiles {
+				missing = append(missing, path)
+			}
+			sort.Strings(missing)
+			s.errorResponse(w, r, http.StatusBadRequest, errCodeIncompleteUpload, "Incomplete upload", map[string][]string{"files": missing})
+			return
+		}
+		// other uploads could be finished in the meantime
+		unlock := s.lockUploads(username)
+		defer unlock()
+		if !s.checkUploadLimits(w, r, user, username, projectDir, info.Files, removes, 0) {
+			return
+		}
+		_, sp = s.tracer.Start(r.Context(), "commit upload")
+		err = s.commitUpload(staging, username, directory, user.Username, info.Files, removes)
+		setSpanError(sp, err)
+		sp.End()
+		if err != nil {
+			if s.pathErrorResponse(w, r, err) {
+				return
 			}
+			s.errorf(r, "Upload error: failed to update project files. %s\n", err)
+			s.serverError(w, r)
+			return
+		}
+		if appWs := s.appsWs.Get(user.Username); appWs != nil {
+			s.sendJSONMessage(appWs, r, "UploadProgress", uploadProgress)
 		}
 		w.Write([]byte(""))
 	}
@@ -271,55 +554,58 @@ func (s *Server) handleArchiveUpload() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		user := r.Context().Value(contextKeyUser).(*User)
 
-		if r.ContentLength > s.config.MaxFileUpload {
-			log.Printf("Upload error: file size is over limit (user: %s)\n", user.Username)
-			http.Error(w, "File size is over limit", http.StatusExpectationFailed)
-			return
-		}
-		ctype, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
-		if err != nil || ctype != "multipart/form-data" {
-			log.Printf("Upload error: invalid content type (user: %s)\n", user.Username)
-			http.Error(w, "Invalid content type", 400)
+		if maxSize := s.settings().MaxFileUpload; r.ContentLength > maxSize {
+			s.errorf(r, "Upload error: file size is over limit (user: %s)\n", user.Username)
+			s.errorResponse(w, r, http.StatusExpectationFailed, errCodeUploadTooLarge, "File size is over limit", sizeErrorDetails{r.ContentLength, maxSize})
 			return
 		}
-		boundary, ok := params["boundary"]
+		boundary, ok := s.checkMultipart(w, r)
 		if !ok {
-			log.Printf("Upload error: Invalid content type (user: %s)\n", user.Username)
-			http.Error(w, http.ErrMissingBoundary.Error(), 400)
+			s.errorf(r, "Upload error: invalid content type (user: %s)\n", user.Username)
 			return
 		}
 
 		if !user.IsSuperuser {
-			r.Body = http.MaxBytesReader(w, r.Body, s.config.MaxFileUpload)
+			r.Body = http.MaxBytesReader(w, r.Body, s.settings().MaxFileUpload)
 		}
 		reader := multipart.NewReader(r.Body, boundary)
-		part, _ := reader.NextPart()
+		part, err := reader.NextPart()
+		if err != nil {
+			s.errorf(r, "Upload error: invalid multipart body. %s (user: %s)\n", err, user.Username)
+			s.errorResponse(w, r, http.StatusBadRequest, errCodeInvalidArchive, "Expected zip archive", nil)
+			return
+		}
 		if !strings.HasSuffix(part.FileName(), ".zip") {
-			log.Printf("Upload error: not a zip archive (user: %s, file: %s)\n", user.Username, part.FileName())
-			http.Error(w, "Expected zip archive", 400)
+			s.errorf(r, "Upload error: not a zip archive (user: %s, file: %s)\n", user.Username, part.FileName())
+			s.errorResponse(w, r, http.StatusBadRequest, errCodeInvalidArchive, "Expected zip archive", nil)
 			return
 		}
 
 		tmpfile, err := ioutil.TempFile("/tmp", part.FileName())
 		if err != nil {
-			log.Printf("Upload error: %s\n", err)
-			http.Error(w, "FileServer error", http.StatusInternalServerError)
+			s.errorf(r, "Upload error: %s\n", err)
+			s.serverError(w, r)
 			return
 		}
 		defer os.Remove(tmpfile.Name())
-		_, err = io.Copy(tmpfile, part)
+		_, sp := s.tracer.Start(r.Context(), "receive archive")
+		size, err := io.Copy(tmpfile, part)
+		sp.SetAttributes(attribute.Int64("file.size", size))
+		setSpanError(sp, err)
+		sp.End()
 		if err != nil {
-			log.Printf("Upload error: %s\n", err)
-			http.Error(w, "FileServer error", http.StatusInternalServerError)
+			s.errorf(r, "Upload error: %s\n", err)
+			s.serverError(w, r)
 			return
 		}
 		archiveReader, err := zip.OpenReader(tmpfile.Name())
 
 		if err != nil {
-			log.Printf("Upload error: %s\n", err)
-			http.Error(w, "FileServer error", http.StatusInternalServerError)
+			s.errorf(r, "Upload error: %s\n", err)
+			s.serverError(w, r)
 			return
 		}
+		defer archiveReader.Close()
 
 		// Check archive structure - all files in one root directory, with QGIS project
 		invalidArchiveHandler := func(msg string) {
@@ -327,21 +613,41 @@ func (s *Server) handleArchiveUpload() http.HandlerFunc {
 			for i, f := range archiveReader.File {
 				filenames[i] = f.Name
 			}
-			log.Printf("Upload error: %s (user: %s)\n", msg, user.Username)
-			log.Printf("Archive files: [%s]\n", strings.Join(filenames, ", "))
-			http.Error(w, msg, http.StatusBadRequest)
+			s.errorf(r, "Upload error: %s (user: %s)\n", msg, user.Username)
+			s.errorf(r, "Archive files: [%s]\n", strings.Join(filenames, ", "))
+			s.errorResponse(w, r, http.StatusBadRequest, errCodeInvalidArchive, msg, nil)
+		}
+		if len(archiveReader.File) == 0 {
+			invalidArchiveHandler("Invalid project archive - no files")
+			return
 		}
-		rootDir, _ := filepath.Split(archiveReader.File[0].Name)
-		if len(rootDir) == 0 {
+		rootDir := strings.SplitN(archiveReader.File[0].Name, "/", 2)[0] + "/"
+		if _, err := fs.CleanName(strings.TrimSuffix(rootDir, "/")); err != nil || rootDir == archiveReader.File[0].Name+"/" {
 			invalidArchiveHandler("Invalid project archive - not a single directory")
 			return
 		}
 		hasQgisProject := false
+		var files []fs.File
+		var entries []*zip.File
 		for _, f := range archiveReader.File {
 			if !strings.HasPrefix(f.Name, rootDir) {
 				invalidArchiveHandler("Invalid project archive - not a single directory")
 				return
 			}
+			// prevent extraction of files outside of the project directory
+			if !f.FileInfo().IsDir() {
+				relPath, err := fs.CleanPath(strings.TrimPrefix(f.Name, rootDir))
+				if err != nil {
+					s.pathErrorResponse(w, r, err)
+					return
+				}
+				// internal data of copied project directory, temporary files, ...
+				if fs.IsExcluded(relPath) {
+					continue
+				}
+				files = append(files, fs.File{Path: relPath, Size: int64(f.UncompressedSize64)})
+				entries = append(entries, f)
+			}
 			if qgisExtRegex.Match([]byte(f.Name)) {
 				hasQgisProject = true
 			}
@@ -351,24 +657,109 @@ func (s *Server) handleArchiveUpload() http.HandlerFunc {
 			return
 		}
 
+		directory := strings.TrimSuffix(rootDir, "/")
+		if err := checkUsername(user.Username); err != nil {
+			s.pathErrorResponse(w, r, err)
+			return
+		}
+		unlock := s.lockUploads(user.Username)
+		defer unlock()
+		if !user.IsSuperuser && !s.checkUploadQuota(w, r, user.Username, projectPath(user.Username, directory), files, nil, 0) {
+			return
+		}
+
 		// Extract files
-		for _, f := range archiveReader.File {
-			dest := filepath.Join(s.config.ProjectsRoot, user.Username, f.Name)
-			if !f.FileInfo().IsDir() {
-				fr, _ := f.Open()
-				err = fs.SaveToFile(fr, dest)
+		staging, err := s.newStagingArea(r, projectPath(user.Username, directory))
+		if err != nil {
+			s.errorf(r, "Upload error: %s\n", err)
+			s.serverError(w, r)
+			return
+		}
+		defer staging.Discard()
+		_, sp = s.tracer.Start(r.Context(), "extract archive")
+		sp.SetAttributes(attribute.Int("files", len(files)))
+		for i, f := range entries {
+			fr, err := f.Open()
+			if err == nil {
+				_, err = staging.Save(fr, files[i].Path, fs.DefaultHashAlgorithm)
 				fr.Close()
-				if err != nil {
-					log.Printf("Upload error: failed to extract archive. %s (user: %s)\n", err, user.Username)
-					http.Error(w, "FileServer error", http.StatusInternalServerError)
-					return
-				}
 			}
+			if err != nil {
+				setSpanError(sp, err)
+				sp.End()
+				s.errorf(r, "Upload error: failed to extract archive. %s (user: %s)\n", err, user.Username)
+				s.serverError(w, r)
+				return
+			}
+		}
+		sp.End()
+		_, sp = s.tracer.Start(r.Context(), "commit upload")
+		err = staging.Commit()
+		setSpanError(sp, err)
+		sp.End()
+		if err != nil {
+			if s.pathErrorResponse(w, r, err) {
+				return
+			}
+			s.errorf(r, "Upload error: failed to extract archive. %s (user: %s)\n", err, user.Username)
+			s.serverError(w, r)
+			return
+		}
+		if err = s.createSnapshot(user.Username, directory, user.Username); err != nil {
+			s.errorf(r, "Failed to create project snapshot: %s/%s (%s)\n", user.Username, directory, err)
 		}
 		w.Write([]byte(""))
 	}
 }
 
+// handleProjectDiff compares client's manifest of project files with
+// published project files
+func (s *Server) handleProjectDiff() http.HandlerFunc {
+	type diffInfo struct {
+		// Hash algorithm of files checksums (default is algorithm of the first file)
+		Algorithm string    `json:"algorithm"`
+		Files     []fs.File `json:"files"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := chi.URLParam(r, "user")
+		directory := chi.URLParam(r, "directory")
+		var info diffInfo
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 10*1024*1024)).Decode(&info); err != nil {
+			s.errorf(r, "Failed to decode files manifest: %s\n", err)
+			s.badRequest(w, r, "Invalid files manifest", nil)
+			return
+		}
+		if info.Algorithm == "" && len(info.Files) > 0 {
+			info.Algorithm = info.Files[0].Algorithm
+		}
+		if !fs.IsHashAlgorithm(info.Algorithm) {
+			s.unsupportedHashAlgorithm(w, r, info.Algorithm)
+			return
+		}
+		opts := fs.ListOptions{Checksum: true, Algorithm: info.Algorithm}
+		files, err := s.storage.ListContext(r.Context(), projectPath(username, directory), opts)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				s.errorf(r, "Failed to list project files: %s\n", err)
+				s.serverError(w, r)
+				return
+			}
+			files = []fs.File{}
+		}
+		changes := fs.Diff(info.Files, files)
+		// QGIS project files extracted from .qgz files are not removed on upload
+		keep := keptFiles(info.Files)
+		deleted := make([]fs.File, 0, len(changes.Deleted))
+		for _, f := range changes.Deleted {
+			if !keep[f.Path] {
+				deleted = append(deleted, f)
+			}
+		}
+		changes.Deleted = deleted
+		s.jsonResponse(w, changes)
+	}
+}
+
 func (s *Server) handleDownload() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		username := chi.URLParam(r, "user")
@@ -379,22 +770,21 @@ func (s *Server) handleDownload() http.HandlerFunc {
 		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.zip", directory))
 		defer writer.Close()
 
-		projectDir := filepath.Join(s.config.ProjectsRoot, username, directory)
-		projectDir, _ = filepath.Abs(projectDir)
-		files, err := fs.ListDir(projectDir, false)
+		projectDir := projectPath(username, directory)
+		files, err := s.storage.List(projectDir, false)
 		if err != nil {
-			log.Printf("Project download error: %s\n", err)
-			http.Error(w, "FileServer error", http.StatusInternalServerError)
+			s.errorf(r, "Project download error: %s\n", err)
+			s.serverError(w, r)
 			return
 		}
-		for _, f := range *files {
-			part, err := writer.Create(filepath.Join(directory, f.Path))
+		for _, f := range files {
+			part, err := writer.Create(path.Join(directory, f.Path))
 			if err != nil {
-				http.Error(w, "FileServer error", http.StatusInternalServerError)
+				s.serverError(w, r)
 				return
 			}
-			if err = fs.CopyFile(part, filepath.Join(projectDir, f.Path)); err != nil {
-				http.Error(w, "FileServer error", http.StatusInternalServerError)
+			if err = s.copyFile(part, path.Join(projectDir, f.Path)); err != nil {
+				s.serverError(w, r)
 				return
 			}
 		}
@@ -403,19 +793,17 @@ func (s *Server) handleDownload() http.HandlerFunc {
 
 func (s *Server) handleProjectDelete() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		user := r.Context().Value(contextKeyUser).(*User)
 		username := chi.URLParam(r, "user")
 		directory := chi.URLParam(r, "directory")
-		if !user.IsSuperuser && user.Username != username {
-			http.Error(w, "Forbidden", http.StatusForbidden)
-			return
-		}
 
-		dest := filepath.Join(s.config.ProjectsRoot, username, directory)
-		if err := os.RemoveAll(dest); err != nil {
-			http.Error(w, "FileServer Error", http.StatusInternalServerError)
+		if err := s.storage.RemoveAll(projectPath(username, directory)); err != nil {
+			s.serverError(w, r)
 			return
 		}
+		// new project with the same name must not inherit collaborators
+		if err := s.storage.Remove(aclPath(username, directory)); err != nil && !os.IsNotExist(err) {
+			s.errorf(r, "Failed to remove project ACL: %s\n", err)
+		}
 
 		// TODO: delete map cache
 		w.Write([]byte(""))
@@ -426,32 +814,22 @@ func (s *Server) handleSaveConfig() http.HandlerFunc {
 	var maxBodySize int64 = 1024 * 1024
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		user := r.Context().Value(contextKeyUser).(*User)
 		username := chi.URLParam(r, "user")
 		directory := chi.URLParam(r, "directory")
 		projectName := chi.URLParam(r, "name")
-		if !user.IsSuperuser && user.Username != username {
-			http.Error(w, "Forbidden", http.StatusForbidden)
-			return
-		}
 		r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
 		defer r.Body.Close()
 		data, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			http.Error(w, "Invalid data", http.StatusBadRequest)
+			s.badRequest(w, r, "Invalid data", nil)
 			return
 		}
 
-		dest := filepath.Join(s.config.ProjectsRoot, username, directory, ".gisquick", projectName+".json")
-		err = os.MkdirAll(filepath.Dir(dest), os.ModePerm)
+		dest := projectPath(username, directory, ".gisquick", projectName+".json")
+		err = storage.SaveFile(s.storage, bytes.NewReader(data), dest)
 		if err != nil {
-			http.Error(w, "FileServer Error", http.StatusInternalServerError)
-			return
-		}
-		err = ioutil.WriteFile(dest, data, 0644)
-		if err != nil {
-			log.Printf("Failed to save config file: %s\n", err.Error())
-			http.Error(w, "FileServer Error", http.StatusInternalServerError)
+			s.errorf(r, "Failed to save config file: %s\n", err.Error())
+			s.serverError(w, r)
 			return
 		}
 		/*
@@ -467,28 +845,23 @@ func (s *Server) handleSaveConfig() http.HandlerFunc {
 
 func (s *Server) handleSaveProjectMeta() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		user := r.Context().Value(contextKeyUser).(*User)
 		username := chi.URLParam(r, "user")
 		directory := chi.URLParam(r, "directory")
 		projectName := chi.URLParam(r, "name")
-		if !user.IsSuperuser && user.Username != username {
-			http.Error(w, "Forbidden", http.StatusForbidden)
-			return
-		}
-		dest := filepath.Join(s.config.ProjectsRoot, username, directory, projectName+".meta")
+		dest := projectPath(username, directory, projectName+".meta")
 		defer r.Body.Close()
 
 		// TODO: create saveConfigFile(data []byte, dest string) function on server or in fs
 		data, _ := ioutil.ReadAll(r.Body)
 		var out bytes.Buffer
 		if err := json.Indent(&out, data, "", "  "); err != nil {
-			log.Printf("Failed to format project metadata: %s\n", err)
-			http.Error(w, "Server error", http.StatusInternalServerError)
+			s.errorf(r, "Failed to format project metadata: %s\n", err)
+			s.serverError(w, r)
 			return
 		}
-		if err := ioutil.WriteFile(dest, out.Bytes(), 0644); err != nil {
-			log.Printf("Failed to save project metadata: %s\n", err)
-			http.Error(w, "Server error", http.StatusInternalServerError)
+		if err := storage.SaveFile(s.storage, &out, dest); err != nil {
+			s.errorf(r, "Failed to save project metadata: %s\n", err)
+			s.serverError(w, r)
 			return
 		}
 		// save content as it is
@@ -508,43 +881,42 @@ func (s *Server) handleGetProjectMeta() http.HandlerFunc {
 		var matchedFilename string
 		matchedTimestamp := -1
 
-		root := filepath.Join(s.config.ProjectsRoot, username, directory)
-		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if !info.IsDir() && strings.HasSuffix(info.Name(), ".meta") {
-				groups := regex.FindStringSubmatch(info.Name())
+		root := projectPath(username, directory)
+		files, err := s.storage.List(root, false)
+		if err != nil && !os.IsNotExist(err) {
+			s.errorf(r, "Failed to list project files: %s\n", err)
+			s.serverError(w, r)
+			return
+		}
+		for _, f := range files {
+			if strings.HasSuffix(f.Path, ".meta") {
+				groups := regex.FindStringSubmatch(path.Base(f.Path))
 				if len(groups) == 3 {
 					timestamp, _ := strconv.Atoi(groups[2])
 					if timestamp > matchedTimestamp {
-						matchedFilename = groups[0]
+						matchedFilename = f.Path
 						matchedTimestamp = timestamp
 					}
 				}
 			}
-			return nil
-		})
-		if err != nil && !os.IsNotExist(err) {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
 		}
 		if matchedFilename == "" {
-			http.Error(w, "Not found", http.StatusNotFound)
+			s.notFound(w, r, "Not found")
 			return
 		}
 
-		jsonContent, err := ioutil.ReadFile(filepath.Join(root, matchedFilename))
+		jsonContent, err := s.readFile(path.Join(root, matchedFilename))
 		if err != nil {
-			http.Error(w, "Not found", http.StatusNotFound)
+			s.notFound(w, r, "Not found")
 			return
 		}
 		var meta map[string]interface{}
 		if err = json.Unmarshal(jsonContent, &meta); err != nil {
-			http.Error(w, "Error", http.StatusInternalServerError)
+			s.errorf(r, "Invalid project metadata: %s (%s)\n", matchedFilename, err)
+			s.serverError(w, r)
 			return
 		}
-		meta["project"] = filepath.Join(username, directory, strings.TrimSuffix(matchedFilename, filepath.Ext(matchedFilename)))
+		meta["project"] = path.Join(username, directory, strings.TrimSuffix(matchedFilename, path.Ext(matchedFilename)))
 		s.jsonResponse(w, meta)
 	}
 }
@@ -553,21 +925,26 @@ func (s *Server) handleGetMap() http.HandlerFunc {
 	client := &http.Client{}
 	mapserverPublishDir := "/publish"
 	return func(w http.ResponseWriter, r *http.Request) {
-		mapParam := r.URL.Query().Get("MAP")
-		username := strings.Split(mapParam, "/")[0]
-		user := r.Context().Value(contextKeyUser).(*User)
-		if !user.IsSuperuser && user.Username != username {
-			http.Error(w, "Permission denied", http.StatusForbidden)
+		mapParam, err := fs.CleanPath(r.URL.Query().Get("MAP"))
+		if err != nil {
+			s.pathErrorResponse(w, r, err)
 			return
 		}
 		req, _ := http.NewRequest(http.MethodGet, s.config.MapServer, nil)
 		query := r.URL.Query()
 		query.Set("MAP", filepath.Join(mapserverPublishDir, mapParam))
 		req.URL.RawQuery = query.Encode()
+		ctx, sp := s.tracer.Start(r.Context(), "map server request", trace.WithSpanKind(trace.SpanKindClient))
+		defer sp.End()
+		sp.SetAttributes(attribute.String("map", mapParam))
+		propagate(r.WithContext(ctx), req)
+		start := time.Now()
 		resp, err := client.Do(req)
 		if err != nil {
-			log.Printf("Mapserver proxy request failed: %s\n", err)
-			http.Error(w, "Error", http.StatusBadGateway)
+			setSpanError(sp, err)
+			s.metrics.mapDuration.WithLabelValues("error").Observe(time.Since(start).Seconds())
+			s.errorf(r, "Mapserver proxy request failed: %s\n", err)
+			s.errorResponse(w, r, http.StatusBadGateway, errCodeMapServerError, "Map server is not available", nil)
 			return
 		}
 		defer resp.Body.Close()
@@ -575,19 +952,16 @@ func (s *Server) handleGetMap() http.HandlerFunc {
 		w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
 		// w.Header().Set("Content-Length", resp.Header.Get("Content-Length"))
 		io.Copy(w, resp.Body)
+		s.metrics.mapDuration.WithLabelValues(strconv.Itoa(resp.StatusCode)).Observe(time.Since(start).Seconds())
+		sp.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
 	}
 }
 
 func (s *Server) handleCacheDelete() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		user := r.Context().Value(contextKeyUser).(*User)
 		username := chi.URLParam(r, "user")
 		directory := chi.URLParam(r, "directory")
 		projectName := chi.URLParam(r, "name")
-		if !user.IsSuperuser && user.Username != username {
-			http.Error(w, "Forbidden", http.StatusForbidden)
-			return
-		}
 		projectPath := filepath.Join(username, directory, projectName)
 		cacheName := fmt.Sprintf("%x", md5.Sum([]byte(projectPath)))
 		cacheDir := filepath.Join(s.config.MapCacheRoot, cacheName)
@@ -595,16 +969,16 @@ func (s *Server) handleCacheDelete() http.HandlerFunc {
 
 		if err := os.Rename(cacheDir, tmpDir); err != nil {
 			if !os.IsNotExist(err) {
-				log.Printf("Failed to delete map cache of project: %s (%s)\n", projectPath, err)
-				http.Error(w, "Server error", http.StatusInternalServerError)
+				s.errorf(r, "Failed to delete map cache of project: %s (%s)\n", projectPath, err)
+				s.serverError(w, r)
 				return
 			}
 		} else {
 			// delete asynchronosly
 			go func() {
-				fmt.Println("Removing obsole cache directory:", tmpDir)
+				s.infof(r, "Removing obsolete cache directory: %s\n", tmpDir)
 				if err := os.RemoveAll(tmpDir); err != nil {
-					log.Printf("Failed to delete map cache of project: %s (%s)\n", projectPath, err)
+					s.errorf(r, "Failed to delete map cache of project: %s (%s)\n", projectPath, err)
 				}
 			}()
 		}
@@ -612,6 +986,18 @@ func (s *Server) handleCacheDelete() http.HandlerFunc {
 	}
 }
 
+// handleLogout proxies logout request to the app server and invalidates
+// cached authentication of the session
+func (s *Server) handleLogout() http.HandlerFunc {
+	proxy := s.handleProxyRequest()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if session := s.authenticator.CacheKey(r); session != "" {
+			s.InvalidateSession(session)
+		}
+		proxy(w, r)
+	}
+}
+
 func (s *Server) handleProxyRequest() http.HandlerFunc {
 	appServerURL, _ := url.Parse(s.config.AppServer)
 	proxy := httputil.NewSingleHostReverseProxy(appServerURL)
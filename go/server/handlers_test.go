@@ -0,0 +1,235 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gislab-npo/gisquick-settings/fs"
+)
+
+// setupProject writes files of user1/project
+func setupProject(t *testing.T, s *Server) {
+	t.Helper()
+	for p, content := range map[string]string{
+		"project.qgs":  "<qgis/>",
+		"data/a.gpkg":  "a",
+		"data/b.gpkg":  "b",
+		"styles/c.qml": "c",
+	} {
+		writeFile(t, s, "user1/project/"+p, content)
+	}
+}
+
+func sortedKeys(m map[string]string) string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+func TestUploadRemoves(t *testing.T) {
+	tests := []struct {
+		name    string
+		changes projectChanges
+		files   string
+	}{
+		{"no changes", projectChanges{}, "data/a.gpkg,data/b.gpkg,new.txt,project.qgs,styles/c.qml"},
+		{"removes", projectChanges{Removes: []string{"data/a.gpkg", "styles/c.qml", "missing.txt"}}, "data/b.gpkg,new.txt,project.qgs"},
+		{
+			"manifest",
+			projectChanges{Manifest: []fs.File{{Path: "project.qgs", Size: 7}, {Path: "data/b.gpkg", Size: 1}}},
+			"data/b.gpkg,new.txt,project.qgs",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, Settings{}, testUser)
+			setupProject(t, s)
+			info := map[string]interface{}{
+				"files":    []fs.File{declaredFile("new.txt", "new")},
+				"removes":  tt.changes.Removes,
+				"manifest": tt.changes.Manifest,
+			}
+			if w := multipartUpload(t, s, "", info, uploadPart{"new.txt", "new"}); w.Code != http.StatusOK {
+				t.Fatalf("upload: %d %s", w.Code, w.Body)
+			}
+			if files := sortedKeys(projectFiles(t, s)); files != tt.files {
+				t.Errorf("project files: %s, want %s", files, tt.files)
+			}
+		})
+	}
+}
+
+func TestUploadDryRun(t *testing.T) {
+	s := newTestServer(t, Settings{}, testUser)
+	setupProject(t, s)
+	before := projectFiles(t, s)
+	info := map[string]interface{}{
+		"files":    []fs.File{declaredFile("data/a.gpkg", "new a")},
+		"manifest": []fs.File{{Path: "project.qgs", Size: 7}},
+	}
+	check := func(name string, w *httptest.ResponseRecorder) {
+		t.Helper()
+		var resp struct {
+			Removes []string `json:"removes"`
+		}
+		if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &resp) != nil {
+			t.Fatalf("%s: %d %s", name, w.Code, w.Body)
+		}
+		sort.Strings(resp.Removes)
+		if strings.Join(resp.Removes, ",") != "data/b.gpkg,styles/c.qml" {
+			t.Errorf("%s removes: %v", name, resp.Removes)
+		}
+		after := projectFiles(t, s)
+		if sortedKeys(after) != sortedKeys(before) || after["data/a.gpkg"] != "a" {
+			t.Errorf("%s changed project files: %v", name, after)
+		}
+	}
+	check("upload", multipartUpload(t, s, "?dry_run=true", info, uploadPart{"data/a.gpkg", "new a"}))
+
+	data, _ := json.Marshal(info)
+	w := request(s, "POST", uploadsURL+"?dry_run=1", "user1", strings.NewReader(string(data)), map[string]string{"Content-Type": "application/json"})
+	check("upload session", w)
+	if sessions, err := s.listUploadSessions("user1", "project"); err != nil || len(sessions) != 0 {
+		t.Errorf("dry run created upload session: %v, %v", sessions, err)
+	}
+}
+
+func TestUploadProjectChangesConflict(t *testing.T) {
+	tests := []struct {
+		name    string
+		changes map[string]interface{}
+	}{
+		{"removed uploaded file", map[string]interface{}{"removes": []string{"data/a.gpkg"}}},
+		{"size in manifest", map[string]interface{}{"manifest": []fs.File{{Path: "data/a.gpkg", Size: 1}}}},
+		{"hash in manifest", map[string]interface{}{"manifest": []fs.File{{Path: "data/a.gpkg", Size: 5, Hash: sha1Hex("old a")}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, Settings{}, testUser)
+			setupProject(t, s)
+			info := map[string]interface{}{"files": []fs.File{declaredFile("data/a.gpkg", "new a")}}
+			for k, v := range tt.changes {
+				info[k] = v
+			}
+			w := multipartUpload(t, s, "", info, uploadPart{"data/a.gpkg", "new a"})
+			if w.Code != http.StatusBadRequest || errorCode(w) != errCodeBadRequest || !strings.Contains(w.Body.String(), `"path":"data/a.gpkg"`) {
+				t.Errorf("upload: %d %s", w.Code, w.Body)
+			}
+			data, _ := json.Marshal(info)
+			w = request(s, "POST", uploadsURL, "user1", strings.NewReader(string(data)), map[string]string{"Content-Type": "application/json"})
+			if w.Code != http.StatusBadRequest || errorCode(w) != errCodeBadRequest {
+				t.Errorf("upload session: %d %s", w.Code, w.Body)
+			}
+			if projectFiles(t, s)["data/a.gpkg"] != "a" {
+				t.Error("rejected upload changed project files")
+			}
+		})
+	}
+}
+
+func TestProjectDiff(t *testing.T) {
+	s := newTestServer(t, Settings{}, testUser)
+	setupProject(t, s)
+	tests := []struct {
+		name  string
+		files []fs.File
+		// expected paths of new, modified, deleted and identical files
+		changes [4]string
+	}{
+		{
+			"changes",
+			[]fs.File{declaredFile("project.qgs", "<qgis/>"), declaredFile("data/a.gpkg", "new"), declaredFile("data/d.gpkg", "d")},
+			[4]string{"data/d.gpkg", "data/a.gpkg", "data/b.gpkg,styles/c.qml", "project.qgs"},
+		},
+		{
+			"same size",
+			[]fs.File{declaredFile("project.qgs", "<qgis/>"), declaredFile("data/a.gpkg", "x"), declaredFile("data/b.gpkg", "b"), declaredFile("styles/c.qml", "c")},
+			[4]string{"", "data/a.gpkg", "", "data/b.gpkg,project.qgs,styles/c.qml"},
+		},
+		{
+			"compressed project",
+			[]fs.File{declaredFile("project.qgz", "qgz")},
+			[4]string{"project.qgz", "", "data/a.gpkg,data/b.gpkg,styles/c.qml", ""},
+		},
+	}
+	paths := func(files []fs.File) string {
+		p := make([]string, len(files))
+		for i, f := range files {
+			p[i] = f.Path
+		}
+		sort.Strings(p)
+		return strings.Join(p, ",")
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, _ := json.Marshal(map[string]interface{}{"files": tt.files})
+			w := request(s, "POST", "/api/project/diff/user1/project", "user1", strings.NewReader(string(data)), nil)
+			var c fs.FilesChanges
+			if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &c) != nil {
+				t.Fatalf("diff: %d %s", w.Code, w.Body)
+			}
+			got := [4]string{paths(c.New), paths(c.Modified), paths(c.Deleted), paths(c.Identical)}
+			if got != tt.changes {
+				t.Errorf("diff = %q, want %q", got, tt.changes)
+			}
+		})
+	}
+
+	data := `{"files": [{"path": "project.qgs", "size": 7, "hash": "x", "algorithm": "md5"}]}`
+	w := request(s, "POST", "/api/project/diff/user1/project", "user1", strings.NewReader(data), nil)
+	if w.Code != http.StatusBadRequest || errorCode(w) != errCodeUnsupportedHash {
+		t.Errorf("unsupported algorithm: %d %s", w.Code, w.Body)
+	}
+
+	// missing project is compared as empty
+	data = `{"files": [{"path": "project.qgs", "size": 7}]}`
+	w = request(s, "POST", "/api/project/diff/user1/other", "user1", strings.NewReader(data), nil)
+	var c fs.FilesChanges
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &c) != nil || paths(c.New) != "project.qgs" {
+		t.Errorf("diff of missing project: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestProjectFilesHashAlgorithm(t *testing.T) {
+	s := newTestServer(t, Settings{}, testUser)
+	setupProject(t, s)
+	w := request(s, "GET", "/api/project/hash-algorithms", "user1", nil, nil)
+	var algorithms []string
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &algorithms) != nil || fs.NegotiateHashAlgorithm(algorithms) != fs.HashAlgorithms[0] {
+		t.Fatalf("hash algorithms: %d %s", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		query     string
+		algorithm string
+		hash      string
+	}{
+		{"", fs.SHA1, sha1Hex("a")},
+		{"?hash=sha1", fs.SHA1, sha1Hex("a")},
+		{"?hash=sha256", fs.SHA256, "ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb"},
+		{"?hash=xxh64", fs.XXHash, "d24ec4f1a98c6e5b"},
+	}
+	for _, tt := range tests {
+		w := request(s, "GET", "/api/project/files/user1/project"+tt.query, "user1", nil, nil)
+		var files []fs.File
+		if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &files) != nil {
+			t.Fatalf("files%s: %d %s", tt.query, w.Code, w.Body)
+		}
+		for _, f := range files {
+			if f.Path == "data/a.gpkg" && (f.Hash != tt.hash || f.Algorithm != tt.algorithm) {
+				t.Errorf("files%s: %+v", tt.query, f)
+			}
+		}
+	}
+	w = request(s, "GET", "/api/project/files/user1/project?hash=md5", "user1", nil, nil)
+	if w.Code != http.StatusBadRequest || errorCode(w) != errCodeUnsupportedHash {
+		t.Errorf("unsupported algorithm: %d %s", w.Code, w.Body)
+	}
+}
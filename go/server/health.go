@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+// readiness checks of dependencies are canceled after this timeout
+const readyCheckTimeout = 5 * time.Second
+
+// checkResult is a result of readiness check of a dependency
+type checkResult struct {
+	Status   string  `json:"status"`
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"duration_ms"`
+	// free space of directories (in bytes)
+	FreeSpace *int64 `json:"free_space,omitempty"`
+	// status code of HTTP services
+	StatusCode int `json:"status_code,omitempty"`
+}
+
+type readinessCheck func(ctx context.Context, result *checkResult) error
+
+// errFreeSpaceUnsupported is returned by freeSpace on platforms where free
+// space can't be determined (it's not checked there)
+var errFreeSpaceUnsupported = errors.New("free space is not supported on this platform")
+
+// checkDirectory checks that directory is writable and has enough free space
+func (s *Server) checkDirectory(dir string) readinessCheck {
+	return func(ctx context.Context, result *checkResult) error {
+		if err := checkWritableDir(dir); err != nil {
+			return err
+		}
+		free, err := freeSpace(dir)
+		if err == errFreeSpaceUnsupported {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		result.FreeSpace = &free
+		if free < s.config.MinFreeSpace {
+			return fmt.Errorf("free space is below %d bytes", s.config.MinFreeSpace)
+		}
+		return nil
+	}
+}
+
+// checkStorage checks that remote storage responds (missing file is
+// a valid response)
+func (s *Server) checkStorage(ctx context.Context, result *checkResult) error {
+	if _, err := s.storage.Stat(".gisquick/readiness-check"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// checkService checks that HTTP service responds, server errors are failures
+// unless allowServerError is set
+func checkService(url string, allowServerError bool) readinessCheck {
+	client := &http.Client{}
+	return func(ctx context.Context, result *checkResult) error {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		result.StatusCode = resp.StatusCode
+		if resp.StatusCode >= 500 && !allowServerError {
+			return fmt.Errorf("service responded with status %d", resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// readinessChecks returns checks of server's dependencies by their names
+func (s *Server) readinessChecks() map[string]readinessCheck {
+	checks := make(map[string]readinessCheck)
+	if s.config.Storage == "" || s.config.Storage == "local" {
+		checks["projects_root"] = s.checkDirectory(s.config.ProjectsRoot)
+	} else {
+		checks["projects_storage"] = s.checkStorage
+	}
+	if s.config.MapCacheRoot != "" {
+		checks["map_cache_root"] = s.checkDirectory(s.config.MapCacheRoot)
+	}
+	if a, ok := s.authenticator.(*AppServerAuthenticator); ok {
+		checks["app_server"] = checkService(a.URL+"/api/auth/user/", false)
+	}
+	if s.config.MapServer != "" {
+		// QGIS server responds with error to requests without project
+		checks["map_server"] = checkService(s.config.MapServer, true)
+	}
+	return checks
+}
+
+// handleHealth reports that server is running (liveness)
+func (s *Server) handleHealth() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.jsonResponse(w, map[string]string{"status": "ok"})
+	}
+}
+
+// handleReady checks dependencies of the server (readiness), it responds
+// with status 503 when some check fails
+func (s *Server) handleReady() http.HandlerFunc {
+	checks := s.readinessChecks()
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readyCheckTimeout)
+		defer cancel()
+		type namedResult struct {
+			name   string
+			result *checkResult
+		}
+		finished := make(chan namedResult, len(checks))
+		for name, check := range checks {
+			go func(name string, check readinessCheck) {
+				start := time.Now()
+				result := &checkResult{Status: "ok"}
+				if err := check(ctx, result); err != nil {
+					result.Status = "fail"
+					result.Error = err.Error()
+				}
+				result.Duration = milliseconds(time.Since(start))
+				finished <- namedResult{name, result}
+			}(name, check)
+		}
+		results := make(map[string]*checkResult, len(checks))
+	wait:
+		for len(results) < len(checks) {
+			select {
+			case res := <-finished:
+				results[res.name] = res.result
+			case <-ctx.Done():
+				break wait
+			}
+		}
+		// checks which didn't finish in time
+		for name := range checks {
+			if _, ok := results[name]; !ok {
+				results[name] = &checkResult{Status: "fail", Error: "timeout", Duration: milliseconds(readyCheckTimeout)}
+			}
+		}
+
+		status := "ok"
+		for name, result := range results {
+			if result.Status != "ok" {
+				s.errorf(r, "Readiness check failed: %s (%s)\n", name, result.Error)
+				status = "fail"
+			}
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		if status != "ok" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		s.jsonResponse(w, map[string]interface{}{"status": status, "checks": results})
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+type readyResponse struct {
+	Status string                  `json:"status"`
+	Checks map[string]*checkResult `json:"checks"`
+}
+
+func checkReady(t *testing.T, s *Server, status int) readyResponse {
+	t.Helper()
+	w := request(s, "GET", "/readyz", "", nil, nil)
+	var resp readyResponse
+	if w.Code != status || json.Unmarshal(w.Body.Bytes(), &resp) != nil {
+		t.Fatalf("readyz: %d %s", w.Code, w.Body)
+	}
+	if w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("readyz is cacheable: %v", w.Header())
+	}
+	return resp
+}
+
+func TestHealth(t *testing.T) {
+	s := newTestServer(t, Settings{})
+	w := request(s, "GET", "/healthz", "", nil, nil)
+	if w.Code != http.StatusOK || w.Body.String() != "{\"status\":\"ok\"}\n" {
+		t.Errorf("healthz: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestReady(t *testing.T) {
+	appStatus := int32(http.StatusUnauthorized)
+	appServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/auth/user/" {
+			t.Errorf("unexpected request of app server: %s", r.URL.Path)
+		}
+		w.WriteHeader(int(atomic.LoadInt32(&appStatus)))
+	}))
+	defer appServer.Close()
+	mapServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer mapServer.Close()
+	config := Config{
+		Authenticator: NewAppServerAuthenticator(appServer.URL, "", nil),
+		MapServer:     mapServer.URL,
+	}
+
+	s := newTestServerConfig(t, config)
+	resp := checkReady(t, s, http.StatusOK)
+	names := []string{"projects_root", "map_cache_root", "app_server", "map_server"}
+	for _, name := range names {
+		if c := resp.Checks[name]; c == nil || c.Status != "ok" {
+			t.Errorf("check %s: %+v", name, c)
+		}
+	}
+	if c := resp.Checks["projects_root"]; c.FreeSpace != nil && *c.FreeSpace <= 0 {
+		t.Errorf("free space: %d", *c.FreeSpace)
+	}
+	if resp.Checks["map_server"].StatusCode != http.StatusInternalServerError || resp.Checks["app_server"].StatusCode != http.StatusUnauthorized {
+		t.Errorf("status codes of services: %+v %+v", resp.Checks["map_server"], resp.Checks["app_server"])
+	}
+
+	// failures of dependencies
+	config.MinFreeSpace = 1 << 62
+	config.MapCacheRoot = filepath.Join(t.TempDir(), "missing")
+	atomic.StoreInt32(&appStatus, http.StatusBadGateway)
+	s = newTestServerConfig(t, config)
+	resp = checkReady(t, s, http.StatusServiceUnavailable)
+	if resp.Status != "fail" {
+		t.Errorf("status: %s", resp.Status)
+	}
+	for _, name := range []string{"map_cache_root", "app_server"} {
+		if c := resp.Checks[name]; c == nil || c.Status != "fail" || c.Error == "" {
+			t.Errorf("check %s: %+v", name, c)
+		}
+	}
+	if c := resp.Checks["projects_root"]; c.FreeSpace != nil && c.Status != "fail" {
+		t.Errorf("free space below limit: %+v", c)
+	}
+	if c := resp.Checks["map_server"]; c.Status != "ok" {
+		t.Errorf("server error of map server: %+v", c)
+	}
+}
@@ -0,0 +1,396 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// JWTConfig export
+type JWTConfig struct {
+	// Expected issuer of tokens ("iss" claim)
+	Issuer string
+	// Expected audience of tokens ("aud" claim), it's required, so tokens
+	// issued for other clients of the issuer are not accepted
+	Audience string
+	// Source of JWKS with keys of the issuer - file or URL. When both are
+	// empty, URL is discovered from issuer's OpenID configuration.
+	JWKSFile string
+	JWKSURL  string
+	// Allowed clock skew when checking time claims
+	Leeway time.Duration
+	// Claims mapped to user (nested claims can be given by path with dots)
+	UsernameClaim string
+	GroupsClaim   string
+	// Users are superusers when boolean claim is true or when they are
+	// members of the group
+	SuperuserClaim string
+	SuperuserGroup string
+}
+
+// minimal interval of reloading keys when token is signed by unknown key
+const jwksMinRefresh = time.Minute
+
+// keys are reloaded periodically to get rotated keys of the issuer
+const jwksMaxAge = time.Hour
+
+// jwksRetry is a delay of reloading keys after failure, it's doubled with
+// each consecutive failure up to jwksMinRefresh
+const jwksRetry = time.Second
+
+// Supported signing algorithms (symmetric algorithms and "none" are not
+// supported)
+var jwtAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+// parseJWKS returns public signing keys of JWKS, unsupported keys are
+// skipped
+func (a *JWTAuthenticator) parseJWKS(r io.Reader) ([]jose.JSONWebKey, error) {
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.NewDecoder(r).Decode(&set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %s", err)
+	}
+	keys := make([]jose.JSONWebKey, 0, len(set.Keys))
+	for _, data := range set.Keys {
+		var k jose.JSONWebKey
+		if err := k.UnmarshalJSON(data); err != nil {
+			a.errorf(nil, "Skipping JWKS key: %s\n", err)
+			continue
+		}
+		if (k.Use != "" && k.Use != "sig") || !k.IsPublic() || !k.Valid() {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS has no usable keys")
+	}
+	return keys, nil
+}
+
+// JWTAuthenticator authenticates users by JWT access tokens (given as Bearer
+// tokens) signed by keys of configured issuer
+type JWTAuthenticator struct {
+	config JWTConfig
+	client *http.Client
+	mutex  sync.Mutex
+	keys   []jose.JSONWebKey
+	loaded time.Time
+	// last failure of loading keys and time of the next attempt
+	loadErr  error
+	failures int
+	retry    time.Time
+	// Errorf logs errors which don't fail the authentication (invalid
+	// tokens, failed reloading of keys), r is nil for errors not related to
+	// a request (nil Errorf discards errors)
+	Errorf func(r *http.Request, format string, v ...interface{})
+}
+
+func (a *JWTAuthenticator) errorf(r *http.Request, format string, v ...interface{}) {
+	if a.Errorf != nil {
+		a.Errorf(r, format, v...)
+	}
+}
+
+// NewJWTAuthenticator export
+func NewJWTAuthenticator(config JWTConfig, client *http.Client) (*JWTAuthenticator, error) {
+	if config.Issuer == "" {
+		return nil, errors.New("Missing JWT issuer")
+	}
+	if config.Audience == "" {
+		return nil, errors.New("Missing JWT audience")
+	}
+	if config.UsernameClaim == "" {
+		config.UsernameClaim = "preferred_username"
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+	if config.SuperuserClaim == "" {
+		config.SuperuserClaim = "is_superuser"
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	a := &JWTAuthenticator{config: config, client: client}
+	// keys from file are loaded immediately to detect configuration errors
+	if config.JWKSFile != "" {
+		if err := a.loadKeys(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// fetch returns body of successful response of GET request
+func (a *JWTAuthenticator) fetch(url string) (io.ReadCloser, error) {
+	resp, err := a.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// jwksURL returns configured URL of JWKS or URL discovered from OpenID
+// configuration of the issuer
+func (a *JWTAuthenticator) jwksURL() (string, error) {
+	if a.config.JWKSURL != "" {
+		return a.config.JWKSURL, nil
+	}
+	var oidc struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	discoveryURL := strings.TrimSuffix(a.config.Issuer, "/") + "/.well-known/openid-configuration"
+	body, err := a.fetch(discoveryURL)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	if err = json.NewDecoder(body).Decode(&oidc); err != nil {
+		return "", err
+	}
+	if oidc.Issuer != a.config.Issuer || oidc.JWKSURI == "" {
+		return "", fmt.Errorf("Invalid OpenID configuration of issuer: %s", a.config.Issuer)
+	}
+	return oidc.JWKSURI, nil
+}
+
+// loadKeys loads keys from JWKS file or URL (must be called with locked mutex
+// or before authenticator is used)
+func (a *JWTAuthenticator) loadKeys() error {
+	var source io.ReadCloser
+	var err error
+	if a.config.JWKSFile != "" {
+		source, err = os.Open(a.config.JWKSFile)
+	} else {
+		var url string
+		if url, err = a.jwksURL(); err == nil {
+			source, err = a.fetch(url)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	keys, err := a.parseJWKS(source)
+	if err != nil {
+		return err
+	}
+	a.keys = keys
+	a.loaded = time.Now()
+	return nil
+}
+
+// reloadKeys loads keys unless the last attempt has failed recently, failed
+// loading is retried with exponential backoff (must be called with locked
+// mutex)
+func (a *JWTAuthenticator) reloadKeys() error {
+	if a.loadErr != nil && time.Now().Before(a.retry) {
+		return a.loadErr
+	}
+	if err := a.loadKeys(); err != nil {
+		delay := jwksMinRefresh
+		if a.failures < 6 {
+			delay = jwksRetry << a.failures
+		}
+		a.failures++
+		a.loadErr = err
+		a.retry = time.Now().Add(delay)
+		return err
+	}
+	a.loadErr = nil
+	a.failures = 0
+	return nil
+}
+
+// signingKeys returns keys which can be used to verify token with given key
+// ID and algorithm. Keys are reloaded when they are outdated (outdated keys
+// are used when reloading fails) or when there is no matching key (rate
+// limited).
+func (a *JWTAuthenticator) signingKeys(kid, alg string) ([]jose.JSONWebKey, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.keys == nil || time.Since(a.loaded) > jwksMaxAge {
+		if err := a.reloadKeys(); err != nil {
+			if a.keys == nil {
+				return nil, err
+			}
+			a.errorf(nil, "Failed to reload JWKS: %s\n", err)
+		}
+	}
+	keys := matchingKeys(a.keys, kid, alg)
+	if len(keys) == 0 && time.Since(a.loaded) > jwksMinRefresh {
+		if err := a.reloadKeys(); err != nil {
+			return nil, err
+		}
+		keys = matchingKeys(a.keys, kid, alg)
+	}
+	return keys, nil
+}
+
+func matchingKeys(keys []jose.JSONWebKey, kid, alg string) []jose.JSONWebKey {
+	var matching []jose.JSONWebKey
+	for _, k := range keys {
+		if (kid == "" || k.KeyID == "" || k.KeyID == kid) && (k.Algorithm == "" || k.Algorithm == alg) {
+			matching = append(matching, k)
+		}
+	}
+	return matching
+}
+
+// jwtError is an error of invalid token (user is not authenticated)
+type jwtError struct {
+	reason string
+}
+
+func (e *jwtError) Error() string {
+	return "invalid JWT: " + e.reason
+}
+
+// verify checks signature and claims of the token and returns its claims
+func (a *JWTAuthenticator) verify(token string) (map[string]interface{}, error) {
+	parsed, err := jwt.ParseSigned(token, jwtAlgorithms)
+	if err != nil {
+		return nil, &jwtError{err.Error()}
+	}
+	header := parsed.Headers[0]
+	keys, err := a.signingKeys(header.KeyID, header.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	var std jwt.Claims
+	var claims map[string]interface{}
+	verified := false
+	for _, k := range keys {
+		if parsed.Claims(k, &std, &claims) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, &jwtError{"invalid signature"}
+	}
+	if std.Expiry == nil {
+		return nil, &jwtError{"missing expiration"}
+	}
+	expected := jwt.Expected{Issuer: a.config.Issuer, AnyAudience: jwt.Audience{a.config.Audience}}
+	if err = std.ValidateWithLeeway(expected, a.config.Leeway); err != nil {
+		return nil, &jwtError{err.Error()}
+	}
+	return claims, nil
+}
+
+// claimValue returns value of the claim given by path with dots
+func claimValue(claims map[string]interface{}, path string) interface{} {
+	var value interface{} = claims
+	for _, name := range strings.Split(path, ".") {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = obj[name]
+	}
+	return value
+}
+
+func claimString(claims map[string]interface{}, path string) string {
+	value, _ := claimValue(claims, path).(string)
+	return value
+}
+
+// claimStrings returns value of the claim with list of strings (or single
+// string)
+func claimStrings(claims map[string]interface{}, path string) []string {
+	switch v := claimValue(claims, path).(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// claimsUser maps claims of the token to user
+func (a *JWTAuthenticator) claimsUser(claims map[string]interface{}) (*User, error) {
+	user := &User{
+		Username:  claimString(claims, a.config.UsernameClaim),
+		FirstName: claimString(claims, "given_name"),
+		LastName:  claimString(claims, "family_name"),
+		Email:     claimString(claims, "email"),
+		Groups:    claimStrings(claims, a.config.GroupsClaim),
+	}
+	if user.Username == "" {
+		return nil, &jwtError{"missing username claim " + a.config.UsernameClaim}
+	}
+	// username is used in storage paths (projects, tokens, snapshots)
+	if err := checkUsername(user.Username); err != nil {
+		return nil, &jwtError{"invalid username claim: " + err.Error()}
+	}
+	if superuser, _ := claimValue(claims, a.config.SuperuserClaim).(bool); superuser {
+		user.IsSuperuser = true
+	}
+	if a.config.SuperuserGroup != "" {
+		for _, group := range user.Groups {
+			if group == a.config.SuperuserGroup {
+				user.IsSuperuser = true
+			}
+		}
+	}
+	return user, nil
+}
+
+// Authenticate returns user of valid Bearer token (nil user when request has
+// no token or token is invalid)
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (*User, error) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) <= 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return nil, nil
+	}
+	claims, err := a.verify(strings.TrimSpace(auth[7:]))
+	var user *User
+	if err == nil {
+		user, err = a.claimsUser(claims)
+	}
+	if err != nil {
+		if _, ok := err.(*jwtError); ok {
+			a.errorf(r, "Authentication failed: %s\n", err)
+			return nil, nil
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// CacheKey returns empty key, tokens are verified locally and their
+// verification is not cached
+func (a *JWTAuthenticator) CacheKey(r *http.Request) string {
+	return ""
+}
@@ -0,0 +1,294 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+const testIssuer = "https://sso.example.com"
+
+var (
+	testRSAKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	testECKey, _  = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+)
+
+// testJWKS returns JWKS with public keys of test keys
+func testJWKS() []byte {
+	set := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &testRSAKey.PublicKey, KeyID: "rsa", Algorithm: "RS256", Use: "sig"},
+		{Key: &testECKey.PublicKey, KeyID: "ec", Use: "sig"},
+	}}
+	data, _ := json.Marshal(set)
+	return data
+}
+
+func newTestJWTAuthenticator(t *testing.T, config JWTConfig) *JWTAuthenticator {
+	t.Helper()
+	config.Issuer = testIssuer
+	if config.Audience == "" {
+		config.Audience = "gisquick"
+	}
+	if config.JWKSURL == "" {
+		config.JWKSFile = filepath.Join(t.TempDir(), "jwks.json")
+		if err := ioutil.WriteFile(config.JWKSFile, testJWKS(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, err := NewJWTAuthenticator(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// signToken returns token with claims signed by the key
+func signToken(t *testing.T, alg jose.SignatureAlgorithm, key interface{}, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	opts := (&jose.SignerOptions{}).WithType("JWT")
+	if kid != "" {
+		opts = opts.WithHeader("kid", kid)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(signer).Claims(claims).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// testClaims returns valid claims with given changes (nil value removes
+// the claim)
+func testClaims(changes map[string]interface{}) map[string]interface{} {
+	claims := map[string]interface{}{
+		"iss":                testIssuer,
+		"aud":                "gisquick",
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"preferred_username": "user1",
+	}
+	for k, v := range changes {
+		if v == nil {
+			delete(claims, k)
+		} else {
+			claims[k] = v
+		}
+	}
+	return claims
+}
+
+func authenticateToken(a *JWTAuthenticator, token string) (*User, error) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return a.Authenticate(r)
+}
+
+func TestJWTClaims(t *testing.T) {
+	a := newTestJWTAuthenticator(t, JWTConfig{Audience: "gisquick", Leeway: time.Minute, SuperuserGroup: "admins"})
+	now := time.Now()
+	tests := []struct {
+		name    string
+		changes map[string]interface{}
+		valid   bool
+	}{
+		{"valid", nil, true},
+		{"audience in list", map[string]interface{}{"aud": []string{"other", "gisquick"}}, true},
+		{"expired within leeway", map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()}, true},
+		{"expired", map[string]interface{}{"exp": now.Add(-2 * time.Minute).Unix()}, false},
+		{"missing expiration", map[string]interface{}{"exp": nil}, false},
+		{"not valid yet within leeway", map[string]interface{}{"nbf": now.Add(30 * time.Second).Unix()}, true},
+		{"not valid yet", map[string]interface{}{"nbf": now.Add(2 * time.Minute).Unix()}, false},
+		{"invalid issuer", map[string]interface{}{"iss": "https://evil.example.com"}, false},
+		{"missing issuer", map[string]interface{}{"iss": nil}, false},
+		{"invalid audience", map[string]interface{}{"aud": "other"}, false},
+		{"missing audience", map[string]interface{}{"aud": nil}, false},
+		{"missing username", map[string]interface{}{"preferred_username": nil}, false},
+		{"username with parent directory", map[string]interface{}{"preferred_username": ".."}, false},
+		{"username with path", map[string]interface{}{"preferred_username": "user1/../user2"}, false},
+		{"username with slash", map[string]interface{}{"preferred_username": "a/b"}, false},
+		{"reserved username", map[string]interface{}{"preferred_username": ".gisquick"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := signToken(t, jose.RS256, testRSAKey, "rsa", testClaims(tt.changes))
+			user, err := authenticateToken(a, token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (user != nil) != tt.valid {
+				t.Errorf("Authenticate() = %+v, want valid: %v", user, tt.valid)
+			}
+		})
+	}
+
+	token := signToken(t, jose.ES256, testECKey, "", testClaims(map[string]interface{}{"groups": []string{"team", "admins"}, "email": "user1@example.com"}))
+	user, err := authenticateToken(a, token)
+	if err != nil || user == nil {
+		t.Fatalf("Authenticate() = %+v, %v", user, err)
+	}
+	if user.Username != "user1" || user.Email != "user1@example.com" || !user.IsSuperuser || len(user.Groups) != 2 {
+		t.Errorf("Authenticate() = %+v", user)
+	}
+}
+
+func TestJWTAudience(t *testing.T) {
+	if _, err := NewJWTAuthenticator(JWTConfig{Issuer: testIssuer, JWKSURL: "https://sso.example.com/jwks"}, nil); err == nil {
+		t.Error("authenticator without audience was created")
+	}
+	a := newTestJWTAuthenticator(t, JWTConfig{})
+	// token issued for other client of the same issuer
+	for _, aud := range []interface{}{"other-client", []string{"other-client", "account"}} {
+		token := signToken(t, jose.RS256, testRSAKey, "rsa", testClaims(map[string]interface{}{"aud": aud, "azp": "other-client"}))
+		if user, err := authenticateToken(a, token); user != nil || err != nil {
+			t.Errorf("Authenticate() with audience %v = %+v, %v", aud, user, err)
+		}
+	}
+}
+
+func TestJWTAlgorithms(t *testing.T) {
+	a := newTestJWTAuthenticator(t, JWTConfig{})
+	claims := testClaims(nil)
+	encode := func(v interface{}) string {
+		data, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	publicKey, _ := x509.MarshalPKIXPublicKey(&testRSAKey.PublicKey)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	tests := map[string]string{
+		"none algorithm": encode(map[string]string{"alg": "none"}) + "." + encode(claims) + ".",
+		// HMAC with public key as the secret
+		"symmetric algorithm":         signToken(t, jose.HS256, publicKey, "rsa", claims),
+		"symmetric algorithm modulus": signToken(t, jose.HS256, testRSAKey.PublicKey.N.Bytes(), "", claims),
+		// RSA key of JWKS is restricted to RS256
+		"algorithm of key": signToken(t, jose.PS256, testRSAKey, "rsa", claims),
+		"key type":         signToken(t, jose.ES256, testECKey, "rsa", claims),
+		"unknown key":      signToken(t, jose.RS256, otherKey, "rsa", claims),
+		"unknown kid":      signToken(t, jose.RS256, testRSAKey, "other", claims),
+		"malformed":        "a.b.c",
+	}
+	var logged *http.Request
+	a.Errorf = func(r *http.Request, format string, v ...interface{}) {
+		logged = r
+	}
+	for name, token := range tests {
+		t.Run(name, func(t *testing.T) {
+			logged = nil
+			if user, err := authenticateToken(a, token); user != nil || err != nil {
+				t.Errorf("Authenticate() = %+v, %v", user, err)
+			}
+			if logged == nil {
+				t.Error("invalid token was not logged with the request")
+			}
+		})
+	}
+}
+
+func TestJWKSRefresh(t *testing.T) {
+	var requests int32
+	var failing atomic.Value
+	failing.Store(false)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if failing.Load().(bool) {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(testJWKS())
+	}))
+	defer server.Close()
+
+	a := newTestJWTAuthenticator(t, JWTConfig{JWKSURL: server.URL})
+	valid := signToken(t, jose.RS256, testRSAKey, "rsa", testClaims(nil))
+	unknown := signToken(t, jose.RS256, testRSAKey, "rotated", testClaims(nil))
+	for i := 0; i < 3; i++ {
+		if user, err := authenticateToken(a, valid); user == nil || err != nil {
+			t.Fatalf("Authenticate() = %+v, %v", user, err)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("JWKS was loaded %d times", requests)
+	}
+
+	// unknown key ID reloads keys at most once per jwksMinRefresh
+	authenticateToken(a, unknown)
+	if requests != 1 {
+		t.Errorf("JWKS was reloaded too early (requests: %d)", requests)
+	}
+	a.loaded = a.loaded.Add(-2 * jwksMinRefresh)
+	authenticateToken(a, unknown)
+	authenticateToken(a, unknown)
+	if requests != 2 {
+		t.Errorf("JWKS was not reloaded once for unknown key (requests: %d)", requests)
+	}
+
+	// outdated keys are used when reloading fails, failures are retried
+	// with backoff
+	var reloadErrors int
+	a.Errorf = func(r *http.Request, format string, v ...interface{}) {
+		if r == nil {
+			reloadErrors++
+		}
+	}
+	failing.Store(true)
+	a.loaded = a.loaded.Add(-2 * jwksMaxAge)
+	for i := 0; i < 3; i++ {
+		if user, err := authenticateToken(a, valid); user == nil || err != nil {
+			t.Fatalf("Authenticate() with outdated keys = %+v, %v", user, err)
+		}
+	}
+	if requests != 3 {
+		t.Errorf("failed loading was retried without backoff (requests: %d)", requests)
+	}
+	if reloadErrors == 0 {
+		t.Error("failed reloading of keys was not logged")
+	}
+	a.retry = time.Now()
+	authenticateToken(a, valid)
+	if requests != 4 || time.Until(a.retry) < jwksRetry {
+		t.Errorf("failed loading was not retried with longer delay (requests: %d, retry in %s)", requests, time.Until(a.retry))
+	}
+
+	failing.Store(false)
+	a.retry = time.Now()
+	authenticateToken(a, valid)
+	if requests != 5 || a.loadErr != nil || time.Since(a.loaded) > time.Minute {
+		t.Errorf("keys were not reloaded after failure (requests: %d, error: %v)", requests, a.loadErr)
+	}
+}
+
+func TestJWKSUnavailable(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	a := newTestJWTAuthenticator(t, JWTConfig{JWKSURL: server.URL})
+	token := signToken(t, jose.RS256, testRSAKey, "rsa", testClaims(nil))
+	for i := 0; i < 5; i++ {
+		if _, err := authenticateToken(a, token); err == nil {
+			t.Fatal("Authenticate() without keys succeeded")
+		}
+	}
+	if requests != 1 {
+		t.Errorf("failed JWKS was fetched %d times", requests)
+	}
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RequestIDHeader is a header with ID of the request, valid IDs received from
+// clients (or proxies) are reused, otherwise new ID is generated
+const RequestIDHeader = "X-Request-ID"
+
+var validRequestID = regexp.MustCompile(`^[\w.:/+=-]{1,128}$`)
+
+var contextKeyRequest = contextKey("request")
+
+// requestInfo is shared by middlewares and handlers of the request to
+// annotate its log entries
+type requestInfo struct {
+	ID string
+	// authenticated user
+	User string
+}
+
+// logEntry is a line of JSON log
+type logEntry struct {
+	Time      string `json:"time"`
+	Level     string `json:"level"`
+	Message   string `json:"msg"`
+	RequestID string `json:"request_id,omitempty"`
+	TraceID   string `json:"trace_id,omitempty"`
+	Method    string `json:"method,omitempty"`
+	Route     string `json:"route,omitempty"`
+	User      string `json:"user,omitempty"`
+	Project   string `json:"project,omitempty"`
+	// fields of access log
+	Path     string  `json:"path,omitempty"`
+	Status   int     `json:"status,omitempty"`
+	Bytes    int     `json:"bytes,omitempty"`
+	Duration float64 `json:"duration_ms,omitempty"`
+	Remote   string  `json:"remote,omitempty"`
+}
+
+var levelNames = map[int]string{logDebug: "debug", logInfo: "info", logError: "error"}
+
+// writeLogEntry writes entry to output of the standard logger
+func writeLogEntry(entry *logEntry) {
+	entry.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	log.Writer().Write(append(data, '\n'))
+}
+
+func newRequestID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestID is a middleware assigning ID to the request, the ID is sent in
+// response header
+func (s *Server) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		ctx := context.WithValue(r.Context(), contextKeyRequest, &requestInfo{ID: id})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// getRequestInfo returns info of the request (nil without requestID middleware)
+func getRequestInfo(r *http.Request) *requestInfo {
+	if r == nil {
+		return nil
+	}
+	info, _ := r.Context().Value(contextKeyRequest).(*requestInfo)
+	return info
+}
+
+// getRequestID returns ID of the request (empty without requestID middleware)
+func getRequestID(r *http.Request) string {
+	if info := getRequestInfo(r); info != nil {
+		return info.ID
+	}
+	return ""
+}
+
+// requestProject returns project accessed by the request (resolved by route's
+// access policy)
+func (s *Server) requestProject(r *http.Request, route string) string {
+	policy, ok := s.policies[r.Method+" "+route]
+	if !ok {
+		policy, ok = s.policies["* "+route]
+	}
+	if !ok || policy.project == nil {
+		return ""
+	}
+	username, directory, err := policy.project(r)
+	if err != nil || username == "" || directory == "" {
+		return ""
+	}
+	return path.Join(username, directory)
+}
+
+// requestEntry returns log entry with fields of the request (r can be nil)
+func (s *Server) requestEntry(r *http.Request, level int, msg string) *logEntry {
+	entry := &logEntry{Level: levelNames[level], Message: msg}
+	if r == nil {
+		return entry
+	}
+	entry.Method = r.Method
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		entry.Route = rctx.RoutePattern()
+	}
+	if info := getRequestInfo(r); info != nil {
+		entry.RequestID = info.ID
+		entry.User = info.User
+	}
+	if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+		entry.TraceID = sc.TraceID().String()
+	}
+	if entry.Route != "" {
+		entry.Project = s.requestProject(r, entry.Route)
+	}
+	return entry
+}
+
+// logf writes log entry of the request (r can be nil) when the level of
+// logging is enabled
+func (s *Server) logf(r *http.Request, level int, format string, v ...interface{}) {
+	if level < logLevels[s.settings().LogLevel] {
+		return
+	}
+	msg := strings.TrimSuffix(fmt.Sprintf(format, v...), "\n")
+	writeLogEntry(s.requestEntry(r, level, msg))
+}
+
+// debugf logs message when debug logging is enabled
+func (s *Server) debugf(r *http.Request, format string, v ...interface{}) {
+	s.logf(r, logDebug, format, v...)
+}
+
+// infof logs message when info logging is enabled
+func (s *Server) infof(r *http.Request, format string, v ...interface{}) {
+	s.logf(r, logInfo, format, v...)
+}
+
+// errorf logs error message
+func (s *Server) errorf(r *http.Request, format string, v ...interface{}) {
+	s.logf(r, logError, format, v...)
+}
+
+// responseStatus returns status code of written response
+func responseStatus(ww middleware.WrapResponseWriter, r *http.Request) int {
+	status := ww.Status()
+	if status == 0 {
+		// nothing was written or connection was hijacked by websocket
+		status = http.StatusOK
+		if websocket.IsWebSocketUpgrade(r) {
+			status = http.StatusSwitchingProtocols
+		}
+	}
+	return status
+}
+
+// requestLogger logs finished requests when info level of logging is enabled
+func (s *Server) requestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		if logLevels[s.settings().LogLevel] > logInfo {
+			return
+		}
+		entry := s.requestEntry(r, logInfo, "Request")
+		entry.Path = r.URL.Path
+		entry.Status = responseStatus(ww, r)
+		entry.Bytes = ww.BytesWritten()
+		entry.Duration = float64(time.Since(start).Microseconds()) / 1000
+		entry.Remote = r.RemoteAddr
+		writeLogEntry(entry)
+	})
+}
+
+// logWriter converts plain lines of the standard logger to JSON log entries
+type logWriter struct {
+	mutex sync.Mutex
+	out   io.Writer
+}
+
+// NewLogWriter returns writer for the standard logger (without flags), which
+// writes plain messages as JSON log entries of info level. Lines which are
+// already JSON log entries are written unchanged.
+func NewLogWriter(out io.Writer) io.Writer {
+	return &logWriter{out: out}
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	line := bytes.TrimSuffix(p, []byte("\n"))
+	if bytes.HasPrefix(line, []byte("{")) && json.Valid(line) {
+		_, err := w.out.Write(p)
+		return len(p), err
+	}
+	entry := logEntry{
+		Time:    time.Now().UTC().Format(time.RFC3339Nano),
+		Level:   levelNames[logInfo],
+		Message: string(line),
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = w.out.Write(append(data, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
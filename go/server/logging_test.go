@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// captureLog redirects output of the standard logger into buffer for the
+// rest of the test
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	out := log.Writer()
+	log.SetOutput(buf)
+	t.Cleanup(func() { log.SetOutput(out) })
+	return buf
+}
+
+// logEntries parses JSON lines of the log
+func logEntries(t *testing.T, buf *bytes.Buffer) []logEntry {
+	t.Helper()
+	var entries []logEntry
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry logEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid log line %q: %s", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestRequestID(t *testing.T) {
+	s := newTestServer(t, Settings{})
+	var handlerID string
+	handler := s.requestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerID = getRequestID(r)
+	}))
+	tests := []struct {
+		name   string
+		header string
+		reused bool
+	}{
+		{"valid", "req-1.a:b/c+d=e_f", true},
+		{"missing", "", false},
+		{"with spaces", "req 1", false},
+		{"with newline", "req1\nlevel=error", false},
+		{"with quotes", `req"1`, false},
+		{"oversized", strings.Repeat("a", 129), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.header != "" {
+				r.Header.Set(RequestIDHeader, tt.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			id := w.Header().Get(RequestIDHeader)
+			if id != handlerID {
+				t.Errorf("request ID of response %q doesn't match ID of request %q", id, handlerID)
+			}
+			if tt.reused && id != tt.header {
+				t.Errorf("valid request ID was replaced: %q", id)
+			}
+			if !tt.reused && (id == tt.header || !validRequestID.MatchString(id) || len(id) != 24) {
+				t.Errorf("request ID %q was not generated", id)
+			}
+		})
+	}
+}
+
+func TestRequestLogger(t *testing.T) {
+	s := newTestServer(t, Settings{LogLevel: "info"}, testUser)
+	writeFile(t, s, "user1/project/project.qgs", "<qgis/>")
+	buf := captureLog(t)
+
+	w := request(s, "GET", "/api/project/files/user1/project", "user1", nil, map[string]string{RequestIDHeader: "req-1"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("files: %d %s", w.Code, w.Body)
+	}
+	entries := logEntries(t, buf)
+	if len(entries) != 1 {
+		t.Fatalf("log entries: %s", buf)
+	}
+	entry := entries[0]
+	expected := logEntry{
+		Time:      entry.Time,
+		Level:     "info",
+		Message:   "Request",
+		RequestID: "req-1",
+		Method:    "GET",
+		Route:     "/api/project/files/{user}/{directory}",
+		User:      "user1",
+		Project:   "user1/project",
+		Path:      "/api/project/files/user1/project",
+		Status:    http.StatusOK,
+		Bytes:     w.Body.Len(),
+		Duration:  entry.Duration,
+		Remote:    entry.Remote,
+	}
+	if entry != expected || entry.Time == "" || entry.Remote == "" {
+		t.Errorf("log entry: %+v", entry)
+	}
+
+	// anonymous request of unknown route
+	buf.Reset()
+	request(s, "GET", "/api/unknown", "", nil, nil)
+	entries = logEntries(t, buf)
+	if len(entries) != 1 || entries[0].Status != http.StatusNotFound || entries[0].User != "" || entries[0].Project != "" || entries[0].RequestID == "" {
+		t.Errorf("log entries: %s", buf)
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	s := newTestServer(t, Settings{LogLevel: "error"})
+	buf := captureLog(t)
+	r := httptest.NewRequest("GET", "/", nil)
+
+	logAll := func() []logEntry {
+		buf.Reset()
+		s.debugf(r, "debug message")
+		s.infof(r, "info message\n")
+		s.errorf(r, "error %s\n", "message")
+		request(s, "GET", "/healthz", "", nil, nil)
+		return logEntries(t, buf)
+	}
+	levels := func(entries []logEntry) string {
+		names := make([]string, len(entries))
+		for i, e := range entries {
+			names[i] = e.Level + ":" + e.Message
+		}
+		return strings.Join(names, ",")
+	}
+
+	tests := []struct {
+		level    string
+		expected string
+	}{
+		{"error", "error:error message"},
+		{"info", "info:info message,error:error message,info:Request"},
+		{"debug", "debug:debug message,info:info message,error:error message,info:Request"},
+	}
+	for _, tt := range tests {
+		settings := *s.settings()
+		settings.LogLevel = tt.level
+		if err := s.Reload(settings); err != nil {
+			t.Fatal(err)
+		}
+		if logged := levels(logAll()); logged != tt.expected {
+			t.Errorf("log level %s: %s", tt.level, logged)
+		}
+	}
+}
@@ -2,14 +2,12 @@ package server
 
 import (
 	"io"
-	"log"
-	"mime"
 	"mime/multipart"
 	"net/http"
-	"path/filepath"
+	"path"
 	"strings"
 
-	"github.com/gislab-npo/gisquick-settings/fs"
+	"github.com/gislab-npo/gisquick-settings/server/storage"
 	"github.com/go-chi/chi"
 )
 
@@ -17,9 +15,14 @@ func (s *Server) handleMediaFile() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		username := chi.URLParam(r, "user")
 		directory := chi.URLParam(r, "directory")
-		filename := chi.URLParam(r, "*")
-		path := filepath.Join(s.config.ProjectsRoot, username, directory, "media", filename)
-		http.ServeFile(w, r, path)
+		filename, err := s.projectFilePath(username, directory, "media", chi.URLParam(r, "*"))
+		if err != nil {
+			if !s.pathErrorResponse(w, r, err) {
+				s.serverError(w, r)
+			}
+			return
+		}
+		s.serveFile(w, r, filename)
 	}
 }
 
@@ -28,20 +31,26 @@ func (s *Server) handleMediaFileUpload() http.HandlerFunc {
 		username := chi.URLParam(r, "user")
 		directory := chi.URLParam(r, "directory")
 
-		mediaDir := filepath.Join(s.config.ProjectsRoot, username, directory, "media")
-
-		ctype, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
-		if err != nil || ctype != "multipart/form-data" {
-			http.Error(w, "Invalid content type", 400)
-			return
-		}
-		boundary, ok := params["boundary"]
+		boundary, ok := s.checkMultipart(w, r)
 		if !ok {
-			http.Error(w, http.ErrMissingBoundary.Error(), 400)
 			return
 		}
 
-		r.Body = http.MaxBytesReader(w, r.Body, 10*1024*1024) // max. 10 MB
+		maxSize := int64(10 * 1024 * 1024) // max. 10 MB
+		user := r.Context().Value(contextKeyUser).(*User)
+		// checked quota can't be exceeded by concurrent uploads
+		unlock := s.lockUploads(username)
+		defer unlock()
+		if !user.IsSuperuser {
+			size := r.ContentLength
+			if size < 0 || size > maxSize {
+				size = maxSize
+			}
+			if !s.checkQuota(w, r, username, size) {
+				return
+			}
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxSize)
 		reader := multipart.NewReader(r.Body, boundary)
 		// res := make([]string, 1)
 		// var res []string = []string{}
@@ -52,19 +61,25 @@ func (s *Server) handleMediaFileUpload() http.HandlerFunc {
 				break
 			}
 			if err != nil {
-				log.Printf("Media upload file error: %s\n", err)
-				http.Error(w, "Upload error", http.StatusBadRequest)
+				s.errorf(r, "Media upload file error: %s\n", err)
+				s.errorResponse(w, r, http.StatusBadRequest, errCodeInvalidUpload, "Upload error", nil)
 				return
 			}
 
-			destPath := filepath.Join(mediaDir, part.FileName())
-			if err = fs.SaveToFile(part, destPath); err != nil {
-				log.Printf("Media upload file error: %s\n", err)
-				http.Error(w, "Upload error", http.StatusBadRequest)
+			destPath, err := s.projectFilePath(username, directory, "media", part.FileName())
+			if err != nil {
+				if !s.pathErrorResponse(w, r, err) {
+					s.serverError(w, r)
+				}
+				return
+			}
+			if err = storage.SaveFile(s.storage, part, destPath); err != nil {
+				s.errorf(r, "Media upload file error: %s\n", err)
+				s.errorResponse(w, r, http.StatusBadRequest, errCodeInvalidUpload, "Upload error", nil)
 				return
 			}
-			res = append(res, filepath.Join("media", part.FileName()))
-			log.Println(destPath)
+			res = append(res, path.Join("media", part.FileName()))
+			s.debugf(r, "Media file saved: %s\n", destPath)
 		}
 		w.Write([]byte(strings.Join(res, ",")))
 	}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"crypto/subtle"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Buckets of histograms (in seconds)
+var (
+	latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	uploadBuckets  = []float64{.1, .5, 1, 5, 10, 30, 60, 120, 300, 600}
+)
+
+// map cache directories are measured periodically in this interval
+const mapCacheSizeInterval = time.Minute
+
+// metrics of the server
+type metrics struct {
+	registry        *prometheus.Registry
+	handler         http.Handler
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	uploadBytes     *prometheus.CounterVec
+	uploadDuration  *prometheus.HistogramVec
+	wsMessages      *prometheus.CounterVec
+	authDuration    *prometheus.HistogramVec
+	mapDuration     *prometheus.HistogramVec
+	mapCacheBytes   prometheus.Gauge
+}
+
+func newMetrics(pluginsWs, appsWs *websocketsMap) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gisquick_http_requests_total",
+			Help: "Number of HTTP requests by route, method and status.",
+		}, []string{"route", "method", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gisquick_http_request_duration_seconds",
+			Help:    "Latency of HTTP requests by route and method.",
+			Buckets: latencyBuckets,
+		}, []string{"route", "method"}),
+		uploadBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gisquick_upload_bytes_total",
+			Help: "Number of uploaded bytes by type of upload.",
+		}, []string{"type"}),
+		uploadDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gisquick_upload_duration_seconds",
+			Help:    "Duration of uploads by type of upload.",
+			Buckets: uploadBuckets,
+		}, []string{"type"}),
+		wsMessages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gisquick_websocket_relayed_messages_total",
+			Help: "Number of messages relayed between plugins and apps.",
+		}, []string{"from", "to"}),
+		authDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gisquick_auth_request_duration_seconds",
+			Help:    "Latency of authentication by the authentication backend.",
+			Buckets: latencyBuckets,
+		}, []string{"result"}),
+		mapDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gisquick_map_request_duration_seconds",
+			Help:    "Latency of map requests proxied to the map server by status.",
+			Buckets: latencyBuckets,
+		}, []string{"status"}),
+		mapCacheBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "gisquick_map_cache_bytes",
+			Help: "Total size of the map cache.",
+		}),
+	}
+	m.registry.MustRegister(
+		m.requests, m.requestDuration, m.uploadBytes, m.uploadDuration,
+		m.wsMessages, m.authDuration, m.mapDuration, m.mapCacheBytes,
+	)
+	for kind, ws := range map[string]*websocketsMap{"plugin": pluginsWs, "app": appsWs} {
+		ws := ws
+		m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "gisquick_websocket_connections",
+			Help:        "Number of connected websockets of plugins and apps.",
+			ConstLabels: prometheus.Labels{"type": kind},
+		}, func() float64 {
+			return float64(len(ws.Connections()))
+		}))
+	}
+	m.handler = promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+	return m
+}
+
+// Types of uploads by route pattern
+var uploadRoutes = map[string]string{
+	"POST /api/project/upload":                                   "archive",
+	"POST /api/project/upload/{user}/{directory}":                "files",
+	"PATCH /api/project/uploads/{user}/{directory}/{id}/files/*": "chunk",
+	"POST /api/project/media/{user}/{directory}":                 "media",
+	"POST /api/project/script/{user}/{directory}":                "script",
+}
+
+// countingReader counts bytes read from request body
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// instrument is a middleware recording metrics of requests (by route
+// pattern) and uploads
+func (s *Server) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		next.ServeHTTP(ww, r)
+
+		duration := time.Since(start).Seconds()
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := responseStatus(ww, r)
+		s.metrics.requests.WithLabelValues(route, r.Method, strconv.Itoa(status)).Inc()
+		if status != http.StatusSwitchingProtocols {
+			s.metrics.requestDuration.WithLabelValues(route, r.Method).Observe(duration)
+		}
+		if kind := uploadRoutes[r.Method+" "+route]; kind != "" {
+			s.metrics.uploadBytes.WithLabelValues(kind).Add(float64(body.n))
+			s.metrics.uploadDuration.WithLabelValues(kind).Observe(duration)
+		}
+	})
+}
+
+// dirSize returns total size of files in the directory
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// measureMapCache updates total size of the map cache (cache directories
+// are named by hashes of projects, so they are not reported separately)
+func (s *Server) measureMapCache() {
+	if _, err := os.Stat(s.config.MapCacheRoot); err != nil {
+		s.errorf(nil, "Failed to measure map cache: %s\n", err)
+		return
+	}
+	s.metrics.mapCacheBytes.Set(float64(dirSize(s.config.MapCacheRoot)))
+}
+
+// monitorMapCache measures map cache every mapCacheSizeInterval until the
+// server is closed (walking the cache can take long, so it's not done on
+// scrapes)
+func (s *Server) monitorMapCache() {
+	defer s.tasks.Done()
+	ticker := time.NewTicker(mapCacheSizeInterval)
+	defer ticker.Stop()
+	for {
+		s.measureMapCache()
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *Server) handleMetrics() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.config.MetricsToken != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.config.MetricsToken)) != 1 {
+				s.errorResponse(w, r, http.StatusUnauthorized, errCodeUnauthorized, "Unauthorized", nil)
+				return
+			}
+		}
+		s.metrics.handler.ServeHTTP(w, r)
+	}
+}
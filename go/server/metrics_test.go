@@ -0,0 +1,65 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	s := newTestServer(t, Settings{}, testUser)
+	writeFile(t, s, "user1/project/project.qgs", "<qgis/>")
+	request(s, "GET", "/api/project/files/user1/project", "user1", nil, nil)
+	os.MkdirAll(filepath.Join(s.config.MapCacheRoot, "project"), 0755)
+	os.MkdirAll(filepath.Join(s.config.MapCacheRoot, "obsolete_project_1"), 0755)
+	for _, p := range []string{"project/tile.png", "obsolete_project_1/tile.png"} {
+		if err := ioutil.WriteFile(filepath.Join(s.config.MapCacheRoot, filepath.FromSlash(p)), []byte("png"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.measureMapCache()
+
+	w := request(s, "GET", "/metrics", "", nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /metrics: %d %s", w.Code, w.Body)
+	}
+	expected := []string{
+		`gisquick_http_requests_total{method="GET",route="/api/project/files/{user}/{directory}",status="200"} 1`,
+		`gisquick_http_request_duration_seconds_count{method="GET",route="/api/project/files/{user}/{directory}"} 1`,
+		`gisquick_websocket_connections{type="plugin"} 0`,
+		`gisquick_map_cache_bytes 6`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("metrics don't contain %s:\n%s", line, w.Body)
+		}
+	}
+
+	s.config.MetricsToken = "secret"
+	if w := request(s, "GET", "/metrics", "", nil, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET /metrics without token: %d", w.Code)
+	}
+	if w := request(s, "GET", "/metrics", "", nil, map[string]string{"Authorization": "Bearer secret"}); w.Code != http.StatusOK {
+		t.Errorf("GET /metrics with token: %d", w.Code)
+	}
+}
+
+func TestCloseStopsMapCacheMonitor(t *testing.T) {
+	s := newTestServer(t, Settings{}, testUser)
+	done := make(chan struct{})
+	go func() {
+		s.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("map cache monitor was not stopped")
+	}
+	// server can be closed repeatedly
+	s.Close()
+}
@@ -2,45 +2,114 @@ package server
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
 	"net/http"
+	"time"
+
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
 )
 
-func (s *Server) authMiddleware(v http.HandlerFunc) http.HandlerFunc {
-	type Data struct {
-		User User `json:"user"`
+// authenticate returns user of the request authenticated by personal API
+// token or by the authenticator, results are cached by token or by cache key
+// of the authenticator
+func (s *Server) authenticate(r *http.Request) (*User, error) {
+	if token := bearerToken(r); token != "" {
+		hash := hashToken(token)
+		if s.authCache == nil {
+			return s.tokenUser(r, hash)
+		}
+		user, err := s.authCache.get(tokenCacheKey(hash), func() (*User, error) {
+			r, cancel := s.sharedAuthRequest(r)
+			defer cancel()
+			return s.tokenUser(r, hash)
+		})
+		// token could expire after it was cached
+		if user != nil && user.token.expired() {
+			return nil, err
+		}
+		return user, err
+	}
+	key := s.authenticator.CacheKey(r)
+	if key == "" || s.authCache == nil {
+		return s.authenticateBackend(r)
+	}
+	return s.authCache.get(sessionCacheKey(key), func() (*User, error) {
+		r, cancel := s.sharedAuthRequest(r)
+		defer cancel()
+		return s.authenticateBackend(r)
+	})
+}
+
+// sharedAuthRequest returns the request with context which is not canceled
+// with the request, cached authentication is shared by concurrent requests
+// and it mustn't fail when the first client disconnects. Authentication is
+// limited by AuthTimeout instead.
+func (s *Server) sharedAuthRequest(r *http.Request) (*http.Request, context.CancelFunc) {
+	ctx := context.WithoutCancel(r.Context())
+	if s.config.AuthTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.config.AuthTimeout)
+		return r.WithContext(ctx), cancel
+	}
+	return r.WithContext(ctx), func() {}
+}
+
+// sessionCacheKey returns key of the session (cache key of the authenticator)
+// in authentication cache
+func sessionCacheKey(key string) string {
+	return "session:" + key
+}
+
+// authenticateBackend authenticates the request by the authenticator and
+// records its latency
+func (s *Server) authenticateBackend(r *http.Request) (*User, error) {
+	start := time.Now()
+	user, err := s.authenticator.Authenticate(r)
+	result := "ok"
+	if err != nil {
+		result = "error"
 	}
-	client := &http.Client{}
-	authURL := fmt.Sprintf("%s/api/auth/user/", s.config.AppServer)
+	s.metrics.authDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+	return user, err
+}
 
+// InvalidateSession removes cached authentication of the session (e.g.
+// after logout)
+func (s *Server) InvalidateSession(session string) {
+	if s.authCache != nil {
+		s.authCache.invalidate(sessionCacheKey(session))
+	}
+}
+
+// handleInvalidateSession removes cached authentication of the request's
+// session, it should be called by the app server on logout
+func (s *Server) handleInvalidateSession() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		authReq, err := http.NewRequest(http.MethodGet, authURL, nil)
-		if err != nil {
-			http.Error(w, "Auth error", http.StatusInternalServerError)
-			return
+		if session := s.authenticator.CacheKey(r); session != "" {
+			s.InvalidateSession(session)
 		}
-		authReq.Header.Set("Host", r.Host)
-		authReq.Header.Set("X-Forwarded-For", r.RemoteAddr)
-		for _, cookie := range r.Cookies() {
-			authReq.AddCookie(cookie)
-		}
-		resp, err := client.Do(authReq)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
 
+func (s *Server) authMiddleware(v http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, sp := s.tracer.Start(r.Context(), "authenticate")
+		user, err := s.authenticate(r.WithContext(ctx))
+		if user != nil {
+			sp.SetAttributes(semconv.EnduserID(user.Username))
+		}
+		setSpanError(sp, err)
+		sp.End()
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			s.errorf(r, "Auth error: %s\n", err)
+			s.errorResponse(w, r, http.StatusInternalServerError, errCodeAuthError, "Auth error", nil)
 			return
 		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode == http.StatusOK {
-			var data Data
-			err = json.NewDecoder(resp.Body).Decode(&data)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+		if user != nil {
+			if info := getRequestInfo(r); info != nil {
+				info.User = user.Username
 			}
-			ctx := context.WithValue(r.Context(), contextKeyUser, &data.User)
+			ctx := context.WithValue(r.Context(), contextKeyUser, user)
 			r = r.WithContext(ctx)
 		}
 		v(w, r)
@@ -51,7 +120,7 @@ func (s *Server) loginRequired(v http.HandlerFunc) http.HandlerFunc {
 	return s.authMiddleware(func(w http.ResponseWriter, r *http.Request) {
 		user, ok := r.Context().Value(contextKeyUser).(*User)
 		if !ok || user.IsGuest {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			s.errorResponse(w, r, http.StatusUnauthorized, errCodeUnauthorized, "Unauthorized", nil)
 			return
 		}
 		v(w, r)
@@ -0,0 +1,788 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gislab-npo/gisquick-settings/fs"
+	"github.com/go-chi/chi"
+)
+
+// API specification (OpenAPI 3) is built from descriptions of operations in
+// apiOperations and from registered routes with their access policies. The
+// same descriptions are used by validateRequest middleware.
+
+// max. size of JSON body validated by validateRequest (larger bodies are
+// rejected)
+const maxValidatedBody = 10 * 1024 * 1024
+
+// schema is a subset of JSON Schema used in the API specification
+type schema struct {
+	Type                 string
+	Format               string
+	Description          string
+	Properties           map[string]*schema
+	Required             []string
+	Items                *schema
+	AdditionalProperties *schema
+	Enum                 []string
+	Minimum              *float64
+	Nullable             bool
+	// named schemas are components of the specification
+	name string
+}
+
+func stringSchema(description string) *schema {
+	return &schema{Type: "string", Description: description}
+}
+
+func enumSchema(values ...string) *schema {
+	return &schema{Type: "string", Enum: values}
+}
+
+func sizeSchema(description string) *schema {
+	min := 0.0
+	return &schema{Type: "integer", Format: "int64", Minimum: &min, Description: description}
+}
+
+func dateTimeSchema(description string) *schema {
+	return &schema{Type: "string", Format: "date-time", Description: description}
+}
+
+func arraySchema(items *schema) *schema {
+	return &schema{Type: "array", Items: items}
+}
+
+func mapSchema(values *schema) *schema {
+	return &schema{Type: "object", AdditionalProperties: values}
+}
+
+func objectSchema(properties map[string]*schema, required ...string) *schema {
+	return &schema{Type: "object", Properties: properties, Required: required}
+}
+
+func namedSchema(name, description string, sc *schema) *schema {
+	sc.name = name
+	sc.Description = description
+	return sc
+}
+
+func permissionNames() []string {
+	names := make([]string, 0, len(aclPermissions))
+	for name := range aclPermissions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Schemas of API objects
+var (
+	fileSchema = namedSchema("File", "Project file", objectSchema(map[string]*schema{
+		"path":      stringSchema("Path relative to project directory"),
+		"hash":      stringSchema("Checksum of the file"),
+		"size":      sizeSchema("Size in bytes"),
+		"mtime":     dateTimeSchema("Modification time"),
+		"algorithm": enumSchema(fs.HashAlgorithms...),
+	}, "path"))
+	uploadInfoSchema = namedSchema("UploadInfo", "Files of upload and changes of project", objectSchema(map[string]*schema{
+		"files":    arraySchema(fileSchema),
+		"removes":  arraySchema(stringSchema("Path of removed file")),
+		"manifest": arraySchema(fileSchema),
+	}, "files"))
+	diffInfoSchema = namedSchema("FilesManifest", "Client's manifest of project files", objectSchema(map[string]*schema{
+		"algorithm": enumSchema(fs.HashAlgorithms...),
+		"files":     arraySchema(fileSchema),
+	}))
+	filesChangesSchema = namedSchema("FilesChanges", "Differences of project files", objectSchema(map[string]*schema{
+		"new":       arraySchema(fileSchema),
+		"modified":  arraySchema(fileSchema),
+		"deleted":   arraySchema(fileSchema),
+		"identical": arraySchema(fileSchema),
+	}))
+	removesSchema = namedSchema("Removes", "Files which would be removed by upload (dry run)", objectSchema(map[string]*schema{
+		"removes": arraySchema(stringSchema("")),
+	}))
+	sessionStatusSchema = namedSchema("UploadSessionStatus", "Received data of upload session files", objectSchema(map[string]*schema{
+		"id": stringSchema("ID of upload session"),
+		"files": arraySchema(objectSchema(map[string]*schema{
+			"path":   stringSchema(""),
+			"size":   sizeSchema(""),
+			"offset": sizeSchema("Received bytes"),
+		})),
+	}))
+	scriptInfoSchema = namedSchema("ScriptInfo", "Script module of the project", objectSchema(map[string]*schema{
+		"path":       stringSchema("Path of the script file"),
+		"components": arraySchema(stringSchema("")),
+	}, "path"))
+	aclSchema = namedSchema("ACL", "Permissions of users and groups", objectSchema(map[string]*schema{
+		"users":  mapSchema(enumSchema(permissionNames()...)),
+		"groups": mapSchema(enumSchema(permissionNames()...)),
+	}))
+	aclEntrySchema = namedSchema("ACLEntry", "Permission of user or group", objectSchema(map[string]*schema{
+		"permission": enumSchema(permissionNames()...),
+	}, "permission"))
+	tokenInfoSchema = namedSchema("TokenInfo", "Personal API token", objectSchema(map[string]*schema{
+		"id":      stringSchema(""),
+		"name":    stringSchema(""),
+		"scopes":  arraySchema(enumSchema(permissionNames()...)),
+		"created": dateTimeSchema(""),
+		"expires": dateTimeSchema(""),
+	}))
+	tokenRequestSchema = namedSchema("TokenRequest", "Request of a new personal API token", objectSchema(map[string]*schema{
+		"name":    stringSchema(""),
+		"scopes":  arraySchema(enumSchema(permissionNames()...)),
+		"expires": &schema{Type: "string", Format: "date-time", Nullable: true},
+	}, "name", "scopes"))
+	tokenCreatedSchema = namedSchema("TokenCreated", "Issued token with its secret value (returned only once)", objectSchema(map[string]*schema{
+		"id":      stringSchema(""),
+		"name":    stringSchema(""),
+		"scopes":  arraySchema(stringSchema("")),
+		"created": dateTimeSchema(""),
+		"expires": dateTimeSchema(""),
+		"token":   stringSchema("Secret value of the token"),
+	}))
+	snapshotInfoSchema = namedSchema("SnapshotInfo", "Snapshot of project files", objectSchema(map[string]*schema{
+		"id":      stringSchema(""),
+		"created": dateTimeSchema(""),
+		"user":    stringSchema("User who created the snapshot"),
+		"files":   &schema{Type: "integer"},
+		"size":    sizeSchema(""),
+	}))
+	storageUsageSchema = namedSchema("StorageUsage", "Storage used by user's projects", objectSchema(map[string]*schema{
+		"used":      sizeSchema(""),
+		"quota":     &schema{Type: "integer", Nullable: true},
+		"free":      &schema{Type: "integer", Nullable: true},
+		"projects":  mapSchema(sizeSchema("")),
+		"types":     mapSchema(sizeSchema("")),
+		"internal":  sizeSchema("Size of internal data (snapshots), not counted to the quota"),
+		"uploads":   sizeSchema("Size of received data of unfinished uploads, counted to the quota"),
+		"snapshots": sizeSchema("Size of content of project snapshots, limited by separate snapshots quota"),
+	}))
+	errorSchema = namedSchema("Error", "Error response", objectSchema(map[string]*schema{
+		"code":       stringSchema("Machine readable code of the error"),
+		"message":    stringSchema(""),
+		"details":    &schema{Description: "Details of the error (e.g. list of invalid fields or path of the file)"},
+		"request_id": stringSchema("ID of the request (same as X-Request-ID header)"),
+	}, "code", "message"))
+	anyObjectSchema = &schema{Type: "object", Description: "JSON object"}
+	binarySchema    = &schema{Type: "string", Format: "binary"}
+)
+
+// apiParam is a query or header parameter of an operation
+type apiParam struct {
+	name        string
+	description string
+	required    bool
+	schema      *schema
+}
+
+// apiContent is a body of request or response
+type apiContent struct {
+	mediaType string
+	schema    *schema
+}
+
+// apiOperation describes a route of the API
+type apiOperation struct {
+	summary string
+	tag     string
+	query   []apiParam
+	headers []apiParam
+	body    *apiContent
+	// status and content of successful response (default status is 200)
+	status   int
+	response *apiContent
+}
+
+func jsonContent(sc *schema) *apiContent {
+	return &apiContent{"application/json", sc}
+}
+
+func multipartContent(properties map[string]*schema, required ...string) *apiContent {
+	return &apiContent{"multipart/form-data", objectSchema(properties, required...)}
+}
+
+var (
+	binaryContent = &apiContent{"application/octet-stream", binarySchema}
+	zipContent    = &apiContent{"application/zip", binarySchema}
+	dryRunParam   = apiParam{"dry_run", "Only check the upload and report files which would be removed", false, &schema{Type: "boolean"}}
+)
+
+// apiOperations by method and route pattern (same keys as access policies)
+var apiOperations = map[string]apiOperation{
+	"GET /api/openapi.json": {summary: "API specification (OpenAPI 3)", tag: "api", response: jsonContent(anyObjectSchema)},
+	"GET /metrics":          {summary: "Metrics in Prometheus text format", tag: "monitoring", response: &apiContent{"text/plain", stringSchema("")}},
+	"GET /healthz":          {summary: "Liveness of the server", tag: "monitoring", response: jsonContent(anyObjectSchema)},
+	"GET /readyz":           {summary: "Readiness of the server with results of dependency checks (status 503 when not ready)", tag: "monitoring", response: jsonContent(anyObjectSchema)},
+
+	"POST /api/auth/invalidate": {summary: "Remove cached authentication of the request's session", tag: "auth", status: http.StatusNoContent},
+	"POST /api/auth/login/":     {summary: "Login (proxied to the app server, development mode)", tag: "auth", body: &apiContent{"application/x-www-form-urlencoded", objectSchema(map[string]*schema{"username": stringSchema(""), "password": stringSchema("")})}},
+	"* /api/auth/logout/":       {summary: "Logout (proxied to the app server, development mode)", tag: "auth"},
+
+	"GET /api/tokens":         {summary: "List personal API tokens of the user", tag: "tokens", response: jsonContent(arraySchema(tokenInfoSchema))},
+	"POST /api/tokens":        {summary: "Create personal API token", tag: "tokens", body: jsonContent(tokenRequestSchema), response: jsonContent(tokenCreatedSchema)},
+	"DELETE /api/tokens/{id}": {summary: "Revoke personal API token", tag: "tokens", status: http.StatusNoContent},
+
+	"GET /ws/plugin": {summary: "Websocket of QGIS plugin (messages are relayed to the app)", tag: "websocket", status: http.StatusSwitchingProtocols},
+	"GET /ws/app":    {summary: "Websocket of the web app (messages are relayed to the plugin)", tag: "websocket", status: http.StatusSwitchingProtocols},
+
+	"GET /api/project/hash-algorithms": {summary: "Supported hash algorithms (in order of preference)", tag: "projects", response: jsonContent(arraySchema(stringSchema("")))},
+	"GET /api/project/files/{user}/{directory}": {
+		summary:  "List project files with checksums",
+		tag:      "projects",
+		query:    []apiParam{{"hash", "Hash algorithm of checksums", false, enumSchema(fs.HashAlgorithms...)}},
+		response: jsonContent(arraySchema(fileSchema)),
+	},
+	"GET /api/project/download/{user}/{directory}": {summary: "Download project files (zip archive)", tag: "projects", response: zipContent},
+	"POST /api/project/diff/{user}/{directory}": {
+		summary:  "Compare client's files with published project files",
+		tag:      "projects",
+		body:     jsonContent(diffInfoSchema),
+		response: jsonContent(filesChangesSchema),
+	},
+	"DELETE /api/project/delete/{user}/{directory}": {summary: "Delete project", tag: "projects"},
+	"POST /api/project/config/{user}/{directory}/{name}": {
+		summary: "Save project configuration",
+		tag:     "projects",
+		body:    jsonContent(anyObjectSchema),
+	},
+	"POST /api/project/meta/{user}/{directory}/{name}": {
+		summary: "Save project metadata",
+		tag:     "projects",
+		body:    jsonContent(anyObjectSchema),
+	},
+	"GET /api/project/meta/{user}/{directory}/{name}":     {summary: "Latest project metadata", tag: "projects", response: jsonContent(anyObjectSchema)},
+	"DELETE /api/project/cache/{user}/{directory}/{name}": {summary: "Delete map cache of the project", tag: "projects"},
+	"GET /api/project/map": {
+		summary:  "Map request proxied to the map server (WMS parameters are passed through)",
+		tag:      "projects",
+		query:    []apiParam{{"MAP", "Project file (user/directory/name.qgs)", true, stringSchema("")}},
+		response: &apiContent{"image/*", binarySchema},
+	},
+
+	"POST /api/project/upload": {
+		summary: "Upload new project as zip archive",
+		tag:     "uploads",
+		body:    multipartContent(map[string]*schema{"file": binarySchema}, "file"),
+	},
+	"POST /api/project/upload/{user}/{directory}": {
+		summary:  "Upload project files (first part is UploadInfo, other parts are files named by their paths, gzip compressed files have .gz filename)",
+		tag:      "uploads",
+		query:    []apiParam{dryRunParam},
+		body:     multipartContent(map[string]*schema{"info": uploadInfoSchema}, "info"),
+		response: jsonContent(removesSchema),
+	},
+	"POST /api/project/uploads/{user}/{directory}": {
+		summary:  "Create (or resume) resumable upload session",
+		tag:      "uploads",
+		query:    []apiParam{dryRunParam},
+		body:     jsonContent(uploadInfoSchema),
+		response: jsonContent(sessionStatusSchema),
+	},
+	"GET /api/project/uploads/{user}/{directory}/{id}":    {summary: "Status of upload session", tag: "uploads", response: jsonContent(sessionStatusSchema)},
+	"DELETE /api/project/uploads/{user}/{directory}/{id}": {summary: "Cancel upload session", tag: "uploads"},
+	"PATCH /api/project/uploads/{user}/{directory}/{id}/files/*": {
+		summary: "Upload chunk of a file (received offset is returned in Upload-Offset header)",
+		tag:     "uploads",
+		headers: []apiParam{{"Upload-Offset", "Offset of the chunk", true, sizeSchema("")}},
+		body:    &apiContent{"application/offset+octet-stream", binarySchema},
+		status:  http.StatusNoContent,
+	},
+	"POST /api/project/uploads/{user}/{directory}/{id}/commit": {summary: "Update project files by completed upload session", tag: "uploads"},
+
+	"GET /api/project/script/{user}/{directory}": {summary: "Script modules of the project", tag: "scripts", response: jsonContent(mapSchema(scriptInfoSchema))},
+	"POST /api/project/script/{user}/{directory}": {
+		summary:  "Upload script module (info part with ScriptInfo followed by the file)",
+		tag:      "scripts",
+		body:     multipartContent(map[string]*schema{"info": scriptInfoSchema, "file": binarySchema}, "info", "file"),
+		response: jsonContent(mapSchema(scriptInfoSchema)),
+	},
+	"DELETE /api/project/script/{user}/{directory}/{module}": {summary: "Delete script module", tag: "scripts", response: jsonContent(mapSchema(scriptInfoSchema))},
+	"GET /api/project/static/{user}/{directory}/*":           {summary: "Static file of the project", tag: "scripts", response: binaryContent},
+
+	"GET /api/project/media/{user}/{directory}/*": {summary: "Media file of the project", tag: "media", response: binaryContent},
+	"POST /api/project/media/{user}/{directory}": {
+		summary:  "Upload media files (parts are named by their paths), returns comma separated paths of saved files",
+		tag:      "media",
+		body:     multipartContent(map[string]*schema{}),
+		response: &apiContent{"text/plain", stringSchema("")},
+	},
+
+	"GET /api/project/acl/{user}/{directory}":                     {summary: "Permissions of project collaborators", tag: "acl", response: jsonContent(aclSchema)},
+	"PUT /api/project/acl/{user}/{directory}":                     {summary: "Replace permissions of project collaborators", tag: "acl", body: jsonContent(aclSchema), response: jsonContent(aclSchema)},
+	"PUT /api/project/acl/{user}/{directory}/{kind}/{name}":       {summary: "Set permission of user or group (kind is users or groups)", tag: "acl", body: jsonContent(aclEntrySchema), response: jsonContent(aclSchema)},
+	"DELETE /api/project/acl/{user}/{directory}/{kind}/{name}":    {summary: "Remove permission of user or group (kind is users or groups)", tag: "acl", response: jsonContent(aclSchema)},
+	"GET /api/usage/{user}":                                       {summary: "Storage usage and quota of the user", tag: "usage", response: jsonContent(storageUsageSchema)},
+	"GET /api/project/snapshots/{user}/{directory}":               {summary: "Snapshots of the project", tag: "snapshots", response: jsonContent(arraySchema(snapshotInfoSchema))},
+	"GET /api/project/snapshots/{user}/{directory}/{id}":          {summary: "Download snapshot (zip archive)", tag: "snapshots", response: zipContent},
+	"POST /api/project/snapshots/{user}/{directory}/{id}/restore": {summary: "Restore project files from snapshot", tag: "snapshots"},
+}
+
+var routeParamRegex = regexp.MustCompile(`{([^}]+)}`)
+
+// openAPIPath converts chi route pattern to OpenAPI path ("*" parameter is
+// named "path")
+func openAPIPath(pattern string) (string, []string) {
+	var params []string
+	for _, m := range routeParamRegex.FindAllStringSubmatch(pattern, -1) {
+		params = append(params, m[1])
+	}
+	if strings.HasSuffix(pattern, "*") {
+		pattern = strings.TrimSuffix(pattern, "*") + "{path}"
+		params = append(params, "path")
+	}
+	return pattern, params
+}
+
+// render returns JSON Schema object, named schemas are referenced and added
+// to components
+func (sc *schema) render(components map[string]interface{}) map[string]interface{} {
+	if sc.name != "" {
+		if _, ok := components[sc.name]; !ok {
+			components[sc.name] = nil
+			components[sc.name] = sc.body(components)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + sc.name}
+	}
+	return sc.body(components)
+}
+
+func (sc *schema) body(components map[string]interface{}) map[string]interface{} {
+	doc := make(map[string]interface{})
+	set := func(key string, value interface{}, ok bool) {
+		if ok {
+			doc[key] = value
+		}
+	}
+	set("type", sc.Type, sc.Type != "")
+	set("format", sc.Format, sc.Format != "")
+	set("description", sc.Description, sc.Description != "")
+	set("required", sc.Required, len(sc.Required) > 0)
+	set("enum", sc.Enum, len(sc.Enum) > 0)
+	set("nullable", true, sc.Nullable)
+	if sc.Minimum != nil {
+		doc["minimum"] = *sc.Minimum
+	}
+	if sc.Properties != nil {
+		properties := make(map[string]interface{}, len(sc.Properties))
+		for name, prop := range sc.Properties {
+			properties[name] = prop.render(components)
+		}
+		doc["properties"] = properties
+	}
+	if sc.Items != nil {
+		doc["items"] = sc.Items.render(components)
+	}
+	if sc.AdditionalProperties != nil {
+		doc["additionalProperties"] = sc.AdditionalProperties.render(components)
+	}
+	return doc
+}
+
+func (c *apiContent) render(components map[string]interface{}) map[string]interface{} {
+	media := map[string]interface{}{"schema": c.schema.render(components)}
+	if c.mediaType == "multipart/form-data" {
+		// JSON parts
+		encoding := make(map[string]interface{})
+		for name, prop := range c.schema.Properties {
+			if prop.Type == "object" {
+				encoding[name] = map[string]string{"contentType": "application/json"}
+			}
+		}
+		if len(encoding) > 0 {
+			media["encoding"] = encoding
+		}
+	}
+	return map[string]interface{}{c.mediaType: media}
+}
+
+func (p apiParam) render(in string, components map[string]interface{}) map[string]interface{} {
+	param := map[string]interface{}{"name": p.name, "in": in, "schema": p.schema.render(components)}
+	if p.description != "" {
+		param["description"] = p.description
+	}
+	if p.required {
+		param["required"] = true
+	}
+	return param
+}
+
+func (op *apiOperation) render(id string, policy routePolicy, params []string, components map[string]interface{}) map[string]interface{} {
+	doc := map[string]interface{}{
+		"summary":     op.summary,
+		"operationId": id,
+		"x-access":    policy.access.String(),
+	}
+	if policy.scope != policy.access {
+		doc["x-token-scope"] = policy.scope.String()
+	}
+	if op.tag != "" {
+		doc["tags"] = []string{op.tag}
+	}
+	var parameters []interface{}
+	for _, name := range params {
+		description := ""
+		if name == "path" {
+			description = "Path of the file (can contain slashes)"
+		}
+		parameters = append(parameters, apiParam{name, description, true, stringSchema("")}.render("path", components))
+	}
+	for _, p := range op.query {
+		parameters = append(parameters, p.render("query", components))
+	}
+	for _, p := range op.headers {
+		parameters = append(parameters, p.render("header", components))
+	}
+	if len(parameters) > 0 {
+		doc["parameters"] = parameters
+	}
+	if op.body != nil && op.body.mediaType != "" {
+		doc["requestBody"] = map[string]interface{}{"required": true, "content": op.body.render(components)}
+	}
+	status := op.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]interface{}{"description": http.StatusText(status)}
+	if op.response != nil && op.response.mediaType != "" {
+		success["content"] = op.response.render(components)
+	}
+	errorResponse := map[string]interface{}{"$ref": "#/components/responses/Error"}
+	doc["responses"] = map[string]interface{}{
+		strconv.Itoa(status): success,
+		"4XX":                errorResponse,
+		"5XX":                errorResponse,
+	}
+	if policy.access == accessPublic {
+		doc["security"] = []interface{}{}
+	}
+	return doc
+}
+
+// apiDocument builds OpenAPI document of registered routes
+func (s *Server) apiDocument() map[string]interface{} {
+	components := make(map[string]interface{})
+	paths := make(map[string]map[string]interface{})
+	for key, policy := range s.policies {
+		op, ok := apiOperations[key]
+		if !ok {
+			op = apiOperation{}
+		}
+		parts := strings.SplitN(key, " ", 2)
+		methods := []string{parts[0]}
+		if parts[0] == "*" {
+			methods = []string{"GET", "POST"}
+		}
+		path, params := openAPIPath(parts[1])
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+		for _, method := range methods {
+			id := strings.ToLower(method) + strings.Title(strings.NewReplacer("/", " ", "{", "", "}", "", "*", "path", "-", " ", ".", " ").Replace(path))
+			paths[path][strings.ToLower(method)] = op.render(strings.Replace(id, " ", "", -1), policy, params, components)
+		}
+	}
+	errorSchemaRef := errorSchema.render(components)
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "Gisquick settings server API",
+			"version":     "1.0",
+			"description": "API for publishing of QGIS projects and management of their settings",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": components,
+			"responses": map[string]interface{}{
+				"Error": map[string]interface{}{
+					"description": "Error",
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{"schema": errorSchemaRef},
+					},
+				},
+			},
+			"securitySchemes": map[string]interface{}{
+				"session": map[string]string{"type": "apiKey", "in": "cookie", "name": s.config.SessionCookie},
+				"token":   map[string]string{"type": "http", "scheme": "bearer", "description": "Personal API token or JWT access token"},
+			},
+		},
+		"security": []interface{}{
+			map[string][]string{"session": {}},
+			map[string][]string{"token": {}},
+		},
+	}
+}
+
+func (s *Server) handleOpenAPI() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.jsonResponse(w, s.apiDocument())
+	}
+}
+
+// missingAPIOperations returns routes which are missing in API specification
+func (s *Server) missingAPIOperations() []string {
+	var missing []string
+	for key := range s.policies {
+		if _, ok := apiOperations[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// checkAPIOperations logs routes which are missing in API specification
+func (s *Server) checkAPIOperations() {
+	for _, key := range s.missingAPIOperations() {
+		s.errorf(nil, "Route is missing in API specification: %s\n", key)
+	}
+}
+
+/* Validation of requests */
+
+type validationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type validationErrors []validationError
+
+func (errs *validationErrors) add(field, format string, v ...interface{}) {
+	*errs = append(*errs, validationError{field, fmt.Sprintf(format, v...)})
+}
+
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case json.Number:
+		return "number"
+	case bool:
+		return "boolean"
+	}
+	return "unknown"
+}
+
+// validate checks JSON value (decoded with numbers as json.Number)
+func (sc *schema) validate(value interface{}, field string, errs *validationErrors) {
+	if sc.Type == "" {
+		return
+	}
+	if value == nil {
+		if !sc.Nullable {
+			errs.add(field, "must be %s", sc.Type)
+		}
+		return
+	}
+	switch sc.Type {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			errs.add(field, "must be object, not %s", jsonType(value))
+			return
+		}
+		for _, name := range sc.Required {
+			if _, ok := obj[name]; !ok {
+				errs.add(joinField(field, name), "is required")
+			}
+		}
+		for name, item := range obj {
+			if prop, ok := sc.Properties[name]; ok {
+				prop.validate(item, joinField(field, name), errs)
+			} else if sc.AdditionalProperties != nil {
+				sc.AdditionalProperties.validate(item, joinField(field, name), errs)
+			}
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			errs.add(field, "must be array, not %s", jsonType(value))
+			return
+		}
+		if sc.Items != nil {
+			for i, item := range items {
+				sc.Items.validate(item, fmt.Sprintf("%s[%d]", field, i), errs)
+			}
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			errs.add(field, "must be string, not %s", jsonType(value))
+			return
+		}
+		sc.validateString(str, field, errs)
+	case "integer", "number":
+		num, ok := value.(json.Number)
+		if !ok {
+			errs.add(field, "must be %s, not %s", sc.Type, jsonType(value))
+			return
+		}
+		sc.validateNumber(num.String(), field, errs)
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			errs.add(field, "must be boolean, not %s", jsonType(value))
+		}
+	}
+}
+
+func (sc *schema) validateString(value, field string, errs *validationErrors) {
+	if len(sc.Enum) > 0 {
+		for _, allowed := range sc.Enum {
+			if value == allowed {
+				return
+			}
+		}
+		errs.add(field, "must be one of: %s", strings.Join(sc.Enum, ", "))
+		return
+	}
+	if sc.Format == "date-time" {
+		if _, err := time.Parse(time.RFC3339, value); err != nil {
+			errs.add(field, "must be date-time (RFC 3339)")
+		}
+	}
+}
+
+func (sc *schema) validateNumber(value, field string, errs *validationErrors) {
+	var num float64
+	var err error
+	if sc.Type == "integer" {
+		var i int64
+		i, err = strconv.ParseInt(value, 10, 64)
+		num = float64(i)
+	} else {
+		num, err = strconv.ParseFloat(value, 64)
+	}
+	if err != nil {
+		errs.add(field, "must be %s", sc.Type)
+		return
+	}
+	if sc.Minimum != nil && num < *sc.Minimum {
+		errs.add(field, "must be at least %v", *sc.Minimum)
+	}
+}
+
+// validateParam checks value of query or header parameter
+func (sc *schema) validateParam(value, field string, errs *validationErrors) {
+	switch sc.Type {
+	case "integer", "number":
+		sc.validateNumber(value, field, errs)
+	case "boolean":
+		if _, err := strconv.ParseBool(value); err != nil {
+			errs.add(field, "must be boolean")
+		}
+	case "string":
+		sc.validateString(value, field, errs)
+	}
+}
+
+func joinField(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
+
+// validateBody checks content type and JSON content of request body
+func validateBody(r *http.Request, body *apiContent, errs *validationErrors) (status int) {
+	ctype, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch body.mediaType {
+	case "multipart/form-data":
+		if err != nil || ctype != body.mediaType || params["boundary"] == "" {
+			errs.add("Content-Type", "must be multipart/form-data with boundary")
+			return http.StatusUnsupportedMediaType
+		}
+	case "application/json":
+		if err == nil && ctype != body.mediaType {
+			errs.add("Content-Type", "must be application/json")
+			return http.StatusUnsupportedMediaType
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxValidatedBody+1))
+		if err != nil {
+			errs.add("body", "failed to read request body")
+			return http.StatusBadRequest
+		}
+		if len(data) > maxValidatedBody {
+			errs.add("body", "must not be larger than %d bytes", maxValidatedBody)
+			return http.StatusRequestEntityTooLarge
+		}
+		// handler reads the same body
+		r.Body = ioutil.NopCloser(bytes.NewReader(data))
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			errs.add("body", "invalid JSON: %s", err)
+			return http.StatusBadRequest
+		}
+		body.schema.validate(value, "body", errs)
+	}
+	if len(*errs) > 0 {
+		return http.StatusBadRequest
+	}
+	return 0
+}
+
+// validateRequest is a middleware rejecting requests which don't match API
+// specification (query and header parameters, content type and JSON body)
+func (s *Server) validateRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pattern := chi.RouteContext(r.Context()).RoutePattern()
+		op, ok := apiOperations[r.Method+" "+pattern]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var errs validationErrors
+		query := r.URL.Query()
+		for _, p := range op.query {
+			if value, ok := query[p.name]; ok {
+				p.schema.validateParam(value[0], p.name, &errs)
+			} else if p.required {
+				errs.add(p.name, "query parameter is required")
+			}
+		}
+		for _, p := range op.headers {
+			if value := r.Header.Get(p.name); value != "" {
+				p.schema.validateParam(value, p.name, &errs)
+			} else if p.required {
+				errs.add(p.name, "header is required")
+			}
+		}
+		status := 0
+		if len(errs) > 0 {
+			status = http.StatusBadRequest
+		} else if op.body != nil && op.body.mediaType != "" {
+			status = validateBody(r, op.body, &errs)
+		}
+		if status != 0 {
+			s.infof(r, "Invalid request: %d problems\n", len(errs))
+			code := errCodeInvalidRequest
+			switch status {
+			case http.StatusUnsupportedMediaType:
+				code = errCodeUnsupportedMediaType
+			case http.StatusRequestEntityTooLarge:
+				code = errCodeRequestTooLarge
+			}
+			s.errorResponse(w, r, status, code, "Request doesn't match API specification", errs)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAPIOperations(t *testing.T) {
+	s := newTestServer(t, Settings{}, testUser)
+	if missing := s.missingAPIOperations(); len(missing) > 0 {
+		t.Errorf("routes are missing in API specification: %s", strings.Join(missing, ", "))
+	}
+}
+
+func TestValidateRequest(t *testing.T) {
+	s := newTestServerConfig(t, Config{ValidateRequests: true}, testUser)
+	writeFile(t, s, "user1/project/project.qgs", "<qgis/>")
+	const aclURL = "/api/project/acl/user1/project/users/user2"
+	const chunkURL = "/api/project/uploads/user1/project/1234/files/a.txt"
+	jsonType := map[string]string{"Content-Type": "application/json"}
+	tests := []struct {
+		name    string
+		method  string
+		url     string
+		body    string
+		headers map[string]string
+		status  int
+		code    string
+		field   string
+	}{
+		{"invalid query", "GET", "/api/project/files/user1/project?hash=md5", "", nil, http.StatusBadRequest, errCodeInvalidRequest, "hash"},
+		{"invalid boolean query", "POST", "/api/project/uploads/user1/project?dry_run=maybe", `{"files": []}`, jsonType, http.StatusBadRequest, errCodeInvalidRequest, "dry_run"},
+		{"invalid header", "PATCH", chunkURL, "data", map[string]string{"Upload-Offset": "first"}, http.StatusBadRequest, errCodeInvalidRequest, "Upload-Offset"},
+		{"negative header", "PATCH", chunkURL, "data", map[string]string{"Upload-Offset": "-1"}, http.StatusBadRequest, errCodeInvalidRequest, "Upload-Offset"},
+		{"missing header", "PATCH", chunkURL, "data", nil, http.StatusBadRequest, errCodeInvalidRequest, "Upload-Offset"},
+		{"invalid JSON", "PUT", aclURL, `{"permission": `, jsonType, http.StatusBadRequest, errCodeInvalidRequest, "body"},
+		{"invalid enum", "PUT", aclURL, `{"permission": "owner"}`, jsonType, http.StatusBadRequest, errCodeInvalidRequest, "body.permission"},
+		{"missing property", "PUT", aclURL, `{}`, jsonType, http.StatusBadRequest, errCodeInvalidRequest, "body.permission"},
+		{"invalid type", "POST", "/api/tokens", `{"name": "ci", "scopes": "read"}`, jsonType, http.StatusBadRequest, errCodeInvalidRequest, "body.scopes"},
+		{"invalid date-time", "POST", "/api/tokens", `{"name": "ci", "scopes": ["read"], "expires": "tomorrow"}`, jsonType, http.StatusBadRequest, errCodeInvalidRequest, "body.expires"},
+		{"JSON content type", "PUT", aclURL, `{"permission": "read"}`, map[string]string{"Content-Type": "text/plain"}, http.StatusUnsupportedMediaType, errCodeUnsupportedMediaType, "Content-Type"},
+		{"multipart content type", "POST", "/api/project/upload/user1/project", "", map[string]string{"Content-Type": "application/json"}, http.StatusUnsupportedMediaType, errCodeUnsupportedMediaType, "Content-Type"},
+		{"multipart boundary", "POST", "/api/project/upload/user1/project", "", map[string]string{"Content-Type": "multipart/form-data"}, http.StatusUnsupportedMediaType, errCodeUnsupportedMediaType, "Content-Type"},
+		{"large body", "POST", "/api/tokens", `{"name": "` + strings.Repeat("x", maxValidatedBody) + `"}`, jsonType, http.StatusRequestEntityTooLarge, errCodeRequestTooLarge, "body"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := request(s, tt.method, tt.url, "user1", strings.NewReader(tt.body), tt.headers)
+			var e struct {
+				Code    string            `json:"code"`
+				Details []validationError `json:"details"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &e)
+			if w.Code != tt.status || e.Code != tt.code || len(e.Details) == 0 || e.Details[0].Field != tt.field {
+				t.Errorf("%s %s: %d %s", tt.method, tt.url, w.Code, w.Body)
+			}
+		})
+	}
+
+	// valid request is passed to the handler (with the same body)
+	w := request(s, "PUT", aclURL, "user1", strings.NewReader(`{"permission": "read"}`), jsonType)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"user2":"read"`) {
+		t.Errorf("valid request: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/gislab-npo/gisquick-settings/fs"
+	"github.com/go-chi/chi"
+)
+
+// storageUsage reports storage used by files of all projects of a user.
+// Server's internal data (snapshots, ...) are reported separately and they
+// are not counted to the quota (content of snapshots is limited by separate
+// snapshots quota). Received data of unfinished uploads are counted to the
+// quota.
+type storageUsage struct {
+	Used int64 `json:"used"`
+	// Quota and free space are not set when user has unlimited quota
+	Quota *int64 `json:"quota"`
+	Free  *int64 `json:"free"`
+	// Used bytes by project directory and by file type (extension)
+	Projects map[string]int64 `json:"projects"`
+	Types    map[string]int64 `json:"types"`
+	// Size of internal data
+	Internal int64 `json:"internal"`
+	// Size of received data of unfinished uploads
+	Uploads int64 `json:"uploads"`
+	// Size of content of projects snapshots
+	Snapshots int64 `json:"snapshots"`
+}
+
+// userQuota returns storage quota of the user in bytes (0 means unlimited)
+func (s *Server) userQuota(username string) int64 {
+	if quota, ok := s.settings().QuotaOverrides[username]; ok {
+		return quota
+	}
+	return s.settings().UserQuota
+}
+
+// snapshotsQuota returns max. size of snapshots content of the user in bytes
+// (0 means unlimited)
+func (s *Server) snapshotsQuota(username string) int64 {
+	if quota := s.settings().SnapshotsQuota; quota > 0 {
+		return quota
+	}
+	return s.userQuota(username)
+}
+
+func fileType(relPath string) string {
+	return strings.ToLower(strings.TrimPrefix(path.Ext(relPath), "."))
+}
+
+// userUsage computes storage usage of the user
+func (s *Server) userUsage(username string) (*storageUsage, error) {
+	usage := &storageUsage{Projects: make(map[string]int64), Types: make(map[string]int64)}
+	files, err := s.listInternal(username)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, f := range files {
+		parts := strings.SplitN(f.Path, "/", 2)
+		if len(parts) < 2 {
+			continue
+		}
+		// received chunks of upload sessions (.gisquick/uploads/<id>/chunks/...)
+		if strings.HasPrefix(parts[1], ".gisquick/uploads/") && strings.Contains(parts[1], "/chunks/") {
+			usage.Uploads += f.Size
+			continue
+		}
+		if strings.HasPrefix(parts[1], ".gisquick/snapshots/blobs/") {
+			usage.Snapshots += f.Size
+			continue
+		}
+		if strings.HasPrefix(parts[1], ".gisquick/") {
+			usage.Internal += f.Size
+			continue
+		}
+		usage.Used += f.Size
+		usage.Projects[parts[0]] += f.Size
+		usage.Types[fileType(parts[1])] += f.Size
+	}
+	if quota := s.userQuota(username); quota > 0 {
+		free := quota - usage.Used - usage.Uploads
+		if free < 0 {
+			free = 0
+		}
+		usage.Quota = &quota
+		usage.Free = &free
+	}
+	return usage, nil
+}
+
+type quotaErrorDetails struct {
+	Used  int64 `json:"used"`
+	Quota int64 `json:"quota"`
+	Free  int64 `json:"free"`
+	// size of stored data
+	Size int64 `json:"size"`
+}
+
+// checkQuota writes error response when storing additional data of given
+// size into user's projects would exceed user's quota
+func (s *Server) checkQuota(w http.ResponseWriter, r *http.Request, username string, size int64) bool {
+	quota := s.userQuota(username)
+	if quota <= 0 || size <= 0 {
+		return true
+	}
+	usage, err := s.userUsage(username)
+	if err != nil {
+		s.errorf(r, "Failed to compute storage usage: %s (%s)\n", username, err)
+		s.serverError(w, r)
+		return false
+	}
+	if usage.Used+usage.Uploads+size > quota {
+		s.infof(r, "Storage quota exceeded: %s (used: %d, uploads: %d, quota: %d, upload: %d)\n", username, usage.Used, usage.Uploads, quota, size)
+		s.errorResponse(w, r, http.StatusBadRequest, errCodeQuotaExceeded, fmt.Sprintf("Storage quota exceeded (free space: %d bytes)", *usage.Free), quotaErrorDetails{usage.Used, quota, *usage.Free, size})
+		return false
+	}
+	return true
+}
+
+// checkUploadQuota checks user's quota for update of project files (pending
+// is size of already received data of the update, which are counted as
+// unfinished upload)
+func (s *Server) checkUploadQuota(w http.ResponseWriter, r *http.Request, username, projectDir string, files []fs.File, removes []string, pending int64) bool {
+	if s.userQuota(username) <= 0 {
+		return true
+	}
+	size := s.projectSizeAfterUpload(projectDir, files, removes) - s.projectSizeAfterUpload(projectDir, nil, nil)
+	return s.checkQuota(w, r, username, size-pending)
+}
+
+func (s *Server) handleStorageUsage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := chi.URLParam(r, "user")
+		usage, err := s.userUsage(username)
+		if err != nil {
+			s.errorf(r, "Failed to compute storage usage: %s (%s)\n", username, err)
+			s.serverError(w, r)
+			return
+		}
+		s.jsonResponse(w, usage)
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"path"
+
+	"github.com/gislab-npo/gisquick-settings/fs"
+	"github.com/gislab-npo/gisquick-settings/server/storage"
+	"github.com/go-chi/chi"
+)
+
+type unsafePathDetails struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// pathErrorResponse writes response for request with invalid path, it
+// reports whether the err was an unsafe path error
+func (s *Server) pathErrorResponse(w http.ResponseWriter, r *http.Request, err error) bool {
+	var pathErr *fs.UnsafePathError
+	if !errors.As(err, &pathErr) {
+		return false
+	}
+	s.infof(r, "Rejected unsafe path: %s\n", err)
+	s.errorResponse(w, r, http.StatusBadRequest, errCodeInvalidPath, "Invalid path", unsafePathDetails{pathErr.Path, pathErr.Reason})
+	return true
+}
+
+// safePathParams rejects requests with URL parameters which can't be safely
+// used in storage paths. The "*" parameter must be a relative path, all other
+// parameters (user, directory, name, ...) must be single path elements and
+// the user can't be a reserved name (e.g. internal directory).
+func (s *Server) safePathParams(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rctx := chi.RouteContext(r.Context()); rctx != nil {
+			for i, key := range rctx.URLParams.Keys {
+				value := rctx.URLParams.Values[i]
+				var err error
+				if key == "*" {
+					if value != "" {
+						_, err = fs.CleanPath(value)
+					}
+				} else if key == "user" {
+					err = checkUsername(value)
+				} else {
+					_, err = fs.CleanName(value)
+				}
+				if err != nil {
+					s.pathErrorResponse(w, r, err)
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// projectFilePath returns storage path of the file within the project
+// directory. Each path element must be a relative path and the file must not
+// refer outside of the project directory (also by symbolic links).
+func (s *Server) projectFilePath(username, directory string, elem ...string) (string, error) {
+	clean := make([]string, len(elem))
+	for i, p := range elem {
+		var err error
+		if clean[i], err = fs.CleanPath(p); err != nil {
+			return "", err
+		}
+	}
+	file := path.Join(clean...)
+	if fs.IsExcluded(file) {
+		return "", reservedPathError(file)
+	}
+	projectDir := projectPath(username, directory)
+	if checker, ok := s.storage.(storage.PathChecker); ok {
+		if err := checker.CheckPath(projectDir, file); err != nil {
+			return "", err
+		}
+	}
+	return path.Join(projectDir, file), nil
+}
+
+// checkOwnerName rejects names of projects owners which would refer to
+// server's internal data in the storage root (.gisquick directory)
+func checkOwnerName(username string) error {
+	if fs.IsExcluded(username) {
+		return reservedPathError(username)
+	}
+	return nil
+}
+
+// checkUsername validates username used in storage paths, it must be a single
+// path element and not a reserved name
+func checkUsername(username string) error {
+	if _, err := fs.CleanName(username); err != nil {
+		return err
+	}
+	return checkOwnerName(username)
+}
+
+func reservedPathError(p string) error {
+	return &fs.UnsafePathError{Path: p, Reason: "reserved path"}
+}
+
+// cleanProjectPath validates path of a project file and returns it in
+// canonical form. Paths excluded from project files (e.g. server's internal
+// data in .gisquick directory) are rejected, so they can't be written by users.
+func cleanProjectPath(p string) (string, error) {
+	clean, err := fs.CleanPath(p)
+	if err != nil {
+		return "", err
+	}
+	if fs.IsExcluded(clean) {
+		return "", reservedPathError(p)
+	}
+	return clean, nil
+}
+
+// validateFilePaths checks that paths of declared project files are safe
+// and in canonical form (so they can be used as keys)
+func validateFilePaths(files []fs.File) error {
+	for _, f := range files {
+		clean, err := cleanProjectPath(f.Path)
+		if err != nil {
+			return err
+		}
+		if clean != f.Path {
+			return &fs.UnsafePathError{Path: f.Path, Reason: "not in canonical form"}
+		}
+	}
+	return nil
+}
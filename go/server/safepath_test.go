@@ -0,0 +1,231 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gislab-npo/gisquick-settings/fs"
+)
+
+// maliciousPaths are paths of project files which must be rejected
+var maliciousPaths = []string{
+	"",
+	".",
+	"..",
+	"../file.txt",
+	"../../user2/project/project.qgs",
+	"data/../../file.txt",
+	"/etc/passwd",
+	"C:/Windows/win.ini",
+	"..\\..\\file.txt",
+	"data\\file.txt",
+	"file\x00.txt",
+	".gisquick",
+	".gisquick/checksums.json",
+	".gisquick/acl/acl.json",
+	".gisquick/snapshots/manifests/20210101T000000.000Z.json",
+	".gisquick/uploads/0123/session.json",
+	"./.gisquick/checksums.json",
+	"data/../.gisquick/checksums.json",
+	"layer.gpkg-wal",
+	"project.qgs~",
+}
+
+func writeFile(t *testing.T, s *Server, relPath, content string) {
+	t.Helper()
+	p := filepath.Join(s.config.ProjectsRoot, filepath.FromSlash(relPath))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateFilePaths(t *testing.T) {
+	for _, p := range maliciousPaths {
+		if err := validateFilePaths([]fs.File{{Path: "valid.txt"}, {Path: p}}); err == nil {
+			t.Errorf("validateFilePaths(%q) is valid", p)
+		}
+	}
+	for _, p := range []string{"./file.txt", "data//file.txt", "data/"} {
+		if err := validateFilePaths([]fs.File{{Path: p}}); err == nil {
+			t.Errorf("validateFilePaths(%q) accepted path in non-canonical form", p)
+		}
+	}
+	valid := []fs.File{{Path: "project.qgs"}, {Path: "data/layer.gpkg"}, {Path: "data/.gisquick/file"}, {Path: "..data"}}
+	if err := validateFilePaths(valid); err != nil {
+		t.Errorf("validateFilePaths(valid paths) = %v", err)
+	}
+}
+
+func TestStagingSaveRejectsUnsafePaths(t *testing.T) {
+	s := newTestServer(t, Settings{})
+	staging, err := s.newStagingArea(nil, projectPath("user1", "project"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer staging.Discard()
+	for _, p := range maliciousPaths {
+		if _, err := staging.Save(strings.NewReader("x"), p, fs.SHA1); err == nil {
+			t.Errorf("Save(%q) succeeded", p)
+		}
+	}
+	if err := staging.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(s.config.ProjectsRoot, "user1", "project", ".gisquick", "checksums.json")); !os.IsNotExist(err) {
+		t.Errorf("internal file was written (%v)", err)
+	}
+}
+
+func TestProjectFilePath(t *testing.T) {
+	s := newTestServer(t, Settings{})
+	root := s.config.ProjectsRoot
+	writeFile(t, s, "user1/project/media/photo.jpg", "x")
+	writeFile(t, s, "user2/project/media/photo.jpg", "x")
+	os.Symlink(filepath.Join(root, "user2", "project"), filepath.Join(root, "user1", "project", "media", "other"))
+	os.Symlink(filepath.Join(root, "user1", "project", "media"), filepath.Join(root, "user1", "project", "media", "self"))
+
+	tests := []struct {
+		elem  []string
+		valid bool
+	}{
+		{[]string{"media", "photo.jpg"}, true},
+		{[]string{"media", "new/file.jpg"}, true},
+		{[]string{"media", "self/photo.jpg"}, true},
+		{[]string{"static", ".gisquick/file"}, true},
+		{[]string{"media", "other/media/photo.jpg"}, false},
+		{[]string{"media", "../../../user2/project/media/photo.jpg"}, false},
+		{[]string{"media", "/etc/passwd"}, false},
+		{[]string{"..", "file.txt"}, false},
+		{[]string{".gisquick", "acl/acl.json"}, false},
+		{[]string{"media/..", ".gisquick/checksums.json"}, false},
+	}
+	for _, tt := range tests {
+		p, err := s.projectFilePath("user1", "project", tt.elem...)
+		if (err == nil) != tt.valid {
+			t.Errorf("projectFilePath(%q) = %q, %v, want valid: %v", tt.elem, p, err, tt.valid)
+		}
+	}
+}
+
+func TestSafePathParams(t *testing.T) {
+	s := newTestServer(t, Settings{}, testUser)
+	writeFile(t, s, "user1/project/static/app.js", "app")
+	writeFile(t, s, "user2/project/static/secret.txt", "content of user2")
+	writeFile(t, s, "user2/project/secret.txt", "content of user2")
+
+	urls := []string{
+		"/api/project/static/user1/project/../../../user2/project/secret.txt",
+		"/api/project/static/user1/project/..%2F..%2F..%2Fuser2%2Fproject%2Fsecret.txt",
+		"/api/project/static/user1/project/%2e%2e/%2e%2e/%2e%2e/user2/project/secret.txt",
+		"/api/project/static/user1/project/%2e%2e%2f%2e%2e%2f%2e%2e%2fuser2/project/secret.txt",
+		"/api/project/static/user1/project/..%5c..%5c..%5cuser2%5cproject%5csecret.txt",
+		"/api/project/static/user1/project/%2Fetc%2Fpasswd",
+		"/api/project/static/user1/project/app.js%00.txt",
+		"/api/project/static/user1/..%2Fuser2%2Fproject/secret.txt",
+		"/api/project/static/user1/%2e%2e/user2/project/static/secret.txt",
+		"/api/project/static/..%2Fuser2/project/secret.txt",
+	}
+	for _, url := range urls {
+		w := request(s, "GET", url, "user1", nil, nil)
+		if w.Code == http.StatusOK || strings.Contains(w.Body.String(), "content of user2") {
+			t.Errorf("GET %s: %d %s", url, w.Code, w.Body)
+		}
+	}
+	if w := request(s, "GET", "/api/project/static/user1/project/app.js", "user1", nil, nil); w.Code != http.StatusOK {
+		t.Errorf("GET of valid static file: %d", w.Code)
+	}
+}
+
+func TestUploadRejectsReservedPaths(t *testing.T) {
+	s := newTestServer(t, Settings{}, testUser)
+	for _, p := range []string{".gisquick/checksums.json", ".gisquick/acl/acl.json", "../user2/project/project.qgs"} {
+		data, _ := json.Marshal(map[string]interface{}{"files": []fs.File{{Path: p, Size: 1}}})
+		w := request(s, "POST", uploadsURL, "user1", strings.NewReader(string(data)), map[string]string{"Content-Type": "application/json"})
+		if w.Code != http.StatusBadRequest || errorCode(w) != errCodeInvalidPath {
+			t.Errorf("upload session with file %s: %d %s", p, w.Code, w.Body)
+		}
+	}
+}
+
+func TestDeleteScriptWithUnsafePath(t *testing.T) {
+	s := newTestServer(t, Settings{}, testUser)
+	writeFile(t, s, "user2/project/project.qgs", "victim")
+	// scripts metadata can be written by project upload
+	writeFile(t, s, "user1/project/static/scripts.json", `{"evil": {"path": "../../../user2/project/project.qgs"}}`)
+
+	w := request(s, "DELETE", "/api/project/script/user1/project/evil", "user1", nil, nil)
+	if w.Code != http.StatusOK {
+		t.Errorf("delete of script: %d %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(filepath.Join(s.config.ProjectsRoot, "user2", "project", "project.qgs")); err != nil {
+		t.Errorf("file outside of the project was deleted (%v)", err)
+	}
+}
+
+// archiveUpload returns multipart body with zip archive of the files
+func archiveUpload(t *testing.T, files map[string]string) (*bytes.Buffer, map[string]string) {
+	t.Helper()
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	part, err := mw.CreateFormFile("file", "project.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(part)
+	for name, content := range files {
+		f, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	mw.Close()
+	return body, map[string]string{"Content-Type": mw.FormDataContentType()}
+}
+
+func TestArchiveUploadUnsafeUsername(t *testing.T) {
+	users := []*User{testUser, {Username: ".."}, {Username: "../user2"}, {Username: "a/b"}, {Username: ".gisquick"}}
+	s := newTestServer(t, Settings{}, users...)
+	for _, user := range users[1:] {
+		body, header := archiveUpload(t, map[string]string{"project/project.qgs": "<qgis/>"})
+		w := request(s, "POST", "/api/project/upload", user.Username, body, header)
+		if w.Code != http.StatusBadRequest || errorCode(w) != errCodeInvalidPath {
+			t.Errorf("archive upload of user %q: %d %s", user.Username, w.Code, w.Body)
+		}
+	}
+	filepath.Walk(filepath.Dir(s.config.ProjectsRoot), func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.Name() == "project.qgs" {
+			t.Errorf("archive was extracted: %s", p)
+		}
+		return nil
+	})
+
+	body, header := archiveUpload(t, map[string]string{"project/project.qgs": "<qgis/>"})
+	if w := request(s, "POST", "/api/project/upload", "user1", body, header); w.Code != http.StatusOK {
+		t.Errorf("archive upload: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestArchiveUploadInvalidBody(t *testing.T) {
+	s := newTestServer(t, Settings{}, testUser)
+	for _, body := range []string{"", "--boundary\r\nmalformed", "--boundary--\r\n"} {
+		w := request(s, "POST", "/api/project/upload", "user1", strings.NewReader(body), map[string]string{"Content-Type": "multipart/form-data; boundary=boundary"})
+		if w.Code != http.StatusBadRequest || errorCode(w) != errCodeInvalidArchive {
+			t.Errorf("archive upload with body %q: %d %s", body, w.Code, w.Body)
+		}
+	}
+}
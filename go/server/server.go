@@ -1,24 +1,68 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/gislab-npo/gisquick-settings/fs"
+	"github.com/gislab-npo/gisquick-settings/server/storage"
 	"github.com/go-chi/chi"
-	"github.com/go-chi/chi/middleware"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Config export
 type Config struct {
-	ProjectsRoot   string
-	MapCacheRoot   string
-	AppServer      string
-	MapServer      string
-	MaxFileUpload  int64
-	MaxProjectSize int64
+	ProjectsRoot string
+	MapCacheRoot string
+	AppServer    string
+	MapServer    string
+	// Token of the app server's API used to look up owners of personal API
+	// tokens by GET <AppServer>/api/auth/users/<username>/ with header
+	// "Authorization: Token <AppServerToken>". The app server responds with
+	// {"user": {...}} like for the session, or with 404 for unknown or
+	// inactive users. Personal API tokens are disabled when it's not set.
+	AppServerToken string
+	// Settings which can be changed while server is running
+	Settings
+	// Storage backend of projects files - "local" (default) or "s3".
+	// With S3 storage, ProjectsRoot is used as a key prefix in the bucket.
+	Storage string
+	S3      storage.S3Config
+	// Number of files hashed in parallel (0 means number of CPUs)
+	HashWorkers int
+	// Default ignore patterns of projects files (nil means fs.DefaultIgnorePatterns)
+	IgnorePatterns []string
+	// Name of the session cookie of the app server (default is "sessionid")
+	SessionCookie string
+	// Timeout of authentication requests to the app server (0 means no timeout)
+	AuthTimeout time.Duration
+	// Authenticated users are cached by session for this time (0 disables cache)
+	AuthCacheTTL time.Duration
+	// Authentication of users - "app" (default) by session of the app server,
+	// or "jwt" by JWT access tokens
+	Auth string
+	JWT  JWTConfig
+	// Custom authenticator (overrides Auth)
+	Authenticator Authenticator
+	// Bearer token required to read metrics (empty means public metrics)
+	MetricsToken string
+	// Export of traces
+	Tracing TracingConfig
+	// Server is not ready when free space of projects root or map cache root
+	// is below this size
+	MinFreeSpace int64
+	// Reject requests which don't match API specification
+	ValidateRequests bool
 }
 
 // User export
@@ -29,18 +73,25 @@ type User struct {
 	Email       string `json:"email"`
 	IsGuest     bool   `json:"is_guest"`
 	IsSuperuser bool   `json:"is_superuser"`
+	// Groups are used to grant access to projects of other users
+	Groups []string `json:"groups,omitempty"`
+	// personal API token used to authenticate the user (nil with session)
+	token *tokenInfo
 }
 
 type message struct {
 	Type   string          `json:"type"`
 	Status int             `json:"status,omitempty"`
 	Data   json.RawMessage `json:"data,omitempty"`
+	// ID of the request which triggered the message
+	RequestID string `json:"request_id,omitempty"`
 }
 
 type genericMessage struct {
-	Type   string      `json:"type"`
-	Status int         `json:"status,omitempty"`
-	Data   interface{} `json:"data"`
+	Type      string      `json:"type"`
+	Status    int         `json:"status,omitempty"`
+	Data      interface{} `json:"data"`
+	RequestID string      `json:"request_id,omitempty"`
 }
 
 /* Structure for managing websocket connections for concurrent access */
@@ -61,17 +112,82 @@ func (w *websocketsMap) Get(key string) *websocket.Conn {
 	return w.connections[key]
 }
 
+// Connections returns all active connections
+func (w *websocketsMap) Connections() []*websocket.Conn {
+	w.Lock()
+	defer w.Unlock()
+	var conns []*websocket.Conn
+	for _, conn := range w.connections {
+		if conn != nil {
+			conns = append(conns, conn)
+		}
+	}
+	return conns
+}
+
 func newWebsocketsMap() *websocketsMap {
 	return &websocketsMap{connections: make(map[string]*websocket.Conn)}
 }
 
+// CloseWebsockets sends close frames to all connected plugins and apps and
+// waits (with timeout) until clients close connections
+func (s *Server) CloseWebsockets(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "Server is shutting down")
+	conns := append(s.pluginsWs.Connections(), s.appsWs.Connections()...)
+	for _, conn := range conns {
+		if err := conn.WriteControl(websocket.CloseMessage, msg, deadline); err != nil {
+			conn.Close()
+		}
+	}
+	for time.Now().Before(deadline) {
+		if len(s.pluginsWs.Connections())+len(s.appsWs.Connections()) == 0 {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	for _, conn := range append(s.pluginsWs.Connections(), s.appsWs.Connections()...) {
+		conn.Close()
+	}
+}
+
 // Server export
 type Server struct {
 	config    Config
+	storage   storage.Storage
 	router    *chi.Mux
 	upgrader  websocket.Upgrader
 	pluginsWs *websocketsMap
 	appsWs    *websocketsMap
+	// access policies of routes (by method and route pattern)
+	policies map[string]routePolicy
+	aclMutex sync.Mutex
+	// serializes updates of personal API tokens
+	tokensMutex sync.Mutex
+	// locks of uploads commits by user (*sync.Mutex)
+	uploadLocks sync.Map
+	// current settings (*Settings), they can be changed by Reload
+	currentSettings atomic.Value
+	// authenticator of users and cache of its results
+	authenticator Authenticator
+	authCache     *authCache
+	metrics       *metrics
+	// background tasks are stopped by closing the stop channel
+	stop     chan struct{}
+	stopOnce sync.Once
+	tasks    sync.WaitGroup
+	// tracer of requests (noop tracer when tracing is disabled) and its
+	// provider (nil when tracing is disabled)
+	tracer         trace.Tracer
+	tracerProvider trace.TracerProvider
+}
+
+// Close stops background tasks of the server
+func (s *Server) Close() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+	s.tasks.Wait()
 }
 
 type contextKey string
@@ -88,17 +204,89 @@ func (s *Server) jsonResponse(w http.ResponseWriter, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	err := json.NewEncoder(w).Encode(data)
 	if err != nil {
-		log.Printf("Failed to serialize JSON: %s\n", err)
-		http.Error(w, "Server error", http.StatusInternalServerError)
+		s.errorf(nil, "Failed to serialize JSON: %s\n", err)
+		s.serverError(w, nil)
+	}
+}
+
+// projectPath returns storage path of the project directory or a file within the project
+func projectPath(username, directory string, elem ...string) string {
+	return path.Join(append([]string{username, directory}, elem...)...)
+}
+
+func (s *Server) readFile(path string) ([]byte, error) {
+	file, err := s.storage.Open(path)
+	if err != nil {
+		return nil, err
 	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
 }
 
-func (s *Server) sendJSONMessage(ws *websocket.Conn, name string, data interface{}) error {
+func (s *Server) copyFile(dest io.Writer, path string) error {
+	file, err := s.storage.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(dest, file)
+	return err
+}
+
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, path string) {
+	info, err := s.storage.Stat(path)
+	// directories are reported without modification time
+	if os.IsNotExist(err) || (err == nil && info.Mtime.IsZero()) {
+		s.notFound(w, r, "Not found")
+		return
+	}
+	if err != nil {
+		s.errorf(r, "Failed to read file: %s (%s)\n", path, err)
+		s.serverError(w, r)
+		return
+	}
+	file, err := s.storage.Open(path)
+	if err != nil {
+		s.errorf(r, "Failed to open file: %s (%s)\n", path, err)
+		s.serverError(w, r)
+		return
+	}
+	defer file.Close()
+	http.ServeContent(w, r, info.Path, info.Mtime, file)
+}
+
+func newStorage(config Config) (storage.Storage, error) {
+	switch config.Storage {
+	case "", "local":
+		local := storage.NewLocalStorage(config.ProjectsRoot)
+		local.HashWorkers = config.HashWorkers
+		local.Ignore = config.IgnorePatterns
+		return local, nil
+	case "s3":
+		s3, err := storage.NewS3Storage(config.S3, config.ProjectsRoot)
+		if err != nil {
+			return nil, err
+		}
+		s3.Ignore = config.IgnorePatterns
+		return s3, nil
+	}
+	return nil, fmt.Errorf("Unknown storage backend: %s", config.Storage)
+}
+
+// listInternal lists files in a directory with server's internal data (ignore
+// rules of projects files are not applied). For project directory it lists all
+// stored project files, including ignored ones.
+func (s *Server) listInternal(dir string) ([]fs.File, error) {
+	return s.storage.ListContext(context.Background(), dir, fs.ListOptions{Ignore: []string{}, SkipIgnoreFile: true})
+}
+
+// sendJSONMessage sends message triggered by the request
+func (s *Server) sendJSONMessage(ws *websocket.Conn, r *http.Request, name string, data interface{}) error {
 	jsonData, err := json.Marshal(data)
 	if err != nil {
 		return err
 	}
-	return ws.WriteJSON(message{Type: name, Data: jsonData})
+	return ws.WriteJSON(message{Type: name, Data: jsonData, RequestID: getRequestID(r)})
 }
 
 /*
@@ -133,32 +321,65 @@ func (s *Server) getProjectMetaFile(username, directory, projectName string) (st
 */
 
 func (s *Server) apiRoutes() {
-	s.router.Get("/ws/plugin", s.loginRequired(s.handlePluginWs()))
-	s.router.Get("/ws/app", s.loginRequired(s.handleAppWs()))
-	s.router.Get("/api/project/files/{user}/{directory}", s.loginRequired(s.handleProjectFiles()))
-	s.router.Post("/api/project/upload", s.loginRequired(s.handleArchiveUpload()))
-	s.router.Post("/api/project/upload/{user}/{directory}", s.loginRequired(s.handleUpload()))
-	s.router.Get("/api/project/download/{user}/{directory}", s.loginRequired(s.handleDownload()))
-	s.router.Delete("/api/project/delete/{user}/{directory}", s.loginRequired(s.handleProjectDelete()))
-	s.router.Post("/api/project/config/{user}/{directory}/{name}", s.loginRequired(s.handleSaveConfig()))
-	s.router.Post("/api/project/meta/{user}/{directory}/{name}", s.loginRequired(s.handleSaveProjectMeta()))
-	s.router.Get("/api/project/meta/{user}/{directory}/{name}", s.loginRequired(s.handleGetProjectMeta()))
+	// URL parameters (used in storage paths) are validated before access
+	// policy of the route is checked
+	r := s.router.With(s.safePathParams, s.authorize)
+	if s.config.ValidateRequests {
+		r = r.With(s.validateRequest)
+	}
+	s.route(r, "GET", "/api/openapi.json", accessPublic, s.handleOpenAPI())
+	s.route(r, "POST", "/api/auth/invalidate", accessPublic, s.handleInvalidateSession())
+	s.route(r, "GET", "/metrics", accessPublic, s.handleMetrics())
+	s.route(r, "GET", "/healthz", accessPublic, s.handleHealth())
+	s.route(r, "GET", "/readyz", accessPublic, s.handleReady())
+	s.route(r, "GET", "/api/tokens", accessLogin, s.handleListTokens())
+	s.route(r, "POST", "/api/tokens", accessLogin, s.handleCreateToken())
+	s.route(r, "DELETE", "/api/tokens/{id}", accessLogin, s.handleRevokeToken())
+	s.routeScope(r, "GET", "/ws/plugin", accessWrite, s.handlePluginWs())
+	s.route(r, "GET", "/ws/app", accessLogin, s.handleAppWs())
+	s.route(r, "GET", "/api/project/files/{user}/{directory}", accessRead, s.handleProjectFiles())
+	s.routeScope(r, "POST", "/api/project/upload", accessWrite, s.handleArchiveUpload())
+	s.route(r, "POST", "/api/project/upload/{user}/{directory}", accessWrite, s.handleUpload())
+	s.route(r, "GET", "/api/project/download/{user}/{directory}", accessRead, s.handleDownload())
+	s.route(r, "POST", "/api/project/diff/{user}/{directory}", accessRead, s.handleProjectDiff())
+	s.route(r, "GET", "/api/project/hash-algorithms", accessLogin, s.handleHashAlgorithms())
+	s.route(r, "POST", "/api/project/uploads/{user}/{directory}", accessWrite, s.handleUploadSessionCreate())
+	s.route(r, "GET", "/api/project/uploads/{user}/{directory}/{id}", accessWrite, s.handleUploadSessionStatus())
+	s.route(r, "DELETE", "/api/project/uploads/{user}/{directory}/{id}", accessWrite, s.handleUploadSessionDelete())
+	s.route(r, "PATCH", "/api/project/uploads/{user}/{directory}/{id}/files/*", accessWrite, s.handleUploadChunk())
+	s.route(r, "POST", "/api/project/uploads/{user}/{directory}/{id}/commit", accessWrite, s.handleUploadSessionCommit())
+	s.route(r, "DELETE", "/api/project/delete/{user}/{directory}", accessAdmin, s.handleProjectDelete())
+	s.route(r, "POST", "/api/project/config/{user}/{directory}/{name}", accessAdmin, s.handleSaveConfig())
+	s.route(r, "POST", "/api/project/meta/{user}/{directory}/{name}", accessWrite, s.handleSaveProjectMeta())
+	s.route(r, "GET", "/api/project/meta/{user}/{directory}/{name}", accessRead, s.handleGetProjectMeta())
+
+	s.route(r, "DELETE", "/api/project/cache/{user}/{directory}/{name}", accessWrite, s.handleCacheDelete())
+	s.routeProject(r, "GET", "/api/project/map", accessRead, mapProject, s.handleGetMap())
 
-	s.router.Delete("/api/project/cache/{user}/{directory}/{name}", s.loginRequired(s.handleCacheDelete()))
-	s.router.Get("/api/project/map", s.loginRequired(s.handleGetMap()))
+	s.route(r, "GET", "/api/project/script/{user}/{directory}", accessRead, s.handleScriptsInfo())
+	s.route(r, "POST", "/api/project/script/{user}/{directory}", accessAdmin, s.handleUploadScript())
+	s.route(r, "DELETE", "/api/project/script/{user}/{directory}/{module}", accessAdmin, s.handleDeleteScript())
+	s.route(r, "GET", "/api/project/static/{user}/{directory}/*", accessPublic, s.handleStaticFile())
 
-	s.router.Get("/api/project/script/{user}/{directory}", s.loginRequired(s.handleScriptsInfo()))
-	s.router.Post("/api/project/script/{user}/{directory}", s.loginRequired(s.handleUploadScript()))
-	s.router.Delete("/api/project/script/{user}/{directory}/{module}", s.loginRequired(s.handleDeleteScript()))
-	s.router.Get("/api/project/static/{user}/{directory}/*", s.handleStaticFile())
+	s.route(r, "GET", "/api/project/media/{user}/{directory}/*", accessRead, s.handleMediaFile())
+	s.route(r, "POST", "/api/project/media/{user}/{directory}", accessWrite, s.handleMediaFileUpload())
 
-	s.router.Get("/api/project/media/{user}/{directory}/*", s.loginRequired(s.handleMediaFile()))
-	s.router.Post("/api/project/media/{user}/{directory}", s.loginRequired(s.handleMediaFileUpload()))
+	s.route(r, "GET", "/api/project/acl/{user}/{directory}", accessAdmin, s.handleGetACL())
+	s.route(r, "PUT", "/api/project/acl/{user}/{directory}", accessAdmin, s.handleSetACL())
+	s.route(r, "PUT", "/api/project/acl/{user}/{directory}/{kind}/{name}", accessAdmin, s.handleSetACLEntry())
+	s.route(r, "DELETE", "/api/project/acl/{user}/{directory}/{kind}/{name}", accessAdmin, s.handleDeleteACLEntry())
+
+	s.routeProject(r, "GET", "/api/usage/{user}", accessAdmin, userAccount, s.handleStorageUsage())
+
+	s.route(r, "GET", "/api/project/snapshots/{user}/{directory}", accessRead, s.handleSnapshotsList())
+	s.route(r, "GET", "/api/project/snapshots/{user}/{directory}/{id}", accessRead, s.handleSnapshotDownload())
+	s.route(r, "POST", "/api/project/snapshots/{user}/{directory}/{id}/restore", accessWrite, s.handleSnapshotRestore())
 }
 
 func (s *Server) devRoutes() {
-	s.router.Post("/api/auth/login/", s.handleProxyRequest())
-	s.router.HandleFunc("/api/auth/logout/", s.handleProxyRequest())
+	r := s.router.With(s.authorize)
+	s.route(r, "POST", "/api/auth/login/", accessPublic, s.handleProxyRequest())
+	s.route(r, "*", "/api/auth/logout/", accessPublic, s.handleLogout())
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -166,18 +387,61 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 // NewServer export
-func NewServer(config Config, dev bool) *Server {
+func NewServer(config Config, dev bool) (*Server, error) {
 	var upgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
-		CheckOrigin:     func(r *http.Request) bool { return true },
 	}
-	//
-	s := Server{config, chi.NewRouter(), upgrader, newWebsocketsMap(), newWebsocketsMap()}
-	s.router.Use(middleware.Logger)
+	store, err := newStorage(config)
+	if err != nil {
+		return nil, err
+	}
+	s := Server{
+		config:    config,
+		storage:   store,
+		router:    chi.NewRouter(),
+		upgrader:  upgrader,
+		pluginsWs: newWebsocketsMap(),
+		appsWs:    newWebsocketsMap(),
+		policies:  make(map[string]routePolicy),
+		stop:      make(chan struct{}),
+	}
+	s.metrics = newMetrics(s.pluginsWs, s.appsWs)
+	settings := config.Settings
+	s.currentSettings.Store(&settings)
+	s.upgrader.CheckOrigin = s.checkOrigin
+	s.upgrader.Error = func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+		code := errCodeBadRequest
+		if status == http.StatusForbidden {
+			code = errCodeForbidden
+		}
+		s.errorResponse(w, r, status, code, http.StatusText(status), map[string]string{"reason": reason.Error()})
+	}
+	if err = s.setupTracing(); err != nil {
+		return nil, err
+	}
+	s.authenticator, err = s.newAuthenticator(config)
+	if err != nil {
+		return nil, err
+	}
+	if config.AuthCacheTTL > 0 {
+		s.authCache = newAuthCache(config.AuthCacheTTL)
+	}
+	s.router.Use(s.requestID, s.traceRequest, s.requestLogger, s.instrument)
+	s.router.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		s.notFound(w, r, "Not found")
+	})
+	s.router.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		s.errorResponse(w, r, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Method not allowed", nil)
+	})
 	s.apiRoutes()
 	if dev {
 		s.devRoutes()
 	}
-	return &s
+	s.checkAPIOperations()
+	if config.MapCacheRoot != "" {
+		s.tasks.Add(1)
+		go s.monitorMapCache()
+	}
+	return &s, nil
 }
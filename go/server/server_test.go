@@ -0,0 +1,87 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// testAuthenticator authenticates users by X-Test-User header
+type testAuthenticator map[string]*User
+
+func (a testAuthenticator) Authenticate(r *http.Request) (*User, error) {
+	if user, ok := a[r.Header.Get("X-Test-User")]; ok {
+		copy := *user
+		return &copy, nil
+	}
+	return nil, nil
+}
+
+func (a testAuthenticator) CacheKey(r *http.Request) string {
+	return ""
+}
+
+func (a testAuthenticator) LookupUser(r *http.Request, username string) (*User, error) {
+	if user, ok := a[username]; ok {
+		copy := *user
+		return &copy, nil
+	}
+	return nil, nil
+}
+
+// newTestServer creates server with local storage in temporary directory
+func newTestServer(t *testing.T, settings Settings, users ...*User) *Server {
+	t.Helper()
+	return newTestServerConfig(t, Config{Settings: settings}, users...)
+}
+
+// newTestServerConfig creates server with the config (with test defaults of
+// unset storage directories, settings and authenticator)
+func newTestServerConfig(t *testing.T, config Config, users ...*User) *Server {
+	t.Helper()
+	auth := make(testAuthenticator, len(users))
+	for _, user := range users {
+		auth[user.Username] = user
+	}
+	settings := config.Settings
+	if settings.MaxFileUpload == 0 {
+		settings.MaxFileUpload = 1024 * 1024
+	}
+	if settings.MaxProjectSize == 0 {
+		settings.MaxProjectSize = 1024 * 1024
+	}
+	if settings.LogLevel == "" {
+		settings.LogLevel = "error"
+	}
+	config.Settings = settings
+	if config.ProjectsRoot == "" {
+		config.ProjectsRoot = t.TempDir()
+	}
+	if config.MapCacheRoot == "" {
+		config.MapCacheRoot = t.TempDir()
+	}
+	if config.Authenticator == nil {
+		config.Authenticator = auth
+	}
+	s, err := NewServer(config, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// request sends request of the user (empty username means anonymous user)
+func request(s *Server, method, url, username string, body io.Reader, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, body)
+	if username != "" {
+		r.Header.Set("X-Test-User", username)
+	}
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
@@ -0,0 +1,387 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gislab-npo/gisquick-settings/fs"
+	"github.com/gislab-npo/gisquick-settings/server/storage"
+	"github.com/go-chi/chi"
+)
+
+/*
+Snapshots are stored in the project's .gisquick/snapshots directory:
+  manifests/<id>.json - list of project files (with checksums) after upload
+  blobs/<hash>        - content of files, shared between snapshots
+Only content which is not already stored in blobs is copied on new snapshot.
+*/
+
+type snapshot struct {
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	User    string    `json:"user"`
+	Files   []fs.File `json:"files"`
+}
+
+type snapshotInfo struct {
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	User    string    `json:"user"`
+	Files   int       `json:"files"`
+	Size    int64     `json:"size"`
+}
+
+func snapshotsDir(username, directory string) string {
+	return projectPath(username, directory, ".gisquick", "snapshots")
+}
+
+func (s *Server) copyStorageFile(src, dest string) error {
+	file, err := s.storage.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return storage.SaveFile(s.storage, file, dest)
+}
+
+func (s *Server) loadSnapshot(username, directory, id string) (*snapshot, error) {
+	data, err := s.readFile(path.Join(snapshotsDir(username, directory), "manifests", id+".json"))
+	if err != nil {
+		return nil, err
+	}
+	var snap snapshot
+	if err = json.Unmarshal(data, &snap); err != nil {
+		return nil, err
+	}
+	if err = validateSnapshot(&snap); err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+// isBlobHash reports whether the checksum is a lowercase hex digest of
+// the hash algorithm, so it can be used as a name of blob file
+func isBlobHash(hash, algorithm string) bool {
+	h, err := fs.NewHash(algorithm)
+	if err != nil || len(hash) != 2*h.Size() {
+		return false
+	}
+	for _, c := range hash {
+		if !('0' <= c && c <= '9') && !('a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// validateSnapshot checks paths and checksums of files in the manifest
+// (manifest is a stored file, so it must not be trusted when building
+// storage paths)
+func validateSnapshot(snap *snapshot) error {
+	if err := validateFilePaths(snap.Files); err != nil {
+		return err
+	}
+	for _, f := range snap.Files {
+		if !isBlobHash(f.Hash, f.Algorithm) {
+			return fmt.Errorf("invalid checksum of file %s: %q", f.Path, f.Hash)
+		}
+	}
+	return nil
+}
+
+// listSnapshots returns snapshots of the project sorted from the oldest one
+func (s *Server) listSnapshots(username, directory string) ([]snapshot, error) {
+	files, err := s.listInternal(path.Join(snapshotsDir(username, directory), "manifests"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []snapshot{}, nil
+		}
+		return nil, err
+	}
+	snapshots := make([]snapshot, 0, len(files))
+	for _, f := range files {
+		snap, err := s.loadSnapshot(username, directory, strings.TrimSuffix(f.Path, ".json"))
+		if err != nil {
+			s.errorf(nil, "Invalid snapshot manifest: %s (%s)\n", f.Path, err)
+			continue
+		}
+		snapshots = append(snapshots, *snap)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Created.Before(snapshots[j].Created)
+	})
+	return snapshots, nil
+}
+
+// createSnapshot records current state of the project (caller must hold
+// lockUploads of the project owner)
+func (s *Server) createSnapshot(username, directory, author string) error {
+	if s.settings().SnapshotsLimit <= 0 {
+		return nil
+	}
+	projectDir := projectPath(username, directory)
+	blobsDir := path.Join(snapshotsDir(username, directory), "blobs")
+	files, err := s.storage.List(projectDir, true)
+	if err != nil {
+		return err
+	}
+	// content which is not stored yet
+	var newFiles []fs.File
+	var newSize int64
+	newBlobs := make(map[string]bool)
+	for _, f := range files {
+		if newBlobs[f.Hash] {
+			continue
+		}
+		if _, err := s.storage.Stat(path.Join(blobsDir, f.Hash)); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		newBlobs[f.Hash] = true
+		newFiles = append(newFiles, f)
+		newSize += f.Size
+	}
+	if err := s.checkSnapshotQuota(username, newSize); err != nil {
+		return err
+	}
+	for _, f := range newFiles {
+		if err := s.copyStorageFile(path.Join(projectDir, f.Path), path.Join(blobsDir, f.Hash)); err != nil {
+			return err
+		}
+	}
+	// random suffix keeps IDs of snapshots created in the same millisecond
+	// unique
+	suffix, err := randomString(4, hex.EncodeToString)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	snap := snapshot{ID: now.Format("20060102T150405.000Z") + "-" + suffix, Created: now, User: author, Files: files}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	manifest := path.Join(snapshotsDir(username, directory), "manifests", snap.ID+".json")
+	if err = storage.SaveFile(s.storage, bytes.NewReader(data), manifest); err != nil {
+		return err
+	}
+	return s.pruneSnapshots(username, directory)
+}
+
+// checkSnapshotQuota returns error when storing new content of snapshot of
+// given size would exceed snapshots quota of the project owner
+func (s *Server) checkSnapshotQuota(username string, size int64) error {
+	quota := s.snapshotsQuota(username)
+	if quota <= 0 || size <= 0 {
+		return nil
+	}
+	usage, err := s.userUsage(username)
+	if err != nil {
+		return err
+	}
+	if usage.Snapshots+size > quota {
+		return fmt.Errorf("snapshots quota exceeded (used: %d, quota: %d, snapshot: %d)", usage.Snapshots, quota, size)
+	}
+	return nil
+}
+
+// pruneSnapshots removes snapshots according to retention policy (the latest
+// snapshot is always kept) and content of files not used by any snapshot
+// (caller must hold lockUploads of the project owner)
+func (s *Server) pruneSnapshots(username, directory string) error {
+	snapshots, err := s.listSnapshots(username, directory)
+	if err != nil {
+		return err
+	}
+	root := snapshotsDir(username, directory)
+	settings := s.settings()
+	// limit could be changed by reload of settings
+	limit := settings.SnapshotsLimit
+	if limit < 1 {
+		limit = 1
+	}
+	keep := snapshots
+	if len(keep) > limit {
+		keep = keep[len(keep)-limit:]
+	}
+	if settings.SnapshotsMaxAge > 0 {
+		minTime := time.Now().Add(-settings.SnapshotsMaxAge)
+		for len(keep) > 1 && keep[0].Created.Before(minTime) {
+			keep = keep[1:]
+		}
+	}
+	if len(keep) == len(snapshots) {
+		return nil
+	}
+	for _, snap := range snapshots[:len(snapshots)-len(keep)] {
+		if err := s.storage.Remove(path.Join(root, "manifests", snap.ID+".json")); err != nil {
+			return err
+		}
+	}
+	used := make(map[string]bool)
+	for _, snap := range keep {
+		for _, f := range snap.Files {
+			used[f.Hash] = true
+		}
+	}
+	blobs, err := s.listInternal(path.Join(root, "blobs"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, blob := range blobs {
+		if !used[blob.Path] {
+			if err := s.storage.Remove(path.Join(root, "blobs", blob.Path)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) handleSnapshotsList() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := chi.URLParam(r, "user")
+		directory := chi.URLParam(r, "directory")
+		snapshots, err := s.listSnapshots(username, directory)
+		if err != nil {
+			s.errorf(r, "Failed to list snapshots: %s\n", err)
+			s.serverError(w, r)
+			return
+		}
+		data := make([]snapshotInfo, len(snapshots))
+		for i, snap := range snapshots {
+			var size int64
+			for _, f := range snap.Files {
+				size += f.Size
+			}
+			data[i] = snapshotInfo{snap.ID, snap.Created, snap.User, len(snap.Files), size}
+		}
+		s.jsonResponse(w, data)
+	}
+}
+
+func (s *Server) handleSnapshotDownload() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := chi.URLParam(r, "user")
+		directory := chi.URLParam(r, "directory")
+		id := chi.URLParam(r, "id")
+		snap, err := s.loadSnapshot(username, directory, id)
+		if err != nil {
+			if os.IsNotExist(err) {
+				s.notFound(w, r, "Snapshot not found")
+			} else {
+				s.errorf(r, "Failed to load snapshot: %s\n", err)
+				s.serverError(w, r)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s_%s.zip", directory, snap.ID))
+		writer := zip.NewWriter(w)
+		defer writer.Close()
+
+		blobsDir := path.Join(snapshotsDir(username, directory), "blobs")
+		for _, f := range snap.Files {
+			part, err := writer.Create(path.Join(directory, f.Path))
+			if err != nil {
+				s.serverError(w, r)
+				return
+			}
+			if err = s.copyFile(part, path.Join(blobsDir, f.Hash)); err != nil {
+				s.errorf(r, "Snapshot download error: %s\n", err)
+				s.serverError(w, r)
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) handleSnapshotRestore() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(contextKeyUser).(*User)
+		username := chi.URLParam(r, "user")
+		directory := chi.URLParam(r, "directory")
+		id := chi.URLParam(r, "id")
+		snap, err := s.loadSnapshot(username, directory, id)
+		if err != nil {
+			if os.IsNotExist(err) {
+				s.notFound(w, r, "Snapshot not found")
+			} else {
+				s.errorf(r, "Failed to load snapshot: %s\n", err)
+				s.serverError(w, r)
+			}
+			return
+		}
+		projectDir := projectPath(username, directory)
+		blobsDir := path.Join(snapshotsDir(username, directory), "blobs")
+
+		unlock := s.lockUploads(username)
+		defer unlock()
+		snapshotFiles := make(map[string]bool, len(snap.Files))
+		for _, f := range snap.Files {
+			snapshotFiles[f.Path] = true
+		}
+		currentFiles, err := s.storage.List(projectDir, false)
+		if err != nil {
+			s.errorf(r, "Failed to list project files: %s\n", err)
+			s.serverError(w, r)
+			return
+		}
+		removes := []string{}
+		for _, f := range currentFiles {
+			if !snapshotFiles[f.Path] {
+				removes = append(removes, f.Path)
+			}
+		}
+		// limits could be lowered after the snapshot was created
+		if !s.checkUploadLimits(w, r, user, username, projectDir, snap.Files, removes, 0) {
+			return
+		}
+
+		staging, err := s.newStagingArea(r, projectDir)
+		if err != nil {
+			s.errorf(r, "Failed to restore snapshot: %s\n", err)
+			s.serverError(w, r)
+			return
+		}
+		defer staging.Discard()
+		for _, f := range snap.Files {
+			if err := s.copyStorageFile(path.Join(blobsDir, f.Hash), staging.Path(f.Path)); err != nil {
+				s.errorf(r, "Failed to restore snapshot file: %s (%s)\n", f.Path, err)
+				s.serverError(w, r)
+				return
+			}
+			staging.Add(f.Path)
+		}
+		if err := staging.Commit(); err != nil {
+			if s.pathErrorResponse(w, r, err) {
+				return
+			}
+			s.errorf(r, "Failed to restore snapshot: %s\n", err)
+			s.serverError(w, r)
+			return
+		}
+		for _, p := range removes {
+			if err := s.storage.Remove(path.Join(projectDir, p)); err != nil && !os.IsNotExist(err) {
+				s.errorf(r, "Failed to remove file: %s (%s)\n", p, err)
+			}
+		}
+		if err := s.createSnapshot(username, directory, user.Username); err != nil {
+			s.errorf(r, "Failed to create project snapshot: %s\n", err)
+		}
+		w.Write([]byte(""))
+	}
+}
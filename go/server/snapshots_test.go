@@ -0,0 +1,195 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gislab-npo/gisquick-settings/fs"
+)
+
+// snapshotProject writes files into the project and records its snapshot
+func snapshotProject(t *testing.T, s *Server, files map[string]string) snapshot {
+	t.Helper()
+	for p, content := range files {
+		writeFile(t, s, "user1/project/"+p, content)
+	}
+	// snapshots are ordered by time of creation
+	time.Sleep(2 * time.Millisecond)
+	unlock := s.lockUploads("user1")
+	defer unlock()
+	if err := s.createSnapshot("user1", "project", "user1"); err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err := s.listSnapshots("user1", "project")
+	if err != nil || len(snapshots) == 0 {
+		t.Fatalf("listSnapshots() = %v, %v", snapshots, err)
+	}
+	return snapshots[len(snapshots)-1]
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	s := newTestServer(t, Settings{SnapshotsLimit: 5}, testUser)
+	snap := snapshotProject(t, s, map[string]string{"project.qgs": "original", "data/a.txt": "a"})
+
+	writeFile(t, s, "user1/project/project.qgs", "changed")
+	writeFile(t, s, "user1/project/data/b.txt", "b")
+	os.Remove(filepath.Join(s.config.ProjectsRoot, "user1", "project", "data", "a.txt"))
+
+	w := request(s, "POST", "/api/project/snapshots/user1/project/"+snap.ID+"/restore", "user1", nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("restore: %d %s", w.Code, w.Body)
+	}
+	expected := map[string]string{"project.qgs": "original", "data/a.txt": "a"}
+	files, err := s.storage.List(projectPath("user1", "project"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(expected) {
+		t.Errorf("restored files: %+v", files)
+	}
+	for p, content := range expected {
+		data, err := ioutil.ReadFile(filepath.Join(s.config.ProjectsRoot, "user1", "project", filepath.FromSlash(p)))
+		if err != nil || string(data) != content {
+			t.Errorf("restored file %s: %q (%v)", p, data, err)
+		}
+	}
+}
+
+func TestSnapshotRestoreLimits(t *testing.T) {
+	s := newTestServer(t, Settings{SnapshotsLimit: 5, MaxProjectSize: 15}, testUser)
+	// project was created before the limit was set
+	snap := snapshotProject(t, s, map[string]string{"project.qgs": "01234567890123456789"})
+	writeFile(t, s, "user1/project/project.qgs", "small")
+
+	w := request(s, "POST", "/api/project/snapshots/user1/project/"+snap.ID+"/restore", "user1", nil, nil)
+	if w.Code != http.StatusBadRequest || errorCode(w) != errCodeUploadTooLarge {
+		t.Errorf("restore over limit: %d %s", w.Code, w.Body)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(s.config.ProjectsRoot, "user1", "project", "project.qgs"))
+	if string(data) != "small" {
+		t.Errorf("project was changed by rejected restore: %q", data)
+	}
+}
+
+func TestSnapshotsQuota(t *testing.T) {
+	s := newTestServer(t, Settings{SnapshotsLimit: 5, SnapshotsQuota: 25, UserQuota: 1000}, testUser)
+	snapshotProject(t, s, map[string]string{"project.qgs": "0123456789", "data.txt": "abcdefghij"})
+	// shared content is stored once
+	snapshotProject(t, s, map[string]string{"copy.txt": "abcdefghij"})
+
+	writeFile(t, s, "user1/project/project.qgs", "new content")
+	unlock := s.lockUploads("user1")
+	err := s.createSnapshot("user1", "project", "user1")
+	unlock()
+	if err == nil {
+		t.Error("snapshot over quota was created")
+	}
+	if snapshots, _ := s.listSnapshots("user1", "project"); len(snapshots) != 2 {
+		t.Errorf("snapshots: %d", len(snapshots))
+	}
+	usage, err := s.userUsage("user1")
+	if err != nil || usage.Snapshots != 20 || usage.Used != 31 || *usage.Free != 1000-31 {
+		t.Errorf("userUsage() = %+v, %v", usage, err)
+	}
+
+	// quota of snapshots is the same as user's quota by default
+	settings := *s.settings()
+	settings.SnapshotsQuota = 0
+	s.Reload(settings)
+	if quota := s.snapshotsQuota("user1"); quota != 1000 {
+		t.Errorf("snapshotsQuota() = %d", quota)
+	}
+	snapshotProject(t, s, nil)
+}
+
+func TestSnapshotIDsAreUnique(t *testing.T) {
+	s := newTestServer(t, Settings{SnapshotsLimit: 10}, testUser)
+	writeFile(t, s, "user1/project/project.qgs", "<qgis/>")
+	unlock := s.lockUploads("user1")
+	for i := 0; i < 5; i++ {
+		if err := s.createSnapshot("user1", "project", "user1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	unlock()
+	snapshots, err := s.listSnapshots("user1", "project")
+	if err != nil || len(snapshots) != 5 {
+		t.Fatalf("listSnapshots() = %v, %v", snapshots, err)
+	}
+	ids := make(map[string]bool)
+	for _, snap := range snapshots {
+		ids[snap.ID] = true
+	}
+	if len(ids) != len(snapshots) {
+		t.Errorf("IDs of snapshots are not unique: %v", ids)
+	}
+}
+
+func TestSnapshotsPrune(t *testing.T) {
+	s := newTestServer(t, Settings{SnapshotsLimit: 2}, testUser)
+	first := snapshotProject(t, s, map[string]string{"project.qgs": "v1", "data.txt": "shared"})
+	second := snapshotProject(t, s, map[string]string{"project.qgs": "v2"})
+	third := snapshotProject(t, s, map[string]string{"project.qgs": "v3"})
+
+	snapshots, err := s.listSnapshots("user1", "project")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 || snapshots[0].ID != second.ID || snapshots[1].ID != third.ID {
+		t.Fatalf("snapshots after pruning: %+v", snapshots)
+	}
+	blobs := func(snap snapshot) map[string]string {
+		m := make(map[string]string, len(snap.Files))
+		for _, f := range snap.Files {
+			m[f.Path] = filepath.Join(s.config.ProjectsRoot, snapshotsDir("user1", "project"), "blobs", f.Hash)
+		}
+		return m
+	}
+	if _, err := os.Stat(blobs(first)["project.qgs"]); !os.IsNotExist(err) {
+		t.Errorf("blob of pruned snapshot was not removed: %v", err)
+	}
+	// content of the unchanged file is still referenced by kept snapshots
+	for _, snap := range []snapshot{first, second, third} {
+		for p, blob := range blobs(snap) {
+			if snap.ID == first.ID && p == "project.qgs" {
+				continue
+			}
+			if _, err := os.Stat(blob); err != nil {
+				t.Errorf("blob of %s in snapshot %s: %v", p, snap.ID, err)
+			}
+		}
+	}
+}
+
+func TestValidateSnapshot(t *testing.T) {
+	const sha1 = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	tests := []struct {
+		name  string
+		file  fs.File
+		valid bool
+	}{
+		{"sha1", fs.File{Path: "data/layer.gpkg", Hash: sha1}, true},
+		{"sha256", fs.File{Path: "a", Hash: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", Algorithm: fs.SHA256}, true},
+		{"xxhash", fs.File{Path: "a", Hash: "ef46db3751d8e999", Algorithm: fs.XXHash}, true},
+		{"empty hash", fs.File{Path: "a"}, false},
+		{"traversal hash", fs.File{Path: "a", Hash: "../../../../other/project/project.qgs"}, false},
+		{"traversal of hash length", fs.File{Path: "a", Hash: "../../../../../../../../../../../etc/pwd"}, false},
+		{"uppercase hash", fs.File{Path: "a", Hash: "DA39A3EE5E6B4B0D3255BFEF95601890AFD80709"}, false},
+		{"wrong length", fs.File{Path: "a", Hash: sha1, Algorithm: fs.SHA256}, false},
+		{"unknown algorithm", fs.File{Path: "a", Hash: sha1, Algorithm: "md5"}, false},
+		{"traversal path", fs.File{Path: "../other/project.qgs", Hash: sha1}, false},
+		{"absolute path", fs.File{Path: "/etc/passwd", Hash: sha1}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateSnapshot(&snapshot{Files: []fs.File{tt.file}})
+			if (err == nil) != tt.valid {
+				t.Errorf("validateSnapshot(%+v) error = %v, want valid: %v", tt.file, err, tt.valid)
+			}
+		})
+	}
+}
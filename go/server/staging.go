@@ -0,0 +1,169 @@
+package server
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/gislab-npo/gisquick-settings/fs"
+	"github.com/gislab-npo/gisquick-settings/server/storage"
+)
+
+// stagingArea collects files of a project update in a temporary directory
+// (inside of project's .gisquick directory). Files are moved into the project
+// directory only when the whole update was received (Commit), otherwise all
+// received data are removed (Discard).
+type stagingArea struct {
+	// server and request of the update (used for logging)
+	server     *Server
+	request    *http.Request
+	storage    storage.Storage
+	projectDir string
+	dir        string
+	files      map[string]bool
+	checksums  []fs.File
+}
+
+func (s *Server) newStagingArea(r *http.Request, projectDir string) (*stagingArea, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	dir := path.Join(projectDir, ".gisquick", "staging", fmt.Sprintf("%x", id))
+	return &stagingArea{s, r, s.storage, projectDir, dir, make(map[string]bool), nil}, nil
+}
+
+// Path returns storage path of the staged file
+func (st *stagingArea) Path(file string) string {
+	return path.Join(st.dir, file)
+}
+
+// Add marks file written directly into Path(file) as a part of the update
+func (st *stagingArea) Add(file string) {
+	st.files[file] = true
+}
+
+// Save stores file into staging area and returns its size and checksum
+// (computed with given hash algorithm). Paths excluded from project files
+// are rejected.
+func (st *stagingArea) Save(src io.Reader, file, algorithm string) (fs.File, error) {
+	h, err := fs.NewHash(algorithm)
+	if err != nil {
+		return fs.File{}, err
+	}
+	if file, err = cleanProjectPath(file); err != nil {
+		return fs.File{}, err
+	}
+	dest, err := st.storage.Create(st.Path(file))
+	if err != nil {
+		return fs.File{}, err
+	}
+	size, err := io.Copy(io.MultiWriter(dest, h), src)
+	if err != nil {
+		dest.Abort()
+		return fs.File{}, err
+	}
+	if err = dest.Close(); err != nil {
+		return fs.File{}, err
+	}
+	st.Add(file)
+	f := fs.File{Path: file, Hash: fmt.Sprintf("%x", h.Sum(nil)), Size: size, Algorithm: algorithm}
+	st.checksums = append(st.checksums, f)
+	return f, nil
+}
+
+// Commit moves all staged files into the project directory. QGIS project
+// files are moved as the last ones, so they don't reference missing data.
+// Checksums of saved files are recorded (when supported by the storage).
+// Nothing is moved when some file would be written outside of the project
+// directory through symbolic link.
+//
+// Replaced files are moved into the staging directory first. When some file
+// can't be moved, already moved files are removed and the replaced ones are
+// restored, so the project is either updated as a whole or left unchanged.
+func (st *stagingArea) Commit() error {
+	files := make([]string, 0, len(st.files))
+	for file := range st.files {
+		files = append(files, file)
+	}
+	isProjectFile := func(file string) bool {
+		ext := strings.ToLower(path.Ext(file))
+		return ext == ".qgs" || ext == ".qgz"
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return !isProjectFile(files[i]) && isProjectFile(files[j])
+	})
+	if checker, ok := st.storage.(storage.PathChecker); ok {
+		for _, file := range files {
+			if err := checker.CheckPath(st.projectDir, file); err != nil {
+				return err
+			}
+		}
+	}
+	var moved []string
+	replaced := make(map[string]bool)
+	for _, file := range files {
+		dest := path.Join(st.projectDir, file)
+		_, err := st.storage.Stat(dest)
+		if err == nil {
+			err = st.storage.Rename(dest, st.replacedPath(file))
+			if err == nil {
+				replaced[file] = true
+			}
+		} else if os.IsNotExist(err) {
+			err = nil
+		}
+		if err == nil {
+			err = st.storage.Rename(st.Path(file), dest)
+		}
+		if err != nil {
+			st.rollback(moved, replaced)
+			return err
+		}
+		moved = append(moved, file)
+	}
+	for _, file := range files {
+		delete(st.files, file)
+	}
+	if recorder, ok := st.storage.(storage.ChecksumRecorder); ok {
+		if err := recorder.RecordChecksums(st.projectDir, st.checksums); err != nil {
+			st.server.errorf(st.request, "Failed to update checksum index: %s (%s)\n", st.projectDir, err)
+		}
+	}
+	return st.storage.RemoveAll(st.dir)
+}
+
+// replacedPath returns storage path where the replaced project file is kept
+// during commit (reserved paths can't be staged files)
+func (st *stagingArea) replacedPath(file string) string {
+	return path.Join(st.dir, ".gisquick", "replaced", file)
+}
+
+// rollback removes moved files from the project directory and restores
+// files replaced by failed commit
+func (st *stagingArea) rollback(moved []string, replaced map[string]bool) {
+	for _, file := range moved {
+		if !replaced[file] {
+			if err := st.storage.Remove(path.Join(st.projectDir, file)); err != nil {
+				st.server.errorf(st.request, "Failed to remove file of failed upload: %s (%s)\n", file, err)
+			}
+		}
+	}
+	for file := range replaced {
+		if err := st.storage.Rename(st.replacedPath(file), path.Join(st.projectDir, file)); err != nil {
+			st.server.errorf(st.request, "Failed to restore replaced file: %s (%s)\n", file, err)
+		}
+	}
+}
+
+// Discard removes all staged files (safe to call after Commit)
+func (st *stagingArea) Discard() {
+	if err := st.storage.RemoveAll(st.dir); err != nil {
+		st.server.errorf(st.request, "Failed to remove staging directory: %s (%s)\n", st.dir, err)
+	}
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gislab-npo/gisquick-settings/fs"
+	"github.com/gislab-npo/gisquick-settings/server/storage"
+)
+
+// uploadPart is a file sent in multipart upload
+type uploadPart struct {
+	path    string
+	content string
+}
+
+// multipartUpload uploads files into user1/project, info is the first part
+// with upload metadata
+func multipartUpload(t *testing.T, s *Server, query string, info interface{}, parts ...uploadPart) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	data, _ := json.Marshal(info)
+	if err := writer.WriteField("info", string(data)); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range parts {
+		part, err := writer.CreateFormFile(p.path, p.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(p.content))
+	}
+	writer.Close()
+	url := "/api/project/upload/user1/project" + query
+	return request(s, "POST", url, "user1", &body, map[string]string{"Content-Type": writer.FormDataContentType()})
+}
+
+// declaredFile returns metadata of the file with given content
+func declaredFile(path, content string) fs.File {
+	return fs.File{Path: path, Size: int64(len(content)), Hash: sha1Hex(content)}
+}
+
+// projectFiles returns content of files in user1/project (without internal data)
+func projectFiles(t *testing.T, s *Server) map[string]string {
+	t.Helper()
+	files, err := s.storage.List(projectPath("user1", "project"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := make(map[string]string, len(files))
+	for _, f := range files {
+		data, err := ioutil.ReadFile(filepath.Join(s.config.ProjectsRoot, "user1", "project", filepath.FromSlash(f.Path)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		content[f.Path] = string(data)
+	}
+	return content
+}
+
+func TestUploadIsAllOrNothing(t *testing.T) {
+	s := newTestServer(t, Settings{}, testUser)
+	writeFile(t, s, "user1/project/project.qgs", "<qgis/>")
+	writeFile(t, s, "user1/project/a.txt", "old a")
+	before := projectFiles(t, s)
+
+	info := map[string]interface{}{"files": []fs.File{
+		declaredFile("a.txt", "new a"),
+		declaredFile("b.txt", "new b"),
+		declaredFile("project.qgs", "<qgis version='3'/>"),
+	}}
+	// content of the second file doesn't match its checksum
+	w := multipartUpload(t, s, "", info,
+		uploadPart{"a.txt", "new a"},
+		uploadPart{"b.txt", "bad b"},
+		uploadPart{"project.qgs", "<qgis version='3'/>"},
+	)
+	if w.Code != http.StatusBadRequest || errorCode(w) != errCodeCorruptedFile {
+		t.Fatalf("upload of corrupted file: %d %s", w.Code, w.Body)
+	}
+	after := projectFiles(t, s)
+	if len(after) != len(before) {
+		t.Errorf("project files after failed upload: %v", after)
+	}
+	for p, content := range before {
+		if after[p] != content {
+			t.Errorf("file %s was changed by failed upload: %q", p, after[p])
+		}
+	}
+	staging := filepath.Join(s.config.ProjectsRoot, "user1", "project", ".gisquick", "staging")
+	if entries, err := ioutil.ReadDir(staging); err == nil && len(entries) > 0 {
+		t.Errorf("staging directory was not removed: %d entries", len(entries))
+	} else if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+
+	// the same upload with valid content replaces all files
+	w = multipartUpload(t, s, "", info,
+		uploadPart{"a.txt", "new a"},
+		uploadPart{"b.txt", "new b"},
+		uploadPart{"project.qgs", "<qgis version='3'/>"},
+	)
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload: %d %s", w.Code, w.Body)
+	}
+	if after := projectFiles(t, s); after["a.txt"] != "new a" || after["b.txt"] != "new b" || after["project.qgs"] != "<qgis version='3'/>" {
+		t.Errorf("project files after upload: %v", after)
+	}
+}
+
+// failingRenameStorage fails the first rename of staged file into destination
+// with given suffix
+type failingRenameStorage struct {
+	storage.Storage
+	suffix string
+	failed bool
+}
+
+func (s *failingRenameStorage) Rename(oldpath, newpath string) error {
+	if !s.failed && strings.HasSuffix(newpath, s.suffix) {
+		s.failed = true
+		return errors.New("rename failed")
+	}
+	return s.Storage.Rename(oldpath, newpath)
+}
+
+func TestStagingCommitRollback(t *testing.T) {
+	s := newTestServer(t, Settings{}, testUser)
+	writeFile(t, s, "user1/project/project.qgs", "<qgis/>")
+	writeFile(t, s, "user1/project/a.txt", "old a")
+	writeFile(t, s, "user1/project/data/c.txt", "old c")
+	before := projectFiles(t, s)
+
+	// the project file is moved as the last one
+	st, err := s.newStagingArea(httptest.NewRequest("POST", "/", nil), projectPath("user1", "project"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Discard()
+	for _, f := range []uploadPart{{"a.txt", "new a"}, {"b.txt", "new b"}, {"data/c.txt", "new c"}, {"project.qgs", "<qgis version='3'/>"}} {
+		if _, err := st.Save(strings.NewReader(f.content), f.path, fs.DefaultHashAlgorithm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st.storage = &failingRenameStorage{Storage: s.storage, suffix: "project/project.qgs"}
+	if err := st.Commit(); err == nil {
+		t.Fatal("commit with failed rename succeeded")
+	}
+	after := projectFiles(t, s)
+	if len(after) != len(before) {
+		t.Errorf("project files after failed commit: %v", after)
+	}
+	for p, content := range before {
+		if after[p] != content {
+			t.Errorf("file %s was changed by failed commit: %q", p, after[p])
+		}
+	}
+}
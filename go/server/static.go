@@ -2,15 +2,14 @@ package server
 
 import (
 	"encoding/json"
-	"log"
-	"mime"
 	"mime/multipart"
 	"net/http"
 	"os"
-	"path/filepath"
+	"path"
 	"strings"
 
 	"github.com/gislab-npo/gisquick-settings/fs"
+	"github.com/gislab-npo/gisquick-settings/server/storage"
 	"github.com/go-chi/chi"
 )
 
@@ -19,48 +18,45 @@ type scriptInfo struct {
 	Components []string `json:"components"`
 }
 
-func saveScriptsInfo(path string, data map[string]scriptInfo) error {
-	dest, err := os.Create(path)
+func (s *Server) loadScriptsInfo(path string) map[string]scriptInfo {
+	scripts := make(map[string]scriptInfo)
+	f, err := s.storage.Open(path)
+	if err == nil {
+		json.NewDecoder(f).Decode(&scripts)
+		f.Close()
+	}
+	return scripts
+}
+
+func (s *Server) saveScriptsInfo(path string, data map[string]scriptInfo) error {
+	dest, err := s.storage.Create(path)
 	if err != nil {
-		log.Printf("Failed to create scripts metadata file: %s\n", err)
+		s.errorf(nil, "Failed to create scripts metadata file: %s\n", err)
 		return err
 	}
-	defer dest.Close()
-
 	encoder := json.NewEncoder(dest)
 	encoder.SetIndent("", "  ")
 	if err = encoder.Encode(data); err != nil {
-		log.Printf("Failed to encode scripts metadata: %s\n", err)
+		dest.Abort()
+		s.errorf(nil, "Failed to encode scripts metadata: %s\n", err)
 		return err
 	}
-	return nil
+	return dest.Close()
 }
 
 func (s *Server) handleUploadScript() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		user := r.Context().Value(contextKeyUser).(*User)
 		username := chi.URLParam(r, "user")
 		directory := chi.URLParam(r, "directory")
 
-		if !user.IsSuperuser && user.Username != username {
-			http.Error(w, "Forbidden", http.StatusForbidden)
+		projectDir := projectPath(username, directory)
+		if _, err := s.storage.Stat(projectDir); os.IsNotExist(err) {
+			s.errorResponse(w, r, http.StatusBadRequest, errCodeProjectNotFound, "Project directory not found", nil)
 			return
 		}
 
-		projectDir := filepath.Join(s.config.ProjectsRoot, username, directory)
-		if _, err := os.Stat(projectDir); os.IsNotExist(err) {
-			http.Error(w, "Project directory not found", 400)
-			return
-		}
-
-		ctype, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
-		if err != nil || ctype != "multipart/form-data" {
-			http.Error(w, "Invalid content type", 400)
-			return
-		}
-		boundary, ok := params["boundary"]
+		boundary, ok := s.checkMultipart(w, r)
 		if !ok {
-			http.Error(w, http.ErrMissingBoundary.Error(), 400)
 			return
 		}
 
@@ -70,52 +66,66 @@ func (s *Server) handleUploadScript() http.HandlerFunc {
 
 		part, err := reader.NextPart()
 		if err != nil {
-			log.Println(err)
-			http.Error(w, "Server error", http.StatusInternalServerError)
+			s.errorf(r, "Invalid upload stream: %s\n", err)
+			s.serverError(w, r)
 			return
 		}
 
 		if part.FormName() != "info" {
-			log.Println("Missing 'info' form field")
-			http.Error(w, "Invalid request data", 400)
+			s.errorf(r, "Missing 'info' form field\n")
+			s.badRequest(w, r, "Invalid request data", nil)
 			return
 		}
 		var info scriptInfo
 		err = json.NewDecoder(part).Decode(&info)
 		if err != nil {
-			log.Println("Failed to parse 'info' field:", err)
-			http.Error(w, "Invalid metadata content", 400)
+			s.errorf(r, "Failed to parse 'info' field: %s\n", err)
+			s.badRequest(w, r, "Invalid metadata content", nil)
 			return
 		}
 
-		part, _ = reader.NextPart()
-		filename := filepath.Join(projectDir, "static", part.FileName())
-		if err = fs.SaveToFile(part, filename); err != nil {
-			log.Printf("Failed to save script: %s (%s)\n", filename, err)
-			http.Error(w, "Failed to save script", http.StatusInternalServerError)
+		if _, err := fs.CleanPath(info.Path); err != nil {
+			s.pathErrorResponse(w, r, err)
 			return
 		}
-
-		// var scripts map[string]scriptInfo
-		scripts := make(map[string]scriptInfo)
-		scriptsFile := filepath.Join(s.config.ProjectsRoot, username, directory, "static", "scripts.json")
-		f, err := os.Open(scriptsFile)
-		if err == nil {
-			json.NewDecoder(f).Decode(&scripts)
+		part, err = reader.NextPart()
+		if err != nil {
+			s.errorf(r, "Invalid upload stream: %s\n", err)
+			s.badRequest(w, r, "Invalid request data", nil)
+			return
+		}
+		filename, err := s.projectFilePath(username, directory, "static", part.FileName())
+		if err != nil {
+			if !s.pathErrorResponse(w, r, err) {
+				s.serverError(w, r)
+			}
+			return
+		}
+		if err = storage.SaveFile(s.storage, part, filename); err != nil {
+			s.errorf(r, "Failed to save script: %s (%s)\n", filename, err)
+			s.serverError(w, r)
+			return
 		}
-		modName := strings.SplitN(filepath.Base(info.Path), ".", 2)[0]
+
+		scriptsFile := path.Join(projectDir, "static", "scripts.json")
+		scripts := s.loadScriptsInfo(scriptsFile)
+		modName := strings.SplitN(path.Base(info.Path), ".", 2)[0]
 		entry, ok := scripts[modName]
 		if ok && entry.Path != info.Path {
-			fullpath := filepath.Join(s.config.ProjectsRoot, username, directory, "static", entry.Path)
-			log.Println("delete", entry.Path, fullpath)
-			if err = os.Remove(fullpath); err != nil {
-				log.Printf("Failed to delete old script file: %s (%s)\n", fullpath, err)
+			// scripts metadata file can be modified by project upload
+			fullpath, err := s.projectFilePath(username, directory, "static", entry.Path)
+			if err == nil {
+				s.debugf(r, "Deleting old script file: %s\n", fullpath)
+				err = s.storage.Remove(fullpath)
+			}
+			if err != nil {
+				s.errorf(r, "Failed to delete old script file: %s (%s)\n", entry.Path, err)
 			}
 		}
 		scripts[modName] = info
 
-		if err = saveScriptsInfo(scriptsFile, scripts); err != nil {
-			http.Error(w, "Server error", http.StatusInternalServerError)
+		if err = s.saveScriptsInfo(scriptsFile, scripts); err != nil {
+			s.serverError(w, r)
 			return
 		}
 		s.jsonResponse(w, scripts)
@@ -124,40 +134,32 @@ func (s *Server) handleUploadScript() http.HandlerFunc {
 
 func (s *Server) handleDeleteScript() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		user := r.Context().Value(contextKeyUser).(*User)
 		username := chi.URLParam(r, "user")
 		directory := chi.URLParam(r, "directory")
 		module := chi.URLParam(r, "module")
 
-		if !user.IsSuperuser && user.Username != username {
-			http.Error(w, "Forbidden", http.StatusForbidden)
-			return
-		}
-
-		// var scripts []scriptInfo
-		scripts := make(map[string]scriptInfo)
-		scriptsFile := filepath.Join(s.config.ProjectsRoot, username, directory, "static", "scripts.json")
-		f, err := os.Open(scriptsFile)
-		if err == nil {
-			json.NewDecoder(f).Decode(&scripts)
-		}
+		scriptsFile := projectPath(username, directory, "static", "scripts.json")
+		scripts := s.loadScriptsInfo(scriptsFile)
 		entry, ok := scripts[module]
 		if !ok {
-			log.Printf("Script module does not exist: %s\n", module)
-			http.Error(w, "Not found", http.StatusNotFound)
+			s.errorf(r, "Script module does not exist: %s\n", module)
+			s.notFound(w, r, "Not found")
 			return
 		}
 
-		path := filepath.Join(s.config.ProjectsRoot, username, directory, "static", entry.Path)
-
-		if err = os.Remove(path); err != nil {
-			log.Printf("Failed to delete script file: %s\n", path)
-			http.Error(w, "Server error", http.StatusInternalServerError)
+		// scripts metadata file can be modified by project upload, so the
+		// path of the script must be validated
+		path, err := s.projectFilePath(username, directory, "static", entry.Path)
+		if err != nil {
+			s.errorf(r, "Invalid path of script module %s: %s\n", module, err)
+		} else if err = s.storage.Remove(path); err != nil {
+			s.errorf(r, "Failed to delete script file: %s\n", path)
+			s.serverError(w, r)
 			return
 		}
 		delete(scripts, module)
-		if err = saveScriptsInfo(scriptsFile, scripts); err != nil {
-			http.Error(w, "Server error", http.StatusInternalServerError)
+		if err := s.saveScriptsInfo(scriptsFile, scripts); err != nil {
+			s.serverError(w, r)
 			return
 		}
 
@@ -167,29 +169,11 @@ func (s *Server) handleDeleteScript() http.HandlerFunc {
 
 func (s *Server) handleScriptsInfo() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		user := r.Context().Value(contextKeyUser).(*User)
 		username := chi.URLParam(r, "user")
 		directory := chi.URLParam(r, "directory")
 
-		if !user.IsSuperuser && user.Username != username {
-			http.Error(w, "Forbidden", http.StatusForbidden)
-			return
-		}
-
-		scriptsFile := filepath.Join(s.config.ProjectsRoot, username, directory, "static", "scripts.json")
-		/*
-			w.Header().Set("Content-Type", "application/json")
-			http.ServeFile(w, r, scriptsFile)
-		*/
-		// var scripts map[string]scriptInfo
-		scripts := make(map[string]scriptInfo)
-		f, err := os.Open(scriptsFile)
-		if err == nil {
-			json.NewDecoder(f).Decode(&scripts)
-		}
-		// if scripts == nil {
-		// 	scripts = make(map[string]scriptInfo)
-		// }
+		scriptsFile := projectPath(username, directory, "static", "scripts.json")
+		scripts := s.loadScriptsInfo(scriptsFile)
 		s.jsonResponse(w, scripts)
 	}
 }
@@ -198,8 +182,13 @@ func (s *Server) handleStaticFile() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		username := chi.URLParam(r, "user")
 		directory := chi.URLParam(r, "directory")
-		filename := chi.URLParam(r, "*")
-		path := filepath.Join(s.config.ProjectsRoot, username, directory, "static", filename)
-		http.ServeFile(w, r, path)
+		filename, err := s.projectFilePath(username, directory, "static", chi.URLParam(r, "*"))
+		if err != nil {
+			if !s.pathErrorResponse(w, r, err) {
+				s.serverError(w, r)
+			}
+			return
+		}
+		s.serveFile(w, r, filename)
 	}
 }
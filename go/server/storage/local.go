@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/gislab-npo/gisquick-settings/fs"
+)
+
+// LocalStorage stores files in a directory on local disk
+type LocalStorage struct {
+	Root string
+	// HashWorkers is a default number of files hashed in parallel
+	HashWorkers int
+	// Ignore is a list of default ignore patterns of projects files
+	Ignore []string
+}
+
+// NewLocalStorage creates storage rooted in given directory
+func NewLocalStorage(root string) *LocalStorage {
+	return &LocalStorage{Root: root}
+}
+
+func (s *LocalStorage) fullPath(path string) string {
+	return filepath.Join(s.Root, filepath.FromSlash(path))
+}
+
+// Open export
+func (s *LocalStorage) Open(path string) (File, error) {
+	return os.Open(s.fullPath(path))
+}
+
+// Create export
+func (s *LocalStorage) Create(path string) (Writer, error) {
+	return fs.CreateAtomic(s.fullPath(path))
+}
+
+// Stat export
+func (s *LocalStorage) Stat(path string) (fs.File, error) {
+	info, err := os.Stat(s.fullPath(path))
+	if err != nil {
+		return fs.File{}, err
+	}
+	if info.IsDir() {
+		return fs.File{Path: path}, nil
+	}
+	return fs.File{Path: path, Size: info.Size(), Mtime: info.ModTime()}, nil
+}
+
+// List export
+func (s *LocalStorage) List(dir string, checksum bool) ([]fs.File, error) {
+	return s.ListContext(context.Background(), dir, fs.ListOptions{Checksum: checksum})
+}
+
+// ListContext export
+func (s *LocalStorage) ListContext(ctx context.Context, dir string, opts fs.ListOptions) ([]fs.File, error) {
+	if opts.Workers == 0 {
+		opts.Workers = s.HashWorkers
+	}
+	if opts.Ignore == nil {
+		opts.Ignore = s.Ignore
+	}
+	files, err := fs.ListDirContext(ctx, s.fullPath(dir), opts)
+	if err != nil {
+		return nil, err
+	}
+	for i, f := range *files {
+		(*files)[i].Path = filepath.ToSlash(f.Path)
+	}
+	return *files, nil
+}
+
+// CheckPath export
+func (s *LocalStorage) CheckPath(dir, path string) error {
+	_, err := fs.SafeJoin(s.fullPath(dir), path)
+	return err
+}
+
+// Remove export
+func (s *LocalStorage) Remove(path string) error {
+	return os.Remove(s.fullPath(path))
+}
+
+// RemoveAll export
+func (s *LocalStorage) RemoveAll(path string) error {
+	return os.RemoveAll(s.fullPath(path))
+}
+
+// Rename export
+func (s *LocalStorage) Rename(oldpath, newpath string) error {
+	dest := s.fullPath(newpath)
+	if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		return err
+	}
+	return os.Rename(s.fullPath(oldpath), dest)
+}
+
+// RecordChecksums updates checksum index of the project directory
+func (s *LocalStorage) RecordChecksums(projectDir string, files []fs.File) error {
+	index := fs.OpenChecksumIndex(s.fullPath(projectDir))
+	for _, f := range files {
+		info, err := os.Stat(s.fullPath(path.Join(projectDir, f.Path)))
+		if err != nil {
+			continue
+		}
+		index.Update(filepath.FromSlash(f.Path), info, f.Algorithm, f.Hash)
+	}
+	return index.Save()
+}
@@ -0,0 +1,342 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gislab-npo/gisquick-settings/fs"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// maximal size of object which can be copied with a single CopyObject request
+const maxCopyObjectSize = 5 * 1024 * 1024 * 1024
+
+// S3Config export
+type S3Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// Timeout of waiting for response headers (0 means default 1 minute).
+	// Transfer of data itself is not limited.
+	Timeout time.Duration
+}
+
+// S3Storage stores files as objects in a bucket of S3 compatible object
+// storage (AWS S3, MinIO, ...), using path-style addressing.
+//
+// There are no real directories and no rename operation in S3, Rename is
+// implemented as a server-side copy followed by removal of the source object.
+// Replacing of each object is atomic (readers get either old or new content),
+// but moving of multiple files (e.g. commit of staged upload) is not.
+type S3Storage struct {
+	client *minio.Client
+	bucket string
+	prefix string
+	// Ignore is a list of default ignore patterns of projects files
+	Ignore []string
+}
+
+// NewS3Storage creates storage with all objects stored under the prefix
+func NewS3Storage(config S3Config, prefix string) (*S3Storage, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("Invalid S3 endpoint: %s", config.Endpoint)
+	}
+	if config.Bucket == "" {
+		return nil, errors.New("Missing S3 bucket name")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.Timeout == 0 {
+		config.Timeout = time.Minute
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: config.Timeout,
+		ExpectContinueTimeout: time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   16,
+	}
+	client, err := minio.New(endpoint.Host, &minio.Options{
+		Creds:        credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
+		Secure:       endpoint.Scheme == "https",
+		Region:       config.Region,
+		BucketLookup: minio.BucketLookupPath,
+		Transport:    transport,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &S3Storage{client: client, bucket: config.Bucket, prefix: strings.Trim(prefix, "/")}, nil
+}
+
+func (s *S3Storage) key(p string) string {
+	return strings.Trim(path.Join(s.prefix, p), "/")
+}
+
+func (s *S3Storage) dirPrefix(dir string) string {
+	if prefix := s.key(dir); prefix != "" {
+		return prefix + "/"
+	}
+	return ""
+}
+
+// convertError converts errors of missing objects to errors satisfying os.IsNotExist
+func convertError(op, key string, err error) error {
+	if err == nil {
+		return nil
+	}
+	resp := minio.ToErrorResponse(err)
+	if resp.Code == "NoSuchKey" || (resp.StatusCode == http.StatusNotFound && resp.Code != "NoSuchBucket") {
+		return &os.PathError{Op: op, Path: key, Err: os.ErrNotExist}
+	}
+	return fmt.Errorf("S3 %s %s: %w", op, key, err)
+}
+
+func (s *S3Storage) walk(ctx context.Context, prefix string, fn func(obj minio.ObjectInfo) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return convertError("list", prefix, obj.Err)
+		}
+		if err := fn(obj); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+func (s *S3Storage) checksum(ctx context.Context, key, algorithm string) (string, error) {
+	h, err := fs.NewHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+	obj, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return "", convertError("open", key, err)
+	}
+	defer obj.Close()
+	if _, err := io.Copy(h, obj); err != nil {
+		return "", convertError("open", key, err)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// Open export
+func (s *S3Storage) Open(path string) (File, error) {
+	key := s.key(path)
+	obj, err := s.client.GetObject(context.Background(), s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, convertError("open", key, err)
+	}
+	// object is fetched lazily, Stat checks that it exists
+	if _, err = obj.Stat(); err != nil {
+		obj.Close()
+		return nil, convertError("open", key, err)
+	}
+	return obj, nil
+}
+
+// Create export
+func (s *S3Storage) Create(path string) (Writer, error) {
+	file, err := ioutil.TempFile("", "gisquick-s3-")
+	if err != nil {
+		return nil, err
+	}
+	return &s3Writer{storage: s, key: s.key(path), file: file}, nil
+}
+
+// Stat export
+func (s *S3Storage) Stat(path string) (fs.File, error) {
+	key := s.key(path)
+	info, err := s.client.StatObject(context.Background(), s.bucket, key, minio.StatObjectOptions{})
+	if err == nil {
+		return fs.File{Path: path, Size: info.Size, Mtime: info.LastModified}, nil
+	}
+	if err = convertError("stat", key, err); !os.IsNotExist(err) {
+		return fs.File{}, err
+	}
+	// there are no real directories, just objects with common prefix
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	objects := s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.dirPrefix(path), Recursive: true, MaxKeys: 1})
+	obj, ok := <-objects
+	if !ok {
+		return fs.File{}, &os.PathError{Op: "stat", Path: key, Err: os.ErrNotExist}
+	}
+	if obj.Err != nil {
+		return fs.File{}, convertError("stat", key, obj.Err)
+	}
+	return fs.File{Path: path}, nil
+}
+
+// ignoreRules returns default ignore patterns extended with patterns from
+// the ignore file in the directory (unless skipFile is set)
+func (s *S3Storage) ignoreRules(dir string, defaults []string, skipFile bool) (*fs.IgnoreRules, error) {
+	if defaults == nil {
+		defaults = s.Ignore
+	}
+	if defaults == nil {
+		defaults = fs.DefaultIgnorePatterns
+	}
+	if skipFile {
+		return fs.NewIgnoreRules(defaults), nil
+	}
+	file, err := s.Open(path.Join(dir, fs.IgnoreFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fs.NewIgnoreRules(defaults), nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	patterns, err := fs.ReadIgnorePatterns(file)
+	if err != nil {
+		return nil, err
+	}
+	return fs.NewIgnoreRules(append(append([]string{}, defaults...), patterns...)), nil
+}
+
+// List export
+func (s *S3Storage) List(dir string, checksum bool) ([]fs.File, error) {
+	return s.ListContext(context.Background(), dir, fs.ListOptions{Checksum: checksum})
+}
+
+// ListContext export (checksums are computed sequentially)
+func (s *S3Storage) ListContext(ctx context.Context, dir string, opts fs.ListOptions) ([]fs.File, error) {
+	prefix := s.dirPrefix(dir)
+	ignore, err := s.ignoreRules(dir, opts.Ignore, opts.SkipIgnoreFile)
+	if err != nil {
+		return nil, err
+	}
+	files := []fs.File{}
+	keys := []string{}
+	found := false
+	err = s.walk(ctx, prefix, func(obj minio.ObjectInfo) error {
+		found = true
+		relPath := strings.TrimPrefix(obj.Key, prefix)
+		if fs.IsExcluded(relPath) || strings.HasSuffix(relPath, "/") || ignore.Ignored(relPath) {
+			return nil
+		}
+		files = append(files, fs.File{Path: relPath, Size: obj.Size, Mtime: obj.LastModified})
+		keys = append(keys, obj.Key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, &os.PathError{Op: "list", Path: prefix, Err: os.ErrNotExist}
+	}
+	if opts.Checksum {
+		if opts.Algorithm == "" {
+			opts.Algorithm = fs.DefaultHashAlgorithm
+		}
+		for i := range files {
+			hash, err := s.checksum(ctx, keys[i], opts.Algorithm)
+			if err != nil {
+				return nil, err
+			}
+			files[i].Hash = hash
+			files[i].Algorithm = opts.Algorithm
+			if opts.Progress != nil {
+				opts.Progress(i+1, len(files))
+			}
+		}
+	}
+	return files, nil
+}
+
+// Remove export
+func (s *S3Storage) Remove(path string) error {
+	key := s.key(path)
+	return convertError("remove", key, s.client.RemoveObject(context.Background(), s.bucket, key, minio.RemoveObjectOptions{}))
+}
+
+// RemoveAll export
+func (s *S3Storage) RemoveAll(path string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	prefix := s.dirPrefix(path)
+	objects := s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true})
+	for e := range s.client.RemoveObjects(ctx, s.bucket, objects, minio.RemoveObjectsOptions{}) {
+		return convertError("remove", e.ObjectName, e.Err)
+	}
+	return nil
+}
+
+// Rename export (works only with files). Objects larger than 5 GiB are copied
+// with multipart copy. Destination object is replaced atomically, but when
+// removal of the source object fails, it is left in place.
+func (s *S3Storage) Rename(oldpath, newpath string) error {
+	ctx := context.Background()
+	srcKey := s.key(oldpath)
+	info, err := s.client.StatObject(ctx, s.bucket, srcKey, minio.StatObjectOptions{})
+	if err != nil {
+		return convertError("rename", srcKey, err)
+	}
+	// copy only the checked version of the source object
+	src := minio.CopySrcOptions{Bucket: s.bucket, Object: srcKey, MatchETag: info.ETag}
+	dest := minio.CopyDestOptions{Bucket: s.bucket, Object: s.key(newpath)}
+	if info.Size > maxCopyObjectSize {
+		_, err = s.client.ComposeObject(ctx, dest, src)
+	} else {
+		_, err = s.client.CopyObject(ctx, dest, src)
+	}
+	if err != nil {
+		return convertError("rename", srcKey, err)
+	}
+	return convertError("rename", srcKey, s.client.RemoveObject(ctx, s.bucket, srcKey, minio.RemoveObjectOptions{}))
+}
+
+// s3Writer buffers written data in temporary file, so the object can be
+// uploaded with known size (large files are uploaded in multiple parts)
+type s3Writer struct {
+	storage *S3Storage
+	key     string
+	file    *os.File
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	return w.file.Write(p)
+}
+
+func (w *s3Writer) Abort() error {
+	w.file.Close()
+	return os.Remove(w.file.Name())
+}
+
+func (w *s3Writer) Close() error {
+	defer os.Remove(w.file.Name())
+	defer w.file.Close()
+
+	size, err := w.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err = w.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = w.storage.client.PutObject(context.Background(), w.storage.bucket, w.key, w.file, size, minio.PutObjectOptions{})
+	return convertError("create", w.key, err)
+}
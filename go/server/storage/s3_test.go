@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// newTestS3Storage creates storage in a bucket of MinIO (or other S3 server)
+// configured with S3_TEST_* environment variables, e.g. for a local server:
+//
+//	docker run -p 9000:9000 minio/minio server /data
+//	S3_TEST_ENDPOINT=http://localhost:9000 S3_TEST_BUCKET=test \
+//	S3_TEST_ACCESS_KEY=minioadmin S3_TEST_SECRET_KEY=minioadmin go test ./storage
+//
+// All objects are created under random prefix, which is removed after the test.
+func newTestS3Storage(t *testing.T) *S3Storage {
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_TEST_ENDPOINT is not set")
+	}
+	config := S3Config{
+		Endpoint:  endpoint,
+		Region:    os.Getenv("S3_TEST_REGION"),
+		Bucket:    os.Getenv("S3_TEST_BUCKET"),
+		AccessKey: os.Getenv("S3_TEST_ACCESS_KEY"),
+		SecretKey: os.Getenv("S3_TEST_SECRET_KEY"),
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	s, err := NewS3Storage(config, fmt.Sprintf("gisquick-test-%x", id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.RemoveAll(""); err != nil {
+			t.Errorf("cleanup: %s", err)
+		}
+	})
+	return s
+}
+
+func writeTestFile(t *testing.T, s Storage, path, content string) {
+	t.Helper()
+	if err := SaveFile(s, strings.NewReader(content), path); err != nil {
+		t.Fatalf("save %s: %s", path, err)
+	}
+}
+
+func readTestFile(t *testing.T, s Storage, path string) string {
+	t.Helper()
+	f, err := s.Open(path)
+	if err != nil {
+		t.Fatalf("open %s: %s", path, err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("read %s: %s", path, err)
+	}
+	return string(data)
+}
+
+func TestS3Storage(t *testing.T) {
+	s := newTestS3Storage(t)
+
+	writeTestFile(t, s, "user/project/project.qgs", "<qgis/>")
+	writeTestFile(t, s, "user/project/data/layer.gpkg", "layer data")
+	writeTestFile(t, s, "user/project/.gisquick/checksums.json", "{}")
+	writeTestFile(t, s, "user/project/empty.txt", "")
+
+	if got := readTestFile(t, s, "user/project/data/layer.gpkg"); got != "layer data" {
+		t.Errorf("content = %q", got)
+	}
+	if got := readTestFile(t, s, "user/project/empty.txt"); got != "" {
+		t.Errorf("content of empty file = %q", got)
+	}
+
+	info, err := s.Stat("user/project/project.qgs")
+	if err != nil || info.Size != 7 || info.Mtime.IsZero() {
+		t.Errorf("Stat(file) = %+v, %v", info, err)
+	}
+	if info, err = s.Stat("user/project/data"); err != nil || info.Path != "user/project/data" {
+		t.Errorf("Stat(dir) = %+v, %v", info, err)
+	}
+	if _, err = s.Stat("user/project/missing"); !os.IsNotExist(err) {
+		t.Errorf("Stat(missing) error = %v", err)
+	}
+	if _, err = s.Open("user/project/missing"); !os.IsNotExist(err) {
+		t.Errorf("Open(missing) error = %v", err)
+	}
+
+	files, err := s.List("user/project", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, f.Path)
+		if f.Hash == "" {
+			t.Errorf("missing checksum of %s", f.Path)
+		}
+	}
+	sort.Strings(paths)
+	if want := "data/layer.gpkg,empty.txt,project.qgs"; strings.Join(paths, ",") != want {
+		t.Errorf("List() = %v, want %s", paths, want)
+	}
+	if _, err = s.List("user/missing", false); !os.IsNotExist(err) {
+		t.Errorf("List(missing) error = %v", err)
+	}
+
+	// replaces existing file
+	writeTestFile(t, s, "user/project/new.qgs", "<qgis version=\"2\"/>")
+	if err = s.Rename("user/project/new.qgs", "user/project/project.qgs"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, s, "user/project/project.qgs"); got != "<qgis version=\"2\"/>" {
+		t.Errorf("content after rename = %q", got)
+	}
+	if _, err = s.Stat("user/project/new.qgs"); !os.IsNotExist(err) {
+		t.Errorf("source of rename still exists (%v)", err)
+	}
+	if err = s.Rename("user/project/missing", "user/project/x"); !os.IsNotExist(err) {
+		t.Errorf("Rename(missing) error = %v", err)
+	}
+
+	if err = s.Remove("user/project/empty.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.RemoveAll("user/project/data"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Stat("user/project/data"); !os.IsNotExist(err) {
+		t.Errorf("directory still exists after RemoveAll (%v)", err)
+	}
+}
+
+func TestS3StorageSeek(t *testing.T) {
+	s := newTestS3Storage(t)
+	writeTestFile(t, s, "file.txt", "0123456789")
+	f, err := s.Open("file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, 3)
+	if _, err = f.Seek(4, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Read(buf); err != nil || string(buf) != "456" {
+		t.Errorf("Read() after Seek(4) = %q, %v", buf, err)
+	}
+	if _, err = f.Seek(-2, 2); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil || string(data) != "89" {
+		t.Errorf("read after Seek(-2, end) = %q, %v", data, err)
+	}
+}
+
+func TestS3StorageMultipart(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping large upload in short mode")
+	}
+	s := newTestS3Storage(t)
+	// larger than minimal part size of multipart upload (16 MiB)
+	data := make([]byte, 20*1024*1024)
+	rand.Read(data)
+	if err := SaveFile(s, bytes.NewReader(data), "large.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Rename("large.bin", "moved.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, s, "moved.bin"); got != string(data) {
+		t.Error("content of uploaded file differs")
+	}
+}
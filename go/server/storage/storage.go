@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"context"
+	"io"
+
+	"github.com/gislab-npo/gisquick-settings/fs"
+)
+
+// File is a readable file opened from storage
+type File interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+}
+
+// Writer is used to write content of a new file. The file is created (or
+// replaced) only when the writer is successfully closed, Abort discards
+// written data.
+type Writer interface {
+	io.WriteCloser
+	Abort() error
+}
+
+// Storage provides access to published projects files. All paths are slash
+// separated and relative to the storage root. Errors for missing files
+// satisfy os.IsNotExist.
+type Storage interface {
+	// Open opens file for reading
+	Open(path string) (File, error)
+	// Create creates or replaces file (including parent directories)
+	Create(path string) (Writer, error)
+	// Stat returns file info (without checksum). For directories only Path is set.
+	Stat(path string) (fs.File, error)
+	// List returns project files in directory (recursively), with paths
+	// relative to the directory. Files matching fs.IsExcluded or ignore
+	// rules (default patterns and fs.IgnoreFile in the directory) are skipped.
+	List(dir string, checksum bool) ([]fs.File, error)
+	// ListContext is List with options of checksums computation, listing is
+	// canceled when the context is done
+	ListContext(ctx context.Context, dir string, opts fs.ListOptions) ([]fs.File, error)
+	// Remove removes single file
+	Remove(path string) error
+	// RemoveAll removes directory with all its content
+	RemoveAll(path string) error
+	// Rename moves file to a new location, replacing existing file
+	Rename(oldpath, newpath string) error
+}
+
+// ChecksumRecorder is implemented by storages which keep index of files
+// checksums, so known checksums of written files don't have to be computed
+type ChecksumRecorder interface {
+	// RecordChecksums stores checksums of files (paths relative to the project directory)
+	RecordChecksums(projectDir string, files []fs.File) error
+}
+
+// PathChecker is implemented by storages where files can be symbolic links
+type PathChecker interface {
+	// CheckPath verifies that the path relative to the directory doesn't
+	// refer outside of the directory (e.g. by symbolic link)
+	CheckPath(dir, path string) error
+}
+
+// SaveFile stores content of reader into the file. Existing file is replaced
+// only when the whole content was successfully read.
+func SaveFile(s Storage, src io.Reader, path string) error {
+	dest, err := s.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(dest, src); err != nil {
+		dest.Abort()
+		return err
+	}
+	return dest.Close()
+}
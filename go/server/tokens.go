@@ -0,0 +1,325 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gislab-npo/gisquick-settings/server/storage"
+	"github.com/go-chi/chi"
+)
+
+// TokenPrefix is a prefix of personal API tokens
+const TokenPrefix = "gqt_"
+
+// tokensPath is a storage path of issued tokens (only hashes of tokens are
+// stored)
+const tokensPath = ".gisquick/tokens.json"
+
+// tokenInfo is a public information about personal API token
+type tokenInfo struct {
+	ID      string     `json:"id"`
+	Name    string     `json:"name"`
+	Scopes  []string   `json:"scopes"`
+	Created time.Time  `json:"created"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// access returns the highest level of access allowed by token's scopes
+// (scopes have the same names as permissions of project ACL)
+func (t *tokenInfo) access() access {
+	granted := accessLogin
+	for _, scope := range t.Scopes {
+		if a, ok := aclPermissions[scope]; ok && a > granted {
+			granted = a
+		}
+	}
+	return granted
+}
+
+func (t *tokenInfo) expired() bool {
+	return t.Expires != nil && time.Now().After(*t.Expires)
+}
+
+// apiToken is a stored token with the username of its owner. Current state
+// of the owner (e.g. superuser status) is looked up on authentication.
+type apiToken struct {
+	tokenInfo
+	Username string `json:"username"`
+}
+
+// newToken generates a new token, returns its secret value and stored record
+func newToken(username, name string, scopes []string, expires *time.Time) (string, *apiToken, error) {
+	secret, err := randomString(32, base64.RawURLEncoding.EncodeToString)
+	if err != nil {
+		return "", nil, err
+	}
+	id, err := randomString(8, hex.EncodeToString)
+	if err != nil {
+		return "", nil, err
+	}
+	token := &apiToken{
+		tokenInfo: tokenInfo{
+			ID:      id,
+			Name:    name,
+			Scopes:  scopes,
+			Created: time.Now().UTC(),
+			Expires: expires,
+		},
+		Username: username,
+	}
+	return TokenPrefix + secret, token, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomString(n int, encode func([]byte) string) (string, error) {
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return encode(data), nil
+}
+
+// bearerToken returns personal API token from Authorization header (empty
+// when not present)
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		if token := strings.TrimSpace(auth[7:]); strings.HasPrefix(token, TokenPrefix) {
+			return token
+		}
+	}
+	return ""
+}
+
+// loadTokens returns stored tokens by hash
+func (s *Server) loadTokens() (map[string]*apiToken, error) {
+	tokens := make(map[string]*apiToken)
+	data, err := s.readFile(tokensPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return tokens, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// updateTokens modifies stored tokens, concurrent updates are serialized
+func (s *Server) updateTokens(update func(tokens map[string]*apiToken) error) error {
+	s.tokensMutex.Lock()
+	defer s.tokensMutex.Unlock()
+	tokens, err := s.loadTokens()
+	if err != nil {
+		return err
+	}
+	if err = update(tokens); err != nil {
+		return err
+	}
+	data, err := json.Marshal(tokens)
+	if err != nil {
+		return err
+	}
+	return storage.SaveFile(s.storage, bytes.NewReader(data), tokensPath)
+}
+
+// tokenUser returns current state of the owner of the token given by its
+// hash (nil user when token doesn't exist, has expired or its owner is no
+// longer active)
+func (s *Server) tokenUser(r *http.Request, hash string) (*User, error) {
+	tokens, err := s.loadTokens()
+	if err != nil {
+		return nil, err
+	}
+	token, ok := tokens[hash]
+	if !ok || token.expired() {
+		return nil, nil
+	}
+	lookup, ok := s.userLookup()
+	if !ok {
+		return nil, nil
+	}
+	start := time.Now()
+	user, err := lookup.LookupUser(r, token.Username)
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	s.metrics.authDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+	if err != nil || user == nil || user.Username != token.Username {
+		return nil, err
+	}
+	user.token = &token.tokenInfo
+	return user, nil
+}
+
+// userLookup returns lookup of token owners, personal API tokens are not
+// supported without it. The app server authenticator supports lookups only
+// when the token of app server's API is configured.
+func (s *Server) userLookup() (UserLookup, bool) {
+	if a, ok := s.authenticator.(*AppServerAuthenticator); ok && a.APIToken == "" {
+		return nil, false
+	}
+	lookup, ok := s.authenticator.(UserLookup)
+	return lookup, ok
+}
+
+// userTokens returns tokens of the user sorted by creation time
+func userTokens(tokens map[string]*apiToken, username string) []tokenInfo {
+	list := make([]tokenInfo, 0)
+	for _, t := range tokens {
+		if t.Username == username {
+			list = append(list, t.tokenInfo)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list
+}
+
+// sessionUser returns user authenticated by session, tokens can't be managed
+// with token authentication
+func (s *Server) sessionUser(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	user := r.Context().Value(contextKeyUser).(*User)
+	if user.token != nil {
+		s.errorResponse(w, r, http.StatusForbidden, errCodeForbidden, "Tokens can be managed only with session authentication", nil)
+		return nil, false
+	}
+	return user, true
+}
+
+func (s *Server) handleListTokens() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := s.sessionUser(w, r)
+		if !ok {
+			return
+		}
+		tokens, err := s.loadTokens()
+		if err != nil {
+			s.errorf(r, "Failed to load tokens: %s\n", err)
+			s.serverError(w, r)
+			return
+		}
+		s.jsonResponse(w, userTokens(tokens, user.Username))
+	}
+}
+
+func (s *Server) handleCreateToken() http.HandlerFunc {
+	type tokenRequest struct {
+		Name    string     `json:"name"`
+		Scopes  []string   `json:"scopes"`
+		Expires *time.Time `json:"expires"`
+	}
+	type tokenResponse struct {
+		tokenInfo
+		Token string `json:"token"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := s.sessionUser(w, r)
+		if !ok {
+			return
+		}
+		if _, ok := s.userLookup(); !ok {
+			s.errorResponse(w, r, http.StatusNotImplemented, errCodeBadRequest, "Personal API tokens are not supported by the authentication backend", nil)
+			return
+		}
+		var req tokenRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024*1024)).Decode(&req); err != nil {
+			s.badRequest(w, r, "Invalid token request", nil)
+			return
+		}
+		if strings.TrimSpace(req.Name) == "" {
+			s.badRequest(w, r, "Missing token name", nil)
+			return
+		}
+		if len(req.Scopes) == 0 {
+			s.badRequest(w, r, "Missing token scopes", nil)
+			return
+		}
+		for _, scope := range req.Scopes {
+			if _, ok := aclPermissions[scope]; !ok {
+				s.badRequest(w, r, fmt.Sprintf("Invalid scope: %s", scope), map[string]string{"scope": scope})
+				return
+			}
+		}
+		if req.Expires != nil && req.Expires.Before(time.Now()) {
+			s.badRequest(w, r, "Token expiration is in the past", nil)
+			return
+		}
+
+		secret, token, err := newToken(user.Username, req.Name, req.Scopes, req.Expires)
+		if err == nil {
+			err = s.updateTokens(func(tokens map[string]*apiToken) error {
+				tokens[hashToken(secret)] = token
+				return nil
+			})
+		}
+		if err != nil {
+			s.errorf(r, "Failed to create token: %s\n", err)
+			s.serverError(w, r)
+			return
+		}
+		s.jsonResponse(w, tokenResponse{token.tokenInfo, secret})
+	}
+}
+
+var errTokenNotFound = errors.New("token not found")
+
+func (s *Server) handleRevokeToken() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := s.sessionUser(w, r)
+		if !ok {
+			return
+		}
+		id := chi.URLParam(r, "id")
+		var revoked string
+		err := s.updateTokens(func(tokens map[string]*apiToken) error {
+			for hash, t := range tokens {
+				if t.ID == id && t.Username == user.Username {
+					delete(tokens, hash)
+					revoked = hash
+					return nil
+				}
+			}
+			return errTokenNotFound
+		})
+		if err == errTokenNotFound {
+			s.notFound(w, r, "Token not found")
+			return
+		}
+		if err != nil {
+			s.errorf(r, "Failed to revoke token: %s\n", err)
+			s.serverError(w, r)
+			return
+		}
+		if s.authCache != nil {
+			s.authCache.invalidate(tokenCacheKey(revoked))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// tokenCacheKey returns key of the token in authentication cache, keys of
+// tokens and sessions have different prefixes, so they can't collide (cache
+// keys of sessions are chosen by clients)
+func tokenCacheKey(hash string) string {
+	return "token:" + hash
+}
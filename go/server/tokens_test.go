@@ -0,0 +1,213 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// createToken issues token of the user with given scopes
+func createToken(t *testing.T, s *Server, username string, scopes ...string) string {
+	t.Helper()
+	body, _ := json.Marshal(map[string]interface{}{"name": "test", "scopes": scopes})
+	w := request(s, "POST", "/api/tokens", username, strings.NewReader(string(body)), map[string]string{"Content-Type": "application/json"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("create token: %d %s", w.Code, w.Body)
+	}
+	var data struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&data); err != nil {
+		t.Fatal(err)
+	}
+	return data.Token
+}
+
+func tokenHeader(token string) map[string]string {
+	return map[string]string{"Authorization": "Bearer " + token}
+}
+
+func TestTokenUsesCurrentUser(t *testing.T) {
+	admin := &User{Username: "admin", IsSuperuser: true}
+	s := newTestServer(t, Settings{}, testUser, admin)
+	writeFile(t, s, "user1/project/project.qgs", "<qgis/>")
+	token := createToken(t, s, "admin", "admin")
+
+	if w := request(s, "GET", "/api/usage/user1", "", nil, tokenHeader(token)); w.Code != http.StatusOK {
+		t.Fatalf("request of superuser: %d %s", w.Code, w.Body)
+	}
+	// revoked superuser rights apply to existing tokens
+	s.authenticator.(testAuthenticator)["admin"].IsSuperuser = false
+	if w := request(s, "GET", "/api/usage/user1", "", nil, tokenHeader(token)); w.Code != http.StatusForbidden {
+		t.Errorf("request of former superuser: %d %s", w.Code, w.Body)
+	}
+	// tokens of deactivated users don't authenticate
+	delete(s.authenticator.(testAuthenticator), "admin")
+	if w := request(s, "GET", "/api/usage/admin", "", nil, tokenHeader(token)); w.Code != http.StatusUnauthorized {
+		t.Errorf("request of deactivated user: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestTokenStoresOnlyUsername(t *testing.T) {
+	s := newTestServer(t, Settings{}, &User{Username: "admin", IsSuperuser: true, Groups: []string{"staff"}})
+	createToken(t, s, "admin", "read")
+	data, err := s.readFile(tokensPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tokens map[string]map[string]interface{}
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range tokens {
+		if token["username"] != "admin" || token["user"] != nil || strings.Contains(string(data), "superuser") {
+			t.Errorf("stored token: %s", data)
+		}
+	}
+}
+
+// sessionAuthenticator can't look up users by username
+type sessionAuthenticator struct {
+	users testAuthenticator
+}
+
+func (a sessionAuthenticator) Authenticate(r *http.Request) (*User, error) {
+	return a.users.Authenticate(r)
+}
+
+func (a sessionAuthenticator) CacheKey(r *http.Request) string {
+	return ""
+}
+
+func TestTokensRequireUserLookup(t *testing.T) {
+	s := newTestServer(t, Settings{}, testUser)
+	s.authenticator = sessionAuthenticator{s.authenticator.(testAuthenticator)}
+	w := request(s, "POST", "/api/tokens", "user1", strings.NewReader(`{"name": "test", "scopes": ["read"]}`), map[string]string{"Content-Type": "application/json"})
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("create token: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestTokenScopeOfWrites(t *testing.T) {
+	s := newTestServer(t, Settings{}, testUser)
+	read := createToken(t, s, "user1", "read")
+	upload := createToken(t, s, "user1", "upload")
+
+	for _, route := range []struct{ method, url string }{
+		{"POST", "/api/project/upload"},
+		{"GET", "/ws/plugin"},
+		{"POST", "/api/project/upload/user1/project"},
+	} {
+		w := request(s, route.method, route.url, "", strings.NewReader("x"), tokenHeader(read))
+		if w.Code != http.StatusForbidden || errorCode(w) != errCodeInsufficientScope {
+			t.Errorf("%s %s with read token: %d %s", route.method, route.url, w.Code, w.Body)
+		}
+		w = request(s, route.method, route.url, "", strings.NewReader("x"), tokenHeader(upload))
+		if w.Code == http.StatusForbidden || w.Code == http.StatusUnauthorized {
+			t.Errorf("%s %s with upload token: %d %s", route.method, route.url, w.Code, w.Body)
+		}
+	}
+}
+
+func TestTokenAppServerLookup(t *testing.T) {
+	var lookupStatus int32
+	appServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/auth/user/":
+			if _, err := r.Cookie("sessionid"); err != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		case "/api/auth/users/user1/":
+			if r.Header.Get("Authorization") != "Token secret" {
+				t.Errorf("user lookup with authorization: %q", r.Header.Get("Authorization"))
+			}
+			if status := int(atomic.LoadInt32(&lookupStatus)); status != http.StatusOK {
+				w.WriteHeader(status)
+				return
+			}
+		default:
+			t.Errorf("unexpected request of app server: %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"user": {"username": "user1"}}`))
+	}))
+	defer appServer.Close()
+	session := map[string]string{"Cookie": "sessionid=session", "Content-Type": "application/json"}
+	newToken := func(s *Server) *httptest.ResponseRecorder {
+		return request(s, "POST", "/api/tokens", "", strings.NewReader(`{"name": "test", "scopes": ["read"]}`), session)
+	}
+
+	// tokens are disabled without token of app server's API
+	s := newTestServerConfig(t, Config{Authenticator: NewAppServerAuthenticator(appServer.URL, "", nil)})
+	if w := newToken(s); w.Code != http.StatusNotImplemented {
+		t.Errorf("create token without app server's token: %d %s", w.Code, w.Body)
+	}
+
+	a := NewAppServerAuthenticator(appServer.URL, "", nil)
+	a.APIToken = "secret"
+	s = newTestServerConfig(t, Config{Authenticator: a, AuthCacheTTL: time.Minute})
+	w := newToken(s)
+	if w.Code != http.StatusOK {
+		t.Fatalf("create token: %d %s", w.Code, w.Body)
+	}
+	var data struct {
+		Token string `json:"token"`
+	}
+	json.NewDecoder(w.Body).Decode(&data)
+
+	tests := []struct {
+		lookupStatus int
+		status       int
+	}{
+		// failures of app server are not cached
+		{http.StatusInternalServerError, http.StatusInternalServerError},
+		{http.StatusBadGateway, http.StatusInternalServerError},
+		// unknown user
+		{http.StatusNotFound, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		atomic.StoreInt32(&lookupStatus, int32(tt.lookupStatus))
+		if w := request(s, "GET", "/api/project/hash-algorithms", "", nil, tokenHeader(data.Token)); w.Code != tt.status {
+			t.Errorf("request with token (lookup status %d): %d %s", tt.lookupStatus, w.Code, w.Body)
+		}
+	}
+	atomic.StoreInt32(&lookupStatus, http.StatusOK)
+	s.authCache.invalidate(tokenCacheKey(hashToken(data.Token)))
+	if w := request(s, "GET", "/api/project/hash-algorithms", "", nil, tokenHeader(data.Token)); w.Code != http.StatusOK {
+		t.Errorf("request with token: %d %s", w.Code, w.Body)
+	}
+}
+
+// cookieAuthenticator caches users by value of the session cookie
+type cookieAuthenticator struct {
+	testAuthenticator
+}
+
+func (a cookieAuthenticator) CacheKey(r *http.Request) string {
+	if cookie, err := r.Cookie("sessionid"); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+func TestTokenCacheKeyOfSession(t *testing.T) {
+	s := newTestServerConfig(t, Config{AuthCacheTTL: time.Minute}, testUser)
+	token := createToken(t, s, "user1", "read")
+	s.authenticator = cookieAuthenticator{s.authenticator.(testAuthenticator)}
+	if w := request(s, "GET", "/api/project/hash-algorithms", "", nil, tokenHeader(token)); w.Code != http.StatusOK {
+		t.Fatalf("request with token: %d %s", w.Code, w.Body)
+	}
+	// session with cache key of the token
+	for _, key := range []string{tokenCacheKey(hashToken(token)), "token " + hashToken(token)} {
+		header := map[string]string{"Cookie": "sessionid=" + key}
+		if w := request(s, "GET", "/api/project/hash-algorithms", "", nil, header); w.Code != http.StatusUnauthorized {
+			t.Errorf("request with session %q: %d %s", key, w.Code, w.Body)
+		}
+	}
+}
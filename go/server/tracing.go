@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// TracingConfig export
+type TracingConfig struct {
+	// Exporter of spans - "otlp" (OTLP/HTTP), "stdout" or empty (tracing is
+	// disabled)
+	Exporter string
+	// URL of OTLP traces endpoint, e.g. "http://localhost:4318/v1/traces"
+	Endpoint string
+	// Name of the service reported in traces
+	ServiceName string
+	// Ratio of sampled traces, which are not started by sampled parent (0 - 1)
+	SampleRatio float64
+	// Custom tracer provider (overrides Exporter)
+	TracerProvider trace.TracerProvider
+}
+
+// Validate checks tracing configuration
+func (c *TracingConfig) Validate() []string {
+	var errs []string
+	switch c.Exporter {
+	case "", "none", "stdout":
+	case "otlp":
+		if err := checkURL(c.Endpoint); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid OTLP endpoint %q: %s", c.Endpoint, err))
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("unknown traces exporter %q (expected otlp or stdout)", c.Exporter))
+	}
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		errs = append(errs, "traces sample ratio must be between 0 and 1")
+	}
+	return errs
+}
+
+// tracerName is a name of the instrumentation scope of server's spans
+const tracerName = "github.com/gislab-npo/gisquick-settings/server"
+
+// newTracerProvider creates tracer provider exporting spans by configured
+// exporter (nil when tracing is disabled)
+func newTracerProvider(config TracingConfig) (trace.TracerProvider, error) {
+	if config.TracerProvider != nil {
+		return config.TracerProvider, nil
+	}
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch config.Exporter {
+	case "otlp":
+		exporter, err = otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(config.Endpoint))
+	case "stdout":
+		exporter, err = stdouttrace.New()
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	service := config.ServiceName
+	if service == "" {
+		service = "gisquick-settings"
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(service))),
+	), nil
+}
+
+// tracePropagator reads and writes W3C trace context and baggage headers
+var tracePropagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// setupTracing creates tracer of the server (provider is kept on the server,
+// it's not registered globally)
+func (s *Server) setupTracing() error {
+	provider, err := newTracerProvider(s.config.Tracing)
+	if err != nil {
+		return err
+	}
+	if provider == nil {
+		s.tracer = noop.NewTracerProvider().Tracer(tracerName)
+		return nil
+	}
+	s.tracerProvider = provider
+	s.tracer = provider.Tracer(tracerName)
+	return nil
+}
+
+// setSpanError marks the span as failed (nil error is ignored)
+func setSpanError(sp trace.Span, err error) {
+	if err != nil {
+		sp.RecordError(err)
+		sp.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// propagate adds trace context (of the current span) and ID of the request r
+// to outgoing request
+func propagate(r *http.Request, req *http.Request) {
+	tracePropagator.Inject(r.Context(), propagation.HeaderCarrier(req.Header))
+	if id := getRequestID(r); id != "" {
+		req.Header.Set(RequestIDHeader, id)
+	}
+}
+
+// traceRequest is a middleware starting server span of the request (as child
+// of a span given by traceparent header), the span is named by route pattern
+func (s *Server) traceRequest(next http.Handler) http.Handler {
+	if s.tracerProvider == nil {
+		return next
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+
+		sp := trace.SpanFromContext(r.Context())
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			sp.SetName(r.Method + " " + rctx.RoutePattern())
+			sp.SetAttributes(semconv.HTTPRoute(rctx.RoutePattern()))
+		}
+		sp.SetAttributes(attribute.String("request_id", getRequestID(r)))
+		if info := getRequestInfo(r); info != nil && info.User != "" {
+			sp.SetAttributes(semconv.EnduserID(info.User))
+		}
+	})
+	return otelhttp.NewHandler(handler, "HTTP request",
+		otelhttp.WithTracerProvider(s.tracerProvider),
+		otelhttp.WithPropagators(tracePropagator),
+		otelhttp.WithSpanNameFormatter(func(operation string, r *http.Request) string {
+			return r.Method
+		}),
+	)
+}
+
+// FlushTraces exports all finished spans (with timeout)
+func (s *Server) FlushTraces(timeout time.Duration) {
+	provider, ok := s.tracerProvider.(interface{ ForceFlush(context.Context) error })
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := provider.ForceFlush(ctx); err != nil {
+		s.errorf(nil, "Failed to export traces: %s\n", err)
+	}
+}
+
+// timedReader measures time spent in reading
+type timedReader struct {
+	io.Reader
+	elapsed time.Duration
+}
+
+func (r *timedReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := r.Reader.Read(p)
+	r.elapsed += time.Since(start)
+	return n, err
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func spanAttr(sp sdktrace.ReadOnlySpan, key string) attribute.Value {
+	for _, kv := range sp.Attributes() {
+		if string(kv.Key) == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTraceRequest(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	s, err := NewServer(Config{
+		ProjectsRoot:  t.TempDir(),
+		Settings:      Settings{MaxFileUpload: 1024, MaxProjectSize: 1024, LogLevel: "error"},
+		Authenticator: testAuthenticator{"user1": testUser},
+		Tracing:       TracingConfig{TracerProvider: provider},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if otel.GetTracerProvider() == provider {
+		t.Error("tracer provider was registered globally")
+	}
+	writeFile(t, s, "user1/project/project.qgs", "<qgis/>")
+
+	const traceID = "0af7651916cd43dd8448eb211c80319c"
+	const parentID = "b7ad6b7169203331"
+	w := request(s, "GET", "/api/project/files/user1/project", "user1", nil, map[string]string{
+		"traceparent": "00-" + traceID + "-" + parentID + "-01",
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("request: %d %s", w.Code, w.Body)
+	}
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, sp := range recorder.Ended() {
+		spans[sp.Name()] = sp
+	}
+	server, ok := spans["GET /api/project/files/{user}/{directory}"]
+	if !ok {
+		t.Fatalf("server span was not recorded: %v", spans)
+	}
+	if server.SpanKind() != trace.SpanKindServer || server.SpanContext().TraceID().String() != traceID || server.Parent().SpanID().String() != parentID {
+		t.Errorf("server span is not a child of remote parent: %v, %v", server.SpanContext(), server.Parent())
+	}
+	if spanAttr(server, "http.route").AsString() != "/api/project/files/{user}/{directory}" || spanAttr(server, "enduser.id").AsString() != "user1" {
+		t.Errorf("server span attributes: %v", server.Attributes())
+	}
+	auth, ok := spans["authenticate"]
+	if !ok || auth.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Errorf("authentication span is not a child of server span")
+	}
+
+	// trace context is propagated to outgoing requests
+	r := httptest.NewRequest("GET", "/", nil)
+	ctx, sp := s.tracer.Start(r.Context(), "test")
+	defer sp.End()
+	req, _ := http.NewRequest("GET", "http://localhost/", nil)
+	propagate(r.WithContext(ctx), req)
+	if !strings.Contains(req.Header.Get("traceparent"), sp.SpanContext().SpanID().String()) {
+		t.Errorf("traceparent of outgoing request: %q", req.Header.Get("traceparent"))
+	}
+}
@@ -0,0 +1,551 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gislab-npo/gisquick-settings/fs"
+	"github.com/gislab-npo/gisquick-settings/server/storage"
+	"github.com/go-chi/chi"
+)
+
+/*
+Resumable (chunked) uploads. Client declares list of files in a new upload
+session, then sends content of the files in chunks (PATCH requests with
+Upload-Offset header) and finally commits the session. When the connection
+is lost, client can ask for the current state of the session and continue
+from the last received offsets. Sessions are stored in the project's
+.gisquick/uploads directory:
+  <id>/session.json                - session info with list of declared files
+  <id>/chunks/<file path>/<offset> - received chunks of the files
+*/
+
+const (
+	uploadSessionTTL = 24 * time.Hour
+	// max. number of open upload sessions of a user in a project
+	maxUploadSessions = 5
+)
+
+type uploadSession struct {
+	ID      string    `json:"id"`
+	User    string    `json:"user"`
+	Created time.Time `json:"created"`
+	Files   []fs.File `json:"files"`
+	projectChanges
+}
+
+type uploadFileStatus struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Offset int64  `json:"offset"`
+}
+
+type uploadSessionStatus struct {
+	ID    string             `json:"id"`
+	Files []uploadFileStatus `json:"files"`
+}
+
+func uploadSessionDir(username, directory, id string) string {
+	return projectPath(username, directory, ".gisquick", "uploads", id)
+}
+
+// chunkName returns name of the chunk file, names are zero padded so
+// they are sorted by offset
+func chunkName(offset int64) string {
+	return fmt.Sprintf("%020d", offset)
+}
+
+func (session *uploadSession) file(path string) (fs.File, bool) {
+	for _, f := range session.Files {
+		if f.Path == path {
+			return f, true
+		}
+	}
+	return fs.File{}, false
+}
+
+// size returns total size of the session's files
+func (session *uploadSession) size() int64 {
+	var size int64
+	for _, f := range session.Files {
+		size += f.Size
+	}
+	return size
+}
+
+func (session *uploadSession) expired() bool {
+	return session.Created.Before(time.Now().Add(-uploadSessionTTL))
+}
+
+// matches returns true when session was created for the same set of files
+func (session *uploadSession) matches(files []fs.File) bool {
+	if len(session.Files) != len(files) {
+		return false
+	}
+	for _, f := range files {
+		sf, ok := session.file(f.Path)
+		if !ok || sf.Size != f.Size || sf.Hash != f.Hash || sf.Algorithm != f.Algorithm {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) loadUploadSession(username, directory, id string) (*uploadSession, error) {
+	data, err := s.readFile(path.Join(uploadSessionDir(username, directory, id), "session.json"))
+	if err != nil {
+		return nil, err
+	}
+	var session uploadSession
+	if err = json.Unmarshal(data, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// listUploadSessions returns upload sessions of the project, expired sessions are removed
+func (s *Server) listUploadSessions(username, directory string) ([]uploadSession, error) {
+	files, err := s.listInternal(projectPath(username, directory, ".gisquick", "uploads"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []uploadSession{}, nil
+		}
+		return nil, err
+	}
+	sessions := []uploadSession{}
+	for _, f := range files {
+		id := strings.TrimSuffix(f.Path, "/session.json")
+		if id == f.Path || strings.Contains(id, "/") {
+			continue
+		}
+		session, err := s.loadUploadSession(username, directory, id)
+		if err != nil {
+			s.errorf(nil, "Invalid upload session: %s (%s)\n", id, err)
+			continue
+		}
+		if session.expired() {
+			if err := s.storage.RemoveAll(uploadSessionDir(username, directory, id)); err != nil {
+				s.errorf(nil, "Failed to remove expired upload session: %s (%s)\n", id, err)
+			}
+			continue
+		}
+		sessions = append(sessions, *session)
+	}
+	return sessions, nil
+}
+
+// receivedChunks returns paths of received chunks of the file (continuous
+// sequence from the beginning of the file) and the next expected offset
+func (s *Server) receivedChunks(sessionDir, file string) ([]string, int64, error) {
+	chunksDir := path.Join(sessionDir, "chunks", file)
+	chunks, err := s.listInternal(chunksDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, 0, nil
+		}
+		return nil, 0, err
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].Path < chunks[j].Path
+	})
+	paths := make([]string, 0, len(chunks))
+	var offset int64
+	for _, c := range chunks {
+		start, err := strconv.ParseInt(c.Path, 10, 64)
+		if err != nil || start != offset {
+			break
+		}
+		paths = append(paths, path.Join(chunksDir, c.Path))
+		offset += c.Size
+	}
+	return paths, offset, nil
+}
+
+func (s *Server) uploadSessionStatus(username, directory string, session *uploadSession) (*uploadSessionStatus, error) {
+	sessionDir := uploadSessionDir(username, directory, session.ID)
+	status := uploadSessionStatus{ID: session.ID, Files: make([]uploadFileStatus, len(session.Files))}
+	for i, f := range session.Files {
+		_, offset, err := s.receivedChunks(sessionDir, f.Path)
+		if err != nil {
+			return nil, err
+		}
+		status.Files[i] = uploadFileStatus{f.Path, f.Size, offset}
+	}
+	return &status, nil
+}
+
+// chunksReader reads content of the file from its chunks
+type chunksReader struct {
+	storage storage.Storage
+	chunks  []string
+	current storage.File
+}
+
+func (r *chunksReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+			f, err := r.storage.Open(r.chunks[0])
+			if err != nil {
+				return 0, err
+			}
+			r.current = f
+			r.chunks = r.chunks[1:]
+		}
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *chunksReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	return r.current.Close()
+}
+
+// getUploadSession writes error response when the session can't be loaded,
+// is expired or it was created by another user
+func (s *Server) getUploadSession(w http.ResponseWriter, r *http.Request, user *User, username, directory, id string) *uploadSession {
+	session, err := s.loadUploadSession(username, directory, id)
+	if err != nil {
+		if os.IsNotExist(err) {
+			s.notFound(w, r, "Upload session not found")
+		} else {
+			s.errorf(r, "Failed to load upload session: %s\n", err)
+			s.serverError(w, r)
+		}
+		return nil
+	}
+	if session.expired() {
+		if err := s.storage.RemoveAll(uploadSessionDir(username, directory, id)); err != nil {
+			s.errorf(r, "Failed to remove expired upload session: %s (%s)\n", id, err)
+		}
+		s.notFound(w, r, "Upload session has expired")
+		return nil
+	}
+	if session.User != user.Username {
+		s.errorResponse(w, r, http.StatusForbidden, errCodeForbidden, "Upload session belongs to another user", nil)
+		return nil
+	}
+	return session
+}
+
+func (s *Server) handleUploadSessionCreate() http.HandlerFunc {
+	type sessionInfo struct {
+		Files []fs.File `json:"files"`
+		projectChanges
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(contextKeyUser).(*User)
+		username := chi.URLParam(r, "user")
+		directory := chi.URLParam(r, "directory")
+		var info sessionInfo
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 10*1024*1024)).Decode(&info); err != nil {
+			s.errorf(r, "Failed to decode upload session info: %s\n", err)
+			s.badRequest(w, r, "Invalid upload session info", nil)
+			return
+		}
+		declared := make(map[string]bool, len(info.Files))
+		for _, f := range info.Files {
+			if f.Path == "" || f.Size < 0 || declared[f.Path] || !fs.IsHashAlgorithm(f.Algorithm) {
+				s.badRequest(w, r, "Invalid upload session info", nil)
+				return
+			}
+			declared[f.Path] = true
+		}
+		if err := validateFilePaths(info.Files); err != nil {
+			s.pathErrorResponse(w, r, err)
+			return
+		}
+		if !s.checkProjectChanges(w, r, info.Files, info.projectChanges) {
+			return
+		}
+		projectDir := projectPath(username, directory)
+		removes, err := s.filesToRemove(projectDir, info.Files, info.projectChanges)
+		if err != nil {
+			s.errorf(r, "Failed to create upload session: %s\n", err)
+			s.serverError(w, r)
+			return
+		}
+		if !s.checkUploadLimits(w, r, user, username, projectDir, info.Files, removes, 0) {
+			return
+		}
+		if isDryRun(r) {
+			s.jsonResponse(w, map[string][]string{"removes": removes})
+			return
+		}
+
+		sessions, err := s.listUploadSessions(username, directory)
+		if err != nil {
+			s.errorf(r, "Failed to list upload sessions: %s\n", err)
+			s.serverError(w, r)
+			return
+		}
+		var session *uploadSession
+		open := 0
+		// resume unfinished upload of the same files
+		for i := range sessions {
+			if sessions[i].User != user.Username {
+				continue
+			}
+			open++
+			if sessions[i].matches(info.Files) {
+				session = &sessions[i]
+				break
+			}
+		}
+		if session == nil {
+			if open >= maxUploadSessions {
+				s.errorResponse(w, r, http.StatusTooManyRequests, errCodeTooManyUploads, "Too many unfinished uploads", map[string]int{"limit": maxUploadSessions})
+				return
+			}
+			id := make([]byte, 16)
+			if _, err := rand.Read(id); err != nil {
+				s.errorf(r, "Failed to create upload session: %s\n", err)
+				s.serverError(w, r)
+				return
+			}
+			session = &uploadSession{
+				ID:      fmt.Sprintf("%x", id),
+				User:    user.Username,
+				Created: time.Now().UTC(),
+				Files:   info.Files,
+			}
+		}
+		// removed files may differ from the original request of resumed session
+		session.projectChanges = info.projectChanges
+		data, err := json.Marshal(session)
+		if err == nil {
+			err = storage.SaveFile(s.storage, bytes.NewReader(data), path.Join(uploadSessionDir(username, directory, session.ID), "session.json"))
+		}
+		if err != nil {
+			s.errorf(r, "Failed to save upload session: %s\n", err)
+			s.serverError(w, r)
+			return
+		}
+		status, err := s.uploadSessionStatus(username, directory, session)
+		if err != nil {
+			s.errorf(r, "Failed to get upload session status: %s\n", err)
+			s.serverError(w, r)
+			return
+		}
+		s.jsonResponse(w, status)
+	}
+}
+
+func (s *Server) handleUploadSessionStatus() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(contextKeyUser).(*User)
+		username := chi.URLParam(r, "user")
+		directory := chi.URLParam(r, "directory")
+		session := s.getUploadSession(w, r, user, username, directory, chi.URLParam(r, "id"))
+		if session == nil {
+			return
+		}
+		status, err := s.uploadSessionStatus(username, directory, session)
+		if err != nil {
+			s.errorf(r, "Failed to get upload session status: %s\n", err)
+			s.serverError(w, r)
+			return
+		}
+		s.jsonResponse(w, status)
+	}
+}
+
+func (s *Server) handleUploadSessionDelete() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(contextKeyUser).(*User)
+		username := chi.URLParam(r, "user")
+		directory := chi.URLParam(r, "directory")
+		session := s.getUploadSession(w, r, user, username, directory, chi.URLParam(r, "id"))
+		if session == nil {
+			return
+		}
+		if err := s.storage.RemoveAll(uploadSessionDir(username, directory, session.ID)); err != nil {
+			s.errorf(r, "Failed to remove upload session: %s\n", err)
+			s.serverError(w, r)
+			return
+		}
+		w.Write([]byte(""))
+	}
+}
+
+func (s *Server) handleUploadChunk() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(contextKeyUser).(*User)
+		username := chi.URLParam(r, "user")
+		directory := chi.URLParam(r, "directory")
+		filePath := chi.URLParam(r, "*")
+		session := s.getUploadSession(w, r, user, username, directory, chi.URLParam(r, "id"))
+		if session == nil {
+			return
+		}
+		declaredFile, ok := session.file(filePath)
+		if !ok {
+			s.notFound(w, r, "File is not part of the upload session")
+			return
+		}
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil || offset < 0 {
+			s.badRequest(w, r, "Invalid Upload-Offset header", nil)
+			return
+		}
+		sessionDir := uploadSessionDir(username, directory, session.ID)
+		_, currentOffset, err := s.receivedChunks(sessionDir, filePath)
+		if err != nil {
+			s.errorf(r, "Failed to list received chunks: %s\n", err)
+			s.serverError(w, r)
+			return
+		}
+		if offset != currentOffset {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(currentOffset, 10))
+			s.errorResponse(w, r, http.StatusConflict, errCodeOffsetMismatch, "Offset mismatch", map[string]int64{"offset": currentOffset})
+			return
+		}
+		if r.ContentLength > declaredFile.Size-offset {
+			s.errorResponse(w, r, http.StatusBadRequest, errCodeInvalidUpload, "Chunk exceeds declared file size", sizeErrorDetails{r.ContentLength, declaredFile.Size - offset})
+			return
+		}
+		// received chunks are counted to the quota
+		if !user.IsSuperuser {
+			size := r.ContentLength
+			if size < 0 {
+				size = declaredFile.Size - offset
+			}
+			if !s.checkQuota(w, r, username, size) {
+				return
+			}
+		}
+		body := http.MaxBytesReader(w, r.Body, declaredFile.Size-offset)
+		dest, err := s.storage.Create(path.Join(sessionDir, "chunks", filePath, chunkName(offset)))
+		if err != nil {
+			s.errorf(r, "Upload error: %s\n", err)
+			s.serverError(w, r)
+			return
+		}
+		size, err := io.Copy(dest, body)
+		if err != nil || size == 0 {
+			dest.Abort()
+			s.errorf(r, "Upload error: failed to receive chunk of %s (%v)\n", filePath, err)
+			s.errorResponse(w, r, http.StatusBadRequest, errCodeInvalidUpload, "Invalid chunk", nil)
+			return
+		}
+		if err = dest.Close(); err != nil {
+			s.errorf(r, "Upload error: %s\n", err)
+			s.serverError(w, r)
+			return
+		}
+		currentOffset += size
+		// progress of completed files is reported after commit
+		if currentOffset < declaredFile.Size {
+			if appWs := s.appsWs.Get(session.User); appWs != nil {
+				s.sendJSONMessage(appWs, r, "UploadProgress", map[string]int64{filePath: currentOffset})
+			}
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(currentOffset, 10))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) handleUploadSessionCommit() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(contextKeyUser).(*User)
+		username := chi.URLParam(r, "user")
+		directory := chi.URLParam(r, "directory")
+		session := s.getUploadSession(w, r, user, username, directory, chi.URLParam(r, "id"))
+		if session == nil {
+			return
+		}
+		projectDir := projectPath(username, directory)
+		sessionDir := uploadSessionDir(username, directory, session.ID)
+
+		staging, err := s.newStagingArea(r, projectDir)
+		if err != nil {
+			s.errorf(r, "Upload error: %s\n", err)
+			s.serverError(w, r)
+			return
+		}
+		defer staging.Discard()
+
+		uploadProgress := make(map[string]int64, len(session.Files))
+		for _, f := range session.Files {
+			chunks, offset, err := s.receivedChunks(sessionDir, f.Path)
+			if err != nil {
+				s.errorf(r, "Failed to list received chunks: %s\n", err)
+				s.serverError(w, r)
+				return
+			}
+			if offset != f.Size {
+				s.errorResponse(w, r, http.StatusBadRequest, errCodeIncompleteUpload, fmt.Sprintf("Incomplete upload: %s", f.Path), fileErrorDetails{f.Path})
+				return
+			}
+			reader := &chunksReader{storage: s.storage, chunks: chunks}
+			file, err := staging.Save(reader, f.Path, f.Algorithm)
+			reader.Close()
+			if err != nil {
+				s.errorf(r, "Upload error: %s\n", err)
+				s.serverError(w, r)
+				return
+			}
+			if file.Size != f.Size || (f.Hash != "" && file.Hash != f.Hash) {
+				s.errorf(r, "Upload error: file %s doesn't match its metadata\n", file.Path)
+				// drop received data, so the file can be uploaded again
+				if err := s.storage.RemoveAll(path.Join(sessionDir, "chunks", f.Path)); err != nil {
+					s.errorf(r, "Failed to remove chunks of %s: %s\n", f.Path, err)
+				}
+				s.errorResponse(w, r, http.StatusBadRequest, errCodeCorruptedFile, fmt.Sprintf("Corrupted file: %s", file.Path), fileErrorDetails{file.Path})
+				return
+			}
+			uploadProgress[f.Path] = f.Size
+		}
+		// limits are checked again, project could be changed by other uploads
+		// after the session was created
+		unlock := s.lockUploads(username)
+		defer unlock()
+		removes, err := s.filesToRemove(projectDir, session.Files, session.projectChanges)
+		if err != nil {
+			s.errorf(r, "Upload error: %s\n", err)
+			s.serverError(w, r)
+			return
+		}
+		if !s.checkUploadLimits(w, r, user, username, projectDir, session.Files, removes, session.size()) {
+			return
+		}
+		if err = s.commitUpload(staging, username, directory, user.Username, session.Files, removes); err != nil {
+			if s.pathErrorResponse(w, r, err) {
+				return
+			}
+			s.errorf(r, "Upload error: failed to update project files. %s\n", err)
+			s.serverError(w, r)
+			return
+		}
+		if err = s.storage.RemoveAll(sessionDir); err != nil {
+			s.errorf(r, "Failed to remove upload session: %s\n", err)
+		}
+		if appWs := s.appsWs.Get(session.User); appWs != nil {
+			s.sendJSONMessage(appWs, r, "UploadProgress", uploadProgress)
+		}
+		w.Write([]byte(""))
+	}
+}
@@ -0,0 +1,329 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gislab-npo/gisquick-settings/fs"
+)
+
+const uploadsURL = "/api/project/uploads/user1/project"
+
+var testUser = &User{Username: "user1"}
+
+func sha1Hex(content string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(content)))
+}
+
+func createUploadSession(t *testing.T, s *Server, files map[string]string) (*httptest.ResponseRecorder, uploadSessionStatus) {
+	t.Helper()
+	declared := []fs.File{}
+	for path, content := range files {
+		declared = append(declared, fs.File{Path: path, Size: int64(len(content)), Hash: sha1Hex(content)})
+	}
+	data, _ := json.Marshal(map[string]interface{}{"files": declared})
+	w := request(s, "POST", uploadsURL, "user1", strings.NewReader(string(data)), map[string]string{"Content-Type": "application/json"})
+	var status uploadSessionStatus
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w, status
+}
+
+func uploadChunk(s *Server, id, file string, offset int64, data string) *httptest.ResponseRecorder {
+	url := fmt.Sprintf("%s/%s/files/%s", uploadsURL, id, file)
+	return request(s, "PATCH", url, "user1", strings.NewReader(data), map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": strconv.FormatInt(offset, 10),
+	})
+}
+
+func commitUploadSession(s *Server, id string) *httptest.ResponseRecorder {
+	return request(s, "POST", fmt.Sprintf("%s/%s/commit", uploadsURL, id), "user1", nil, nil)
+}
+
+func errorCode(w *httptest.ResponseRecorder) string {
+	var e apiError
+	json.Unmarshal(w.Body.Bytes(), &e)
+	return e.Code
+}
+
+func TestUploadChunkOffsets(t *testing.T) {
+	s := newTestServer(t, Settings{}, testUser)
+	w, session := createUploadSession(t, s, map[string]string{"data/file.txt": "0123456789"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("create session: %d %s", w.Code, w.Body)
+	}
+	steps := []struct {
+		name   string
+		offset int64
+		data   string
+		status int
+		// expected Upload-Offset header
+		next string
+		code string
+	}{
+		{"first chunk", 0, "0123", http.StatusNoContent, "4", ""},
+		{"gap", 6, "6789", http.StatusConflict, "4", errCodeOffsetMismatch},
+		{"overlap", 2, "23456", http.StatusConflict, "4", errCodeOffsetMismatch},
+		{"repeated chunk", 0, "0123", http.StatusConflict, "4", errCodeOffsetMismatch},
+		{"over declared size", 4, "456789X", http.StatusBadRequest, "", errCodeInvalidUpload},
+		{"empty chunk", 4, "", http.StatusBadRequest, "", errCodeInvalidUpload},
+		{"second chunk", 4, "456", http.StatusNoContent, "7", ""},
+		{"last chunk", 7, "789", http.StatusNoContent, "10", ""},
+		{"after end", 10, "X", http.StatusBadRequest, "", errCodeInvalidUpload},
+	}
+	for _, step := range steps {
+		w := uploadChunk(s, session.ID, "data/file.txt", step.offset, step.data)
+		if w.Code != step.status {
+			t.Errorf("%s: status = %d, want %d (%s)", step.name, w.Code, step.status, w.Body)
+		}
+		if step.next != "" && w.Header().Get("Upload-Offset") != step.next {
+			t.Errorf("%s: Upload-Offset = %q, want %q", step.name, w.Header().Get("Upload-Offset"), step.next)
+		}
+		if step.code != "" && errorCode(w) != step.code {
+			t.Errorf("%s: error code = %q, want %q", step.name, errorCode(w), step.code)
+		}
+	}
+	if w := uploadChunk(s, session.ID, "other.txt", 0, "x"); w.Code != http.StatusNotFound {
+		t.Errorf("chunk of undeclared file: status = %d", w.Code)
+	}
+	if w := commitUploadSession(s, session.ID); w.Code != http.StatusOK {
+		t.Fatalf("commit: %d %s", w.Code, w.Body)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(s.config.ProjectsRoot, "user1", "project", "data", "file.txt"))
+	if err != nil || string(data) != "0123456789" {
+		t.Errorf("committed file = %q, %v", data, err)
+	}
+}
+
+func TestUploadSessionResume(t *testing.T) {
+	s := newTestServer(t, Settings{}, testUser)
+	files := map[string]string{"a.txt": "aaaaaaaa", "b.txt": "bbbb"}
+	_, session := createUploadSession(t, s, files)
+	uploadChunk(s, session.ID, "a.txt", 0, "aaa")
+	uploadChunk(s, session.ID, "b.txt", 0, "bbbb")
+
+	if w := commitUploadSession(s, session.ID); w.Code != http.StatusBadRequest || errorCode(w) != errCodeIncompleteUpload {
+		t.Errorf("commit of incomplete upload: %d %s", w.Code, w.Body)
+	}
+
+	// new session with the same files continues the upload
+	w, resumed := createUploadSession(t, s, files)
+	if w.Code != http.StatusOK {
+		t.Fatalf("resume session: %d %s", w.Code, w.Body)
+	}
+	if resumed.ID != session.ID {
+		t.Errorf("resumed session ID = %s, want %s", resumed.ID, session.ID)
+	}
+	offsets := make(map[string]int64)
+	for _, f := range resumed.Files {
+		offsets[f.Path] = f.Offset
+	}
+	if offsets["a.txt"] != 3 || offsets["b.txt"] != 4 {
+		t.Errorf("offsets of resumed session = %v", offsets)
+	}
+	// different files create new session
+	if _, other := createUploadSession(t, s, map[string]string{"a.txt": "other"}); other.ID == session.ID {
+		t.Error("session with different files resumed existing session")
+	}
+
+	if w := uploadChunk(s, session.ID, "a.txt", 3, "aaaaa"); w.Code != http.StatusNoContent {
+		t.Fatalf("upload: %d %s", w.Code, w.Body)
+	}
+	if w := commitUploadSession(s, session.ID); w.Code != http.StatusOK {
+		t.Fatalf("commit: %d %s", w.Code, w.Body)
+	}
+	if w := request(s, "GET", uploadsURL+"/"+session.ID, "user1", nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("status of committed session: %d", w.Code)
+	}
+}
+
+func TestUploadSessionCorruptedFile(t *testing.T) {
+	s := newTestServer(t, Settings{}, testUser)
+	_, session := createUploadSession(t, s, map[string]string{"a.txt": "content"})
+	uploadChunk(s, session.ID, "a.txt", 0, "CONTENT")
+	if w := commitUploadSession(s, session.ID); w.Code != http.StatusBadRequest || errorCode(w) != errCodeCorruptedFile {
+		t.Fatalf("commit of corrupted file: %d %s", w.Code, w.Body)
+	}
+	// received data were dropped, so the file can be uploaded again
+	if w := uploadChunk(s, session.ID, "a.txt", 0, "content"); w.Code != http.StatusNoContent {
+		t.Fatalf("upload after corrupted file: %d %s", w.Code, w.Body)
+	}
+	if w := commitUploadSession(s, session.ID); w.Code != http.StatusOK {
+		t.Fatalf("commit: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestUploadSessionCommitLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings Settings
+		code     string
+	}{
+		{"project size", Settings{MaxProjectSize: 15}, errCodeUploadTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, tt.settings, testUser)
+			// both sessions are within limits when created
+			_, first := createUploadSession(t, s, map[string]string{"a.txt": "0123456789"})
+			w, second := createUploadSession(t, s, map[string]string{"b.txt": "0123456789"})
+			if w.Code != http.StatusOK {
+				t.Fatalf("create session: %d %s", w.Code, w.Body)
+			}
+			uploadChunk(s, first.ID, "a.txt", 0, "0123456789")
+			uploadChunk(s, second.ID, "b.txt", 0, "0123456789")
+			if w := commitUploadSession(s, first.ID); w.Code != http.StatusOK {
+				t.Fatalf("commit: %d %s", w.Code, w.Body)
+			}
+			if w := commitUploadSession(s, second.ID); w.Code != http.StatusBadRequest || errorCode(w) != tt.code {
+				t.Errorf("commit over limit: %d %s", w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestUploadSessionOwner(t *testing.T) {
+	s := newTestServer(t, Settings{}, testUser, &User{Username: "user2"})
+	request(s, "PUT", "/api/project/acl/user1/project/users/user2", "user1", strings.NewReader(`{"permission": "upload"}`), nil)
+	_, session := createUploadSession(t, s, map[string]string{"a.txt": "content"})
+
+	sessionURL := uploadsURL + "/" + session.ID
+	requests := []struct {
+		method string
+		url    string
+		body   string
+	}{
+		{"GET", sessionURL, ""},
+		{"PATCH", sessionURL + "/files/a.txt", "content"},
+		{"POST", sessionURL + "/commit", ""},
+		{"DELETE", sessionURL, ""},
+	}
+	for _, req := range requests {
+		headers := map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": "0"}
+		w := request(s, req.method, req.url, "user2", strings.NewReader(req.body), headers)
+		if w.Code != http.StatusForbidden || errorCode(w) != errCodeForbidden {
+			t.Errorf("%s %s by collaborator: %d %s", req.method, req.url, w.Code, w.Body)
+		}
+	}
+	if w := request(s, "GET", sessionURL, "user1", nil, nil); w.Code != http.StatusOK {
+		t.Errorf("session status by owner: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestUploadSessionExpired(t *testing.T) {
+	s := newTestServer(t, Settings{}, testUser)
+	_, status := createUploadSession(t, s, map[string]string{"a.txt": "content"})
+	session, err := s.loadUploadSession("user1", "project", status.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Created = time.Now().Add(-uploadSessionTTL - time.Minute)
+	data, _ := json.Marshal(session)
+	writeFile(t, s, path.Join(uploadSessionDir("user1", "project", session.ID), "session.json"), string(data))
+
+	if w := uploadChunk(s, session.ID, "a.txt", 0, "content"); w.Code != http.StatusNotFound {
+		t.Errorf("upload to expired session: %d %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(filepath.Join(s.config.ProjectsRoot, uploadSessionDir("user1", "project", session.ID))); !os.IsNotExist(err) {
+		t.Errorf("expired session was not removed: %v", err)
+	}
+}
+
+func TestUploadSessionsLimit(t *testing.T) {
+	s := newTestServer(t, Settings{}, testUser)
+	for i := 0; i < maxUploadSessions; i++ {
+		if w, _ := createUploadSession(t, s, map[string]string{fmt.Sprintf("%d.txt", i): "content"}); w.Code != http.StatusOK {
+			t.Fatalf("create session: %d %s", w.Code, w.Body)
+		}
+	}
+	w, _ := createUploadSession(t, s, map[string]string{"other.txt": "content"})
+	if w.Code != http.StatusTooManyRequests || errorCode(w) != errCodeTooManyUploads {
+		t.Errorf("create session over limit: %d %s", w.Code, w.Body)
+	}
+	// unfinished sessions can be resumed
+	if w, _ := createUploadSession(t, s, map[string]string{"0.txt": "content"}); w.Code != http.StatusOK {
+		t.Errorf("resume session: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestUploadSessionQuota(t *testing.T) {
+	s := newTestServer(t, Settings{UserQuota: 15}, testUser)
+	_, first := createUploadSession(t, s, map[string]string{"a.txt": "0123456789"})
+	_, second := createUploadSession(t, s, map[string]string{"b.txt": "0123456789"})
+	if w := uploadChunk(s, first.ID, "a.txt", 0, "0123456789"); w.Code != http.StatusNoContent {
+		t.Fatalf("upload: %d %s", w.Code, w.Body)
+	}
+	// received chunks of unfinished uploads are counted to the quota
+	if w := uploadChunk(s, second.ID, "b.txt", 0, "0123456789"); w.Code != http.StatusBadRequest || errorCode(w) != errCodeQuotaExceeded {
+		t.Errorf("upload over quota: %d %s", w.Code, w.Body)
+	}
+	w := request(s, "GET", "/api/usage/user1", "user1", nil, nil)
+	var usage storageUsage
+	json.Unmarshal(w.Body.Bytes(), &usage)
+	if usage.Uploads != 10 || usage.Free == nil || *usage.Free != 5 {
+		t.Errorf("storage usage: %s", w.Body)
+	}
+	// received data of committed session are not counted twice
+	if w := commitUploadSession(s, first.ID); w.Code != http.StatusOK {
+		t.Errorf("commit: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestMediaUploadQuota(t *testing.T) {
+	// size of multipart body is counted to the quota
+	s := newTestServer(t, Settings{UserQuota: 1000}, testUser)
+	upload := func() *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		part, _ := writer.CreateFormFile("file", "photo.jpg")
+		part.Write([]byte("0123456789"))
+		writer.Close()
+		return request(s, "POST", "/api/project/media/user1/project", "user1", &body, map[string]string{"Content-Type": writer.FormDataContentType()})
+	}
+	// quota is checked with lock of user's uploads
+	unlock := s.lockUploads("user1")
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- upload() }()
+	select {
+	case <-done:
+		t.Error("media upload didn't wait for concurrent upload")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	if w := <-done; w.Code != http.StatusOK {
+		t.Errorf("media upload: %d %s", w.Code, w.Body)
+	}
+
+	writeFile(t, s, "user1/project/data.bin", strings.Repeat("x", 900))
+	if w := upload(); w.Code != http.StatusBadRequest || errorCode(w) != errCodeQuotaExceeded {
+		t.Errorf("media upload over quota: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestUploadIgnoredFilesSize(t *testing.T) {
+	s := newTestServer(t, Settings{MaxProjectSize: 15}, testUser)
+	// ignored files are hidden in listing, but they are still stored
+	writeFile(t, s, "user1/project/.gisquickignore", "*.bin\n")
+	writeFile(t, s, "user1/project/a.bin", "0123456789")
+	w, _ := createUploadSession(t, s, map[string]string{"b.bin": "0123456789"})
+	if w.Code != http.StatusBadRequest || errorCode(w) != errCodeUploadTooLarge {
+		t.Errorf("upload of ignored file over limit: %d %s", w.Code, w.Body)
+	}
+}
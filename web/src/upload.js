@@ -1,5 +1,15 @@
 
-export function createUpload (ws, files, project) {
+// returns the preferred hash algorithm supported by both plugin and server
+export async function hashAlgorithm (http, ws) {
+  try {
+    const resp = await http.get('/api/project/hash-algorithms')
+    return ws.hashAlgorithms.find(a => resp.data.includes(a)) || 'sha1'
+  } catch (err) {
+    return 'sha1'
+  }
+}
+
+export function createUpload (ws, files, project, removes = []) {
 
   const info = {
     files: {},
@@ -49,7 +59,7 @@ export function createUpload (ws, files, project) {
       return new Promise((resolve, reject) => {
         ws.bind('UploadProgress', onProgressMessage)
         ws.bind('UploadError', onErrorMessage)
-        ws.send('UploadFiles', { files, project })
+        ws.send('UploadFiles', { files, project, removes })
         task = {
           resolve,
           reject,
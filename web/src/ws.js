@@ -9,6 +9,7 @@ export default function WebsocketMessenger (url) {
     connected: false,
     pluginConnected: false,
     clientInfo: '',
+    hashAlgorithms: [],
 
     bind (type, callback) {
       listeners.push({ type, callback })
@@ -60,6 +61,8 @@ export default function WebsocketMessenger (url) {
       const connected = msg.status === 200
       ws.pluginConnected = connected
       ws.clientInfo = connected && msg.data.client
+      // older plugins support only SHA1 checksums
+      ws.hashAlgorithms = (connected && msg.data.hash_algorithms) || ['sha1']
     }
 
     if (activeRequests[msg.type]) {